@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/bokysan/socketace/v2/internal/args"
 	"github.com/bokysan/socketace/v2/internal/commands/client"
+	"github.com/bokysan/socketace/v2/internal/commands/relay"
 	"github.com/bokysan/socketace/v2/internal/commands/server"
 	"github.com/bokysan/socketace/v2/internal/commands/version"
 	scFlags "github.com/bokysan/socketace/v2/internal/flags"
@@ -37,6 +38,7 @@ func NewSocketAce() *SocketAce {
 	sc.setupVersion()
 	sc.setupServer()
 	sc.setupClient()
+	sc.setupRelay()
 
 	return sc
 }
@@ -86,6 +88,18 @@ func (sc *SocketAce) setupClient() {
 	util.MustErrorNilOrExit(err)
 }
 
+// setupRelay adds the `relay` command
+func (sc *SocketAce) setupRelay() {
+	cmd := relay.NewCommand()
+	_, err := sc.parser.AddCommand(
+		"relay",
+		"Run the relay",
+		"Run a relay pairing the servers and the clients which both connect to it",
+		cmd,
+	)
+	util.MustErrorNilOrExit(err)
+}
+
 // main starts socketace and reads the configuration file
 func main() {
 
@@ -26,5 +26,6 @@ require (
 	go.chromium.org/luci v0.0.0-20201018155654-3aac261c05da
 	golang.org/x/crypto v0.0.0-20200728195943-123391ffb6de
 	golang.org/x/net v0.0.0-20200822124328-c89045814202
+	golang.org/x/sys v0.0.0-20200808120158-1030fc2bf1d9
 	gopkg.in/check.v1 v1.0.0-20200227125254-8fa46927fb4f // indirect
 )
@@ -0,0 +1,194 @@
+package listener
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"github.com/bokysan/socketace/v2/internal/client/upstream"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/bokysan/socketace/v2/internal/util/cert"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	stdlog "log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
+)
+
+// HttpProxyListener is an HTTP proxy on the client. It tunnels the `CONNECT host:port` requests and forwards the plain
+// HTTP requests with an absolute URI, each through a new stream to the server, to the destination chosen by
+// targetChannel. If Pac is set, a proxy auto-config file pointing to this proxy is served at that path.
+type HttpProxyListener struct {
+	AbstractListener
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Pac      string `json:"pac"`
+
+	server *http.Server
+	proxy  *httputil.ReverseProxy
+	logger *io.PipeWriter
+}
+
+func (l *HttpProxyListener) Start(upstreams *upstream.Upstreams, config cert.ConfigGetter) (err error) {
+	l.Upstreams = upstreams
+	l.Config = config
+
+	if l.Address.User != nil {
+		// Keep the password out of the logs
+		l.Username = l.Address.User.Username()
+		l.Password, _ = l.Address.User.Password()
+		l.Address.User = nil
+	}
+	if query := l.Address.Query(); query.Get("pac") != "" {
+		l.Pac = query.Get("pac")
+		query.Del("pac")
+		l.Address.RawQuery = query.Encode()
+	}
+	if l.Pac != "" && !strings.HasPrefix(l.Pac, "/") {
+		l.Pac = "/" + l.Pac
+	}
+
+	l.logger = log.StandardLogger().WriterLevel(log.DebugLevel)
+	l.proxy = &httputil.ReverseProxy{
+		// The request URI is absolute already
+		Director: func(r *http.Request) {},
+		Transport: &http.Transport{
+			DialContext: l.dialTarget,
+			// Each request gets its own stream, so that the server sees the right client in the metadata
+			DisableKeepAlives: true,
+		},
+		ErrorLog: stdlog.New(l.logger, "", 0),
+	}
+	l.server = &http.Server{
+		Handler: l,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return withMetadata(ctx, conn)
+		},
+		ErrorLog: l.proxy.ErrorLog,
+	}
+
+	ln, err := net.Listen("tcp", l.Address.Host)
+	if err != nil {
+		return errors.Wrapf(err, "Could not listen on %v", l.Address.Host)
+	}
+
+	log.Infof("Starting HttpProxyListener %v", l.String())
+	go func() {
+		if err := l.server.Serve(ln); err != http.ErrServerClosed {
+			err = errors.WithStack(err)
+			log.WithError(err).Errorf("Could not start the proxy %v", err)
+		}
+	}()
+	return nil
+}
+
+func (l *HttpProxyListener) Shutdown() error {
+	if l.server == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := l.server.Shutdown(ctx)
+	streams.TryClose(l.logger)
+	return errors.WithStack(err)
+}
+
+func (l *HttpProxyListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect && !r.URL.IsAbs() {
+		if l.Pac != "" && r.URL.Path == l.Pac {
+			l.servePac(w, r)
+		} else {
+			http.Error(w, "This is a proxy, not a web server", http.StatusBadRequest)
+		}
+		return
+	}
+
+	if !l.authorized(r) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="SocketAce"`)
+		http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		l.tunnel(w, r)
+	} else if r.URL.Scheme != "http" {
+		http.Error(w, fmt.Sprintf("Unsupported scheme %q, use CONNECT", r.URL.Scheme), http.StatusBadRequest)
+	} else {
+		r.Header.Del("Proxy-Authorization")
+		r.Header.Del("Proxy-Connection")
+		l.proxy.ServeHTTP(w, r)
+	}
+}
+
+// authorized checks the Basic proxy credentials, if the listener requires them
+func (l *HttpProxyListener) authorized(r *http.Request) bool {
+	if l.Username == "" {
+		return true
+	}
+	header := r.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(header, "Basic ") {
+		return false
+	}
+	credentials, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(header, "Basic "))
+	if err != nil {
+		return false
+	}
+	expected := l.Username + ":" + l.Password
+	return subtle.ConstantTimeCompare(credentials, []byte(expected)) == 1
+}
+
+// tunnel handles the CONNECT request
+func (l *HttpProxyListener) tunnel(w http.ResponseWriter, r *http.Request) {
+	address := r.Host
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid destination %q", address), http.StatusBadRequest)
+		return
+	}
+
+	up, err := l.dialTarget(r.Context(), "tcp", address)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to %v", address), http.StatusBadGateway)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		streams.TryClose(up)
+		http.Error(w, "Tunneling not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		streams.TryClose(up)
+		log.WithError(err).Warnf("Could not take over the proxy connection: %v", err)
+		return
+	}
+
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		streams.TryClose(up)
+		streams.TryClose(conn)
+		return
+	}
+
+	// The client may have sent some data already, read it from the buffer first
+	var downstream io.ReadWriteCloser = conn
+	if buffered.Reader.Buffered() > 0 {
+		downstream = streams.NewReadWriteCloser(ioutil.NopCloser(buffered.Reader), conn)
+	}
+	if err := streams.PipeData(downstream, up); err != nil {
+		log.WithError(err).Debugf("Tunnel to %v failed: %v", address, err)
+	}
+	streams.TryClose(up)
+	streams.TryClose(conn)
+}
+
+// servePac returns a proxy auto-config file which sends all the traffic through this proxy
+func (l *HttpProxyListener) servePac(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	_, _ = fmt.Fprintf(w, "function FindProxyForURL(url, host) {\n  return \"PROXY %s\";\n}\n", r.Host)
+}
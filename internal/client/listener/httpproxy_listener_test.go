@@ -0,0 +1,86 @@
+package listener
+
+import (
+	"bufio"
+	"github.com/bokysan/socketace/v2/internal/it"
+	"github.com/bokysan/socketace/v2/internal/server"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func Test_HttpProxyListener(t *testing.T) {
+	echo := it.StartEchoService(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("Hello from " + r.URL.Path))
+	}))
+	defer backend.Close()
+
+	_, loopback, err := net.ParseCIDR("127.0.0.0/8")
+	require.NoError(t, err)
+	channels := server.Channels{
+		&server.DynamicChannel{
+			AbstractChannel: server.AbstractChannel{
+				ProtoName: addr.ProtoName{
+					Name: "internal",
+				},
+				Address: addr.MustParseAddress("dynamic://"),
+			},
+			Destinations: server.Destinations{
+				Networks: []server.Network{{IPNet: loopback}},
+			},
+		},
+	}
+
+	proxyHost := it.FreeAddress(t)
+	ll := Listeners{}
+	require.NoError(t, ll.UnmarshalFlag("internal~httpproxy://alice:secret@"+proxyHost+"?pac=proxy.pac"))
+	startListeners(t, connect(t, it.StartServer(t, channels)), ll...)
+
+	proxyUrl, err := url.Parse("http://alice:secret@" + proxyHost)
+	require.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}, Timeout: 5 * time.Second}
+
+	// Plain HTTP requests are forwarded
+	resp, err := client.Get(backend.URL + "/test")
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "Hello from /test", string(body))
+
+	// Without the credentials, the proxy refuses the requests
+	resp, err = (&http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: proxyHost})}}).Get(backend.URL)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+
+	// CONNECT tunnels
+	conn, err := net.Dial("tcp", proxyHost)
+	require.NoError(t, err)
+	defer streams.TryClose(conn)
+	_, err = conn.Write([]byte("CONNECT " + echo.Host + " HTTP/1.1\r\nHost: " + echo.Host + "\r\nProxy-Authorization: Basic YWxpY2U6c2VjcmV0\r\n\r\n"))
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	resp, err = http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, 0, reader.Buffered())
+	it.HelloEcho(t, conn)
+
+	// The PAC file is served without authentication
+	resp, err = http.Get("http://" + proxyHost + "/proxy.pac")
+	require.NoError(t, err)
+	body, err = ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Contains(t, string(body), "PROXY "+proxyHost)
+}
@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/bokysan/socketace/v2/internal/client/upstream"
+	"github.com/bokysan/socketace/v2/internal/shaping"
+	"github.com/bokysan/socketace/v2/internal/socketace"
 	"github.com/bokysan/socketace/v2/internal/streams"
 	"github.com/bokysan/socketace/v2/internal/util/addr"
 	"github.com/bokysan/socketace/v2/internal/util/cert"
@@ -13,6 +15,7 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync"
 )
 
 // Listeners is a list of Listener objects.
@@ -40,38 +43,40 @@ func (ll *Listeners) UnmarshalFlag(data string) error {
 	data = strings.TrimSpace(data)
 	var l Listener
 
-	if strings.HasPrefix(data, "}") && strings.HasSuffix(data, "}") {
+	if strings.HasPrefix(data, "{") && strings.HasSuffix(data, "}") {
 		stuff := make(map[string]interface{}, 0)
 		err := json.Unmarshal([]byte(data), &stuff)
 		if err != nil {
 			return errors.Wrapf(err, "Failed unmarshalling: %s", data)
 		}
 
-		if a, ok := stuff["address"]; ok {
-			address, err := addr.ParseAddress(a.(string))
-			if err != nil {
-				return errors.Wrapf(err, "Can't parse %q into an address", a)
-			}
-
-			switch address.Scheme {
-			case "stdin", "stdio":
-				l := &InputOutputListener{}
-				err := json.Unmarshal([]byte(data), l)
-				if err != nil {
-					return errors.Wrapf(err, "Failed unmarshalling: %s", data)
-				}
-			case "tcp", "unix", "unixpacket":
-				l := &SocketListener{}
-				err := json.Unmarshal([]byte(data), l)
-				if err != nil {
-					return errors.Wrapf(err, "Failed unmarshalling: %s", data)
-				}
-			default:
-				return errors.Errorf("Can't handle format: %s", address.Scheme)
-			}
-		} else {
+		a, ok := stuff["address"].(string)
+		if !ok {
 			return errors.Errorf("Can't find address in: %s", data)
+		}
+		address, err := addr.ParseAddress(a)
+		if err != nil {
+			return errors.Wrapf(err, "Can't parse %q into an address", a)
+		}
 
+		switch address.Scheme {
+		case "stdin", "stdio":
+			l = &InputOutputListener{}
+		case "tcp", "unix", "unixpacket":
+			l = &SocketListener{}
+		case "udp", "udp4", "udp6", "unixgram":
+			l = &PacketListener{}
+		case "socks":
+			l = &SocksChannelListener{}
+		case "socks5":
+			l = &SocksListener{}
+		case "httpproxy":
+			l = &HttpProxyListener{}
+		default:
+			return errors.Errorf("Can't handle format: %s", address.Scheme)
+		}
+		if err := json.Unmarshal([]byte(data), l); err != nil {
+			return errors.Wrapf(err, "Failed unmarshalling: %s", data)
 		}
 
 	} else if strings.ContainsRune(data, '~') {
@@ -80,10 +85,17 @@ func (ll *Listeners) UnmarshalFlag(data string) error {
 		var forward *addr.ProtoAddress
 
 		channel := parts[0]
+		if err := validateChannel(channel); err != nil {
+			return errors.Wrapf(err, "Invalid listener %q", data)
+		}
 		address, err := addr.ParseAddress(parts[1])
 		if err != nil {
 			return errors.Wrapf(err, "Can't parse %q into an address", parts[1])
 		}
+		shaper, err := shapingParameters(address)
+		if err != nil {
+			return errors.Wrapf(err, "Invalid listener %q", data)
+		}
 		if len(parts) >= 3 {
 			if a, err := addr.ParseAddress(parts[2]); err != nil {
 				return errors.Wrapf(err, "Can't parse %q into an address", parts[2])
@@ -92,6 +104,10 @@ func (ll *Listeners) UnmarshalFlag(data string) error {
 			}
 		}
 
+		if (address.Scheme == "socks5" || address.Scheme == "httpproxy" || address.Scheme == "socks") && strings.Contains(channel, "/") {
+			return errors.Errorf("Invalid listener %q: the proxy client chooses the target", data)
+		}
+
 		switch address.Scheme {
 		case "stdin", "stdio":
 			l = &InputOutputListener{
@@ -101,6 +117,7 @@ func (ll *Listeners) UnmarshalFlag(data string) error {
 					},
 					Address: *address,
 					Forward: forward,
+					Policy:  shaper,
 				},
 			}
 		case "tcp", "unix", "unixpacket":
@@ -111,6 +128,60 @@ func (ll *Listeners) UnmarshalFlag(data string) error {
 					},
 					Address: *address,
 					Forward: forward,
+					Policy:  shaper,
+				},
+			}
+		case "udp", "udp4", "udp6", "unixgram":
+			idleTimeout, err := idleTimeoutParameter(address)
+			if err != nil {
+				return errors.Wrapf(err, "Invalid listener %q", data)
+			}
+			if forward != nil && !streams.IsDatagramNetwork(forward.Scheme) {
+				return errors.Errorf("Invalid listener %q: datagrams can only be forwarded to a packet address", data)
+			}
+			l = &PacketListener{
+				AbstractListener: AbstractListener{
+					ProtoName: addr.ProtoName{
+						Name: channel,
+					},
+					Address: *address,
+					Forward: forward,
+					Policy:  shaper,
+				},
+				IdleTimeout: idleTimeout,
+			}
+		case "socks":
+			l = &SocksChannelListener{
+				SocketListener: SocketListener{
+					AbstractListener: AbstractListener{
+						ProtoName: addr.ProtoName{
+							Name: channel,
+						},
+						Address: *address,
+						Policy:  shaper,
+					},
+				},
+			}
+		case "socks5":
+			l = &SocksListener{
+				SocketListener: SocketListener{
+					AbstractListener: AbstractListener{
+						ProtoName: addr.ProtoName{
+							Name: channel,
+						},
+						Address: *address,
+						Policy:  shaper,
+					},
+				},
+			}
+		case "httpproxy":
+			l = &HttpProxyListener{
+				AbstractListener: AbstractListener{
+					ProtoName: addr.ProtoName{
+						Name: channel,
+					},
+					Address: *address,
+					Policy:  shaper,
 				},
 			}
 		default:
@@ -127,6 +198,56 @@ func (ll *Listeners) UnmarshalFlag(data string) error {
 	return nil
 }
 
+// validateChannel checks the target of a channel, e.g. `internal/db.example.org:22` for a dynamic channel or
+// `hub/laptop-ssh` for a hub. The server decides if the target is allowed.
+func validateChannel(channel string) error {
+	i := strings.Index(channel, "/")
+	if i < 0 {
+		return nil
+	}
+	if i == 0 {
+		return errors.Errorf("Missing channel name: %v", channel)
+	}
+	target := channel[i+1:]
+	if target == "" {
+		return errors.Errorf("Missing target of channel %v", channel[:i])
+	}
+	if !strings.Contains(target, ":") {
+		// The name of a service published to the hub
+		return nil
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid target of channel %v", channel[:i])
+	}
+	if host == "" || port == "" {
+		return errors.Errorf("Invalid target of channel %v: %v", channel[:i], target)
+	}
+	return nil
+}
+
+// shapingParameters will remove the rate limits and the priority from the query parameters of the address, e.g.
+// `tcp://127.0.0.1:2222?priority=interactive` or `tcp://127.0.0.1:8730?priority=bulk&upload-limit=1M`
+func shapingParameters(address *addr.ProtoAddress) (shaping.Policy, error) {
+	policy := shaping.Policy{}
+	query := address.Query()
+	found := false
+	for name, values := range query {
+		if !shaping.IsParameter(name) {
+			continue
+		}
+		if err := policy.Set(name, values[0]); err != nil {
+			return policy, err
+		}
+		query.Del(name)
+		found = true
+	}
+	if found {
+		address.RawQuery = query.Encode()
+	}
+	return policy, nil
+}
+
 // ------ // ------ // ------ // ------ // ------ // ------ // ------ //
 
 // Listener is a high-level implementation that listens to connections and tries to connect to backend upstreams(s).
@@ -143,28 +264,53 @@ type AbstractListener struct {
 	addr.ProtoName `yaml:",inline"`
 
 	Address addr.ProtoAddress  `json:"address" description:"Connect a listening connection at this endpoint."`
-	Forward *addr.ProtoAddress `json:"forward" description:"Try forwarding to this address first. Only valid for non-packet connections. (e.g. UDP not supported)"`
+	Forward *addr.ProtoAddress `json:"forward" description:"Try forwarding to this address first. Packet listeners (e.g. UDP) must forward to a packet address."`
+
+	shaping.Policy `yaml:",inline"`
 
 	Upstreams *upstream.Upstreams
 	Config    cert.ConfigGetter
+
+	shaper     *shaping.Shaper
+	shaperOnce sync.Once
 }
 
 func (l *AbstractListener) String() string {
 	return fmt.Sprintf("%s->%s", l.Address.String(), l.Name)
 }
 
+// Shaper returns the limits of the listener, shared by all its connections
+func (l *AbstractListener) Shaper() *shaping.Shaper {
+	l.shaperOnce.Do(func() {
+		l.shaper = shaping.NewShaper(l.Policy)
+	})
+	return l.shaper
+}
+
 func (l *AbstractListener) ConnectDirectly(conn net.Conn) bool {
 	forward := l.Forward
 	if forward == nil {
 		return false
 	}
-	if forward.Host == "" || forward.Scheme == "" {
+	if (forward.Host == "" && forward.Path == "") || forward.Scheme == "" {
 		return false
 	}
 	log.Debugf("Dialing direct connection to %s %s", forward.Scheme, forward.Host)
 	var direct net.Conn
 	var err error
-	direct, err = net.Dial(forward.Scheme, forward.Host)
+	if streams.IsDatagramNetwork(forward.Scheme) {
+		// The datagrams are framed on the listener's side, so the direct connection must frame them as well
+		address := forward.Host
+		if forward.Scheme == "unixgram" && address == "" {
+			address = forward.Path
+		}
+		direct, err = streams.DialDatagram(forward.Scheme, address)
+		if err == nil {
+			direct = streams.NewDatagramConnection(direct, 0)
+		}
+	} else {
+		direct, err = net.Dial(forward.Scheme, forward.Host)
+	}
 	if err == nil {
 		direct = streams.NewNamedConnection(direct, fmt.Sprintf("%v", forward))
 		err = streams.PipeData(conn, direct)
@@ -187,13 +333,13 @@ func (l *AbstractListener) HandleConnection(conn net.Conn) {
 	}
 
 	log.Tracef("Connecting to upstream for channel %s...", l.Name)
-	up, err := l.Upstreams.Connect(l.Config, l.Name)
+	up, err := l.Upstreams.Connect(l.Config, l.Name, socketace.NewStreamMetadata(conn))
 	if err != nil {
 		log.WithError(err).Warnf("Communication for %s with upstream failed: %v", l.Name, err)
 	} else {
 		log.Tracef("...connected to %s via %s", l.Name, up)
 		stream := streams.NewNamedStream(conn, "->"+conn.RemoteAddr().String())
-		err = streams.PipeData(stream, up)
+		err = streams.PipeData(stream, l.Shaper().Client(up, l.Upstreams.Scheduler()))
 		if err != nil {
 			log.WithError(err).Warnf("Communication for %s with upstream failed: %v", l.Name, err)
 		}
@@ -257,11 +403,16 @@ func (l *SocketListener) Start(upstreams *upstream.Upstreams, config cert.Config
 	l.Config = config
 
 	log.Infof("Starting SocketListener %v", l.String())
+	return l.listen(l.Address.Scheme, l.HandleConnection)
+}
+
+// listen will start accepting the connections and pass them to the handler
+func (l *SocketListener) listen(network string, handler func(conn net.Conn)) (err error) {
 	l.shutdown = make(chan bool, 1)
-	l.netListener, err = net.Listen(l.Address.Scheme, l.Address.Host)
+	l.netListener, err = net.Listen(network, l.Address.Host)
 
 	if err == nil {
-		go l.accept()
+		go l.accept(handler)
 	}
 
 	return errors.WithStack(err)
@@ -277,7 +428,7 @@ func (l *SocketListener) Shutdown() (err error) {
 	return
 }
 
-func (l *SocketListener) accept() {
+func (l *SocketListener) accept(handler func(conn net.Conn)) {
 	for {
 		select {
 		case <-l.shutdown:
@@ -297,7 +448,7 @@ func (l *SocketListener) accept() {
 					continue
 				}
 				log.Debugf("Acceping connection on %p = %v, %s->%s", l, l, conn.RemoteAddr(), conn.LocalAddr())
-				go l.HandleConnection(conn)
+				go handler(conn)
 			}
 		}
 
@@ -0,0 +1,71 @@
+package listener
+
+import (
+	"github.com/bokysan/socketace/v2/internal/util/duration"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func Test_UnmarshalFlagJson(t *testing.T) {
+	ll := Listeners{}
+
+	require.NoError(t, ll.UnmarshalFlag(`{"name":"ssh","address":"tcp://127.0.0.1:2222"}`))
+	require.IsType(t, &SocketListener{}, ll[0])
+	require.Equal(t, "ssh", ll[0].(*SocketListener).Name)
+
+	require.NoError(t, ll.UnmarshalFlag(`{"name":"dns","address":"udp://127.0.0.1:5353","forward":"udp://127.0.0.1:53","idleTimeout":"30s"}`))
+	packet, ok := ll[1].(*PacketListener)
+	require.True(t, ok)
+	require.Equal(t, "dns", packet.Name)
+	require.Equal(t, "127.0.0.1:5353", packet.Address.Host)
+	require.Equal(t, "127.0.0.1:53", packet.Forward.Host)
+	require.Equal(t, duration.Duration(30*time.Second), packet.IdleTimeout)
+
+	require.NoError(t, ll.UnmarshalFlag(`{"name":"proxy","address":"socks://127.0.0.1:1080"}`))
+	socksChannel, ok := ll[2].(*SocksChannelListener)
+	require.True(t, ok)
+	require.Equal(t, "proxy", socksChannel.Name)
+	require.Equal(t, "127.0.0.1:1080", socksChannel.Address.Host)
+
+	require.NoError(t, ll.UnmarshalFlag(`{"name":"internal","address":"socks5://127.0.0.1:1081","username":"user","password":"secret"}`))
+	socks, ok := ll[3].(*SocksListener)
+	require.True(t, ok)
+	require.Equal(t, "internal", socks.Name)
+	require.Equal(t, "user", socks.Username)
+	require.Equal(t, "secret", socks.Password)
+
+	require.NoError(t, ll.UnmarshalFlag(`{"name":"internal","address":"httpproxy://127.0.0.1:3128","pac":"*.internal"}`))
+	http, ok := ll[4].(*HttpProxyListener)
+	require.True(t, ok)
+	require.Equal(t, "internal", http.Name)
+	require.Equal(t, "*.internal", http.Pac)
+
+	require.Len(t, ll, 5)
+}
+
+func Test_UnmarshalFlagJsonInvalid(t *testing.T) {
+	ll := Listeners{}
+	require.Error(t, ll.UnmarshalFlag(`{"name":"ssh"}`))
+	require.Error(t, ll.UnmarshalFlag(`{"name":"ssh","address":22}`))
+	require.Error(t, ll.UnmarshalFlag(`{"name":"ssh","address":"ftp://127.0.0.1:21"}`))
+	require.Error(t, ll.UnmarshalFlag(`{"name":"ssh","address":"tcp://127.0.0.1:2222"`))
+	require.Empty(t, ll)
+}
+
+func Test_UnmarshalFlagIdleTimeout(t *testing.T) {
+	ll := Listeners{}
+	require.NoError(t, ll.UnmarshalFlag("dns~udp://127.0.0.1:5353?idle-timeout=1m"))
+	packet := ll[0].(*PacketListener)
+	require.Equal(t, duration.Duration(time.Minute), packet.IdleTimeout)
+	require.Empty(t, packet.Address.RawQuery)
+	require.Error(t, ll.UnmarshalFlag("dns~udp://127.0.0.1:5353?idle-timeout=soon"))
+}
+
+func Test_UnmarshalFlagTarget(t *testing.T) {
+	ll := Listeners{}
+	require.NoError(t, ll.UnmarshalFlag("internal/db.example.org:5432~tcp://127.0.0.1:5432"))
+	require.Equal(t, "internal/db.example.org:5432", ll[0].(*SocketListener).Name)
+	require.Error(t, ll.UnmarshalFlag("internal/db.example.org:~tcp://127.0.0.1:5432"))
+	require.Error(t, ll.UnmarshalFlag("/db.example.org:5432~tcp://127.0.0.1:5432"))
+}
@@ -0,0 +1,241 @@
+package listener
+
+import (
+	"github.com/bokysan/socketace/v2/internal/client/upstream"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/bokysan/socketace/v2/internal/util/cert"
+	"github.com/bokysan/socketace/v2/internal/util/duration"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PeerQueueSize is the number of datagrams queued for each local sender before they are dropped
+const PeerQueueSize = 64
+
+// PacketListener receives the datagrams on a `udp` or `unixgram` socket. Each local sender gets its own flow through
+// the upstream (or directly to Forward), carrying the datagrams framed by streams.WriteDatagram, and the replies are
+// sent back to it. The flow is closed after IdleTimeout without any datagrams.
+type PacketListener struct {
+	AbstractListener
+	IdleTimeout duration.Duration `json:"idleTimeout"`
+
+	conn  net.PacketConn
+	mutex sync.Mutex
+	peers map[string]*packetPeer
+}
+
+// idleTimeoutParameter will remove the `idle-timeout` query parameter from the address, e.g.
+// `udp://127.0.0.1:53?idle-timeout=30s`
+func idleTimeoutParameter(address *addr.ProtoAddress) (duration.Duration, error) {
+	query := address.Query()
+	value := query.Get("idle-timeout")
+	if value == "" {
+		return 0, nil
+	}
+	d, err := duration.Parse(value)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Invalid idle-timeout: %v", value)
+	}
+	query.Del("idle-timeout")
+	address.RawQuery = query.Encode()
+	return d, nil
+}
+
+// path returns the address to listen on: the host and port or the path of the socket
+func (l *PacketListener) path() string {
+	if l.Address.Scheme == "unixgram" && l.Address.Host == "" {
+		return l.Address.Path
+	}
+	return l.Address.Host
+}
+
+func (l *PacketListener) Start(upstreams *upstream.Upstreams, config cert.ConfigGetter) (err error) {
+	l.Upstreams = upstreams
+	l.Config = config
+	if l.IdleTimeout == 0 {
+		l.IdleTimeout = duration.Duration(streams.DefaultIdleTimeout)
+	}
+
+	log.Infof("Starting PacketListener %v", l.String())
+	l.mutex.Lock()
+	l.peers = make(map[string]*packetPeer)
+	l.mutex.Unlock()
+	l.conn, err = net.ListenPacket(l.Address.Scheme, l.path())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	go l.receive(l.conn)
+	return nil
+}
+
+// Shutdown stops listening and closes all flows
+func (l *PacketListener) Shutdown() (err error) {
+	if l.conn == nil {
+		return nil
+	}
+	err = errors.WithStack(streams.LogClose(l.conn))
+	if l.Address.Scheme == "unixgram" {
+		_ = os.Remove(l.path())
+	}
+	l.conn = nil
+
+	l.mutex.Lock()
+	peers := make([]*packetPeer, 0, len(l.peers))
+	for _, p := range l.peers {
+		peers = append(peers, p)
+	}
+	l.mutex.Unlock()
+	for _, p := range peers {
+		_ = p.Close()
+	}
+	return
+}
+
+// receive passes the datagrams to the flows of their senders
+func (l *PacketListener) receive(conn net.PacketConn) {
+	buf := make([]byte, streams.MaxDatagramSize)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if strings.Contains(err.Error(), "use of closed network connection") {
+				return
+			}
+			log.WithError(err).Errorf("Could not receive datagram on %v: %+v", l, err)
+			return
+		}
+		if from == nil {
+			log.Debugf("Dropping datagram from an unbound socket on %v", l)
+			continue
+		}
+
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		p := l.peer(conn, from)
+		select {
+		case p.incoming <- data:
+		case <-p.closed:
+		default:
+			log.Tracef("Queue of %v is full, dropping datagram", from)
+		}
+	}
+}
+
+// peer returns the flow of the sender, starting a new one if needed
+func (l *PacketListener) peer(conn net.PacketConn, from net.Addr) *packetPeer {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	key := from.String()
+	if p, ok := l.peers[key]; ok {
+		return p
+	}
+	p := &packetPeer{
+		listener: l,
+		conn:     conn,
+		addr:     from,
+		incoming: make(chan []byte, PeerQueueSize),
+		closed:   make(chan struct{}),
+	}
+	l.peers[key] = p
+	log.Debugf("New datagram flow on %p = %v from %v", l, l, from)
+	go l.HandleConnection(streams.NewDatagramConnection(p, time.Duration(l.IdleTimeout)))
+	return p
+}
+
+// remove forgets the flow, so the next datagram from the same sender starts a new one
+func (l *PacketListener) remove(p *packetPeer) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.peers[p.addr.String()] == p {
+		delete(l.peers, p.addr.String())
+	}
+}
+
+// packetPeer is a connected packet socket to a single local sender: reads return its datagrams and writes are sent
+// back to it.
+type packetPeer struct {
+	listener *PacketListener
+	conn     net.PacketConn
+	addr     net.Addr
+	incoming chan []byte
+	closed   chan struct{}
+	once     sync.Once
+
+	mutex    sync.Mutex
+	deadline time.Time
+}
+
+// timeoutError is returned when the read deadline is reached
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func (p *packetPeer) Read(b []byte) (int, error) {
+	p.mutex.Lock()
+	deadline := p.deadline
+	p.mutex.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case data := <-p.incoming:
+		return copy(b, data), nil
+	case <-p.closed:
+		return 0, io.EOF
+	case <-timeout:
+		return 0, timeoutError{}
+	}
+}
+
+func (p *packetPeer) Write(b []byte) (int, error) {
+	select {
+	case <-p.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	return p.conn.WriteTo(b, p.addr)
+}
+
+func (p *packetPeer) Close() error {
+	p.once.Do(func() {
+		close(p.closed)
+		p.listener.remove(p)
+	})
+	return nil
+}
+
+func (p *packetPeer) LocalAddr() net.Addr {
+	return p.conn.LocalAddr()
+}
+
+func (p *packetPeer) RemoteAddr() net.Addr {
+	return p.addr
+}
+
+func (p *packetPeer) SetDeadline(t time.Time) error {
+	return p.SetReadDeadline(t)
+}
+
+func (p *packetPeer) SetReadDeadline(t time.Time) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.deadline = t
+	return nil
+}
+
+func (p *packetPeer) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,74 @@
+package listener
+
+import (
+	"github.com/bokysan/socketace/v2/internal/it"
+	"github.com/bokysan/socketace/v2/internal/server"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/stretchr/testify/require"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test_PacketListener(t *testing.T) {
+	echo := startUdpEcho(t)
+	forwardAddress := addr.MustParseAddress("udp://" + echo.LocalAddr().String())
+	channels := server.Channels{
+		&server.DatagramChannel{
+			AbstractChannel: server.AbstractChannel{
+				ProtoName: addr.ProtoName{
+					Name: "dns",
+				},
+				Address: forwardAddress,
+			},
+		},
+	}
+
+	localAddress, directAddress := freeUdpAddress(t), freeUdpAddress(t)
+	startListeners(t, connect(t, it.StartServer(t, channels)),
+		&PacketListener{
+			AbstractListener: AbstractListener{
+				ProtoName: addr.ProtoName{
+					Name: "dns",
+				},
+				Address: addr.MustParseAddress("udp://" + localAddress),
+			},
+		},
+		// The service is reachable, so the server is not needed
+		&PacketListener{
+			AbstractListener: AbstractListener{
+				ProtoName: addr.ProtoName{
+					Name: "unknown",
+				},
+				Address: addr.MustParseAddress("udp://" + directAddress),
+				Forward: &forwardAddress,
+			},
+		},
+	)
+
+	// Each sender gets its own replies
+	first, err := net.Dial("udp", localAddress)
+	require.NoError(t, err)
+	defer streams.TryClose(first)
+	second, err := net.Dial("udp", localAddress)
+	require.NoError(t, err)
+	defer streams.TryClose(second)
+	direct, err := net.Dial("udp", directAddress)
+	require.NoError(t, err)
+	defer streams.TryClose(direct)
+
+	buf := make([]byte, 1024)
+	for i := 0; i < 3; i++ {
+		for name, conn := range map[string]net.Conn{"first": first, "second": second, "direct": direct} {
+			datagram := name + "-" + strconv.Itoa(i)
+			_, err := conn.Write([]byte(datagram))
+			require.NoError(t, err)
+			require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+			n, err := conn.Read(buf)
+			require.NoError(t, err)
+			require.Equal(t, datagram, string(buf[:n]))
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package listener
+
+import (
+	"context"
+	"github.com/bokysan/socketace/v2/internal/socketace"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"strings"
+)
+
+type metadataKey struct{}
+
+// withMetadata stores the description of the client connection for the streams opened by dialTarget
+func withMetadata(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, metadataKey{}, socketace.NewStreamMetadata(conn))
+}
+
+// targetChannel returns the channel to select for the destination requested by a proxy client: the dynamic channel
+// with the destination (e.g. `internal/example.org:443`) or, if the name is a template (e.g. `web-{port}`), the
+// channel the name expands to. `{host}` and `{port}` are replaced with the requested host and port.
+func targetChannel(name, host, port string) string {
+	if strings.Contains(name, "{host}") || strings.Contains(name, "{port}") {
+		return strings.NewReplacer("{host}", host, "{port}", port).Replace(name)
+	}
+	return name + "/" + net.JoinHostPort(host, port)
+}
+
+// dialTarget opens a stream to the destination through the server. The address is not resolved locally.
+func (l *AbstractListener) dialTarget(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid destination: %v", address)
+	}
+	metadata, _ := ctx.Value(metadataKey{}).(*socketace.StreamMetadata)
+	subProtocol := targetChannel(l.Name, host, port)
+
+	log.Tracef("Connecting to upstream for channel %s...", subProtocol)
+	up, err := l.Upstreams.Connect(l.Config, subProtocol, metadata)
+	if err != nil {
+		log.WithError(err).Warnf("Communication for %s with upstream failed: %v", subProtocol, err)
+		return nil, err
+	}
+	stream := l.Shaper().Client(up, l.Upstreams.Scheduler())
+	return streams.NewNamedConnection(streams.NewSimulatedConnection(stream, streams.Localhost, streams.Localhost), subProtocol), nil
+}
@@ -0,0 +1,297 @@
+package listener
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bokysan/socketace/v2/internal/client/upstream"
+	"github.com/bokysan/socketace/v2/internal/socketace"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/bokysan/socketace/v2/internal/util/cert"
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RemoteRetryInterval is the longest pause between the attempts to (re)open a reverse tunnel
+var RemoteRetryInterval = 30 * time.Second
+
+// Remotes is a list of the reverse tunnels
+type Remotes []*RemoteListener
+
+func (rl *Remotes) Start(connector *upstream.Upstreams, config cert.ConfigGetter) error {
+	var errs error
+	log.Debugf("Start %v reverse tunnels", len(*rl))
+	for _, l := range *rl {
+		if err := l.Start(connector, config); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+	return errs
+}
+
+// MarshalFlag will serialize the whole Remotes for storage by flags
+func (rl *Remotes) MarshalFlag() (string, error) {
+	data, err := json.Marshal(rl)
+	return string(data), errors.WithStack(err)
+}
+
+// UnmarshalFlag will parse the reverse tunnel, e.g. `expose~tcp://0.0.0.0:8080~tcp://127.0.0.1:3000`
+func (rl *Remotes) UnmarshalFlag(data string) error {
+	parts := strings.Split(strings.TrimSpace(data), "~")
+	if len(parts) != 3 || parts[0] == "" || strings.Contains(parts[0], "/") {
+		return errors.Errorf("Unknown syntax for reverse tunnel: %v, expected <channel>~<remote-url>~<local-url>", data)
+	}
+
+	address, err := addr.ParseAddress(parts[1])
+	if err != nil {
+		return errors.Wrapf(err, "Can't parse %q into an address", parts[1])
+	}
+	target, err := parseTarget(parts[2])
+	if err != nil {
+		return errors.Wrapf(err, "Invalid reverse tunnel %q", data)
+	}
+	shaper, err := shapingParameters(target)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid reverse tunnel %q", data)
+	}
+
+	l := &RemoteListener{
+		AbstractListener: AbstractListener{
+			ProtoName: addr.ProtoName{
+				Name: parts[0],
+			},
+			Address: *address,
+			Policy:  shaper,
+		},
+		Target: *target,
+	}
+	log.Infof("Adding reverse tunnel %v to the list", l)
+	*rl = append(*rl, l)
+	return nil
+}
+
+// Publications is a list of the services published to the hubs
+type Publications Remotes
+
+func (pl *Publications) Start(connector *upstream.Upstreams, config cert.ConfigGetter) error {
+	return (*Remotes)(pl).Start(connector, config)
+}
+
+// MarshalFlag will serialize the whole Publications for storage by flags
+func (pl *Publications) MarshalFlag() (string, error) {
+	return (*Remotes)(pl).MarshalFlag()
+}
+
+// UnmarshalFlag will parse the published service, e.g. `hub~laptop-ssh~tcp://127.0.0.1:22`
+func (pl *Publications) UnmarshalFlag(data string) error {
+	parts := strings.Split(strings.TrimSpace(data), "~")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || strings.Contains(parts[0], "/") {
+		return errors.Errorf("Unknown syntax for published service: %v, expected <hub>~<name>~<local-url>", data)
+	}
+
+	target, err := parseTarget(parts[2])
+	if err != nil {
+		return errors.Wrapf(err, "Invalid published service %q", data)
+	}
+	shaper, err := shapingParameters(target)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid published service %q", data)
+	}
+
+	l := &RemoteListener{
+		AbstractListener: AbstractListener{
+			ProtoName: addr.ProtoName{
+				Name: parts[0],
+			},
+			Policy: shaper,
+		},
+		Target:  *target,
+		Publish: parts[1],
+	}
+	log.Infof("Adding published service %v to the list", l)
+	*pl = append(*pl, l)
+	return nil
+}
+
+// parseTarget parses the local address the streams opened by the server are connected to
+func parseTarget(data string) (*addr.ProtoAddress, error) {
+	target, err := addr.ParseAddress(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Can't parse %q into an address", data)
+	}
+	switch target.Scheme {
+	case "tcp", "tcp4", "tcp6", "unix":
+	default:
+		return nil, errors.Errorf("Can't handle format: %s", target.Scheme)
+	}
+	return target, nil
+}
+
+// RemoteListener is a reverse tunnel: the server listens on the Address and the connections it accepts are forwarded
+// back to the client, which connects them to the Target. If Publish is set, the Target is published in the hub
+// channel Name instead, and the server relays the streams of the other clients to it.
+type RemoteListener struct {
+	AbstractListener
+	Target  addr.ProtoAddress `json:"target"  description:"Connect the connections accepted by the server to this address."`
+	Publish string            `json:"publish" description:"Publish the target in the hub under this name."`
+
+	mutex    sync.Mutex
+	control  io.Closer
+	shutdown chan struct{}
+}
+
+func (l *RemoteListener) String() string {
+	if l.Publish != "" {
+		return fmt.Sprintf("%s<-%s/%s", l.Target.String(), l.Name, l.Publish)
+	}
+	return fmt.Sprintf("%s<-%s<-%s", l.Target.String(), l.Name, l.Address.String())
+}
+
+// protocol returns the protocol of the streams opened by the server
+func (l *RemoteListener) protocol() string {
+	if l.Publish != "" {
+		return "/" + l.Name + "/" + l.Publish
+	}
+	return "/" + l.Name + "/" + l.Address.String()
+}
+
+// controlProtocol returns the subprotocol of the control stream
+func (l *RemoteListener) controlProtocol() string {
+	if l.Publish != "" {
+		return strings.TrimPrefix(socketace.PublishProtocol, "/") + l.protocol()
+	}
+	return strings.TrimPrefix(l.protocol(), "/")
+}
+
+func (l *RemoteListener) Start(upstreams *upstream.Upstreams, config cert.ConfigGetter) error {
+	l.Upstreams = upstreams
+	l.Config = config
+	l.shutdown = make(chan struct{})
+
+	upstreams.HandleReverse(l.protocol(), func(protocol string, stream io.ReadWriteCloser) error {
+		l.handleStream(stream)
+		return nil
+	})
+
+	log.Infof("Starting RemoteListener %v", l.String())
+	go l.maintain()
+	return nil
+}
+
+// Shutdown will close the tunnel, so the server stops listening
+func (l *RemoteListener) Shutdown() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.shutdown != nil {
+		close(l.shutdown)
+		l.shutdown = nil
+		l.Upstreams.HandleReverse(l.protocol(), nil)
+	}
+	if l.control != nil {
+		streams.TryClose(l.control)
+		l.control = nil
+	}
+	return nil
+}
+
+// maintain keeps the tunnel open: it asks the server to listen and reopens the tunnel when the session is lost
+func (l *RemoteListener) maintain() {
+	l.mutex.Lock()
+	shutdown := l.shutdown
+	l.mutex.Unlock()
+
+	delay := time.Second
+	for {
+		if established := l.open(shutdown); established {
+			delay = time.Second
+		}
+
+		select {
+		case <-shutdown:
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > RemoteRetryInterval {
+			delay = RemoteRetryInterval
+		}
+	}
+}
+
+// open will ask the server to listen and wait until the tunnel is closed. It returns true if the server listened.
+func (l *RemoteListener) open(shutdown chan struct{}) bool {
+	control, err := l.Upstreams.Connect(l.Config, l.controlProtocol(), nil)
+	if err != nil {
+		log.WithError(err).Warnf("Could not open reverse tunnel %v: %v", l, err)
+		return false
+	}
+
+	l.mutex.Lock()
+	select {
+	case <-shutdown:
+		l.mutex.Unlock()
+		streams.TryClose(control)
+		return false
+	default:
+		l.control = control
+	}
+	l.mutex.Unlock()
+
+	if err := socketace.ReadBindReply(control); err != nil {
+		log.WithError(err).Warnf("Could not open reverse tunnel %v: %v", l, err)
+		l.release(control)
+		return false
+	}
+	if l.Publish != "" {
+		log.Infof("Published %v in %v as %v", l.Target.String(), l.Name, l.Publish)
+	} else {
+		log.Infof("Server is listening on %v for %v", l.Address.String(), l.Target.String())
+	}
+
+	// Nothing is sent over the control stream, it's closed with the tunnel
+	_, _ = io.Copy(ioutil.Discard, control)
+	l.release(control)
+	log.Infof("Reverse tunnel %v closed", l)
+	return true
+}
+
+// release will close the control stream, unless Shutdown already did so
+func (l *RemoteListener) release(control io.Closer) {
+	l.mutex.Lock()
+	owned := l.control == control
+	if owned {
+		l.control = nil
+	}
+	l.mutex.Unlock()
+
+	if owned {
+		streams.TryClose(control)
+	}
+}
+
+// handleStream connects the stream opened by the server to the target
+func (l *RemoteListener) handleStream(stream io.ReadWriteCloser) {
+	network, address := l.Target.Scheme, l.Target.Host
+	if address == "" {
+		address = l.Target.Path
+	}
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		log.WithError(err).Warnf("Could not connect reverse tunnel %v to %v: %v", l.Name, l.Target.String(), err)
+		streams.TryClose(stream)
+		return
+	}
+
+	log.Tracef("Reverse connection via %s to %s", l.Name, l.Target.String())
+	if err := streams.PipeData(streams.NewNamedConnection(conn, l.Target.String()), l.Shaper().Client(stream, l.Upstreams.Scheduler())); err != nil {
+		log.WithError(err).Debugf("Reverse connection via %s failed: %v", l.Name, err)
+	}
+	streams.TryClose(conn)
+	streams.TryClose(stream)
+}
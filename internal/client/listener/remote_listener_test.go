@@ -0,0 +1,107 @@
+package listener
+
+import (
+	"github.com/bokysan/socketace/v2/internal/it"
+	"github.com/bokysan/socketace/v2/internal/server"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/bokysan/socketace/v2/internal/util/auth"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_RemoteListener(t *testing.T) {
+	echo := it.StartEchoService(t)
+	channels := server.Channels{
+		&server.ReverseChannel{
+			AbstractChannel: server.AbstractChannel{
+				ProtoName: addr.ProtoName{
+					Name: "expose",
+				},
+				Address: addr.MustParseAddress("reverse://"),
+			},
+			Bind: []string{"tcp://127.0.0.1:*"},
+		},
+	}
+
+	remoteAddress := it.FreeAddress(t)
+	_, port, err := net.SplitHostPort(it.FreeAddress(t))
+	require.NoError(t, err)
+	rl := Remotes{}
+	require.NoError(t, rl.UnmarshalFlag("expose~tcp://"+remoteAddress+"~"+echo.String()))
+	require.NoError(t, rl.UnmarshalFlag("expose~tcp://0.0.0.0:"+port+"~"+echo.String()))
+	require.Error(t, rl.UnmarshalFlag("expose~tcp://"+remoteAddress))
+	startListeners(t, connect(t, it.StartServer(t, channels)), rl[0], rl[1])
+
+	// The server starts listening once the client asks it to
+	var conn net.Conn
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", remoteAddress); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.NoError(t, err)
+	it.HelloEcho(t, conn)
+	streams.TryClose(conn)
+
+	// The server does not listen on the addresses it does not permit
+	_, err = net.Dial("tcp", "127.0.0.1:"+port)
+	require.Error(t, err)
+
+	// The server stops listening when the client goes away
+	require.NoError(t, rl[0].Shutdown())
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", remoteAddress); err != nil {
+			break
+		}
+		streams.TryClose(conn)
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Error(t, err)
+}
+
+func Test_Publications(t *testing.T) {
+	hub := &server.HubChannel{
+		AbstractChannel: server.AbstractChannel{
+			ProtoName: addr.ProtoName{
+				Name: "hub",
+			},
+			Address: addr.MustParseAddress("hub://"),
+		},
+		Publish: auth.Rules{{}},
+	}
+	address := it.StartServer(t, server.Channels{hub})
+	echo := it.StartEchoService(t)
+
+	// One client publishes the echo service...
+	pl := Publications{}
+	require.NoError(t, pl.UnmarshalFlag("hub~echo~"+echo.String()))
+	require.Error(t, pl.UnmarshalFlag("hub~~"+echo.String()))
+	startListeners(t, connect(t, address), pl[0])
+
+	// ...and the other one uses it
+	localAddress := it.FreeAddress(t)
+	ll := Listeners{}
+	require.NoError(t, ll.UnmarshalFlag("hub/echo~tcp://"+localAddress))
+	startListeners(t, connect(t, address), ll...)
+
+	for i := 0; i < 50 && len(hub.Published()) == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Equal(t, map[string]string{"echo": "anonymous"}, hub.Published())
+
+	conn, err := net.Dial("tcp", localAddress)
+	require.NoError(t, err)
+	it.HelloEcho(t, conn)
+	streams.TryClose(conn)
+
+	// The name is withdrawn when the publisher goes away
+	require.NoError(t, pl[0].Shutdown())
+	for i := 0; i < 50 && len(hub.Published()) > 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Empty(t, hub.Published())
+}
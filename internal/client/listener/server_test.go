@@ -0,0 +1,82 @@
+package listener
+
+import (
+	"github.com/bokysan/socketace/v2/internal/client/upstream"
+	"github.com/bokysan/socketace/v2/internal/server"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/bokysan/socketace/v2/internal/util/cert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+type testConfig struct{}
+
+func (testConfig) CertManager() cert.TlsConfig {
+	return &cert.ClientConfig{}
+}
+
+// connect returns the upstreams of the server at the address
+func connect(t *testing.T, address addr.ProtoAddress) *upstream.Upstreams {
+	ul := &upstream.Upstreams{
+		Data: []upstream.Upstream{
+			&upstream.Socket{
+				Address: address,
+			},
+		},
+	}
+	t.Cleanup(ul.Shutdown)
+	return ul
+}
+
+// startListeners will start the listeners and shut them down when the test completes
+func startListeners(t *testing.T, ul *upstream.Upstreams, ll ...Listener) {
+	for _, l := range ll {
+		l := l
+		require.NoError(t, l.Start(ul, testConfig{}))
+		t.Cleanup(func() {
+			_ = l.Shutdown()
+		})
+	}
+}
+
+// echoChannel returns the channel with the given name which leads to the echo service
+func echoChannel(name string, echo addr.ProtoAddress) *server.NetworkChannel {
+	return &server.NetworkChannel{
+		AbstractChannel: server.AbstractChannel{
+			ProtoName: addr.ProtoName{
+				Name: name,
+			},
+			Address: echo,
+		},
+	}
+}
+
+// startUdpEcho starts a service which sends the datagrams back to the sender and returns its socket
+func startUdpEcho(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		streams.TryClose(conn)
+	})
+	go func() {
+		buf := make([]byte, streams.MaxDatagramSize)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteTo(buf[:n], from)
+		}
+	}()
+	return conn
+}
+
+// freeUdpAddress returns a local UDP address with a port assigned by the OS
+func freeUdpAddress(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer streams.TryClose(conn)
+	return conn.LocalAddr().String()
+}
@@ -0,0 +1,209 @@
+package listener
+
+import (
+	"github.com/armon/go-socks5"
+	"github.com/bokysan/socketace/v2/internal/client/upstream"
+	"github.com/bokysan/socketace/v2/internal/socketace"
+	"github.com/bokysan/socketace/v2/internal/socks"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/bokysan/socketace/v2/internal/util/cert"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+)
+
+// SocksChannelListener passes the SOCKS connections to the socks channel on the server. The channel carries the
+// datagrams of UDP ASSOCIATE over the stream, so the listener opens the UDP port for them on the client and relays
+// the datagrams of the SOCKS client.
+type SocksChannelListener struct {
+	SocketListener
+}
+
+func (l *SocksChannelListener) Start(upstreams *upstream.Upstreams, config cert.ConfigGetter) (err error) {
+	l.Upstreams = upstreams
+	l.Config = config
+
+	log.Infof("Starting SocksChannelListener %v", l.String())
+	return l.listen("tcp", l.serve)
+}
+
+func (l *SocksChannelListener) serve(conn net.Conn) {
+	log.Tracef("Connecting to upstream for channel %s...", l.Name)
+	up, err := l.Upstreams.Connect(l.Config, l.Name, socketace.NewStreamMetadata(conn))
+	if err != nil {
+		log.WithError(err).Warnf("Communication for %s with upstream failed: %v", l.Name, err)
+		streams.TryClose(conn)
+		return
+	}
+	stream := l.Shaper().Client(up, l.Upstreams.Scheduler())
+
+	command, err := negotiate(conn, stream)
+	if err != nil {
+		log.WithError(err).Debugf("SOCKS connection from %v failed: %v", conn.RemoteAddr(), err)
+		streams.TryClose(stream)
+		streams.TryClose(conn)
+		return
+	}
+
+	if command == socks5.AssociateCommand {
+		err = l.associate(conn, stream)
+	} else {
+		err = streams.PipeData(streams.NewNamedStream(conn, "->"+conn.RemoteAddr().String()), stream)
+	}
+	if err != nil {
+		log.WithError(err).Warnf("Communication for %s with upstream failed: %v", l.Name, err)
+	}
+}
+
+// negotiate passes the greeting, the authentication and the request of the SOCKS client to the server and returns
+// the requested command
+func negotiate(conn net.Conn, stream io.ReadWriter) (uint8, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return 0, errors.Wrapf(err, "Failed to read the SOCKS greeting")
+	}
+	if header[0] != socks.Version {
+		return 0, errors.Errorf("Unsupported SOCKS version: %v", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return 0, errors.Wrapf(err, "Failed to read the authentication methods")
+	}
+	if _, err := stream.Write(append(header, methods...)); err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	choice := make([]byte, 2)
+	if err := forward(conn, stream, choice); err != nil {
+		return 0, err
+	}
+	switch choice[1] {
+	case socks.MethodNoAuth:
+	case socks.MethodUserPass:
+		// VER ULEN UNAME PLEN PASSWD
+		auth := make([]byte, 2)
+		if _, err := io.ReadFull(conn, auth); err != nil {
+			return 0, errors.WithStack(err)
+		}
+		auth = append(auth, make([]byte, int(auth[1])+1)...)
+		if _, err := io.ReadFull(conn, auth[2:]); err != nil {
+			return 0, errors.WithStack(err)
+		}
+		password := make([]byte, auth[len(auth)-1])
+		if _, err := io.ReadFull(conn, password); err != nil {
+			return 0, errors.WithStack(err)
+		}
+		if _, err := stream.Write(append(auth, password...)); err != nil {
+			return 0, errors.WithStack(err)
+		}
+		status := make([]byte, 2)
+		if err := forward(conn, stream, status); err != nil {
+			return 0, err
+		}
+		if status[1] != 0 {
+			return 0, errors.Errorf("Authentication failed")
+		}
+	default:
+		return 0, errors.Errorf("No acceptable authentication method")
+	}
+
+	req, err := socks5.NewRequest(conn)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if err := socks.WriteRequest(stream, req.Command, req.DestAddr); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return req.Command, nil
+}
+
+// forward reads the response of the server into the buffer and passes it to the SOCKS client
+func forward(conn io.Writer, stream io.Reader, p []byte) error {
+	if _, err := io.ReadFull(stream, p); err != nil {
+		return errors.Wrapf(err, "Failed to read the SOCKS response")
+	}
+	_, err := conn.Write(p)
+	return errors.WithStack(err)
+}
+
+// associate opens the UDP port for the SOCKS client and relays its datagrams over the stream. The association ends
+// when the SOCKS client closes the connection.
+func (l *SocksChannelListener) associate(conn net.Conn, stream io.ReadWriteCloser) error {
+	var relay net.PacketConn
+	var once sync.Once
+	closeAll := func() {
+		once.Do(func() {
+			streams.TryClose(stream)
+			streams.TryClose(conn)
+			if relay != nil {
+				streams.TryClose(relay)
+			}
+		})
+	}
+	defer closeAll()
+
+	code, bound, err := socks.ReadReply(stream)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to read the SOCKS reply")
+	}
+	if code != socks.ReplySuccess {
+		return socks.WriteReply(conn, code, bound)
+	}
+
+	local := conn.LocalAddr().(*net.TCPAddr)
+	client := conn.RemoteAddr().(*net.TCPAddr)
+	if relay, err = net.ListenPacket("udp", net.JoinHostPort(local.IP.String(), "0")); err != nil {
+		_ = socks.WriteReply(conn, socks.ReplyServerFailure, nil)
+		return errors.Wrapf(err, "Could not open a UDP port")
+	}
+	if err := socks.WriteReply(conn, socks.ReplySuccess, socks.AddrSpec(relay.LocalAddr())); err != nil {
+		return errors.WithStack(err)
+	}
+	log.Debugf("Relaying SOCKS datagrams of %v on %v", client, relay.LocalAddr())
+
+	var mutex sync.Mutex
+	var sender net.Addr
+
+	go func() {
+		defer closeAll()
+		_, _ = io.Copy(ioutil.Discard, conn)
+	}()
+
+	go func() {
+		defer closeAll()
+		buf := make([]byte, streams.MaxDatagramSize)
+		for {
+			n, err := streams.ReadDatagram(stream, buf)
+			if err != nil {
+				return
+			}
+			mutex.Lock()
+			to := sender
+			mutex.Unlock()
+			if to != nil {
+				_, _ = relay.WriteTo(buf[:n], to)
+			}
+		}
+	}()
+
+	buf := make([]byte, streams.MaxDatagramSize)
+	for {
+		n, from, err := relay.ReadFrom(buf)
+		if err != nil {
+			return nil
+		}
+		// Only the SOCKS client may use the port
+		if udp, ok := from.(*net.UDPAddr); !ok || !udp.IP.Equal(client.IP) {
+			continue
+		}
+		mutex.Lock()
+		sender = from
+		mutex.Unlock()
+		if err := streams.WriteDatagram(stream, buf[:n]); err != nil {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package listener
+
+import (
+	"github.com/armon/go-socks5"
+	"github.com/bokysan/socketace/v2/internal/it"
+	"github.com/bokysan/socketace/v2/internal/server"
+	"github.com/bokysan/socketace/v2/internal/socks"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_SocksChannelListener(t *testing.T) {
+	echo := it.StartEchoService(t)
+	udpEcho := startUdpEcho(t)
+	channels := server.Channels{
+		&server.SocksChannel{
+			AbstractChannel: server.AbstractChannel{
+				ProtoName: addr.ProtoName{
+					Name: "proxy",
+				},
+				Address: addr.MustParseAddress("socks://"),
+			},
+			Users: map[string]string{"alice": "secret"},
+		},
+	}
+
+	proxyAddress := it.FreeAddress(t)
+	startListeners(t, connect(t, it.StartServer(t, channels)), &SocksChannelListener{
+		SocketListener: SocketListener{
+			AbstractListener: AbstractListener{
+				ProtoName: addr.ProtoName{
+					Name: "proxy",
+				},
+				Address: addr.MustParseAddress("socks://" + proxyAddress),
+			},
+		},
+	})
+
+	socksProxy, err := proxy.SOCKS5("tcp", proxyAddress, &proxy.Auth{User: "alice", Password: "secret"}, proxy.Direct)
+	require.NoError(t, err)
+	conn, err := socksProxy.Dial("tcp", echo.Host)
+	require.NoError(t, err)
+	defer streams.TryClose(conn)
+	it.HelloEcho(t, conn)
+
+	// UDP ASSOCIATE
+	control, err := net.Dial("tcp", proxyAddress)
+	require.NoError(t, err)
+	defer streams.TryClose(control)
+	_, err = control.Write([]byte{5, 1, 2})
+	require.NoError(t, err)
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(control, reply)
+	require.NoError(t, err)
+	require.Equal(t, []byte{5, 2}, reply)
+	_, err = control.Write([]byte("\x01\x05alice\x06secret"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(control, reply)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 0}, reply)
+	require.NoError(t, socks.WriteRequest(control, 3, &socks5.AddrSpec{IP: net.IPv4zero}))
+	code, bound, err := socks.ReadReply(control)
+	require.NoError(t, err)
+	require.Equal(t, socks.ReplySuccess, code)
+
+	udp, err := net.Dial("udp", bound.Address())
+	require.NoError(t, err)
+	defer streams.TryClose(udp)
+	dest := socks.AddrSpec(udpEcho.LocalAddr())
+	buf := make([]byte, 1024)
+	for _, datagram := range []string{"first", "second"} {
+		p, err := socks.Datagram(dest, []byte(datagram))
+		require.NoError(t, err)
+		_, err = udp.Write(p)
+		require.NoError(t, err)
+		require.NoError(t, udp.SetReadDeadline(time.Now().Add(5*time.Second)))
+		n, err := udp.Read(buf)
+		require.NoError(t, err)
+		from, data, err := socks.ParseDatagram(buf[:n])
+		require.NoError(t, err)
+		require.Equal(t, datagram, string(data))
+		require.Equal(t, dest.Port, from.Port)
+	}
+}
@@ -0,0 +1,94 @@
+package listener
+
+import (
+	"context"
+	"github.com/armon/go-socks5"
+	"github.com/bokysan/socketace/v2/internal/client/upstream"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/bokysan/socketace/v2/internal/util/cert"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	stdlog "log"
+	"net"
+	"sync"
+)
+
+// SocksListener is a SOCKS5 proxy on the client. Each CONNECT opens a stream to the server, to the destination
+// chosen by targetChannel.
+type SocksListener struct {
+	SocketListener
+	Username string `json:"username"`
+	Password string `json:"password"`
+
+	server  *socks5.Server
+	logger  *io.PipeWriter
+	clients sync.Map // the SOCKS connections by the remote address
+}
+
+func (l *SocksListener) Start(upstreams *upstream.Upstreams, config cert.ConfigGetter) (err error) {
+	l.Upstreams = upstreams
+	l.Config = config
+
+	if l.Address.User != nil {
+		// Keep the password out of the logs
+		l.Username = l.Address.User.Username()
+		l.Password, _ = l.Address.User.Password()
+		l.Address.User = nil
+	}
+
+	l.logger = log.StandardLogger().WriterLevel(log.DebugLevel)
+	conf := &socks5.Config{
+		Resolver: remoteResolver{},
+		Rules:    l,
+		Dial:     l.dialTarget,
+		Logger:   stdlog.New(l.logger, "", 0),
+	}
+	if l.Username != "" {
+		conf.Credentials = socks5.StaticCredentials{l.Username: l.Password}
+	}
+	if l.server, err = socks5.New(conf); err != nil {
+		return errors.Wrapf(err, "Could not configure the SOCKS proxy")
+	}
+
+	log.Infof("Starting SocksListener %v", l.String())
+	return l.listen("tcp", l.serve)
+}
+
+func (l *SocksListener) Shutdown() error {
+	err := l.SocketListener.Shutdown()
+	if l.logger != nil {
+		streams.TryClose(l.logger)
+	}
+	return err
+}
+
+func (l *SocksListener) serve(conn net.Conn) {
+	key := conn.RemoteAddr().String()
+	l.clients.Store(key, conn)
+	defer l.clients.Delete(key)
+
+	if err := l.server.ServeConn(conn); err != nil {
+		log.WithError(err).Debugf("SOCKS connection from %v failed: %v", key, err)
+	}
+}
+
+// Allow permits only the CONNECT requests and remembers the client connection for the stream metadata
+func (l *SocksListener) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if req.Command != socks5.ConnectCommand {
+		return ctx, false
+	}
+	if req.RemoteAddr != nil {
+		if conn, ok := l.clients.Load(req.RemoteAddr.Address()); ok {
+			ctx = withMetadata(ctx, conn.(net.Conn))
+		}
+	}
+	return ctx, true
+}
+
+// remoteResolver leaves the names to be resolved by the server
+type remoteResolver struct{}
+
+func (remoteResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, nil, nil
+}
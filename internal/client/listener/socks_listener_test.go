@@ -0,0 +1,69 @@
+package listener
+
+import (
+	"github.com/bokysan/socketace/v2/internal/it"
+	"github.com/bokysan/socketace/v2/internal/server"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+	"net"
+	"strconv"
+	"testing"
+)
+
+func Test_SocksListener(t *testing.T) {
+	echo := it.StartEchoService(t)
+	_, p, err := net.SplitHostPort(echo.Host)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(p)
+	require.NoError(t, err)
+
+	_, loopback, err := net.ParseCIDR("127.0.0.0/8")
+	require.NoError(t, err)
+	channels := server.Channels{
+		&server.DynamicChannel{
+			AbstractChannel: server.AbstractChannel{
+				ProtoName: addr.ProtoName{
+					Name: "internal",
+				},
+				Address: addr.MustParseAddress("dynamic://"),
+			},
+			Destinations: server.Destinations{
+				Networks: []server.Network{{IPNet: loopback}},
+				Ports:    []server.PortRange{{From: port, To: port}},
+			},
+		},
+		echoChannel("echo-"+p, echo),
+	}
+
+	dynamicAddress, templateAddress := it.FreeAddress(t), it.FreeAddress(t)
+	ll := Listeners{}
+	require.NoError(t, ll.UnmarshalFlag("internal~socks5://alice:secret@"+dynamicAddress))
+	require.NoError(t, ll.UnmarshalFlag("echo-{port}~socks5://"+templateAddress))
+	require.Error(t, ll.UnmarshalFlag("internal/127.0.0.1:22~socks5://"+templateAddress))
+	startListeners(t, connect(t, it.StartServer(t, channels)), ll...)
+
+	// The host name is resolved by the server
+	dynamic, err := proxy.SOCKS5("tcp", dynamicAddress, &proxy.Auth{User: "alice", Password: "secret"}, proxy.Direct)
+	require.NoError(t, err)
+	conn, err := dynamic.Dial("tcp", "localhost:"+p)
+	require.NoError(t, err)
+	defer streams.TryClose(conn)
+	it.HelloEcho(t, conn)
+
+	_, err = dynamic.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port+1))
+	require.Error(t, err, "The destination is not on the allowlist")
+
+	unauthorized, err := proxy.SOCKS5("tcp", dynamicAddress, &proxy.Auth{User: "alice", Password: "wrong"}, proxy.Direct)
+	require.NoError(t, err)
+	_, err = unauthorized.Dial("tcp", "localhost:"+p)
+	require.Error(t, err)
+
+	template, err := proxy.SOCKS5("tcp", templateAddress, nil, proxy.Direct)
+	require.NoError(t, err)
+	conn, err = template.Dial("tcp", "anything:"+p)
+	require.NoError(t, err)
+	defer streams.TryClose(conn)
+	it.HelloEcho(t, conn)
+}
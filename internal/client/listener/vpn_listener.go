@@ -0,0 +1,231 @@
+package listener
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bokysan/socketace/v2/internal/client/upstream"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/bokysan/socketace/v2/internal/util/cert"
+	"github.com/bokysan/socketace/v2/internal/vpn"
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Vpns is a list of the VPN attachments
+type Vpns []*VpnListener
+
+func (vl *Vpns) Start(connector *upstream.Upstreams, config cert.ConfigGetter) error {
+	var errs error
+	log.Debugf("Start %v VPNs", len(*vl))
+	for _, l := range *vl {
+		if err := l.Start(connector, config); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+	return errs
+}
+
+// MarshalFlag will serialize the whole Vpns for storage by flags
+func (vl *Vpns) MarshalFlag() (string, error) {
+	data, err := json.Marshal(vl)
+	return string(data), errors.WithStack(err)
+}
+
+// UnmarshalFlag will parse the VPN, e.g. `vpn~tun://socketace0` or `vpn~userspace://`
+func (vl *Vpns) UnmarshalFlag(data string) error {
+	parts := strings.Split(strings.TrimSpace(data), "~")
+	if len(parts) != 2 || parts[0] == "" || strings.Contains(parts[0], "/") {
+		return errors.Errorf("Unknown syntax for VPN: %v, expected <channel>~<device-url>", data)
+	}
+
+	address, err := addr.ParseAddress(parts[1])
+	if err != nil {
+		return errors.Wrapf(err, "Can't parse %q into an address", parts[1])
+	}
+	switch address.Scheme {
+	case "tun", "userspace":
+	default:
+		return errors.Errorf("Unknown VPN device: %v, expected tun:// or userspace://", parts[1])
+	}
+	shaper, err := shapingParameters(address)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid VPN %q", data)
+	}
+
+	l := &VpnListener{
+		AbstractListener: AbstractListener{
+			ProtoName: addr.ProtoName{
+				Name: parts[0],
+			},
+			Address: *address,
+			Policy:  shaper,
+		},
+	}
+	log.Infof("Adding VPN %v to the list", l)
+	*vl = append(*vl, l)
+	return nil
+}
+
+// VpnListener attaches the device (a TUN interface or a userspace network stack) to the VPN channel of the server.
+// The device is configured with the address and the routes sent by the server, and the packets are exchanged over a
+// single stream. The stream is reopened when the session is lost.
+type VpnListener struct {
+	AbstractListener
+
+	mutex    sync.Mutex
+	device   vpn.Device
+	stream   io.ReadWriteCloser
+	shutdown chan struct{}
+}
+
+func (l *VpnListener) String() string {
+	return fmt.Sprintf("%s<->%s", l.Address.String(), l.Name)
+}
+
+// Device returns the device of the VPN, once started
+func (l *VpnListener) Device() vpn.Device {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.device
+}
+
+func (l *VpnListener) Start(upstreams *upstream.Upstreams, config cert.ConfigGetter) error {
+	l.Upstreams = upstreams
+	l.Config = config
+
+	device, err := vpn.Open(&l.Address)
+	if err != nil {
+		return errors.Wrapf(err, "Could not open VPN device %v", l.Address.String())
+	}
+	l.mutex.Lock()
+	l.device = device
+	l.shutdown = make(chan struct{})
+	l.mutex.Unlock()
+
+	log.Infof("Starting VpnListener %v", l.String())
+	go l.readDevice(device)
+	go l.maintain()
+	return nil
+}
+
+// Shutdown will detach from the server and close the device
+func (l *VpnListener) Shutdown() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.shutdown != nil {
+		close(l.shutdown)
+		l.shutdown = nil
+	}
+	if l.stream != nil {
+		streams.TryClose(l.stream)
+		l.stream = nil
+	}
+	if l.device != nil {
+		return errors.WithStack(l.device.Close())
+	}
+	return nil
+}
+
+// maintain keeps the VPN attached, reattaching when the session is lost
+func (l *VpnListener) maintain() {
+	l.mutex.Lock()
+	shutdown := l.shutdown
+	l.mutex.Unlock()
+
+	delay := time.Second
+	for {
+		if attached := l.attach(shutdown); attached {
+			delay = time.Second
+		}
+
+		select {
+		case <-shutdown:
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > RemoteRetryInterval {
+			delay = RemoteRetryInterval
+		}
+	}
+}
+
+// attach will configure the device as instructed by the server and forward the packets of the server to the device
+// until the stream is closed. It returns true if the server accepted the client.
+func (l *VpnListener) attach(shutdown chan struct{}) bool {
+	stream, err := l.Upstreams.Connect(l.Config, l.Name, nil)
+	if err != nil {
+		log.WithError(err).Warnf("Could not attach VPN %v: %v", l, err)
+		return false
+	}
+
+	config, err := vpn.ReadConfig(stream)
+	if err == nil {
+		err = l.device.Configure(*config)
+	}
+	if err != nil {
+		log.WithError(err).Warnf("Could not attach VPN %v: %v", l, err)
+		streams.TryClose(stream)
+		return false
+	}
+	log.Infof("VPN %v attached as %v", l, config.Address)
+
+	shaped := l.Shaper().Client(stream, l.Upstreams.Scheduler())
+	l.mutex.Lock()
+	select {
+	case <-shutdown:
+		l.mutex.Unlock()
+		streams.TryClose(stream)
+		return false
+	default:
+		l.stream = shaped
+	}
+	l.mutex.Unlock()
+
+	buf := make([]byte, streams.MaxDatagramSize)
+	for {
+		n, err := streams.ReadDatagram(shaped, buf)
+		if err != nil {
+			break
+		}
+		if _, err := l.device.Write(buf[:n]); err != nil {
+			log.WithError(err).Tracef("Could not write the packet to %v: %v", l.device.Name(), err)
+		}
+	}
+
+	l.mutex.Lock()
+	if l.stream == shaped {
+		l.stream = nil
+	}
+	l.mutex.Unlock()
+	streams.TryClose(shaped)
+	log.Infof("VPN %v detached", l)
+	return true
+}
+
+// readDevice sends the packets of the device to the server. The packets are dropped while detached.
+func (l *VpnListener) readDevice(device vpn.Device) {
+	buf := make([]byte, streams.MaxDatagramSize)
+	for {
+		n, err := device.Read(buf)
+		if err != nil {
+			log.Debugf("Stopped reading %v: %v", device.Name(), err)
+			return
+		}
+
+		// Only this goroutine writes to the stream
+		l.mutex.Lock()
+		stream := l.stream
+		l.mutex.Unlock()
+		if stream != nil {
+			if err := streams.WriteDatagram(stream, buf[:n]); err != nil {
+				log.WithError(err).Tracef("Could not send the packet of %v: %v", device.Name(), err)
+			}
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package listener
+
+import (
+	"github.com/bokysan/socketace/v2/internal/it"
+	"github.com/bokysan/socketace/v2/internal/server"
+	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/bokysan/socketace/v2/internal/vpn"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_VpnListener(t *testing.T) {
+	address := it.StartServer(t, server.Channels{
+		&server.VpnChannel{
+			AbstractChannel: server.AbstractChannel{
+				ProtoName: addr.ProtoName{
+					Name: "vpn",
+				},
+				Address: addr.MustParseAddress("vpn://"),
+			},
+			Network: server.Network{IPNet: &net.IPNet{IP: net.IPv4(10, 8, 0, 0).To4(), Mask: net.CIDRMask(24, 32)}},
+		},
+	})
+
+	attach := func() *vpn.Stack {
+		vl := Vpns{}
+		require.NoError(t, vl.UnmarshalFlag("vpn~userspace://"))
+		startListeners(t, connect(t, address), vl[0])
+		return vl[0].Device().(*vpn.Stack)
+	}
+	first, second := attach(), attach()
+
+	// Wait for the server to assign the addresses
+	for i := 0; i < 50 && (first.Address() == nil || second.Address() == nil); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.NotNil(t, first.Address())
+	require.NotNil(t, second.Address())
+	require.NotEqual(t, first.Address().String(), second.Address().String())
+
+	// ICMP to the server...
+	_, err := first.Ping(net.IPv4(10, 8, 0, 1), 5*time.Second)
+	require.NoError(t, err)
+
+	// ...and UDP to the other client
+	service, err := second.ListenUDP(7)
+	require.NoError(t, err)
+	defer service.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, from, err := service.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = service.WriteTo(buf[:n], from)
+		}
+	}()
+
+	conn, err := first.ListenUDP(0)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.WriteTo([]byte("Hello, world!"), service.LocalAddr())
+	require.NoError(t, err)
+	buf := make([]byte, 1024)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, _, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, "Hello, world!", string(buf[:n]))
+}
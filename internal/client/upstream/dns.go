@@ -3,14 +3,17 @@ package upstream
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"github.com/bokysan/socketace/v2/internal/socketace"
 	"github.com/bokysan/socketace/v2/internal/streams"
 	"github.com/bokysan/socketace/v2/internal/streams/dns"
 	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/bokysan/socketace/v2/internal/util/auth"
 	"github.com/bokysan/socketace/v2/internal/util/cert"
 	dns2 "github.com/miekg/dns"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"net"
 	"os/exec"
 	"runtime"
 	"strings"
@@ -39,7 +42,12 @@ func (ups *Dns) String() string {
 	return ups.Address.String()
 }
 
-func (ups *Dns) Connect(manager cert.TlsConfig, mustSecure bool) error {
+// Unwrap returns the established connection
+func (ups *Dns) Unwrap() net.Conn {
+	return ups.Connection
+}
+
+func (ups *Dns) Connect(ctx context.Context, manager cert.TlsConfig, credentials auth.Credentials, mux *socketace.MuxConfig, mustSecure bool) error {
 
 	if ups.Address.Scheme != "dns" {
 		return errors.Errorf("DNS can only handle 'dns' schemes. Cannot handle: %q", ups.Address.String())
@@ -104,12 +112,19 @@ main:
 			return err
 		}
 
+		if err = ctx.Err(); err != nil {
+			return errors.WithStack(err)
+		}
+
 		conn, err = dns.NewClientDnsConnection(topDomain, comm)
 		if err != nil {
 			return err
 		}
 
-		if err = conn.Handshake(); err != nil {
+		stop := closeOnCancel(ctx, conn)
+		err = conn.Handshake()
+		stop()
+		if err != nil {
 			if len(conf.Servers) == 1 {
 				// Nothing more to do, give up
 				return err
@@ -138,10 +153,14 @@ main:
 		return errors.Errorf("Connection not established!")
 	}
 
-	cc, err := socketace.NewClientConnection(conn, manager, false, ups.Address.Host)
+	stop := closeOnCancel(ctx, conn)
+	cc, err := socketace.NewClientConnection(conn, manager, false, ups.Address.Host, credentials, mux)
+	stop()
 	if err != nil {
+		streams.TryClose(conn)
 		return errors.Wrapf(err, "Could not open connection")
 	} else if mustSecure && !cc.Secure() {
+		streams.TryClose(conn)
 		return errors.Errorf("Could not establish a secure connection to %v", ups.Address)
 	}
 
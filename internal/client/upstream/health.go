@@ -0,0 +1,385 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/bokysan/socketace/v2/internal/resume"
+	"github.com/bokysan/socketace/v2/internal/socketace"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	ms "github.com/multiformats/go-multistream"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/xtaci/smux"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultHealthTimeout is the default maximum round-trip time of a health probe
+	DefaultHealthTimeout = 5 * time.Second
+	// DefaultHealthFailures is the default number of failed probes in a row which trigger a failover
+	DefaultHealthFailures = 3
+	// DefaultFailbackInterval is the default interval between the checks of the preferred upstreams
+	DefaultFailbackInterval = time.Minute
+)
+
+// failbackTimeout limits how long a single failback attempt may take
+const failbackTimeout = 30 * time.Second
+
+// UpstreamHealth is the last known state of a single upstream
+type UpstreamHealth struct {
+	Upstream    string    `json:"upstream"`
+	Healthy     bool      `json:"healthy"`
+	LastChecked time.Time `json:"lastChecked"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+// Status is a snapshot of the client connection to the upstreams
+type Status struct {
+	Current   string           `json:"current,omitempty"` // Current is the upstream the session runs over
+	Since     time.Time        `json:"since"`             // Since is the time the current upstream was selected
+	RoundTrip time.Duration    `json:"roundTrip"`         // RoundTrip is the duration of the last health probe
+	Failovers int              `json:"failovers"`
+	Failbacks int              `json:"failbacks"`
+	Paths     []string         `json:"paths,omitempty"` // Paths are the upstreams the multipath session runs over
+	Upstreams []UpstreamHealth `json:"upstreams"`
+}
+
+// Status returns the current state of the upstreams
+func (ul *Upstreams) Status() Status {
+	ul.statusMutex.Lock()
+	defer ul.statusMutex.Unlock()
+
+	status := ul.status
+	status.Upstreams = make([]UpstreamHealth, 0, len(ul.Data))
+	for _, u := range ul.Data {
+		if h, ok := ul.health[u]; ok {
+			status.Upstreams = append(status.Upstreams, *h)
+		} else {
+			status.Upstreams = append(status.Upstreams, UpstreamHealth{Upstream: fmt.Sprint(u)})
+		}
+	}
+	return status
+}
+
+// notify will report the status change to the listener, if any
+func (ul *Upstreams) notify() {
+	if ul.OnStatus != nil {
+		ul.OnStatus(ul.Status())
+	}
+}
+
+// markHealth will record the outcome of a connection attempt or a health probe
+func (ul *Upstreams) markHealth(u Upstream, err error) {
+	ul.statusMutex.Lock()
+	if ul.health == nil {
+		ul.health = make(map[Upstream]*UpstreamHealth)
+	}
+	h, ok := ul.health[u]
+	if !ok {
+		h = &UpstreamHealth{Upstream: fmt.Sprint(u)}
+		ul.health[u] = h
+	}
+	wasHealthy, known := h.Healthy, !h.LastChecked.IsZero()
+	h.LastChecked = time.Now()
+	h.Healthy = err == nil
+	h.LastError = ""
+	if err != nil {
+		h.LastError = err.Error()
+	}
+	ul.statusMutex.Unlock()
+
+	if known && wasHealthy && err != nil {
+		log.Warnf("[Upstream] %v is unhealthy: %v", u, err)
+	} else if known && !wasHealthy && err == nil {
+		log.Infof("[Upstream] %v is healthy again", u)
+	}
+	if !known || wasHealthy != (err == nil) {
+		ul.notify()
+	}
+}
+
+// unhealthy returns true if the last connection attempt or health probe of the upstream failed
+func (ul *Upstreams) unhealthy(u Upstream) bool {
+	ul.statusMutex.Lock()
+	defer ul.statusMutex.Unlock()
+	h, ok := ul.health[u]
+	return ok && !h.Healthy
+}
+
+// selected will record the upstream the session is now running over
+func (ul *Upstreams) selected(u Upstream) {
+	ul.statusMutex.Lock()
+	changed := ul.current != u
+	ul.current = u
+	ul.status.Current = fmt.Sprint(u)
+	if changed {
+		ul.status.Since = time.Now()
+	}
+	ul.statusMutex.Unlock()
+
+	if changed {
+		log.Infof("[Upstream] Connected via %v", u)
+		ul.notify()
+	}
+}
+
+// event will count a failover or a failback
+func (ul *Upstreams) event(failback bool) {
+	ul.statusMutex.Lock()
+	if failback {
+		ul.status.Failbacks++
+	} else {
+		ul.status.Failovers++
+	}
+	ul.statusMutex.Unlock()
+	ul.notify()
+}
+
+// monitor will periodically probe the session. When the probes fail, the client fails over to another upstream. When
+// a more preferred upstream becomes reachable again, the client fails back to it.
+func (ul *Upstreams) monitor(stop <-chan struct{}) {
+	ticker := time.NewTicker(ul.HealthInterval)
+	defer ticker.Stop()
+
+	failures := 0
+	lastFailback := time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		ul.mutex.Lock()
+		session := ul.session
+		connection := ul.connection
+		ul.mutex.Unlock()
+
+		if r, ok := connection.(*resume.Connection); ok && !r.Closed() && !r.Attached() {
+			// Session is being resumed, nothing to probe
+			continue
+		}
+
+		ul.statusMutex.Lock()
+		current := ul.current
+		ul.statusMutex.Unlock()
+
+		if session == nil || session.IsClosed() {
+			if current != nil {
+				ul.failover(current, errors.Errorf("Session closed"))
+			}
+			continue
+		}
+
+		rtt, err := ul.probe(session)
+		if err != nil {
+			failures++
+			log.WithError(err).Debugf("[Upstream] Health probe %v/%v via %v failed: %v", failures, ul.HealthFailures, current, err)
+			if failures >= ul.HealthFailures {
+				failures = 0
+				ul.failover(current, err)
+			}
+			continue
+		}
+
+		failures = 0
+		log.Tracef("[Upstream] Health probe via %v took %v", current, rtt)
+		ul.statusMutex.Lock()
+		ul.status.RoundTrip = rtt
+		ul.statusMutex.Unlock()
+		ul.markHealth(current, nil)
+
+		// With multipath, the session already runs over all the upstreams which are reachable
+		if ul.FailbackInterval > 0 && !ul.Multipath && time.Since(lastFailback) >= ul.FailbackInterval {
+			lastFailback = time.Now()
+			ul.failback(current)
+		}
+	}
+}
+
+// probe will measure the round-trip time over the session using the health protocol
+func (ul *Upstreams) probe(session *smux.Session) (time.Duration, error) {
+	type result struct {
+		rtt time.Duration
+		err error
+	}
+
+	// Opening a stream might block on a broken connection, so don't wait for it longer than the timeout
+	done := make(chan *result, 1)
+	go func() {
+		rtt, err := roundTrip(session, ul.HealthTimeout)
+		done <- &result{rtt: rtt, err: err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.rtt, r.err
+	case <-time.After(ul.HealthTimeout):
+		return 0, errors.Errorf("Health probe timed out after %v", ul.HealthTimeout)
+	}
+}
+
+func roundTrip(session *smux.Session, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	stream, err := session.OpenStream()
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer streams.TryClose(stream)
+	if err := stream.SetDeadline(start.Add(timeout)); err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	if err := ms.SelectProtoOrFail(socketace.HealthProtocol, stream); err == ms.ErrNotSupported {
+		// Older servers don't know the health protocol, but they did respond
+		return time.Since(start), nil
+	} else if err != nil {
+		return 0, errors.Wrapf(err, "Could not select health protocol")
+	}
+
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, uint64(start.UnixNano()))
+	if _, err := stream.Write(payload); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	echo := make([]byte, len(payload))
+	if _, err := io.ReadFull(stream, echo); err != nil {
+		return 0, errors.WithStack(err)
+	} else if !bytes.Equal(payload, echo) {
+		return 0, errors.Errorf("Invalid health probe response")
+	}
+
+	return time.Since(start), nil
+}
+
+// failover will drop the connection to the unresponsive upstream and connect to the next working one
+func (ul *Upstreams) failover(current Upstream, cause error) {
+	log.Warnf("[Upstream] %v is not responding, failing over: %v", current, cause)
+	ul.markHealth(current, cause)
+	ul.event(false)
+
+	ul.mutex.Lock()
+	r, resumable := ul.connection.(*resume.Connection)
+	ul.mutex.Unlock()
+	if resumable && !r.Closed() {
+		// Resuming the session will pick the next upstream, while keeping the streams open
+		r.Detach(cause)
+		return
+	}
+
+	ul.mutex.Lock()
+	defer ul.mutex.Unlock()
+
+	if ul.session != nil {
+		streams.TryClose(ul.session)
+	}
+	if ul.connection != nil {
+		streams.TryClose(ul.connection)
+	}
+	ul.session = nil
+	ul.connection = nil
+
+	if err := ul.open(ul.manager); err != nil {
+		log.WithError(err).Warnf("[Upstream] Failover failed, will retry: %v", err)
+	}
+}
+
+// failback will check if any of the upstreams preferred over the current one is reachable again and switch to it
+func (ul *Upstreams) failback(current Upstream) {
+	candidates := make([]Upstream, 0)
+	for _, u := range ul.sorted(false) {
+		if u == current {
+			break
+		}
+		// Only the upstreams which failed are retried; the others were reachable but lost the race
+		if ul.unhealthy(u) {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 {
+		return
+	}
+
+	ul.mutex.Lock()
+	connection := ul.connection
+	session := ul.session
+	ul.mutex.Unlock()
+
+	resumable, isResumable := connection.(*resume.Connection)
+	if !isResumable && (session == nil || session.NumStreams() > 0) {
+		// Switching would break the open streams
+		log.Debugf("[Upstream] Not failing back while there are open streams")
+		return
+	}
+
+	log.Debugf("[Upstream] Checking if preferred upstreams are reachable again: %v", candidates)
+	ctx, cancel := context.WithTimeout(context.Background(), failbackTimeout)
+	defer cancel()
+
+	if isResumable {
+		atomic.StoreInt32(&ul.switching, 1)
+		defer func() {
+			atomic.StoreInt32(&ul.switching, 0)
+			if !resumable.Closed() && !resumable.Attached() {
+				// The old connection was dropped, but the new one could not be attached
+				go ul.resume(resumable)
+			}
+		}()
+	}
+
+	var r *resume.Connection
+	if isResumable {
+		r = resumable
+	}
+	u, conn, negotiated, err := ul.connect(ctx, candidates, ul.manager, r, false)
+	if err != nil {
+		log.WithError(err).Debugf("[Upstream] Preferred upstreams still not reachable: %v", err)
+		return
+	}
+
+	if isResumable {
+		if !negotiated.Resumed {
+			log.Warnf("[Upstream] %v did not resume session %v, staying on %v", u, resumable.ID(), current)
+			streams.TryClose(conn)
+			return
+		}
+		if err := resumable.Attach(conn, negotiated.Received); err != nil {
+			log.WithError(err).Warnf("[Upstream] Could not fail back to %v: %v", u, err)
+			streams.TryClose(conn)
+			return
+		}
+	} else {
+		ul.mutex.Lock()
+		if ul.session != session || session.NumStreams() > 0 {
+			ul.mutex.Unlock()
+			streams.TryClose(conn)
+			return
+		}
+		old := ul.connection
+		if negotiated != nil {
+			err = ul.attach(conn, negotiated)
+		} else {
+			ul.connection = conn
+			err = ul.creteSession(conn, true)
+		}
+		if err != nil {
+			ul.connection = nil
+			ul.session = nil
+		}
+		ul.mutex.Unlock()
+		streams.TryClose(session)
+		streams.TryClose(old)
+		if err != nil {
+			log.WithError(err).Warnf("[Upstream] Could not fail back to %v: %v", u, err)
+			return
+		}
+	}
+
+	log.Infof("[Upstream] Failed back from %v to %v", current, u)
+	ul.event(true)
+	ul.selected(u)
+}
@@ -0,0 +1,49 @@
+package upstream
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func Test_FailoverAndFailback(t *testing.T) {
+	address := startEchoServer(t)
+	preferred := newFlakyProxy(t, address)
+	backup := newFlakyProxy(t, address)
+
+	preferredUpstream, backupUpstream := preferred.upstream(), backup.upstream()
+	ul := &Upstreams{
+		Data:             []Upstream{preferredUpstream, backupUpstream},
+		ResumeTimeout:    10 * time.Second,
+		Stagger:          time.Second,
+		HealthInterval:   200 * time.Millisecond,
+		HealthTimeout:    200 * time.Millisecond,
+		HealthFailures:   2,
+		FailbackInterval: 500 * time.Millisecond,
+	}
+	defer ul.Shutdown()
+
+	current := func(u *Socket) func() bool {
+		return func() bool {
+			return ul.Status().Current == u.String()
+		}
+	}
+
+	e := openEcho(t, ul)
+	e.echo("HELLO")
+	require.True(t, current(preferredUpstream)())
+
+	preferred.setStalled(true)
+	require.Eventually(t, current(backupUpstream), 10*time.Second, 50*time.Millisecond)
+	e.echo("FAILOVER")
+
+	preferred.setStalled(false)
+	require.Eventually(t, current(preferredUpstream), 10*time.Second, 50*time.Millisecond)
+	e.echo("FAILBACK")
+
+	status := ul.Status()
+	require.Equal(t, 1, status.Failovers)
+	require.Equal(t, 1, status.Failbacks)
+	require.Len(t, status.Upstreams, 2)
+	require.True(t, status.Upstreams[0].Healthy)
+}
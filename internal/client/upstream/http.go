@@ -1,14 +1,18 @@
 package upstream
 
 import (
+	"context"
 	"crypto/tls"
 	"github.com/bokysan/socketace/v2/internal/socketace"
 	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/bokysan/socketace/v2/internal/streams/polling"
 	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/bokysan/socketace/v2/internal/util/auth"
 	"github.com/bokysan/socketace/v2/internal/util/cert"
 	"github.com/gorilla/websocket"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"net"
 	"net/http"
 	"time"
 )
@@ -25,7 +29,12 @@ func (ups *Http) String() string {
 	return ups.Address.String()
 }
 
-func (ups *Http) Connect(manager cert.TlsConfig, mustSecure bool) error {
+// Unwrap returns the established connection
+func (ups *Http) Unwrap() net.Conn {
+	return ups.Connection
+}
+
+func (ups *Http) Connect(ctx context.Context, manager cert.TlsConfig, credentials auth.Credentials, mux *socketace.MuxConfig, mustSecure bool) error {
 
 	a := ups.Address
 
@@ -63,22 +72,53 @@ func (ups *Http) Connect(manager cert.TlsConfig, mustSecure bool) error {
 		TLSClientConfig:  tlsConfig,
 	}
 
-	log.Debugf("Dialing %s", a.String())
-	c, _, err := dialer.Dial(a.String(), nil)
-	if err == websocket.ErrBadHandshake {
-		// Gracefully handle errors, fallback to GET/POST handling if websocket connection cannot be established
-		return errors.Wrapf(err, "Could not connect to %v", ups.Address)
-	} else if err != nil {
-		return errors.Wrapf(err, "Could not connect to %v", ups.Address)
+	if secure && !proxied(a) {
+		// Offer SocketAce with ALPN. If the server doesn't select it, the websocket is opened over the same connection.
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = a.Hostname()
+		}
+		conn, err := dialTls(ctx, "tcp", hostPort(a), tlsConfig, socketace.AlpnProtocol, "http/1.1")
+		if err != nil {
+			return errors.Wrapf(err, "Could not connect to %v", ups.Address)
+		}
+		if conn.ConnectionState().NegotiatedProtocol == socketace.AlpnProtocol {
+			log.Debugf("[Client] %v negotiated %v", ups.Address.String(), socketace.AlpnProtocol)
+			stream = streams.NewNamedConnection(conn, socketace.AlpnProtocol)
+		} else {
+			dialer.Proxy = nil
+			dialer.NetDialContext = func(context.Context, string, string) (net.Conn, error) {
+				return conn, nil
+			}
+			a.Scheme = "ws"
+		}
+	}
+
+	if stream == nil {
+		log.Debugf("Dialing %s", a.String())
+		c, _, err := dialer.DialContext(ctx, a.String(), nil)
+		if err == websocket.ErrBadHandshake {
+			// The websockets may be blocked, e.g. by a proxy stripping the Upgrade header: fall back to polling
+			log.Infof("[Client] Websocket handshake with %v failed, falling back to polling", ups.Address.String())
+			if stream, err = ups.poll(ctx, secure, tlsConfig); err != nil {
+				return errors.Wrapf(err, "Could not connect to %v", ups.Address)
+			}
+		} else if err != nil {
+			return errors.Wrapf(err, "Could not connect to %v", ups.Address)
+		} else {
+			stream = streams.NewWebsocketTunnelConnection(c)
+		}
 	}
 	log.Debugf("[Client] Http upstream connection established to %+v", ups.Address)
-	cert.PrintPeerCertificates(c.UnderlyingConn())
+	cert.PrintPeerCertificates(stream)
 
-	stream = streams.NewWebsocketTunnelConnection(c)
-	cc, err := socketace.NewClientConnection(stream, manager, secure, ups.Address.Host)
+	stop := closeOnCancel(ctx, stream)
+	cc, err := socketace.NewClientConnection(stream, manager, secure, ups.Address.Host, credentials, mux)
+	stop()
 	if err != nil {
+		streams.TryClose(stream)
 		return errors.Wrapf(err, "Could not open connection")
 	} else if mustSecure && !cc.Secure() {
+		streams.TryClose(stream)
 		return errors.Errorf("Could not establish a secure connection to %v", ups.Address)
 	} else {
 		stream = cc
@@ -87,3 +127,38 @@ func (ups *Http) Connect(manager cert.TlsConfig, mustSecure bool) error {
 
 	return nil
 }
+
+// poll opens a polling session with the endpoint, using plain GET and POST requests
+func (ups *Http) poll(ctx context.Context, secure bool, tlsConfig *tls.Config) (streams.Connection, error) {
+	a := ups.Address
+	a.Scheme = "http"
+	if secure {
+		a.Scheme = "https"
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+	conn, err := polling.Dial(ctx, client, a.String())
+	if err != nil {
+		return nil, err
+	}
+	return streams.NewNamedConnection(conn, "polling"), nil
+}
+
+// proxied returns true if the connections to the address go through a proxy
+func proxied(a addr.ProtoAddress) bool {
+	a.Scheme = "https"
+	proxy, err := http.ProxyFromEnvironment(&http.Request{URL: &a.URL})
+	return err != nil || proxy != nil
+}
+
+// hostPort returns the host and the port of the secure address, with the default port if not set
+func hostPort(a addr.ProtoAddress) string {
+	if a.Port() == "" {
+		return net.JoinHostPort(a.Hostname(), "443")
+	}
+	return a.Host
+}
@@ -0,0 +1,71 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"github.com/bokysan/socketace/v2/internal/it"
+	"github.com/bokysan/socketace/v2/internal/server"
+	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_HttpAlpn(t *testing.T) {
+	channels := server.Channels{
+		&server.NetworkChannel{
+			AbstractChannel: server.AbstractChannel{
+				ProtoName: addr.ProtoName{
+					Name: "echo",
+				},
+				Address: it.StartEchoService(t),
+			},
+		},
+	}
+	address := addr.MustParseAddress("https://" + it.FreeAddress(t))
+	s := &server.HttpServer{
+		ServerConfig: it.TlsServerConfig(),
+		Address:      address,
+		Endpoints: server.WebsocketEndpointList{
+			server.HttpEndpoint{
+				Endpoint: "/ws/all",
+			},
+		},
+	}
+	require.NoError(t, s.Startup(channels))
+	defer func() {
+		require.NoError(t, s.Shutdown())
+	}()
+
+	// A server which doesn't know ALPN: the client falls back to the websocket
+	handler, err := (&server.HttpServer{}).EndpointHandler(&server.HttpEndpoint{Endpoint: "/ws"}, channels)
+	require.NoError(t, err)
+	legacy := httptest.NewTLSServer(handler)
+	defer legacy.Close()
+
+	for _, a := range []string{address.String() + "/ws/all", legacy.URL + "/ws"} {
+		ul := &Upstreams{
+			Data: []Upstream{
+				&Http{
+					Address: addr.MustParseAddress(a),
+				},
+			},
+		}
+		e := openEcho(t, ul)
+		e.echo("HELLO")
+		e.echo("QUIT")
+		ul.Shutdown()
+	}
+
+	// The same listener still serves HTTP/2
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+		},
+	}
+	res, err := client.Get("https://" + address.Host + "/")
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, 2, res.ProtoMajor)
+}
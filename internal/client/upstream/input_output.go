@@ -1,14 +1,17 @@
 package upstream
 
 import (
+	"context"
 	"crypto/tls"
 	"github.com/bokysan/socketace/v2/internal/socketace"
 	"github.com/bokysan/socketace/v2/internal/streams"
 	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/bokysan/socketace/v2/internal/util/auth"
 	"github.com/bokysan/socketace/v2/internal/util/cert"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"io"
+	"net"
 	"os"
 )
 
@@ -27,7 +30,12 @@ func (ups *InputOutput) String() string {
 	return ups.Address.String()
 }
 
-func (ups *InputOutput) Connect(manager cert.TlsConfig, mustSecure bool) error {
+// Unwrap returns the established connection
+func (ups *InputOutput) Unwrap() net.Conn {
+	return ups.Connection
+}
+
+func (ups *InputOutput) Connect(ctx context.Context, manager cert.TlsConfig, credentials auth.Credentials, mux *socketace.MuxConfig, mustSecure bool) error {
 	var stream streams.Connection
 	var secure bool
 	var err error
@@ -47,6 +55,8 @@ func (ups *InputOutput) Connect(manager cert.TlsConfig, mustSecure bool) error {
 		&addr.StandardIOAddress{Address: "client-input"},
 		&addr.StandardIOAddress{Address: "client-output"},
 	)
+	stop := closeOnCancel(ctx, stream)
+	defer stop()
 
 	if addr.HasTls.MatchString(ups.Address.Scheme) {
 		secure = true
@@ -73,7 +83,7 @@ func (ups *InputOutput) Connect(manager cert.TlsConfig, mustSecure bool) error {
 	log.Debugf("[Client] Input/output upstream connection established to %+v", ups.Address)
 
 	log.Debugf("[Client] mustSecure=%v", mustSecure)
-	cc, err := socketace.NewClientConnection(stream, manager, secure, "")
+	cc, err := socketace.NewClientConnection(stream, manager, secure, "", credentials, mux)
 	log.Debugf("[Client] cc=%v", cc)
 	if cc != nil {
 		log.Debugf("[Client] mustSecure=%v cc.Secure()=%v", mustSecure, cc.Secure())
@@ -0,0 +1,132 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"github.com/bokysan/socketace/v2/internal/resume"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// PathRedialInterval is the pause between the checks for upstreams missing from the multipath session
+var PathRedialInterval = time.Second
+
+// bondedPath is one of the physical connections the multipath session runs over
+type bondedPath struct {
+	upstream   Upstream
+	connection streams.Connection
+}
+
+// bond will record the physical connection the session has just been (re)attached to. Any other paths have been
+// dropped by the attach. Expects the mutex to be held.
+func (ul *Upstreams) bond(u Upstream, conn streams.Connection) {
+	ul.paths = []*bondedPath{{upstream: u, connection: conn}}
+	ul.bonded()
+}
+
+// bonded will update the list of upstreams in the status. Expects the mutex to be held.
+func (ul *Upstreams) bonded() {
+	if !ul.Multipath {
+		return
+	}
+	names := make([]string, 0, len(ul.paths))
+	for _, p := range ul.paths {
+		names = append(names, fmt.Sprint(p.upstream))
+	}
+	ul.statusMutex.Lock()
+	ul.status.Paths = names
+	ul.statusMutex.Unlock()
+	ul.notify()
+}
+
+// maintainPaths will join the physical connections to all the upstreams into the session and re-dial the ones which
+// died
+func (ul *Upstreams) maintainPaths(stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ticker := time.NewTicker(PathRedialInterval)
+	defer ticker.Stop()
+
+	for {
+		ul.fillPaths(ctx, stop)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// fillPaths will remove the dead paths and join the upstreams missing from the session
+func (ul *Upstreams) fillPaths(ctx context.Context, stop <-chan struct{}) {
+	ul.mutex.Lock()
+	resumable, ok := ul.connection.(*resume.Connection)
+	if !ok || resumable.Closed() || !resumable.Attached() {
+		// Nothing to join, or the session is being resumed
+		ul.mutex.Unlock()
+		return
+	}
+	alive := make([]*bondedPath, 0, len(ul.paths))
+	connected := make(map[Upstream]bool)
+	for _, p := range ul.paths {
+		if !resumable.HasPath(p.connection) {
+			log.Infof("[Upstream] Path to %v lost", p.upstream)
+		} else {
+			alive = append(alive, p)
+			connected[p.upstream] = true
+		}
+	}
+	if len(alive) != len(ul.paths) {
+		ul.paths = alive
+		ul.bonded()
+	}
+	ul.mutex.Unlock()
+
+	for _, u := range ul.ordered() {
+		if connected[u] || ctx.Err() != nil {
+			continue
+		}
+
+		_, conn, negotiated, err := ul.connect(ctx, []Upstream{u}, ul.manager, resumable, true)
+		if err != nil {
+			log.WithError(err).Debugf("[Upstream] Could not add path to %v, will retry: %v", u, err)
+			continue
+		}
+		if !negotiated.Resumed {
+			// Can't happen, the server refuses to join unknown sessions
+			streams.TryClose(conn)
+			continue
+		}
+		if err := resumable.Join(conn, negotiated.Received); err != nil {
+			log.WithError(err).Debugf("[Upstream] Could not add path to %v: %v", u, err)
+			streams.TryClose(conn)
+			return
+		}
+
+		ul.mutex.Lock()
+		select {
+		case <-stop:
+			// Shut down while dialing
+			streams.TryClose(conn)
+		default:
+			if ul.connection == resumable {
+				log.Infof("[Upstream] Added path to %v", u)
+				ul.paths = append(ul.paths, &bondedPath{upstream: u, connection: conn})
+				ul.bonded()
+			} else {
+				streams.TryClose(conn)
+			}
+		}
+		ul.mutex.Unlock()
+	}
+}
@@ -0,0 +1,48 @@
+package upstream
+
+import (
+	"github.com/bokysan/socketace/v2/internal/resume"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func Test_MultipathSession(t *testing.T) {
+	pathTimeout := resume.PathTimeout
+	resume.PathTimeout = 2 * time.Second
+	defer func() {
+		resume.PathTimeout = pathTimeout
+	}()
+
+	address := startEchoServer(t)
+	first := newFlakyProxy(t, address)
+	second := newFlakyProxy(t, address)
+
+	ul := &Upstreams{
+		Data:          []Upstream{first.upstream(), second.upstream()},
+		ResumeTimeout: 10 * time.Second,
+		Multipath:     true,
+	}
+	defer ul.Shutdown()
+
+	bonded := func() bool {
+		return len(ul.Status().Paths) == 2
+	}
+
+	e := openEcho(t, ul)
+	e.echo("HELLO")
+	require.Eventually(t, bonded, 5*time.Second, 50*time.Millisecond)
+
+	// The lost path is dialed again
+	first.breakConnections()
+	e.echo("BROKEN")
+	require.Eventually(t, func() bool { return first.connections() >= 1 && bonded() }, 5*time.Second, 50*time.Millisecond)
+
+	// The data goes over the other path while this one is stalled
+	second.setStalled(true)
+	e.echo("STALLED")
+	second.setStalled(false)
+	require.Eventually(t, bonded, 10*time.Second, 50*time.Millisecond)
+
+	e.echo("QUIT")
+}
@@ -1,10 +1,12 @@
 package upstream
 
 import (
+	"context"
 	"crypto/sha256"
 	"github.com/bokysan/socketace/v2/internal/socketace"
 	"github.com/bokysan/socketace/v2/internal/streams"
 	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/bokysan/socketace/v2/internal/util/auth"
 	"github.com/bokysan/socketace/v2/internal/util/cert"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
@@ -39,15 +41,20 @@ func (ups *Packet) String() string {
 	return ups.Address.String()
 }
 
+// Unwrap returns the established connection
+func (ups *Packet) Unwrap() net.Conn {
+	return ups.Connection
+}
+
 // Connect will create a stream over packet connection and use the DefaultCreateConnection to do so.
-func (ups *Packet) Connect(manager cert.TlsConfig, mustSecure bool) error {
-	return ups.ConnectPacket(manager, mustSecure, DefaultCreateConnection)
+func (ups *Packet) Connect(ctx context.Context, manager cert.TlsConfig, credentials auth.Credentials, mux *socketace.MuxConfig, mustSecure bool) error {
+	return ups.ConnectPacket(ctx, manager, credentials, mux, mustSecure, DefaultCreateConnection)
 }
 
 // ConnectPacket will create a stream over a packet connection. It will take the supplied
 // connectFunc to actually "cast" the packet connection into a net.Conn. This is to allow pluggable
 // mechanism of underlying packet translation service.
-func (ups *Packet) ConnectPacket(manager cert.TlsConfig, mustSecure bool, connectFunc ConnectionFromPacketConn) error {
+func (ups *Packet) ConnectPacket(ctx context.Context, manager cert.TlsConfig, credentials auth.Credentials, mux *socketace.MuxConfig, mustSecure bool, connectFunc ConnectionFromPacketConn) error {
 
 	var stream streams.Connection
 	var secure bool
@@ -99,10 +106,14 @@ func (ups *Packet) ConnectPacket(manager cert.TlsConfig, mustSecure bool, connec
 	// communication. Why? Because:
 	// - we can check certificates / hostnames
 	// - we can execute mutual (client-server) authentication
-	cc, err := socketace.NewClientConnection(c, manager, false, ups.Address.Host)
+	stop := closeOnCancel(ctx, c)
+	cc, err := socketace.NewClientConnection(c, manager, false, ups.Address.Host, credentials, mux)
+	stop()
 	if err != nil {
+		streams.TryClose(c)
 		return errors.Wrapf(err, "Could not open connection")
 	} else if mustSecure && !cc.Secure() {
+		streams.TryClose(c)
 		return errors.Errorf("Could not establish a secure connection to %v", ups.Address)
 	} else {
 		stream = cc
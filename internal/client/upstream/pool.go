@@ -0,0 +1,184 @@
+package upstream
+
+import (
+	"context"
+	"github.com/bokysan/socketace/v2/internal/socketace"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/xtaci/smux"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// PoolRoundRobin spreads the streams across the pool in turns
+	PoolRoundRobin = "round-robin"
+	// PoolLeastLoaded opens the stream on the session with the fewest open streams
+	PoolLeastLoaded = "least-loaded"
+)
+
+// PoolRedialInterval is the pause between the checks for dead pool members
+var PoolRedialInterval = time.Second
+
+// poolMember is an additional physical connection, with its own session, to one of the upstreams
+type poolMember struct {
+	upstream   Upstream
+	connection streams.Connection
+	session    *smux.Session
+	metadata   bool // the server expects the stream metadata
+}
+
+// closed returns true if the member can't be used anymore. The session is not closed by itself when the physical
+// connection breaks, so check both.
+func (m *poolMember) closed() bool {
+	return m.session.IsClosed() || m.connection.Closed()
+}
+
+func (m *poolMember) close() {
+	streams.TryClose(m.session)
+	streams.TryClose(m.connection)
+}
+
+// pick will select the session to open the next stream on. It also returns true if the server of the session
+// expects the stream metadata.
+func (ul *Upstreams) pick() (*smux.Session, bool, error) {
+	ul.mutex.Lock()
+	defer ul.mutex.Unlock()
+
+	sessions := make([]*poolMember, 0, len(ul.pool)+1)
+	if ul.session != nil && !ul.session.IsClosed() && ul.connection != nil && !ul.connection.Closed() {
+		sessions = append(sessions, &poolMember{session: ul.session, metadata: ul.metadata})
+	}
+	for _, m := range ul.pool {
+		if !m.closed() {
+			sessions = append(sessions, m)
+		}
+	}
+
+	var picked *poolMember
+	if len(sessions) == 0 {
+		return nil, false, errors.Errorf("No session to the upstream open")
+	} else if len(sessions) == 1 {
+		picked = sessions[0]
+	} else if ul.PoolStrategy == PoolLeastLoaded {
+		picked = sessions[0]
+		for _, s := range sessions[1:] {
+			if s.session.NumStreams() < picked.session.NumStreams() {
+				picked = s
+			}
+		}
+	} else {
+		next := atomic.AddUint32(&ul.poolNext, 1)
+		picked = sessions[int(next-1)%len(sessions)]
+	}
+	return picked.session, picked.metadata, nil
+}
+
+// candidates returns the upstreams in the order the n-th pool member should try them in. The healthy upstreams are
+// rotated, so that the pool is spread across them when multiple upstreams are defined.
+func (ul *Upstreams) candidates(n int) []Upstream {
+	ordered := ul.ordered()
+	healthy := 0
+	for healthy < len(ordered) && !ul.unhealthy(ordered[healthy]) {
+		healthy++
+	}
+	if healthy < 2 {
+		return ordered
+	}
+
+	n = n % healthy
+	res := make([]Upstream, 0, len(ordered))
+	res = append(res, ordered[n:healthy]...)
+	res = append(res, ordered[:n]...)
+	return append(res, ordered[healthy:]...)
+}
+
+// dial will open a new pool member
+func (ul *Upstreams) dial(ctx context.Context, n int) (*poolMember, error) {
+	u, conn, negotiated, err := ul.connect(ctx, ul.candidates(n), ul.manager, nil, false)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &poolMember{
+		upstream:   u,
+		connection: conn,
+		metadata:   hasCapability(conn, socketace.CapabilityMetadata),
+	}
+	if negotiated == nil {
+		m.session, err = ul.newSession(conn, negotiatedMux(conn), true)
+	} else if m.connection, err = ul.newResumable(conn, negotiated); err == nil {
+		m.session, err = ul.newSession(m.connection, negotiatedMux(conn), false)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// maintainPool will open the additional pool members and re-dial the ones which died
+func (ul *Upstreams) maintainPool(stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ticker := time.NewTicker(PoolRedialInterval)
+	defer ticker.Stop()
+
+	for {
+		ul.fillPool(ctx, stop)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// fillPool will remove the dead pool members and dial the missing ones
+func (ul *Upstreams) fillPool(ctx context.Context, stop <-chan struct{}) {
+	for ctx.Err() == nil {
+		ul.mutex.Lock()
+		alive := make([]*poolMember, 0, len(ul.pool))
+		for _, m := range ul.pool {
+			if m.closed() {
+				log.Infof("[Upstream] Pool connection to %v lost", m.upstream)
+				m.close()
+			} else {
+				alive = append(alive, m)
+			}
+		}
+		ul.pool = alive
+		n := len(ul.pool) + 1
+		ul.mutex.Unlock()
+
+		if n >= ul.PoolSize {
+			return
+		}
+
+		m, err := ul.dial(ctx, n)
+		if err != nil {
+			log.WithError(err).Debugf("[Upstream] Could not open pool connection, will retry: %v", err)
+			return
+		}
+
+		ul.mutex.Lock()
+		select {
+		case <-stop:
+			// Shut down while dialing
+			m.close()
+		default:
+			log.Debugf("[Upstream] Pool connection %v/%v opened to %v", n+1, ul.PoolSize, m.upstream)
+			ul.pool = append(ul.pool, m)
+		}
+		ul.mutex.Unlock()
+	}
+}
@@ -0,0 +1,148 @@
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/stretchr/testify/require"
+	"github.com/xtaci/smux"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestMember(t *testing.T) *poolMember {
+	c1, c2 := net.Pipe()
+	server, err := smux.Server(c2, nil)
+	require.NoError(t, err)
+	go func() {
+		for {
+			if _, err := server.AcceptStream(); err != nil {
+				return
+			}
+		}
+	}()
+	conn := streams.NewSafeConnection(c1)
+	client, err := smux.Client(conn, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return &poolMember{connection: conn, session: client}
+}
+
+func Test_PoolPickRoundRobin(t *testing.T) {
+	m1, m2, m3 := newTestMember(t), newTestMember(t), newTestMember(t)
+	s1, s2, s3 := m1.session, m2.session, m3.session
+	ul := &Upstreams{
+		connection: m1.connection,
+		session:    s1,
+		pool:       []*poolMember{m2, m3},
+	}
+
+	picked := make([]*smux.Session, 0)
+	for i := 0; i < 6; i++ {
+		s, _, err := ul.pick()
+		require.NoError(t, err)
+		picked = append(picked, s)
+	}
+	require.Equal(t, []*smux.Session{s1, s2, s3, s1, s2, s3}, picked)
+
+	// Dead members are skipped, also if only the physical connection was closed
+	require.NoError(t, s2.Close())
+	require.NoError(t, m3.connection.Close())
+	for i := 0; i < 4; i++ {
+		s, _, err := ul.pick()
+		require.NoError(t, err)
+		require.Equal(t, s1, s)
+	}
+}
+
+func Test_PoolPickLeastLoaded(t *testing.T) {
+	m1, m2 := newTestMember(t), newTestMember(t)
+	s1, s2 := m1.session, m2.session
+	ul := &Upstreams{
+		PoolStrategy: PoolLeastLoaded,
+		connection:   m1.connection,
+		session:      s1,
+		pool:         []*poolMember{m2},
+	}
+
+	s, _, err := ul.pick()
+	require.NoError(t, err)
+	require.Equal(t, s1, s)
+
+	_, err = s1.OpenStream()
+	require.NoError(t, err)
+	s, _, err = ul.pick()
+	require.NoError(t, err)
+	require.Equal(t, s2, s)
+}
+
+func Test_PoolFill(t *testing.T) {
+	udp := &fakeUpstream{name: "udp://example.org:1000"}
+	tcp := &fakeUpstream{name: "tcp://example.org:1000"}
+
+	ul := &Upstreams{
+		Data:     []Upstream{udp, tcp},
+		Stagger:  time.Minute,
+		PoolSize: 3,
+	}
+	defer ul.Shutdown()
+
+	stop := make(chan struct{})
+	ul.fillPool(context.Background(), stop)
+	require.Len(t, ul.pool, 2)
+	// Each member starts the race with a different upstream
+	require.Equal(t, tcp, ul.pool[0].upstream)
+	require.Equal(t, udp, ul.pool[1].upstream)
+
+	// Dead members are replaced
+	dead := ul.pool[0].session
+	require.NoError(t, dead.Close())
+	ul.fillPool(context.Background(), stop)
+	require.Len(t, ul.pool, 2)
+	for _, m := range ul.pool {
+		require.NotEqual(t, dead, m.session)
+	}
+}
+
+func Test_Pool(t *testing.T) {
+	proxy := newFlakyProxy(t, startEchoServer(t))
+	ul := &Upstreams{
+		Data:         []Upstream{proxy.upstream()},
+		PoolSize:     3,
+		PoolStrategy: PoolLeastLoaded,
+	}
+	defer ul.Shutdown()
+
+	echo := func() {
+		e := openEcho(t, ul)
+		e.echo("HELLO")
+		e.echo("QUIT")
+	}
+
+	echo()
+	require.Eventually(t, func() bool { return proxy.connections() == 3 }, 5*time.Second, 50*time.Millisecond)
+	for i := 0; i < 6; i++ {
+		echo()
+	}
+	require.Equal(t, 3, proxy.connections())
+
+	// The broken members are replaced and the streams are opened again
+	proxy.breakConnections()
+	require.Eventually(t, func() bool { return proxy.connections() >= 2 }, 10*time.Second, 50*time.Millisecond)
+	require.Eventually(t, func() bool {
+		stream, err := ul.Connect(testConfig{}, "echo", nil)
+		if err != nil {
+			return false
+		}
+		defer streams.TryClose(stream)
+		if _, err := stream.Write([]byte("QUIT\r\n")); err != nil {
+			return false
+		}
+		scanner := bufio.NewScanner(stream)
+		return scanner.Scan() && scanner.Text() == "QUIT"
+	}, 10*time.Second, 100*time.Millisecond)
+}
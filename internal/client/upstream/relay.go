@@ -0,0 +1,67 @@
+package upstream
+
+import (
+	"context"
+	"github.com/bokysan/socketace/v2/internal/relay"
+	"github.com/bokysan/socketace/v2/internal/socketace"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/bokysan/socketace/v2/internal/util/auth"
+	"github.com/bokysan/socketace/v2/internal/util/cert"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"net"
+)
+
+// Relay connects to the server through a relay, which pairs the client with a server waiting in the same session
+type Relay struct {
+	streams.Connection
+
+	// Address is the parsed representation of the address and calculated automatically while unmarshalling
+	Address addr.ProtoAddress
+}
+
+func (ups *Relay) String() string {
+	return relay.Redact(ups.Address)
+}
+
+// Unwrap returns the established connection
+func (ups *Relay) Unwrap() net.Conn {
+	return ups.Connection
+}
+
+func (ups *Relay) Connect(ctx context.Context, manager cert.TlsConfig, credentials auth.Credentials, mux *socketace.MuxConfig, mustSecure bool) error {
+	a, err := relay.ParseAddress(ups.Address)
+	if err != nil {
+		return err
+	}
+
+	c, err := relay.Connect(ctx, a, relay.RoleClient, manager)
+	if err != nil {
+		return err
+	}
+
+	stop := closeOnCancel(ctx, c)
+	err = relay.Await(c)
+	if err != nil {
+		stop()
+		streams.TryClose(c)
+		return errors.Wrapf(err, "Could not connect to %v", a)
+	}
+	log.Debugf("[Client] Paired with the server via relay %v", a)
+
+	// The relay transport is not end to end, let the server upgrade the link with StartTLS. The relay is not trusted,
+	// so the link must be secured regardless of mustSecure.
+	cc, err := socketace.NewClientConnection(c, manager, false, a.ServerName, credentials, mux)
+	stop()
+	if err != nil {
+		streams.TryClose(c)
+		return errors.Wrapf(err, "Could not open connection")
+	} else if !cc.Secure() {
+		streams.TryClose(c)
+		return errors.Errorf("Could not establish a secure connection to %v", a)
+	}
+
+	ups.Connection = streams.NewNamedConnection(streams.NewNamedConnection(cc, ups.String()), "relay")
+	return nil
+}
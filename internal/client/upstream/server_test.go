@@ -0,0 +1,156 @@
+package upstream
+
+import (
+	"bufio"
+	"github.com/bokysan/socketace/v2/internal/it"
+	"github.com/bokysan/socketace/v2/internal/server"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/bokysan/socketace/v2/internal/util/cert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"sync"
+	"testing"
+)
+
+type testConfig struct{}
+
+func (testConfig) CertManager() cert.TlsConfig {
+	return &cert.ClientConfig{InsecureSkipVerify: true}
+}
+
+// startEchoServer starts a server with the `echo` channel and returns its address
+func startEchoServer(t *testing.T) addr.ProtoAddress {
+	return it.StartServer(t, server.Channels{
+		&server.NetworkChannel{
+			AbstractChannel: server.AbstractChannel{
+				ProtoName: addr.ProtoName{
+					Name: "echo",
+				},
+				Address: it.StartEchoService(t),
+			},
+		},
+	})
+}
+
+// lineEcho is a stream to the echo channel
+type lineEcho struct {
+	t       *testing.T
+	stream  streams.ReadWriteCloserClosed
+	scanner *bufio.Scanner
+}
+
+func openEcho(t *testing.T, ul *Upstreams) *lineEcho {
+	stream, err := ul.Connect(testConfig{}, "echo", nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		streams.TryClose(stream)
+	})
+	return &lineEcho{t: t, stream: stream, scanner: bufio.NewScanner(stream)}
+}
+
+// echo will send the line and check it comes back
+func (e *lineEcho) echo(line string) {
+	_, err := e.stream.Write([]byte(line + "\r\n"))
+	require.NoError(e.t, err)
+	require.True(e.t, e.scanner.Scan(), "Could not get %q from echo service", line)
+	require.Equal(e.t, line, e.scanner.Text())
+}
+
+// flakyProxy forwards the connections to the server and can break them on demand
+type flakyProxy struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	conns    []net.Conn
+	stalled  bool
+}
+
+func newFlakyProxy(t *testing.T, target addr.ProtoAddress) *flakyProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	p := &flakyProxy{
+		listener: l,
+	}
+	t.Cleanup(p.Close)
+	go func() {
+		for {
+			downstream, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if p.isStalled() {
+				streams.TryClose(downstream)
+				continue
+			}
+			upstream, err := net.Dial("tcp", target.Host)
+			if err != nil {
+				streams.TryClose(downstream)
+				continue
+			}
+			p.mutex.Lock()
+			p.conns = append(p.conns, downstream, upstream)
+			p.mutex.Unlock()
+			go p.pipe(downstream, upstream)
+			go p.pipe(upstream, downstream)
+		}
+	}()
+	return p
+}
+
+// upstream returns the upstream which connects through the proxy
+func (p *flakyProxy) upstream() *Socket {
+	return &Socket{Address: addr.MustParseAddress("tcp://" + p.listener.Addr().String())}
+}
+
+// pipe will copy the data from src to dst, dropping it while the proxy is stalled
+func (p *flakyProxy) pipe(dst, src net.Conn) {
+	defer streams.TryClose(dst)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if err != nil {
+			return
+		}
+		if p.isStalled() {
+			continue
+		}
+		if _, err := dst.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+// setStalled will make the proxy silently drop all the data and refuse new connections, as if the network went away
+func (p *flakyProxy) setStalled(stalled bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.stalled = stalled
+}
+
+func (p *flakyProxy) isStalled() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.stalled
+}
+
+// breakConnections will close all the currently proxied connections
+func (p *flakyProxy) breakConnections() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, c := range p.conns {
+		streams.TryClose(c)
+	}
+	p.conns = nil
+}
+
+// connections returns the number of the currently proxied connections
+func (p *flakyProxy) connections() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.conns) / 2
+}
+
+func (p *flakyProxy) Close() {
+	streams.TryClose(p.listener)
+	p.breakConnections()
+}
@@ -1,14 +1,17 @@
 package upstream
 
 import (
+	"context"
 	"crypto/tls"
 	"github.com/bokysan/socketace/v2/internal/socketace"
 	"github.com/bokysan/socketace/v2/internal/streams"
 	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/bokysan/socketace/v2/internal/util/auth"
 	"github.com/bokysan/socketace/v2/internal/util/cert"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"net"
+	"strings"
 )
 
 // Socket connects to the server via a socket connection
@@ -23,7 +26,12 @@ func (ups *Socket) String() string {
 	return ups.Address.String()
 }
 
-func (ups *Socket) Connect(manager cert.TlsConfig, mustSecure bool) error {
+// Unwrap returns the established connection
+func (ups *Socket) Unwrap() net.Conn {
+	return ups.Connection
+}
+
+func (ups *Socket) Connect(ctx context.Context, manager cert.TlsConfig, credentials auth.Credentials, mux *socketace.MuxConfig, mustSecure bool) error {
 
 	a := ups.Address
 
@@ -37,20 +45,24 @@ func (ups *Socket) Connect(manager cert.TlsConfig, mustSecure bool) error {
 		return errors.WithStack(err)
 	}
 
+	dialer := &net.Dialer{}
 	if addr.HasTls.MatchString(a.Scheme) {
 		secure = true
 		var tlsConfig *tls.Config
 		if tlsConfig, err = manager.GetTlsConfig(); err != nil {
 			return errors.Wrapf(err, "Could not configure TLS")
 		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = a.Hostname()
+		}
 		a.Scheme = addr.PlusEnd.ReplaceAllString(a.Scheme, "")
 		log.Debugf("Dialing TLS %s", a.String())
 
-		c, err = tls.Dial(n.Network(), n.String(), tlsConfig)
+		c, err = dialTls(ctx, n.Network(), n.String(), tlsConfig, socketace.AlpnProtocol)
 	} else {
 		a.Scheme = addr.PlusEnd.ReplaceAllString(a.Scheme, "")
 		log.Debugf("Dialing plain %s", a.String())
-		c, err = net.Dial(n.Network(), n.String())
+		c, err = dialer.DialContext(ctx, n.Network(), n.String())
 	}
 
 	if err != nil {
@@ -60,10 +72,14 @@ func (ups *Socket) Connect(manager cert.TlsConfig, mustSecure bool) error {
 	log.Debugf("[Client] Socket upstream connection established to %v", ups.Address.String())
 	cert.PrintPeerCertificates(c)
 
-	cc, err := socketace.NewClientConnection(c, manager, secure, ups.Address.Host)
+	stop := closeOnCancel(ctx, c)
+	cc, err := socketace.NewClientConnection(c, manager, secure, ups.Address.Host, credentials, mux)
+	stop()
 	if err != nil {
+		streams.TryClose(c)
 		return errors.Wrapf(err, "Could not open connection")
 	} else if mustSecure && !cc.Secure() {
+		streams.TryClose(c)
 		return errors.Errorf("Could not establish a secure connection to %v", ups.Address)
 	} else {
 		stream = cc
@@ -73,3 +89,35 @@ func (ups *Socket) Connect(manager cert.TlsConfig, mustSecure bool) error {
 
 	return nil
 }
+
+// dialTls opens a TLS connection offering the ALPN protocols, unless the configuration defines its own. If the server
+// refuses all of them, the connection is opened again without ALPN.
+func dialTls(ctx context.Context, network, address string, config *tls.Config, protocols ...string) (*tls.Conn, error) {
+	config = config.Clone()
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = protocols
+	}
+	conn, err := handshakeTls(ctx, network, address, config)
+	if err != nil && len(config.NextProtos) > 0 && strings.Contains(err.Error(), "no application protocol") {
+		log.Debugf("[Client] %v refused ALPN %v, retrying without it", address, config.NextProtos)
+		config.NextProtos = nil
+		conn, err = handshakeTls(ctx, network, address, config)
+	}
+	return conn, err
+}
+
+func handshakeTls(ctx context.Context, network, address string, config *tls.Config) (*tls.Conn, error) {
+	c, err := (&net.Dialer{}).DialContext(ctx, network, address)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	conn := tls.Client(c, config)
+	stop := closeOnCancel(ctx, conn)
+	err = conn.Handshake()
+	stop()
+	if err != nil {
+		streams.TryClose(conn)
+		return nil, errors.WithStack(err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,32 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/bokysan/socketace/v2/internal/socketace"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_DialTlsFallback(t *testing.T) {
+	// The server only speaks HTTP/2 and refuses the other protocols
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	srv.TLS.NextProtos = []string{"h2"}
+
+	config := &tls.Config{InsecureSkipVerify: true}
+	conn, err := dialTls(context.Background(), "tcp", srv.Listener.Addr().String(), config, socketace.AlpnProtocol)
+	require.NoError(t, err)
+	require.Equal(t, "", conn.ConnectionState().NegotiatedProtocol)
+	require.NoError(t, conn.Close())
+
+	conn, err = dialTls(context.Background(), "tcp", srv.Listener.Addr().String(), config, socketace.AlpnProtocol, "h2")
+	require.NoError(t, err)
+	require.Equal(t, "h2", conn.ConnectionState().NegotiatedProtocol)
+	require.NoError(t, conn.Close())
+	require.Empty(t, config.NextProtos, "The configuration is not modified")
+}
@@ -1,45 +1,195 @@
 package upstream
 
 import (
+	"context"
 	"fmt"
+	"github.com/bokysan/socketace/v2/internal/resume"
+	"github.com/bokysan/socketace/v2/internal/shaping"
+	"github.com/bokysan/socketace/v2/internal/socketace"
 	"github.com/bokysan/socketace/v2/internal/streams"
 	"github.com/bokysan/socketace/v2/internal/util/addr"
-	"github.com/bokysan/socketace/v2/internal/util/buffers"
+	"github.com/bokysan/socketace/v2/internal/util/auth"
 	"github.com/bokysan/socketace/v2/internal/util/cert"
+	"github.com/hashicorp/go-multierror"
 	ms "github.com/multiformats/go-multistream"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/xtaci/smux"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Upstream adds the Connect method to connect to the upstream
 type Upstream interface {
 	streams.Connection
-	Connect(manager cert.TlsConfig, mustSecure bool) error
+	streams.UnwrappedConnection
+	// Connect will connect to the upstream and execute the SocketAce handshake, offering the given multiplexer
+	// parameters. If the context is cancelled, the connection attempt is aborted.
+	Connect(ctx context.Context, manager cert.TlsConfig, credentials auth.Credentials, mux *socketace.MuxConfig, mustSecure bool) error
+}
+
+// closeOnCancel will close the connection if the context is cancelled before the returned function is called.
+// It's used to abort the handshakes of the upstreams which lost the race. Once stop returns, the connection is
+// guaranteed not to be closed anymore.
+func closeOnCancel(ctx context.Context, conn io.Closer) (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		select {
+		case <-ctx.Done():
+			streams.TryClose(conn)
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
 }
 
 // ------ // ------ // ------ // ------ // ------ // ------ // ------ //
 
 // Upstreams is a list of upstream servers
 type Upstreams struct {
-	Data       []Upstream
-	MustSecure bool // If MustSecure is true, non-secured sessions are not tolerated
+	Data        []Upstream
+	MustSecure  bool             // If MustSecure is true, non-secured sessions are not tolerated
+	Credentials auth.Credentials // Credentials are sent to servers which require authorization
+
+	// ResumeTimeout defines how long the client tries to resume a broken session. Zero disables resumption.
+	ResumeTimeout time.Duration
+	// Stagger is the delay before the next upstream is tried in parallel, while the previous attempts are still
+	// in progress. Zero means all the upstreams are tried at once.
+	Stagger time.Duration
+	// Prefer is the list of schemes (e.g. `tcp`, `https`) which are tried first, in the given order. Upstreams
+	// not on the list are tried afterwards, in the order they were defined.
+	Prefer []string
+
+	// HealthInterval defines how often the session is probed. Zero disables the health monitoring.
+	HealthInterval time.Duration
+	// HealthTimeout is the maximum round-trip time of a single health probe
+	HealthTimeout time.Duration
+	// HealthFailures is the number of failed probes in a row after which the client fails over to another upstream
+	HealthFailures int
+	// FailbackInterval defines how often the client checks if a more preferred upstream is reachable again. Zero
+	// disables the failback.
+	FailbackInterval time.Duration
+	// OnStatus is called whenever the current upstream or the health of any of the upstreams changes
+	OnStatus func(status Status)
+
+	// PoolSize is the number of physical connections (each with its own session) opened to the upstreams. The
+	// logical streams are spread across them. Values below 2 disable the pool.
+	PoolSize int
+	// PoolStrategy defines how the streams are spread across the pool: PoolRoundRobin or PoolLeastLoaded
+	PoolStrategy string
+
+	// Multipath bonds the physical connections to all the upstreams into one resumable session. The data is sent
+	// over the path with the lowest round-trip time and loss, and the session survives as long as any path is up.
+	Multipath bool
+	// DuplicateLoss is the probe loss ratio at which the data sent over a path is duplicated on the next best path.
+	// Zero disables the duplication.
+	DuplicateLoss float64
+
+	// Mux are the multiplexer parameters offered to the servers. They can be overridden per upstream with the
+	// `mux-*` query parameters of the upstream address, e.g. `tcp://example.org:1234?mux-version=1`.
+	Mux socketace.MuxConfig `no-flag:"true"`
+
 	mutex      sync.Mutex
-	connection Upstream
+	dialMutex  sync.Mutex // serializes the connection attempts, as an Upstream holds one connection at a time
+	manager    cert.TlsConfig
+	connection streams.Connection
 	session    *smux.Session
+	metadata   bool // the server of the session expects the stream metadata
+	monitoring chan struct{}
+	switching  int32 // set while the physical connection of a resumable session is being replaced
+
+	pool     []*poolMember
+	pooling  chan struct{}
+	poolNext uint32
+
+	paths   []*bondedPath
+	bonding chan struct{}
+
+	muxOverrides  map[Upstream]*socketace.MuxConfig
+	reverse       sync.Map // handlers of the streams opened by the server, by protocol
+	scheduler     *shaping.Scheduler
+	schedulerOnce sync.Once
+
+	statusMutex sync.Mutex
+	status      Status
+	current     Upstream
+	health      map[Upstream]*UpstreamHealth
 }
 
+// DefaultStagger is the default delay between the parallel connection attempts
+const DefaultStagger = 250 * time.Millisecond
+
+// ResumeRetryInterval is the pause between the attempts to resume the session
+var ResumeRetryInterval = time.Second
+
 func (ul *Upstreams) UnmarshalFlag(endpoint string) error {
+	endpoint, mux, err := muxOverride(endpoint)
+	if err != nil {
+		return err
+	}
 	conn, err := unmarshalUpstream(endpoint)
 	if err != nil {
 		return err
 	}
 	ul.Data = append(ul.Data, conn)
 
+	if mux != nil {
+		if ul.muxOverrides == nil {
+			ul.muxOverrides = make(map[Upstream]*socketace.MuxConfig)
+		}
+		ul.muxOverrides[conn] = mux
+	}
+
 	return nil
 }
 
+// muxOverride will remove the `mux-*` query parameters from the endpoint and return them as the multiplexer
+// parameters of the upstream. The returned config is nil if the endpoint has no such parameters.
+func muxOverride(endpoint string) (string, *socketace.MuxConfig, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return endpoint, nil, nil
+	}
+
+	var mux *socketace.MuxConfig
+	query := u.Query()
+	for name, values := range query {
+		if !strings.HasPrefix(strings.ToLower(name), "mux-") {
+			continue
+		}
+		if mux == nil {
+			mux = &socketace.MuxConfig{}
+		}
+		if err := mux.Set(name, values[0]); err != nil {
+			return endpoint, nil, errors.Wrapf(err, "Invalid URL: %s", endpoint)
+		}
+		query.Del(name)
+	}
+	if mux == nil {
+		return endpoint, nil, nil
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), mux, nil
+}
+
+// mux returns the multiplexer parameters offered to the given upstream
+func (ul *Upstreams) mux(u Upstream) *socketace.MuxConfig {
+	res := ul.Mux.Override(ul.muxOverrides[u])
+	return &res
+}
+
 func unmarshalUpstream(endpoint string) (Upstream, error) {
 	address, err := addr.ParseAddress(endpoint)
 	err = errors.Wrapf(err, "Invalid URL: %s", endpoint)
@@ -58,54 +208,389 @@ func unmarshalUpstream(endpoint string) (Upstream, error) {
 		return &Packet{Address: *address}, nil
 	case "dns", "dns+udp", "dns+unixgram":
 		return &Dns{Address: *address}, nil
+	case "relay+tcp", "relay+tcp+tls", "relay+unix", "relay+http", "relay+https", "relay+ws", "relay+wss", "relay+udp":
+		return &Relay{Address: *address}, nil
 	default:
 		return nil, errors.Errorf("Unknown scheme: %s", address.Scheme)
 	}
 }
 
-// creteSession will create a logical connection muxer from a physical connection
-func (ul *Upstreams) creteSession() (err error) {
+// creteSession will create a logical connection muxer on top of the connection, with the parameters negotiated over
+// the physical connection
+func (ul *Upstreams) creteSession(physical net.Conn, keepAlive bool) (err error) {
+	ul.metadata = hasCapability(physical, socketace.CapabilityMetadata)
+	ul.session, err = ul.newSession(ul.connection, negotiatedMux(physical), keepAlive)
+	if err != nil {
+		ul.connection = nil
+	}
+	return err
+}
 
-	config := smux.DefaultConfig()
-	config.MaxFrameSize = buffers.BufferSize - 128
-	ul.session, err = smux.Client(ul.connection, config)
+// newSession will create a logical connection muxer on top of the connection, with the multiplexer parameters
+// negotiated with the server. The connection is closed if the muxer can't be created.
+func (ul *Upstreams) newSession(conn streams.Connection, mux *socketace.MuxConfig, keepAlive bool) (*smux.Session, error) {
+	config := mux.Smux()
+	if !keepAlive {
+		// Never time out, the resumable session takes care of the physical connection
+		config.KeepAliveTimeout = math.MaxInt64
+	} else if mux == nil && ul.HealthInterval > 0 && ul.HealthFailures > 0 {
+		// The server doesn't negotiate the keepalive, so it's safe to follow the health checks
+		config.KeepAliveInterval = ul.HealthInterval
+		config.KeepAliveTimeout = ul.HealthInterval * time.Duration(ul.HealthFailures)
+	}
 
+	session, err := smux.Client(conn, config)
 	if err != nil {
-		if e := streams.LogClose(ul.connection); e != nil {
+		if e := streams.LogClose(conn); e != nil {
 			log.WithError(e).Errorf("Failed closing the connection: %+v", e)
 		}
-		ul.connection = nil
+		return nil, errors.WithStack(err)
 	}
+	go ul.acceptStreams(session)
+	return session, nil
+}
 
-	return err
+// HandleReverse registers the handler of the streams the server opens for the protocol, e.g. for the connections
+// accepted by a reverse tunnel. A nil handler removes the registration.
+func (ul *Upstreams) HandleReverse(protocol string, handler ms.HandlerFunc) {
+	if handler == nil {
+		ul.reverse.Delete(protocol)
+	} else {
+		ul.reverse.Store(protocol, handler)
+	}
+}
+
+// acceptStreams will serve the streams opened by the server until the session is closed
+func (ul *Upstreams) acceptStreams(session *smux.Session) {
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func(stream net.Conn) {
+			mux := ms.NewMultistreamMuxer()
+			ul.reverse.Range(func(protocol, handler interface{}) bool {
+				mux.AddHandler(protocol.(string), handler.(ms.HandlerFunc))
+				return true
+			})
+			if err := mux.Handle(stream); err != nil {
+				log.WithError(err).Debugf("[Upstream] Could not handle the stream opened by the server: %v", err)
+			}
+			streams.TryClose(stream)
+		}(stream)
+	}
 }
 
+// ordered returns the upstreams in the order they should be tried in. Upstreams which are known to be unhealthy
+// are tried last.
+func (ul *Upstreams) ordered() []Upstream {
+	return ul.sorted(true)
+}
+
+// sorted returns the upstreams sorted by preference and, optionally, by their health
+func (ul *Upstreams) sorted(byHealth bool) []Upstream {
+	rank := func(u Upstream) int {
+		name := ""
+		if s, ok := u.(fmt.Stringer); ok {
+			name = strings.ToLower(s.String())
+		}
+		for i, p := range ul.Prefer {
+			if strings.HasPrefix(name, strings.ToLower(p)+":") {
+				return i
+			}
+		}
+		return len(ul.Prefer)
+	}
+
+	res := make([]Upstream, len(ul.Data))
+	copy(res, ul.Data)
+	sort.SliceStable(res, func(i, j int) bool {
+		if byHealth {
+			if a, b := ul.unhealthy(res[i]), ul.unhealthy(res[j]); a != b {
+				return b
+			}
+		}
+		return rank(res[i]) < rank(res[j])
+	})
+	return res
+}
+
+type attempt struct {
+	upstream Upstream
+	conn     net.Conn
+	err      error
+}
+
+// race will start connecting to the candidates, staggered by the Stagger delay. The first upstream to complete the
+// SocketAce handshake wins, the attempts still in progress are cancelled and the other successful connections
+// are closed. If requireResume is set, only upstreams which support session resumption are accepted.
+//
+// Each attempt captures its own connection as soon as it completes, as the upstream may be re-connected by someone
+// else after the race is over.
+func (ul *Upstreams) race(parent context.Context, candidates []Upstream, manager cert.TlsConfig, requireResume bool) (*attempt, error) {
+	if len(candidates) == 0 {
+		return nil, errors.Errorf("No upstream endpoints defined!")
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	results := make(chan *attempt, len(candidates))
+	started := 0
+	pending := 0
+	start := func() {
+		a := candidates[started]
+		started++
+		pending++
+		go func() {
+			log.Debugf("[Upstream] Connecting to %v", a)
+			var conn net.Conn
+			err := a.Connect(ctx, manager, ul.Credentials, ul.mux(a), ul.MustSecure)
+			if err == nil {
+				conn = a.Unwrap()
+			}
+			if err == nil && requireResume {
+				if cc := socketace.FindClientConnection(conn); cc == nil || !cc.HasCapability(socketace.CapabilityResume) {
+					streams.TryClose(conn)
+					err = errors.Errorf("Server at %v can't resume sessions", a)
+				}
+			}
+			if err == nil {
+				ul.markHealth(a, nil)
+			} else if ctx.Err() == nil {
+				// Attempts cancelled because another upstream was faster don't say anything about the health
+				ul.markHealth(a, err)
+			}
+			results <- &attempt{upstream: a, conn: conn, err: err}
+		}()
+	}
+
+	var errs error
+	start()
+	for pending > 0 {
+		var stagger <-chan time.Time
+		if started < len(candidates) {
+			stagger = time.After(ul.Stagger)
+		}
+
+		select {
+		case <-stagger:
+			start()
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				log.Tracef("[Upstream] Physical connection to %v opened", r.upstream)
+				cancel()
+				go func(pending int) {
+					// Close the connections which completed after the winner
+					for ; pending > 0; pending-- {
+						if r := <-results; r.err == nil {
+							log.Debugf("[Upstream] Closing connection to %v, another upstream was faster", r.upstream)
+							streams.TryClose(r.conn)
+						}
+					}
+				}(pending)
+				return r, nil
+			}
+			log.WithError(r.err).Debugf("Could not connect to %v: %v", r.upstream, r.err)
+			errs = multierror.Append(errs, r.err)
+			if started < len(candidates) {
+				// Don't wait for the stagger delay if the previous attempt already failed
+				start()
+			}
+		}
+	}
+
+	return nil, errors.Wrapf(errs, "Could not connect to any upstream endpoints!")
+}
+
+// connect will connect to the fastest available candidate and negotiate the session, if the server supports it.
+// If the resumable connection is provided, the server will be asked to resume it -- or to add the connection to it,
+// if join is set. The negotiated session is nil if the server does not support resumption.
+func (ul *Upstreams) connect(ctx context.Context, candidates []Upstream, manager cert.TlsConfig, resumable *resume.Connection, join bool) (Upstream, streams.Connection, *socketace.Session, error) {
+	ul.dialMutex.Lock()
+	defer ul.dialMutex.Unlock()
+
+	r, err := ul.race(ctx, candidates, manager, resumable != nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	a := r.upstream
+
+	// Detach the connection from the upstream, as the same upstream might be re-connected while resuming
+	conn, ok := r.conn.(streams.Connection)
+	if !ok {
+		conn = streams.NewSafeConnection(r.conn)
+	}
+
+	cc := socketace.FindClientConnection(conn)
+	if cc == nil || !cc.HasCapability(socketace.CapabilityResume) {
+		return a, conn, nil, nil
+	}
+	if join && !cc.HasCapability(socketace.CapabilityMultipath) {
+		streams.TryClose(conn)
+		return nil, nil, nil, errors.Errorf("Server at %v does not support multipath sessions", a)
+	}
+
+	requested := &socketace.Session{}
+	if resumable != nil {
+		requested.Id = resumable.ID()
+		requested.Secret = resumable.Secret()
+		requested.Received = resumable.Received()
+		requested.Join = join
+	}
+	sessionConn, negotiated, err := socketace.RequestSession(conn, requested)
+	if err != nil {
+		streams.TryClose(conn)
+		return nil, nil, nil, errors.Wrapf(err, "Could not negotiate session with %v", a)
+	}
+	return a, sessionConn, negotiated, nil
+}
+
+// open will connect to the upstreams and create a new session. Expects the mutex to be held.
 func (ul *Upstreams) open(manager cert.TlsConfig) (err error) {
-	for _, a := range ul.Data {
-		err = a.Connect(manager, ul.MustSecure)
+	u, conn, negotiated, err := ul.connect(context.Background(), ul.ordered(), manager, nil, false)
+	if err != nil {
+		return err
+	} else if negotiated == nil {
+		ul.connection = conn
+		err = ul.creteSession(conn, true)
+	} else if err = ul.attach(conn, negotiated); err == nil {
+		ul.bond(u, conn)
+	}
+
+	if err == nil {
+		ul.selected(u)
+	}
+	return err
+}
+
+// attach will create a new resumable connection on top of the physical connection. Expects the mutex to be held.
+func (ul *Upstreams) attach(conn streams.Connection, negotiated *socketace.Session) error {
+	resumable, err := ul.newResumable(conn, negotiated)
+	if err != nil {
+		return err
+	}
+	ul.connection = resumable
+	return ul.creteSession(conn, false)
+}
+
+// negotiatedMux returns the multiplexer parameters agreed with the server over the physical connection, or nil if
+// the server does not negotiate them
+func negotiatedMux(conn net.Conn) *socketace.MuxConfig {
+	if hasCapability(conn, socketace.CapabilityMux) {
+		return socketace.FindClientConnection(conn).Mux()
+	}
+	return nil
+}
+
+// hasCapability returns true if the capability has been negotiated over the physical connection
+func hasCapability(conn net.Conn, cap string) bool {
+	cc := socketace.FindClientConnection(conn)
+	return cc != nil && cc.HasCapability(cap)
+}
+
+// newResumable will create a new resumable connection on top of the physical connection
+func (ul *Upstreams) newResumable(conn streams.Connection, negotiated *socketace.Session) (*resume.Connection, error) {
+	resumable := resume.NewConnection(negotiated.Id, ul.detached)
+	resumable.SetSecret(negotiated.Secret)
+	resumable.SetDuplicateLoss(ul.DuplicateLoss)
+	if err := resumable.Attach(conn, negotiated.Received); err != nil {
+		streams.TryClose(conn)
+		return nil, errors.Wrapf(err, "Could not attach to session %v", negotiated.Id)
+	}
+	return resumable, nil
+}
+
+// detached is called when the physical connection of the resumable session is lost
+func (ul *Upstreams) detached(resumable *resume.Connection, err error) {
+	ul.mutex.Lock()
+	primary := ul.connection == resumable
+	ul.mutex.Unlock()
+
+	if primary && atomic.LoadInt32(&ul.switching) == 1 {
+		// The old connection was closed while switching to a new upstream
+		log.Debugf("[Upstream] Replacing the connection of %v", resumable)
+		return
+	}
+	if ul.ResumeTimeout <= 0 {
+		streams.TryClose(resumable)
+		return
+	}
+	go ul.resume(resumable)
+}
+
+// resume will try to re-dial any of the upstreams and resume the session. Logical streams will block until the
+// session is resumed. If the session can't be resumed within the timeout, it is closed.
+func (ul *Upstreams) resume(resumable *resume.Connection) {
+	deadline := time.Now().Add(ul.ResumeTimeout)
+	log.Infof("[Upstream] Connection lost, trying to resume %v for %v", resumable, ul.ResumeTimeout)
+
+	for time.Now().Before(deadline) && !resumable.Closed() {
+		u, conn, negotiated, err := ul.connect(context.Background(), ul.ordered(), ul.manager, resumable, false)
 		if err != nil {
-			log.WithError(err).Debugf("Could not connect to %v, will retry with the next endpoint.", a)
+			log.WithError(err).Debugf("Could not resume %v: %v", resumable, err)
+			time.Sleep(ResumeRetryInterval)
 			continue
 		}
 
-		ul.connection = a
-		log.Tracef("[Upstream] Physical connection to %v opened", a)
+		if negotiated.Resumed {
+			if err := resumable.Attach(conn, negotiated.Received); err != nil {
+				log.WithError(err).Warnf("Could not resume %v: %v", resumable, err)
+				streams.TryClose(conn)
+				break
+			}
+			log.Infof("[Upstream] Session %v resumed", resumable.ID())
+			ul.mutex.Lock()
+			primary := ul.connection == resumable
+			if primary {
+				ul.bond(u, conn)
+			}
+			ul.mutex.Unlock()
+			if primary {
+				ul.selected(u)
+			}
+			return
+		}
 
-		return ul.creteSession()
+		// The server does not know about our session anymore. Start a fresh one, existing streams are lost.
+		log.Warnf("[Upstream] Server expired session %v, starting a new one", resumable.ID())
+		streams.TryClose(resumable)
+		ul.mutex.Lock()
+		if ul.connection == resumable {
+			if err := ul.attach(conn, negotiated); err != nil {
+				log.WithError(err).Errorf("Could not start a new session: %v", err)
+				ul.connection = nil
+				ul.session = nil
+			} else {
+				ul.bond(u, conn)
+				ul.selected(u)
+			}
+		} else {
+			streams.TryClose(conn)
+		}
+		ul.mutex.Unlock()
+		return
 	}
 
-	return errors.Errorf("Could not connect to any upstream endpoints!")
+	log.Warnf("[Upstream] Could not resume %v within %v", resumable, ul.ResumeTimeout)
+	streams.TryClose(resumable)
 }
 
-// openStream will select a specific subprotocol stream within our session
-func (ul *Upstreams) openStream(subProtocol string) (streams.ReadWriteCloserClosed, error) {
-	conn, err := ul.session.OpenStream()
+// openStream will select a specific subprotocol stream within our session. The metadata is sent to the servers
+// which expect it.
+func (ul *Upstreams) openStream(subProtocol string, metadata *socketace.StreamMetadata) (streams.ReadWriteCloserClosed, error) {
+	session, sendMetadata, err := ul.pick()
+	if err != nil {
+		return nil, err
+	}
 
+	conn, err := session.OpenStream()
 	if err != nil {
 		return nil, err
 	}
 
-	stream := streams.NewNamedStream(conn, ul.session.RemoteAddr().String())
+	stream := streams.NewNamedStream(conn, session.RemoteAddr().String())
 	err = ms.SelectProtoOrFail(fmt.Sprintf("/%s", subProtocol), stream)
 	if err != nil {
 		if e := streams.LogClose(stream); e != nil {
@@ -113,21 +598,41 @@ func (ul *Upstreams) openStream(subProtocol string) (streams.ReadWriteCloserClos
 		}
 		return nil, errors.Wrapf(err, "Could no select protocol %s", subProtocol)
 	}
+	if sendMetadata {
+		if err := socketace.WriteStreamMetadata(stream, metadata); err != nil {
+			streams.TryClose(stream)
+			return nil, err
+		}
+	}
 
 	return streams.NewNamedStream(stream, subProtocol), err
 }
 
 // Connect will return a mutex stream to the first upstream available. If an upstream connection is already opened,
-// it will be reused -- only one physical connection will be opened against the server, no matter how many logical
-// connections you start.
-func (ul *Upstreams) Connect(config cert.ConfigGetter, subProtocol string) (streams.ReadWriteCloserClosed, error) {
+// it will be reused -- only one physical connection will be opened against the server (or PoolSize connections, if
+// the pool is enabled), no matter how many logical connections you start. The metadata (may be nil) describes the
+// connection the stream is opened for.
+func (ul *Upstreams) Connect(config cert.ConfigGetter, subProtocol string, metadata *socketace.StreamMetadata) (streams.ReadWriteCloserClosed, error) {
 	var err error
 
 	ul.mutex.Lock()
 	if ul.connection == nil || ul.connection.Closed() {
 		ul.connection = nil
 		ul.session = nil
-		err = ul.open(config.CertManager())
+		ul.manager = config.CertManager()
+		err = ul.open(ul.manager)
+	}
+	if err == nil && ul.monitoring == nil && ul.HealthInterval > 0 {
+		ul.monitoring = make(chan struct{})
+		go ul.monitor(ul.monitoring)
+	}
+	if err == nil && ul.pooling == nil && ul.PoolSize > 1 {
+		ul.pooling = make(chan struct{})
+		go ul.maintainPool(ul.pooling)
+	}
+	if err == nil && ul.bonding == nil && ul.Multipath {
+		ul.bonding = make(chan struct{})
+		go ul.maintainPaths(ul.bonding)
 	}
 	ul.mutex.Unlock()
 
@@ -135,13 +640,38 @@ func (ul *Upstreams) Connect(config cert.ConfigGetter, subProtocol string) (stre
 		return nil, err
 	}
 
-	return ul.openStream(subProtocol)
+	return ul.openStream(subProtocol, metadata)
+}
+
+// Scheduler returns the scheduler which orders the writes of the streams by their priority
+func (ul *Upstreams) Scheduler() *shaping.Scheduler {
+	ul.schedulerOnce.Do(func() {
+		ul.scheduler = shaping.NewScheduler()
+	})
+	return ul.scheduler
 }
 
 // Shutdown will close the connection to the connected upstream server
 func (ul *Upstreams) Shutdown() {
 	go func() {
 		ul.mutex.Lock()
+		if ul.monitoring != nil {
+			close(ul.monitoring)
+			ul.monitoring = nil
+		}
+		if ul.pooling != nil {
+			close(ul.pooling)
+			ul.pooling = nil
+		}
+		for _, m := range ul.pool {
+			m.close()
+		}
+		ul.pool = nil
+		if ul.bonding != nil {
+			close(ul.bonding)
+			ul.bonding = nil
+		}
+		ul.paths = nil
 		if ul.session != nil {
 			streams.TryClose(ul.session)
 		}
@@ -0,0 +1,152 @@
+package upstream
+
+import (
+	"context"
+	"github.com/bokysan/socketace/v2/internal/socketace"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/bokysan/socketace/v2/internal/util/auth"
+	"github.com/bokysan/socketace/v2/internal/util/cert"
+	"github.com/bokysan/socketace/v2/internal/util/duration"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeUpstream struct {
+	streams.Connection
+	name      string
+	delay     time.Duration
+	fail      bool
+	cancelled int32
+}
+
+func (f *fakeUpstream) String() string {
+	return f.name
+}
+
+func (f *fakeUpstream) Unwrap() net.Conn {
+	return f.Connection
+}
+
+func (f *fakeUpstream) Connect(ctx context.Context, manager cert.TlsConfig, credentials auth.Credentials, mux *socketace.MuxConfig, mustSecure bool) error {
+	select {
+	case <-time.After(f.delay):
+	case <-ctx.Done():
+		atomic.StoreInt32(&f.cancelled, 1)
+		return ctx.Err()
+	}
+	if f.fail {
+		return errors.Errorf("Connection to %v failed", f.name)
+	}
+	c, _ := net.Pipe()
+	f.Connection = streams.NewSafeConnection(c)
+	return nil
+}
+
+func (f *fakeUpstream) wasCancelled() bool {
+	return atomic.LoadInt32(&f.cancelled) == 1
+}
+
+func Test_RaceFastestWins(t *testing.T) {
+	udp := &fakeUpstream{name: "udp://example.org:1000", delay: 5 * time.Second}
+	tcp := &fakeUpstream{name: "tcp://example.org:1000", delay: 10 * time.Millisecond}
+
+	ul := &Upstreams{
+		Data:    []Upstream{udp, tcp},
+		Stagger: 50 * time.Millisecond,
+	}
+
+	start := time.Now()
+	winner, err := ul.race(context.Background(), ul.ordered(), nil, false)
+	require.NoError(t, err)
+	require.Equal(t, tcp, winner.upstream)
+	require.Less(t, int64(time.Since(start)), int64(time.Second))
+	require.Eventually(t, udp.wasCancelled, time.Second, 10*time.Millisecond)
+}
+
+func Test_RaceFailureStartsNext(t *testing.T) {
+	udp := &fakeUpstream{name: "udp://example.org:1000", fail: true}
+	tcp := &fakeUpstream{name: "tcp://example.org:1000"}
+
+	ul := &Upstreams{
+		Data:    []Upstream{udp, tcp},
+		Stagger: time.Minute,
+	}
+
+	start := time.Now()
+	winner, err := ul.race(context.Background(), ul.ordered(), nil, false)
+	require.NoError(t, err)
+	require.Equal(t, tcp, winner.upstream)
+	require.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func Test_RaceAllFail(t *testing.T) {
+	ul := &Upstreams{
+		Data: []Upstream{
+			&fakeUpstream{name: "udp://example.org:1000", fail: true},
+			&fakeUpstream{name: "tcp://example.org:1000", fail: true},
+		},
+	}
+
+	_, err := ul.race(context.Background(), ul.ordered(), nil, false)
+	require.Error(t, err)
+}
+
+func Test_Prefer(t *testing.T) {
+	udp := &fakeUpstream{name: "udp://example.org:1000"}
+	tcp := &fakeUpstream{name: "tcp://example.org:1000"}
+	http := &fakeUpstream{name: "http://example.org/ws"}
+	https := &fakeUpstream{name: "https://example.org/ws"}
+
+	ul := &Upstreams{
+		Data: []Upstream{udp, tcp, http, https},
+	}
+	require.Equal(t, []Upstream{udp, tcp, http, https}, ul.ordered())
+
+	ul.Prefer = []string{"https", "tcp"}
+	require.Equal(t, []Upstream{https, tcp, udp, http}, ul.ordered())
+
+	// With preference and a long stagger, the preferred upstream is tried first and wins
+	ul.Stagger = time.Minute
+	winner, err := ul.race(context.Background(), ul.ordered(), nil, false)
+	require.NoError(t, err)
+	require.Equal(t, https, winner.upstream)
+}
+
+func Test_MuxOverride(t *testing.T) {
+	ul := &Upstreams{
+		Mux: socketace.MuxConfig{Version: 2, MaxStreamBuffer: 1024},
+	}
+	require.NoError(t, ul.UnmarshalFlag("tcp://example.org:1000?mux-version=1&mux-keepalive-timeout=1m"))
+	require.NoError(t, ul.UnmarshalFlag("https://example.org/ws?token=x"))
+	require.Error(t, ul.UnmarshalFlag("tcp://example.org:1000?mux-version=x"))
+	require.Len(t, ul.Data, 2)
+
+	tcp := ul.Data[0].(*Socket)
+	require.Equal(t, "tcp://example.org:1000", tcp.Address.String())
+	require.Equal(t, &socketace.MuxConfig{Version: 1, KeepAliveTimeout: duration.Duration(time.Minute), MaxStreamBuffer: 1024}, ul.mux(tcp))
+
+	https := ul.Data[1].(*Http)
+	require.Equal(t, "https://example.org/ws?token=x", https.Address.String())
+	require.Equal(t, &ul.Mux, ul.mux(https))
+}
+
+func Test_ResumeSession(t *testing.T) {
+	proxy := newFlakyProxy(t, startEchoServer(t))
+	ul := &Upstreams{
+		Data:          []Upstream{proxy.upstream()},
+		ResumeTimeout: 10 * time.Second,
+	}
+	defer ul.Shutdown()
+
+	e := openEcho(t, ul)
+	e.echo("HELLO")
+
+	// The stream survives the broken physical connection
+	proxy.breakConnections()
+	e.echo("AGAIN")
+	e.echo("QUIT")
+}
@@ -1,29 +1,70 @@
 package client
 
 import (
+	"encoding/json"
 	"github.com/bokysan/socketace/v2/internal/client/listener"
 	"github.com/bokysan/socketace/v2/internal/client/upstream"
 	"github.com/bokysan/socketace/v2/internal/logging"
+	"github.com/bokysan/socketace/v2/internal/socketace"
+	"github.com/bokysan/socketace/v2/internal/util/auth"
 	"github.com/bokysan/socketace/v2/internal/util/cert"
+	"github.com/bokysan/socketace/v2/internal/util/duration"
 	"github.com/hashicorp/go-multierror"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"io/ioutil"
 	"os"
 	"os/signal"
 	"reflect"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
 type Command struct {
 	cert.ClientConfig
+	auth.ClientCredentials
 
-	ListenList listener.Listeners `json:"listen"   short:"l" long:"listen"    env:"LISTEN"   env-delim:" "   description:"List of addresses to listen on (for specific name). Use multiple times to listen to different services."`
-	Upstream   upstream.Upstreams `json:"upstream" short:"u" long:"upstream"  env:"UPSTREAM" required:"true" description:"Upstream server address(es). Will be tried in other specified on the command line e.g. 'tcp://example.org:1234', 'https://172.10.1.11/ws/all', 'tcp+tls://10.1.2.3:2222', 'stdin:'"`
-	Secure     bool               `json:"secure"   short:"s" long:"secure"    env:"SECURE"                   description:"Force secure connections to upstream (fail if a secure channel cannot be established)"`
+	ListenList  listener.Listeners    `json:"listen"   short:"l" long:"listen"    env:"LISTEN"   env-delim:" "   description:"List of addresses to listen on (for specific name). Use multiple times to listen to different services."`
+	RemoteList  listener.Remotes      `json:"remote"   short:"R" long:"remote"    env:"REMOTE"   env-delim:" "   description:"Reverse tunnel: ask the server to listen and forward the connections back to a local address, e.g. 'expose~tcp://0.0.0.0:8080~tcp://127.0.0.1:3000'."`
+	PublishList listener.Publications `json:"publish"            long:"publish"   env:"PUBLISH"  env-delim:" "   description:"Publish a local service to a hub on the server, e.g. 'hub~laptop-ssh~tcp://127.0.0.1:22'."`
+	VpnList     listener.Vpns         `json:"vpn"                long:"vpn"       env:"VPN"      env-delim:" "   description:"Attach a TUN interface or a userspace network stack to a VPN channel, e.g. 'vpn~tun://socketace0' or 'vpn~userspace://'."`
+	Upstream    upstream.Upstreams    `json:"upstream" short:"u" long:"upstream"  env:"UPSTREAM" required:"true" description:"Upstream server address(es). Will be tried in other specified on the command line e.g. 'tcp://example.org:1234', 'https://172.10.1.11/ws/all', 'tcp+tls://10.1.2.3:2222', 'stdin:'"`
+	Secure      bool                  `json:"secure"   short:"s" long:"secure"    env:"SECURE"                   description:"Force secure connections to upstream (fail if a secure channel cannot be established)"`
+
+	ResumeTimeout duration.Duration `json:"resumeTimeout" long:"resume-timeout" env:"RESUME_TIMEOUT" default:"0" description:"How long to try to resume the session when the connection to the upstream is lost, e.g. '1m'. Disabled by default."`
+	Stagger       duration.Duration `json:"stagger"       long:"stagger"        env:"STAGGER"        default:"250ms" description:"Delay before trying the next upstream in parallel, while the previous ones are still connecting."`
+	Prefer        []string          `json:"prefer"        long:"prefer"         env:"PREFER" env-delim:","       description:"Schemes of the upstreams to try first, in order, e.g. 'tcp,https'. Others are tried in the order they are defined."`
+
+	HealthInterval   duration.Duration `json:"healthInterval"   long:"health-interval"   env:"HEALTH_INTERVAL"   default:"0"   description:"How often to probe the connection to the upstream, e.g. '10s'. Disabled by default, the server must support the health probes."`
+	HealthTimeout    duration.Duration `json:"healthTimeout"    long:"health-timeout"    env:"HEALTH_TIMEOUT"    default:"5s"  description:"Maximum round-trip time of a health probe."`
+	HealthFailures   int               `json:"healthFailures"   long:"health-failures"   env:"HEALTH_FAILURES"   default:"3"   description:"Number of failed health probes in a row after which the client fails over to another upstream."`
+	FailbackInterval duration.Duration `json:"failbackInterval" long:"failback-interval" env:"FAILBACK_INTERVAL" default:"1m"  description:"How often to check if a preferred upstream is reachable again. Set to 0 to disable failback."`
+	StatusFile       string            `json:"statusFile"       long:"status-file"       env:"STATUS_FILE"                     description:"Write the state of the upstreams to this file (as JSON) whenever it changes."`
+
+	PoolSize     int    `json:"poolSize"     long:"pool-size"     env:"POOL_SIZE"     default:"1"           description:"Number of physical connections to open to the upstreams. Logical connections are spread across them."`
+	PoolStrategy string `json:"poolStrategy" long:"pool-strategy" env:"POOL_STRATEGY" default:"round-robin" description:"How to spread the logical connections across the pool." choice:"round-robin" choice:"least-loaded"`
+
+	Multipath     bool    `json:"multipath"     long:"multipath"      env:"MULTIPATH"                  description:"Bond the connections to all the upstreams into one session, sending the data over the fastest path."`
+	DuplicateLoss float64 `json:"duplicateLoss" long:"duplicate-loss" env:"DUPLICATE_LOSS" default:"0" description:"Probe loss ratio (0-1) at which the data sent over a multipath path is duplicated on the next best path. Set to 0 to disable."`
+
+	Mux socketace.MuxConfig `json:"mux" group:"Multiplexer Options"`
+
+	statusMutex sync.Mutex
 }
 
 func NewCommand() *Command {
-	return &Command{}
+	return &Command{
+		Stagger: duration.Duration(upstream.DefaultStagger),
+
+		HealthTimeout:    duration.Duration(upstream.DefaultHealthTimeout),
+		HealthFailures:   upstream.DefaultHealthFailures,
+		FailbackInterval: duration.Duration(upstream.DefaultFailbackInterval),
+
+		PoolSize:     1,
+		PoolStrategy: upstream.PoolRoundRobin,
+	}
 }
 
 func (s *Command) CertManager() cert.TlsConfig {
@@ -36,17 +77,82 @@ func (s *Command) Startup(interrupted <-chan os.Signal) error {
 		return nil
 	default:
 		s.Upstream.MustSecure = s.Secure
+		s.Upstream.Credentials = &s.ClientCredentials
+		s.Upstream.ResumeTimeout = time.Duration(s.ResumeTimeout)
+		s.Upstream.Stagger = time.Duration(s.Stagger)
+		s.Upstream.HealthInterval = time.Duration(s.HealthInterval)
+		s.Upstream.HealthTimeout = time.Duration(s.HealthTimeout)
+		s.Upstream.HealthFailures = s.HealthFailures
+		s.Upstream.FailbackInterval = time.Duration(s.FailbackInterval)
+		s.Upstream.PoolSize = s.PoolSize
+		s.Upstream.PoolStrategy = s.PoolStrategy
+		s.Upstream.Multipath = s.Multipath
+		s.Upstream.DuplicateLoss = s.DuplicateLoss
+		s.Upstream.Mux = s.Mux
+		if s.StatusFile != "" {
+			s.Upstream.OnStatus = s.writeStatus
+		}
+		s.Upstream.Prefer = make([]string, 0)
+		for _, p := range s.Prefer {
+			// Allow both `--prefer tcp --prefer https` and `--prefer tcp,https`
+			for _, scheme := range strings.Split(p, ",") {
+				if scheme = strings.TrimSpace(scheme); scheme != "" {
+					s.Upstream.Prefer = append(s.Upstream.Prefer, scheme)
+				}
+			}
+		}
 		if err := s.ListenList.Start(&s.Upstream, s); err != nil {
 			return errors.Wrapf(err, "Could not listen on some of the addresses: %s", err)
 		}
+		if err := s.RemoteList.Start(&s.Upstream, s); err != nil {
+			return errors.Wrapf(err, "Could not start some of the reverse tunnels: %s", err)
+		}
+		if err := s.PublishList.Start(&s.Upstream, s); err != nil {
+			return errors.Wrapf(err, "Could not publish some of the services: %s", err)
+		}
+		if err := s.VpnList.Start(&s.Upstream, s); err != nil {
+			return errors.Wrapf(err, "Could not start some of the VPNs: %s", err)
+		}
 		return nil
 	}
 }
 
+// writeStatus will (atomically) replace the status file with the current state of the upstreams
+func (s *Command) writeStatus(status upstream.Status) {
+	s.statusMutex.Lock()
+	defer s.statusMutex.Unlock()
+
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		log.WithError(err).Warnf("Could not serialize status: %v", err)
+		return
+	}
+	tmp := s.StatusFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		log.WithError(err).Warnf("Could not write status file %v: %v", tmp, err)
+		return
+	}
+	if err := os.Rename(tmp, s.StatusFile); err != nil {
+		log.WithError(err).Warnf("Could not write status file %v: %v", s.StatusFile, err)
+	}
+}
+
 func (s *Command) Shutdown() error {
 	var errs error
 
 	log.Infof("Graceful client shutdown...")
+	for _, remotes := range []listener.Remotes{s.RemoteList, listener.Remotes(s.PublishList)} {
+		for _, srv := range remotes {
+			if err := srv.Shutdown(); err != nil {
+				errs = multierror.Append(errs, errors.Wrapf(err, "Could not shutdown %v", srv))
+			}
+		}
+	}
+	for _, srv := range s.VpnList {
+		if err := srv.Shutdown(); err != nil {
+			errs = multierror.Append(errs, errors.Wrapf(err, "Could not shutdown %v", srv))
+		}
+	}
 	s.Upstream.Shutdown()
 	for _, srv := range s.ListenList {
 		srvType := reflect.TypeOf(reflect.Indirect(reflect.ValueOf(srv)).Interface())
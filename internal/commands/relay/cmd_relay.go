@@ -0,0 +1,62 @@
+package relay
+
+import (
+	"github.com/bokysan/socketace/v2/internal/logging"
+	"github.com/bokysan/socketace/v2/internal/relay"
+	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/bokysan/socketace/v2/internal/util/cert"
+	"github.com/hashicorp/go-multierror"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+type Command struct {
+	cert.ServerConfig
+
+	Listen []addr.ProtoAddress `json:"listen" short:"l" long:"listen" env:"LISTEN" env-delim:" " required:"true" description:"Address(es) to accept the links of the servers and the clients on, e.g. 'tcp://0.0.0.0:9000', 'https://0.0.0.0:443/relay', 'udp://0.0.0.0:9000'."`
+
+	relay relay.Relay
+}
+
+func NewCommand() *Command {
+	return &Command{}
+}
+
+func (s *Command) Startup(interrupted <-chan os.Signal) error {
+	var errs error
+	for _, address := range s.Listen {
+		select {
+		case <-interrupted:
+			return errs
+		default:
+		}
+		if err := s.relay.Listen(address, &s.ServerConfig); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+	return errs
+}
+
+func (s *Command) Shutdown() error {
+	log.Infof("Graceful relay shutdown...")
+	return s.relay.Shutdown()
+}
+
+func (s *Command) Execute(args []string) error {
+	logging.SetupLogging()
+
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+
+	if err := s.Startup(interrupted); err != nil {
+		_ = s.Shutdown()
+		return err
+	}
+
+	select {
+	case <-interrupted:
+		return s.Shutdown()
+	}
+}
@@ -2,7 +2,9 @@ package server
 
 import (
 	"github.com/bokysan/socketace/v2/internal/logging"
+	"github.com/bokysan/socketace/v2/internal/resume"
 	"github.com/bokysan/socketace/v2/internal/server"
+	"github.com/bokysan/socketace/v2/internal/util/duration"
 	"github.com/hashicorp/go-multierror"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
@@ -12,17 +14,22 @@ import (
 	"reflect"
 	"sync"
 	"syscall"
+	"time"
 )
 
 type Command struct {
 	Channels server.Channels `json:"channels"    short:"L" long:"channel"     env:"UPSTREAM"                description:"Add an endpoint. Syntax: '<name>-><protocol>:<address>', e.g. 'ssh->tcp:127.0.0.1:22'"`
 	Servers  server.Servers  `json:"servers"     short:"s" long:"server"      env:"SERVER" env-delim:" "    description:"UpstreamList of listening server."`
+
+	SessionGracePeriod duration.Duration `json:"sessionGracePeriod" long:"session-grace-period" env:"SESSION_GRACE_PERIOD" default:"1m" description:"How long to keep the session of a disconnected client, waiting for it to resume. Set to 0 to disable."`
 }
 
 func NewCommand() *Command {
 	s := Command{
 		Channels: make(server.Channels, 0),
 		Servers:  make(server.Servers, 0),
+
+		SessionGracePeriod: duration.Duration(resume.DefaultGracePeriod),
 	}
 
 	return &s
@@ -30,6 +37,8 @@ func NewCommand() *Command {
 
 func (s *Command) Startup(interrupted <-chan os.Signal) error {
 	var errs error
+	server.Sessions.GracePeriod = time.Duration(s.SessionGracePeriod)
+
 	m := &sync.Mutex{}
 	wg := &sync.WaitGroup{}
 	wg.Add(len(s.Servers))
@@ -0,0 +1,154 @@
+package it
+
+import (
+	"bufio"
+	"github.com/bokysan/socketace/v2/internal/server"
+	"github.com/bokysan/socketace/v2/internal/socketace"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/bokysan/socketace/v2/internal/util/auth"
+	"github.com/bokysan/socketace/v2/internal/util/cert"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"testing"
+)
+
+func echoService(r io.ReadCloser, w io.WriteCloser) error {
+	defer func() {
+		log.Debugf("(echo)   Closing streams...")
+		r.Close()
+		w.Close()
+	}()
+
+	scanner := bufio.NewReader(r)
+
+	var line []byte
+	for true {
+		l, prefix, err := scanner.ReadLine()
+		if err == io.EOF {
+			if len(line) == 0 {
+				log.Debugf("(echo)   EOF")
+				return nil
+			}
+		} else if err != nil {
+			return err
+		} else if prefix {
+			line = append(line, l...)
+			continue
+		} else {
+			line = append(line, l...)
+		}
+
+		log.Tracef("(echo)   Received: %v", string(line))
+		response := append(line, '\r', '\n')
+		if _, err := w.Write(response); err != nil {
+			return err
+		}
+		log.Tracef("(echo)   Wrote:    %v", string(response[0:len(response)-2]))
+		if string(line) == "QUIT" {
+			break
+		}
+
+		line = make([]byte, 0)
+
+		if err == io.EOF {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// FreeAddress returns a local address with a port assigned by the OS, for the services which bind the port themselves
+func FreeAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer streams.TryClose(l)
+	return l.Addr().String()
+}
+
+// TlsServerConfig returns the server configuration with the test certificate
+func TlsServerConfig() cert.ServerConfig {
+	return cert.ServerConfig{
+		Config: cert.Config{
+			Certificate:        testCertificate,
+			PrivateKey:         testPrivatekey,
+			PrivateKeyPassword: &testPassword,
+		},
+	}
+}
+
+// StartEchoService starts the echo service on a port assigned by the OS and returns its address. The service is
+// stopped when the test completes.
+func StartEchoService(t *testing.T) addr.ProtoAddress {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		streams.TryClose(l)
+	})
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = echoService(conn, conn)
+			}()
+		}
+	}()
+
+	return addr.MustParseAddress("tcp://" + l.Addr().String())
+}
+
+// StartServer starts a plain SocketAce server with the channels on a port assigned by the OS and returns its address.
+// The server is stopped when the test completes.
+func StartServer(t *testing.T, channels server.Channels) addr.ProtoAddress {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		streams.TryClose(l)
+	})
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = server.AcceptConnection(conn, &cert.ServerConfig{}, false, &auth.ServerConfig{}, &socketace.MuxConfig{}, channels)
+			}()
+		}
+	}()
+
+	return addr.MustParseAddress("tcp://" + l.Addr().String())
+}
+
+// HelloEcho checks that the connection leads to the echo service
+func HelloEcho(t *testing.T, conn io.ReadWriteCloser) {
+	var err error
+
+	scanner := bufio.NewScanner(conn)
+
+	log.Debugf("Sending HELO...")
+	_, err = conn.Write([]byte("HELLO\r\n"))
+	require.NoError(t, err)
+	log.Debugf("Reading HELO...")
+	require.True(t, scanner.Scan(), "Could not get first line from echo service")
+	require.Equal(t, "HELLO", scanner.Text())
+
+	log.Debugf("Sending QUIT...")
+	_, err = conn.Write([]byte("QUIT\r\n"))
+	require.NoError(t, err)
+	log.Debugf("Reading QUIT...")
+	require.True(t, scanner.Scan(), "Could not gt the second line from the echo service")
+	require.Equal(t, "QUIT", scanner.Text())
+
+	log.Debugf("Making sure the stream is finished...")
+	require.False(t, scanner.Scan())
+
+}
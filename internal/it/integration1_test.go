@@ -1,12 +1,14 @@
 package it
 
 import (
-	"bufio"
+	"context"
 	"github.com/bokysan/socketace/v2/internal/client/listener"
 	"github.com/bokysan/socketace/v2/internal/client/upstream"
 	clientCmd "github.com/bokysan/socketace/v2/internal/commands/client"
 	serverCmd "github.com/bokysan/socketace/v2/internal/commands/server"
+	"github.com/bokysan/socketace/v2/internal/relay"
 	"github.com/bokysan/socketace/v2/internal/server"
+	"github.com/bokysan/socketace/v2/internal/socketace"
 	"github.com/bokysan/socketace/v2/internal/streams"
 	"github.com/bokysan/socketace/v2/internal/util/addr"
 	"github.com/bokysan/socketace/v2/internal/util/cert"
@@ -17,6 +19,7 @@ import (
 	"os"
 	"strconv"
 	"testing"
+	"time"
 )
 
 const echoServicePort int = 41000
@@ -25,52 +28,6 @@ var echoServiceAddress = addr.MustParseAddress("tcp://" + "127.0.0.1:" + strconv
 
 type closer func()
 
-func echoService(r io.ReadCloser, w io.WriteCloser) error {
-	defer func() {
-		log.Debugf("(echo)   Closing streams...")
-		r.Close()
-		w.Close()
-	}()
-
-	scanner := bufio.NewReader(r)
-
-	var line []byte
-	for true {
-		l, prefix, err := scanner.ReadLine()
-		if err == io.EOF {
-			if len(line) == 0 {
-				log.Debugf("(echo)   EOF")
-				return nil
-			}
-		} else if err != nil {
-			return err
-		} else if prefix {
-			line = append(line, l...)
-			continue
-		} else {
-			line = append(line, l...)
-		}
-
-		log.Tracef("(echo)   Received: %v", string(line))
-		response := append(line, '\r', '\n')
-		if _, err := w.Write(response); err != nil {
-			return err
-		}
-		log.Tracef("(echo)   Wrote:    %v", string(response[0:len(response)-2]))
-		if string(line) == "QUIT" {
-			break
-		}
-
-		line = make([]byte, 0)
-
-		if err == io.EOF {
-			return nil
-		}
-	}
-
-	return nil
-}
-
 func TestMain(m *testing.M) {
 	log.SetLevel(log.TraceLevel)
 
@@ -137,30 +94,6 @@ func setup() (closer, error) {
 	}, nil
 }
 
-func helloEchoTest(t *testing.T, conn io.ReadWriteCloser) {
-	var err error
-
-	scanner := bufio.NewScanner(conn)
-
-	log.Debugf("Sending HELO...")
-	_, err = conn.Write([]byte("HELLO\r\n"))
-	require.NoError(t, err)
-	log.Debugf("Reading HELO...")
-	require.True(t, scanner.Scan(), "Could not get first line from echo service")
-	require.Equal(t, "HELLO", scanner.Text())
-
-	log.Debugf("Sending QUIT...")
-	_, err = conn.Write([]byte("QUIT\r\n"))
-	require.NoError(t, err)
-	log.Debugf("Reading QUIT...")
-	require.True(t, scanner.Scan(), "Could not gt the second line from the echo service")
-	require.Equal(t, "QUIT", scanner.Text())
-
-	log.Debugf("Making sure the stream is finished...")
-	require.False(t, scanner.Scan())
-
-}
-
 func Test_UdpConnection(t *testing.T) {
 
 	localServiceAddress := addr.MustParseAddress("tcp://localhost:" + strconv.Itoa(echoServicePort+10))
@@ -221,7 +154,7 @@ func Test_UdpConnection(t *testing.T) {
 
 	defer streams.TryClose(conn)
 
-	helloEchoTest(t, conn)
+	HelloEcho(t, conn)
 
 	log.Infof("Test completed.")
 
@@ -290,7 +223,7 @@ func Test_DnsConnection(t *testing.T) {
 
 	defer streams.TryClose(conn)
 
-	helloEchoTest(t, conn)
+	HelloEcho(t, conn)
 
 	log.Infof("Test completed.")
 
@@ -361,7 +294,7 @@ func Test_SimpleInsecureConnection(t *testing.T) {
 	conn = streams.NewSafeConnection(conn)
 	defer streams.TryClose(conn)
 
-	helloEchoTest(t, conn)
+	HelloEcho(t, conn)
 
 	log.Infof("Test completed.")
 
@@ -444,7 +377,7 @@ func Test_SimpleWrappedTlsConnection(t *testing.T) {
 
 	defer streams.TryClose(conn)
 
-	helloEchoTest(t, conn)
+	HelloEcho(t, conn)
 
 	log.Infof("Test completed.")
 
@@ -527,7 +460,7 @@ func Test_SimpleStartTlsConnection(t *testing.T) {
 
 	defer streams.TryClose(conn)
 
-	helloEchoTest(t, conn)
+	HelloEcho(t, conn)
 
 	log.Infof("Test completed.")
 
@@ -593,7 +526,7 @@ func Test_TcpSocketConnection(t *testing.T) {
 
 	defer streams.TryClose(conn)
 
-	helloEchoTest(t, conn)
+	HelloEcho(t, conn)
 
 	log.Infof("Test completed.")
 
@@ -669,7 +602,7 @@ func Test_TcpWrappedTlsSocketConnection(t *testing.T) {
 	conn = streams.NewSafeConnection(conn)
 	defer streams.TryClose(conn)
 
-	helloEchoTest(t, conn)
+	HelloEcho(t, conn)
 
 	log.Infof("Test completed.")
 
@@ -741,7 +674,7 @@ func Test_WebsocketConnection(t *testing.T) {
 
 	defer streams.TryClose(conn)
 
-	helloEchoTest(t, conn)
+	HelloEcho(t, conn)
 
 	log.Infof("Test completed.")
 
@@ -817,7 +750,176 @@ func Test_IoListener(t *testing.T) {
 
 	defer streams.TryClose(p4)
 
-	helloEchoTest(t, p4)
+	HelloEcho(t, p4)
+
+	log.Infof("Test completed.")
+
+}
+
+func Test_Relay(t *testing.T) {
+
+	socketRelayAddress := FreeAddress(t)
+	websocketRelayAddress := FreeAddress(t)
+	localServiceAddress := FreeAddress(t)
+
+	r := &relay.Relay{}
+	require.NoError(t, r.Listen(addr.MustParseAddress("tcp://"+socketRelayAddress), &cert.ServerConfig{}))
+	require.NoError(t, r.Listen(addr.MustParseAddress("http://"+websocketRelayAddress+"/relay"), &cert.ServerConfig{}))
+	defer func() {
+		require.NoError(t, r.Shutdown())
+	}()
+
+	// The server dials out to the relay...
+	s := serverCmd.Command{
+		Channels: server.Channels{
+			&server.NetworkChannel{
+				AbstractChannel: server.AbstractChannel{
+					ProtoName: addr.ProtoName{
+						Name: "echo",
+					},
+					Address: StartEchoService(t),
+				},
+			},
+		},
+		Servers: server.Servers{
+			&server.RelayServer{
+				ServerConfig: TlsServerConfig(),
+				Address:      addr.MustParseAddress("relay+tcp://" + socketRelayAddress + "?session=office&secret=s3cret"),
+				Idle:         2,
+			},
+		},
+	}
+
+	interrupted := make(chan os.Signal, 1)
+	require.NoError(t, s.Startup(interrupted))
+	defer func() {
+		require.NoError(t, s.Shutdown())
+	}()
+	for i := 0; i < 50 && r.Waiting("office") < 2; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Equal(t, 2, r.Waiting("office"))
+
+	// ...and so does the client, over a different transport. The link is secured end to end with StartTLS.
+	c := clientCmd.Command{
+		ClientConfig: cert.ClientConfig{
+			InsecureSkipVerify: true,
+		},
+		Upstream: upstream.Upstreams{
+			Data: []upstream.Upstream{
+				&upstream.Relay{
+					Address: addr.MustParseAddress("relay+ws://" + websocketRelayAddress + "/relay?session=office&secret=s3cret"),
+				},
+			},
+		},
+		Secure: true,
+		ListenList: listener.Listeners{
+			&listener.SocketListener{
+				AbstractListener: listener.AbstractListener{
+					ProtoName: addr.ProtoName{
+						Name: "echo",
+					},
+					Address: addr.MustParseAddress("tcp://" + localServiceAddress),
+				},
+			},
+		},
+	}
+	require.NoError(t, c.Startup(interrupted))
+
+	conn, err := net.Dial("tcp", localServiceAddress)
+	require.NoError(t, err)
+	HelloEcho(t, conn)
+	streams.TryClose(conn)
+
+	// The server replaces the paired link
+	for i := 0; i < 50 && r.Waiting("office") < 2; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Equal(t, 2, r.Waiting("office"))
+
+	interrupted <- os.Interrupt
+	require.NoError(t, c.Shutdown())
+
+	// The relay does not pair the clients which don't know the secret
+	intruder := &upstream.Relay{
+		Address: addr.MustParseAddress("relay+tcp://" + socketRelayAddress + "?session=office&secret=guess"),
+	}
+	require.Error(t, intruder.Connect(context.Background(), &cert.ClientConfig{InsecureSkipVerify: true}, nil, &socketace.MuxConfig{}, false))
+
+	log.Infof("Test completed.")
+
+}
+
+func Test_HttpPolling(t *testing.T) {
+
+	httpListenAddress := addr.MustParseAddress("http://" + FreeAddress(t))
+	echoListenAddress := addr.MustParseAddress("tcp://" + FreeAddress(t))
+
+	s := serverCmd.Command{
+		Channels: server.Channels{
+			&server.NetworkChannel{
+				AbstractChannel: server.AbstractChannel{
+					ProtoName: addr.ProtoName{
+						Name: "echo",
+					},
+					Address: StartEchoService(t),
+				},
+			},
+		},
+		Servers: server.Servers{
+			&server.HttpServer{
+				ServerConfig: TlsServerConfig(),
+				Address:      httpListenAddress,
+				Endpoints: server.WebsocketEndpointList{
+					server.HttpEndpoint{
+						// Websockets are refused, the client must fall back to polling
+						Endpoint: "/ws/all",
+						Mode:     server.ModePolling,
+					},
+				},
+			},
+		},
+	}
+
+	c := clientCmd.Command{
+		ClientConfig: cert.ClientConfig{
+			InsecureSkipVerify: true,
+		},
+		Upstream: upstream.Upstreams{
+			Data: []upstream.Upstream{
+				&upstream.Http{
+					Address: addr.MustParseAddress(httpListenAddress.String() + "/ws/all"),
+				},
+			},
+		},
+		ListenList: listener.Listeners{
+			&listener.SocketListener{
+				AbstractListener: listener.AbstractListener{
+					ProtoName: addr.ProtoName{
+						Name: "echo",
+					},
+					Address: echoListenAddress,
+				},
+			},
+		},
+	}
+
+	interrupted := make(chan os.Signal, 1)
+	require.NoError(t, s.Startup(interrupted))
+	require.NoError(t, c.Startup(interrupted))
+
+	defer func() {
+		interrupted <- os.Interrupt
+		require.NoError(t, c.Shutdown())
+		require.NoError(t, s.Shutdown())
+	}()
+
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", echoListenAddress.Host)
+		require.NoError(t, err)
+		HelloEcho(t, conn)
+		streams.TryClose(conn)
+	}
 
 	log.Infof("Test completed.")
 
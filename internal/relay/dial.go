@@ -0,0 +1,191 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/bokysan/socketace/v2/internal/util/cert"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/xtaci/kcp-go/v5"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SchemePrefix is the prefix of the addresses of the relays, e.g. `relay+tcp://relay.example.org:9000`
+const SchemePrefix = "relay+"
+
+// Address is the address of a relay as configured on the servers and the clients, e.g.
+// `relay+wss://relay.example.org/relay?session=office&secret=s3cret`. The optional `server-name` parameter is the
+// name the client expects in the certificate of the server, as the relay host name won't match it.
+type Address struct {
+	Transport  addr.ProtoAddress
+	Session    string
+	Secret     string
+	ServerName string
+}
+
+// ParseAddress splits the relay address into the transport address and the session parameters
+func ParseAddress(a addr.ProtoAddress) (*Address, error) {
+	if !strings.HasPrefix(a.Scheme, SchemePrefix) {
+		return nil, errors.Errorf("Not a relay address: %v", a.String())
+	}
+	res := &Address{
+		Transport: a,
+	}
+	res.Transport.Scheme = strings.TrimPrefix(a.Scheme, SchemePrefix)
+
+	query := a.Query()
+	res.Session = query.Get("session")
+	res.Secret = query.Get("secret")
+	res.ServerName = query.Get("server-name")
+	query.Del("session")
+	query.Del("secret")
+	query.Del("server-name")
+	res.Transport.RawQuery = query.Encode()
+
+	if err := validSession(res.Session); err != nil {
+		return nil, errors.Wrapf(err, "Invalid relay address %v", Redact(a))
+	}
+	if res.ServerName == "" {
+		res.ServerName = res.Transport.Hostname()
+	}
+	return res, nil
+}
+
+// Redact returns the relay address without the secret, for logging
+func Redact(a addr.ProtoAddress) string {
+	query := a.Query()
+	if query.Get("secret") != "" {
+		query.Del("secret")
+		a.RawQuery = query.Encode()
+	}
+	return a.String()
+}
+
+func (a *Address) String() string {
+	return a.Transport.String() + "#" + a.Session
+}
+
+// Connect opens a link to the relay and introduces it. Call Await to wait until the link is paired with a peer, and
+// use the returned connection afterwards, as it might have buffered the data sent by the peer.
+func Connect(ctx context.Context, a *Address, role string, manager cert.TlsConfig) (*streams.BufferedInputConnection, error) {
+	c, err := Dial(ctx, a.Transport, manager)
+	if err != nil {
+		return nil, err
+	}
+	conn := streams.NewBufferedInputConnection(c)
+	if err := authenticate(conn, role, a); err != nil {
+		streams.TryClose(conn)
+		return nil, err
+	}
+	return conn, nil
+}
+
+// authenticate introduces the link to the relay and answers its challenge. The key of the session is revealed only to
+// register a session the relay does not know yet.
+func authenticate(conn *streams.BufferedInputConnection, role string, a *Address) error {
+	_ = conn.SetReadDeadline(time.Now().Add(HelloTimeout))
+	defer func() {
+		_ = conn.SetReadDeadline(time.Time{})
+	}()
+
+	if err := WriteHello(conn, role, a.Session); err != nil {
+		return err
+	}
+	nonce, unknown, err := ReadChallenge(conn.Reader)
+	if err != nil {
+		return err
+	}
+	key := Key(a.Session, a.Secret)
+	reveal := ""
+	if unknown && role == RoleServer {
+		reveal = key
+	}
+	return WriteProof(conn, Proof(key, nonce), reveal)
+}
+
+// Await waits until the relay pairs the link with a peer
+func Await(conn *streams.BufferedInputConnection) error {
+	return ReadReply(conn.Reader)
+}
+
+// Dial opens a raw link over the transport of the relay
+func Dial(ctx context.Context, transport addr.ProtoAddress, manager cert.TlsConfig) (net.Conn, error) {
+	secure := addr.HasTls.MatchString(transport.Scheme) || transport.Scheme == "https" || transport.Scheme == "wss"
+	scheme := addr.PlusEnd.ReplaceAllString(transport.Scheme, "")
+
+	var tlsConfig *tls.Config
+	if secure {
+		var err error
+		if tlsConfig, err = manager.GetTlsConfig(); err != nil {
+			return nil, errors.Wrapf(err, "Could not configure TLS")
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = transport.Hostname()
+		}
+	}
+
+	log.Debugf("Dialing relay %v", transport.String())
+	switch scheme {
+	case "tcp", "tcp4", "tcp6", "unix":
+		dialer := &net.Dialer{}
+		c, err := dialer.DialContext(ctx, scheme, transport.Host)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not connect to relay %v", transport.String())
+		}
+		if tlsConfig == nil {
+			return c, nil
+		}
+		tlsConn := tls.Client(c, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			streams.TryClose(c)
+			return nil, errors.Wrapf(err, "Could not connect to relay %v", transport.String())
+		}
+		return tlsConn, nil
+
+	case "http", "https", "ws", "wss":
+		u := transport.URL
+		if secure {
+			u.Scheme = "wss"
+		} else {
+			u.Scheme = "ws"
+		}
+		dialer := &websocket.Dialer{
+			Proxy:            http.ProxyFromEnvironment,
+			HandshakeTimeout: 45 * time.Second,
+			TLSClientConfig:  tlsConfig,
+		}
+		c, _, err := dialer.DialContext(ctx, u.String(), nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not connect to relay %v", transport.String())
+		}
+		return streams.NewWebsocketTunnelConnection(c), nil
+
+	case "udp", "udp4", "udp6":
+		if secure {
+			return nil, errors.Errorf("TLS is not supported over %v", scheme)
+		}
+		remote, err := net.ResolveUDPAddr(scheme, transport.Host)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		conn, err := net.ListenPacket(scheme, "")
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		c, err := kcp.NewConn2(remote, nil, 10, 3, conn)
+		if err != nil {
+			streams.TryClose(conn)
+			return nil, errors.Wrapf(err, "Could not connect to relay %v", transport.String())
+		}
+		return c, nil
+
+	default:
+		return nil, errors.Errorf("Can't handle format: %s", transport.Scheme)
+	}
+}
@@ -0,0 +1,130 @@
+package relay
+
+import (
+	"crypto/tls"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/bokysan/socketace/v2/internal/util/cert"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/xtaci/kcp-go/v5"
+	"io"
+	"net"
+	"net/http"
+)
+
+// Listen will accept the links on the address. Supported are the sockets (`tcp://`, `tcp+tls://`, `unix://`), the
+// websockets (`http://`, `https://`, `ws://`, `wss://`) and KCP (`udp://`). The manager is used for the TLS
+// transports.
+func (r *Relay) Listen(address addr.ProtoAddress, manager cert.TlsConfig) error {
+	secure := addr.HasTls.MatchString(address.Scheme) || address.Scheme == "https" || address.Scheme == "wss"
+	scheme := addr.PlusEnd.ReplaceAllString(address.Scheme, "")
+
+	var tlsConfig *tls.Config
+	if secure {
+		var err error
+		if tlsConfig, err = manager.GetTlsConfig(); err != nil {
+			return errors.Wrapf(err, "Could not configure TLS")
+		}
+	}
+
+	var closer io.Closer
+	var err error
+	switch scheme {
+	case "tcp", "tcp4", "tcp6", "unix":
+		closer, err = r.listenSocket(scheme, address.Host, tlsConfig)
+	case "http", "https", "ws", "wss":
+		closer, err = r.listenWebsocket(address, tlsConfig)
+	case "udp", "udp4", "udp6":
+		if secure {
+			return errors.Errorf("TLS is not supported over %v", scheme)
+		}
+		closer, err = r.listenPacket(scheme, address.Host)
+	default:
+		return errors.Errorf("Can't handle format: %s", address.Scheme)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Could not listen on %v", address.String())
+	}
+
+	log.Infof("[Relay] Listening on %v", address.String())
+	r.mutex.Lock()
+	r.listeners = append(r.listeners, closer)
+	r.mutex.Unlock()
+	return nil
+}
+
+func (r *Relay) listenSocket(network, host string, tlsConfig *tls.Config) (net.Listener, error) {
+	var listener net.Listener
+	var err error
+	if tlsConfig != nil {
+		listener, err = tls.Listen(network, host, tlsConfig)
+	} else {
+		listener, err = net.Listen(network, host)
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	go r.accept(listener)
+	return listener, nil
+}
+
+func (r *Relay) listenPacket(network, host string) (net.Listener, error) {
+	conn, err := net.ListenPacket(network, host)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	listener, err := kcp.ServeConn(nil, 10, 3, conn)
+	if err != nil {
+		streams.TryClose(conn)
+		return nil, errors.WithStack(err)
+	}
+	go r.accept(listener)
+	return listener, nil
+}
+
+func (r *Relay) listenWebsocket(address addr.ProtoAddress, tlsConfig *tls.Config) (*http.Server, error) {
+	endpoint := address.Path
+	if endpoint == "" {
+		endpoint = "/"
+	}
+	upgrader := websocket.Upgrader{}
+	mux := http.NewServeMux()
+	mux.HandleFunc(endpoint, func(w http.ResponseWriter, req *http.Request) {
+		c, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			log.WithError(err).Debugf("[Relay] Socket upgrade failed: %v", err)
+			return
+		}
+		r.Handle(streams.NewWebsocketTunnelConnection(c))
+	})
+
+	listener, err := net.Listen("tcp", address.Host)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	server := &http.Server{
+		Handler: mux,
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Errorf("[Relay] Could not serve %v: %v", address.String(), err)
+		}
+	}()
+	return server, nil
+}
+
+func (r *Relay) accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.WithError(err).Debugf("[Relay] Stopped accepting the links: %v", err)
+			return
+		}
+		go r.Handle(conn)
+	}
+}
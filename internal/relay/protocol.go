@@ -0,0 +1,184 @@
+package relay
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"strings"
+)
+
+const (
+	// RoleServer is the role of the SocketAce server, waiting at the relay for the clients
+	RoleServer = "server"
+	// RoleClient is the role of the SocketAce client, paired with one of the waiting servers
+	RoleClient = "client"
+
+	helloPrefix     = "RELAY"
+	challengePrefix = "CHALLENGE"
+	proofPrefix     = "PROOF"
+	newSession      = "NEW"
+	replyOk         = "OK"
+	replyError      = "ERROR "
+	maxSessionName  = 128
+	nonceSize       = 32
+)
+
+// Key returns the key of the session, derived from the shared secret. The relay learns the key when the first server
+// registers the session, but never the secret itself.
+func Key(session, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(session))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Proof returns the answer to the challenge of the relay, which proves the knowledge of the session key
+func Proof(key, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validProof checks the answer to the challenge in constant time
+func validProof(key, nonce, proof string) bool {
+	return subtle.ConstantTimeCompare([]byte(Proof(key, nonce)), []byte(proof)) == 1
+}
+
+// newNonce returns a random challenge, different for every link
+func newNonce() (string, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", errors.Wrapf(err, "Could not generate challenge")
+	}
+	return hex.EncodeToString(nonce), nil
+}
+
+// validSession returns an error if the session name can't be sent to the relay
+func validSession(session string) error {
+	if session == "" || len(session) > maxSessionName || strings.IndexFunc(session, func(r rune) bool {
+		return r <= ' ' || r == 0x7f
+	}) >= 0 {
+		return errors.Errorf("Invalid session name: %q", session)
+	}
+	return nil
+}
+
+// WriteHello introduces the link to the relay. It's the first line sent over a new link.
+func WriteHello(w io.Writer, role, session string) error {
+	if err := validSession(session); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%s %s %s\r\n", helloPrefix, role, session)
+	return errors.Wrapf(err, "Could not send the relay hello")
+}
+
+// ReadHello reads the introduction of the link
+func ReadHello(r *bufio.Reader) (role, session string, err error) {
+	line, err := readLine(r)
+	if err != nil {
+		return "", "", err
+	}
+	parts := strings.Split(line, " ")
+	if len(parts) != 3 || parts[0] != helloPrefix {
+		return "", "", errors.Errorf("Invalid relay hello: %q", line)
+	}
+	if parts[1] != RoleServer && parts[1] != RoleClient {
+		return "", "", errors.Errorf("Invalid role: %q", parts[1])
+	}
+	if err := validSession(parts[2]); err != nil {
+		return "", "", err
+	}
+	return parts[1], parts[2], nil
+}
+
+// WriteChallenge sends the nonce the link must answer with the proof of the session key. If the session is not known
+// yet, the relay asks the server to reveal the key as well.
+func WriteChallenge(w io.Writer, nonce string, unknown bool) error {
+	line := challengePrefix + " " + nonce
+	if unknown {
+		line += " " + newSession
+	}
+	_, err := w.Write([]byte(line + "\r\n"))
+	return errors.Wrapf(err, "Could not send the relay challenge")
+}
+
+// ReadChallenge reads the nonce sent by the relay and whether the session is not known yet
+func ReadChallenge(r *bufio.Reader) (nonce string, unknown bool, err error) {
+	line, err := readLine(r)
+	if err != nil {
+		return "", false, err
+	}
+	if strings.HasPrefix(line, replyError) {
+		return "", false, errors.Errorf("Relay refused the link: %v", strings.TrimPrefix(line, replyError))
+	}
+	parts := strings.Split(line, " ")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] != challengePrefix || parts[1] == "" {
+		return "", false, errors.Errorf("Invalid relay challenge: %q", line)
+	}
+	return parts[1], len(parts) == 3 && parts[2] == newSession, nil
+}
+
+// WriteProof answers the challenge. The key is revealed only when registering a new session.
+func WriteProof(w io.Writer, proof, key string) error {
+	line := proofPrefix + " " + proof
+	if key != "" {
+		line += " " + key
+	}
+	_, err := w.Write([]byte(line + "\r\n"))
+	return errors.Wrapf(err, "Could not send the relay proof")
+}
+
+// ReadProof reads the answer to the challenge and the revealed key, if any
+func ReadProof(r *bufio.Reader) (proof, key string, err error) {
+	line, err := readLine(r)
+	if err != nil {
+		return "", "", err
+	}
+	parts := strings.Split(line, " ")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] != proofPrefix || parts[1] == "" {
+		return "", "", errors.Errorf("Invalid relay proof: %q", line)
+	}
+	if len(parts) == 3 {
+		key = parts[2]
+	}
+	return parts[1], key, nil
+}
+
+// WriteReply tells the link whether it has been paired with a peer
+func WriteReply(w io.Writer, err error) error {
+	line := replyOk
+	if err != nil {
+		line = replyError + strings.NewReplacer("\r", " ", "\n", " ").Replace(err.Error())
+	}
+	_, e := w.Write([]byte(line + "\r\n"))
+	return errors.Wrapf(e, "Could not send the relay reply")
+}
+
+// ReadReply reads the reply of the relay and returns the error it reported, if any
+func ReadReply(r *bufio.Reader) error {
+	reply, err := readLine(r)
+	if err != nil {
+		return err
+	}
+	if reply == replyOk {
+		return nil
+	} else if strings.HasPrefix(reply, replyError) {
+		return errors.Errorf("Relay refused the link: %v", strings.TrimPrefix(reply, replyError))
+	}
+	return errors.Errorf("Invalid relay reply: %q", reply)
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", errors.Errorf("Relay line too long")
+	} else if err != nil {
+		return "", errors.Wrapf(err, "Could not read from the relay link")
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
@@ -0,0 +1,304 @@
+package relay
+
+import (
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// HelloTimeout is how long the relay waits for a new link to introduce itself
+var HelloTimeout = 30 * time.Second
+
+// MaxWaiting is the maximum number of the server links waiting in one session
+var MaxWaiting = 16
+
+// SessionRetention is how long the relay remembers the key of a session without any waiting server links. Until then,
+// only the servers which know the key may wait in the session again.
+var SessionRetention = 10 * time.Minute
+
+// Relay pairs the servers and the clients which dial out to it. The servers keep idle links open in their session;
+// each client is paired with one of them and the relay splices the two links. Every link must answer a challenge with
+// the key of the session, which the first server reveals when it registers the session. The relay never looks into
+// the data, which is protected by the TLS between the client and the server.
+type Relay struct {
+	mutex     sync.Mutex
+	sessions  map[string]*session
+	listeners []io.Closer
+}
+
+// session is the list of the server links waiting for the clients
+type session struct {
+	key     string
+	waiting []*link
+	// left is the time the last waiting link left the session
+	left time.Time
+}
+
+// hello is the introduction of a link along with its answer to the challenge
+type hello struct {
+	role    string
+	session string
+	nonce   string
+	proof   string
+	key     string
+}
+
+// link is a server link waiting for a client
+type link struct {
+	conn   *streams.BufferedInputConnection
+	peer   net.Conn
+	gone   bool
+	peeked chan struct{}
+	once   sync.Once
+}
+
+// Read returns the data sent by the server, once watch stopped peeking at it
+func (l *link) Read(p []byte) (int, error) {
+	<-l.peeked
+	return l.conn.Read(p)
+}
+
+func (l *link) Write(p []byte) (int, error) {
+	return l.conn.Write(p)
+}
+
+// Close closes the server link. It's safe to call it from the concurrent goroutines.
+func (l *link) Close() error {
+	l.once.Do(func() {
+		streams.TryClose(l.conn)
+	})
+	return nil
+}
+
+func (l *link) String() string {
+	return l.conn.RemoteAddr().String()
+}
+
+// Handle reads the introduction of the link, challenges it and either parks it (for the servers) or pairs it with a
+// waiting server link (for the clients).
+func (r *Relay) Handle(c net.Conn) {
+	conn := streams.NewBufferedInputConnection(c)
+	_ = conn.SetReadDeadline(time.Now().Add(HelloTimeout))
+	h, err := r.challenge(conn)
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		log.WithError(err).Debugf("[Relay] Invalid link from %v: %v", c.RemoteAddr(), err)
+		streams.TryClose(conn)
+		return
+	}
+
+	if h.role == RoleServer {
+		err = r.register(h, conn)
+	} else {
+		err = r.pair(h, conn)
+	}
+	if err != nil {
+		log.WithError(err).Infof("[Relay] Refused %v link from %v: %v", h.role, c.RemoteAddr(), err)
+		_ = WriteReply(conn, err)
+		streams.TryClose(conn)
+	}
+}
+
+// challenge reads the introduction of the link and asks it to prove that it knows the key of the session
+func (r *Relay) challenge(conn *streams.BufferedInputConnection) (*hello, error) {
+	role, name, err := ReadHello(conn.Reader)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	if err := WriteChallenge(conn, nonce, role == RoleServer && !r.known(name)); err != nil {
+		return nil, err
+	}
+	proof, key, err := ReadProof(conn.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &hello{role: role, session: name, nonce: nonce, proof: proof, key: key}, nil
+}
+
+// known returns true if the relay remembers the key of the session
+func (r *Relay) known(name string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.expire()
+	_, ok := r.sessions[name]
+	return ok
+}
+
+// expire forgets the sessions without any waiting links for longer than SessionRetention. Expects the mutex to be
+// held.
+func (r *Relay) expire() {
+	for name, s := range r.sessions {
+		if len(s.waiting) == 0 && time.Since(s.left) > SessionRetention {
+			delete(r.sessions, name)
+		}
+	}
+}
+
+// Waiting returns the number of the server links waiting in the session
+func (r *Relay) Waiting(name string) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if s, ok := r.sessions[name]; ok {
+		return len(s.waiting)
+	}
+	return 0
+}
+
+// register parks the server link in the session. A new session is registered with the key revealed by the server; the
+// servers joining a known session must prove they know its key.
+func (r *Relay) register(h *hello, conn *streams.BufferedInputConnection) error {
+	name := h.session
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.expire()
+	s, ok := r.sessions[name]
+	if !ok {
+		if h.key == "" || !validProof(h.key, h.nonce, h.proof) {
+			return errors.Errorf("Invalid credentials for session %v", name)
+		}
+		s = &session{key: h.key}
+		if r.sessions == nil {
+			r.sessions = make(map[string]*session)
+		}
+		r.sessions[name] = s
+	} else if !validProof(s.key, h.nonce, h.proof) {
+		return errors.Errorf("Session %v is used by another server", name)
+	} else if len(s.waiting) >= MaxWaiting {
+		return errors.Errorf("Too many servers waiting in session %v", name)
+	}
+
+	l := &link{conn: conn, peeked: make(chan struct{})}
+	s.waiting = append(s.waiting, l)
+	log.Debugf("[Relay] Server %v waiting in session %v", conn.RemoteAddr(), name)
+	go r.watch(name, l)
+	return nil
+}
+
+// pair splices the client link with a waiting server link
+func (r *Relay) pair(h *hello, conn *streams.BufferedInputConnection) error {
+	name := h.session
+	for {
+		l, err := r.take(h)
+		if err != nil {
+			return err
+		}
+		// The server link might have died in the meantime, try the next one
+		if err := WriteReply(l, nil); err != nil || !r.attach(l, conn) {
+			log.Debugf("[Relay] Server link %v in session %v is gone", l, name)
+			_ = l.Close()
+			continue
+		}
+		if err := WriteReply(conn, nil); err != nil {
+			_ = l.Close()
+			streams.TryClose(conn)
+			return nil
+		}
+
+		log.Infof("[Relay] Paired client %v with server %v in session %v", conn.RemoteAddr(), l, name)
+		if err := streams.PipeData(conn, l); err != nil {
+			log.WithError(err).Debugf("[Relay] Link in session %v failed: %v", name, err)
+		}
+		_ = l.Close()
+		streams.TryClose(conn)
+		return nil
+	}
+}
+
+// take removes the first waiting server link from the session, if the client proved it knows the key of the session
+func (r *Relay) take(h *hello) (*link, error) {
+	name := h.session
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	s, ok := r.sessions[name]
+	if !ok {
+		return nil, errors.Errorf("No server is waiting in session %v", name)
+	} else if !validProof(s.key, h.nonce, h.proof) {
+		return nil, errors.Errorf("Invalid credentials for session %v", name)
+	} else if len(s.waiting) == 0 {
+		return nil, errors.Errorf("No server is waiting in session %v", name)
+	}
+
+	l := s.waiting[0]
+	s.waiting = s.waiting[1:]
+	if len(s.waiting) == 0 {
+		s.left = time.Now()
+	}
+	return l, nil
+}
+
+// attach makes the client the peer of the server link. It returns false if the server link has been closed.
+func (r *Relay) attach(l *link, conn net.Conn) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if l.gone {
+		return false
+	}
+	l.peer = conn
+	return true
+}
+
+// remove removes the server link from the session and returns its peer, if it has been paired already
+func (r *Relay) remove(name string, l *link) net.Conn {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if l.peer != nil {
+		return l.peer
+	}
+	l.gone = true
+	if s, ok := r.sessions[name]; ok {
+		for i, w := range s.waiting {
+			if w == l {
+				s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+				break
+			}
+		}
+		if len(s.waiting) == 0 {
+			s.left = time.Now()
+		}
+	}
+	return nil
+}
+
+// watch waits for the data on the server link. The server sends nothing until it's paired, so this either fails,
+// when the waiting link is closed, or returns the data for the client, which is left in the buffer.
+func (r *Relay) watch(name string, l *link) {
+	_, _ = l.conn.Reader.Peek(1)
+	close(l.peeked)
+
+	if peer := r.remove(name, l); peer == nil {
+		log.Debugf("[Relay] Server %v left session %v", l, name)
+		_ = l.Close()
+	}
+}
+
+// Shutdown stops listening and closes the waiting links. The paired links are left alone.
+func (r *Relay) Shutdown() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var err error
+	for _, l := range r.listeners {
+		if e := streams.LogClose(l); e != nil {
+			err = e
+		}
+	}
+	r.listeners = nil
+	for _, s := range r.sessions {
+		for _, l := range s.waiting {
+			_ = l.Close()
+		}
+	}
+	r.sessions = nil
+	return err
+}
@@ -0,0 +1,144 @@
+package relay
+
+import (
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// openLink opens a link to the relay, introduces it and answers the challenge
+func openLink(t *testing.T, r *Relay, role, session, secret string) *streams.BufferedInputConnection {
+	local, remote := net.Pipe()
+	go r.Handle(remote)
+	conn := streams.NewBufferedInputConnection(local)
+	require.NoError(t, authenticate(conn, role, &Address{Session: session, Secret: secret}))
+	return conn
+}
+
+func Test_RelayPairing(t *testing.T) {
+	r := &Relay{}
+
+	server := openLink(t, r, RoleServer, "office", "s3cret")
+	require.Eventually(t, func() bool { return r.Waiting("office") == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	// Another server can't join the session without the secret
+	intruder := openLink(t, r, RoleServer, "office", "guess")
+	require.Error(t, ReadReply(intruder.Reader))
+
+	// Neither can the clients
+	client := openLink(t, r, RoleClient, "office", "guess")
+	require.Error(t, ReadReply(client.Reader))
+	client = openLink(t, r, RoleClient, "home", "s3cret")
+	require.Error(t, ReadReply(client.Reader))
+	require.Equal(t, 1, r.Waiting("office"))
+
+	client = openLink(t, r, RoleClient, "office", "s3cret")
+	require.NoError(t, ReadReply(server.Reader))
+	require.NoError(t, ReadReply(client.Reader))
+	require.Equal(t, 0, r.Waiting("office"))
+
+	go func() {
+		_, _ = client.Write([]byte("ping"))
+	}()
+	buf := make([]byte, 4)
+	_, err := io.ReadFull(server, buf)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(buf))
+
+	go func() {
+		_, _ = server.Write([]byte("pong"))
+	}()
+	_, err = io.ReadFull(client, buf)
+	require.NoError(t, err)
+	require.Equal(t, "pong", string(buf))
+
+	streams.TryClose(server)
+	_, err = client.Read(buf)
+	require.Error(t, err)
+}
+
+func Test_RelayLeave(t *testing.T) {
+	r := &Relay{}
+
+	server := openLink(t, r, RoleServer, "office", "s3cret")
+	require.Eventually(t, func() bool { return r.Waiting("office") == 1 }, 5*time.Second, 10*time.Millisecond)
+	streams.TryClose(server)
+	require.Eventually(t, func() bool { return r.Waiting("office") == 0 }, 5*time.Second, 10*time.Millisecond)
+
+	client := openLink(t, r, RoleClient, "office", "s3cret")
+	require.Error(t, ReadReply(client.Reader))
+}
+
+func Test_RelayChallenge(t *testing.T) {
+	r := &Relay{}
+	key := Key("office", "s3cret")
+
+	// The first server reveals the key to register the session
+	local, remote := net.Pipe()
+	go r.Handle(remote)
+	server := streams.NewBufferedInputConnection(local)
+	require.NoError(t, WriteHello(server, RoleServer, "office"))
+	nonce, unknown, err := ReadChallenge(server.Reader)
+	require.NoError(t, err)
+	require.True(t, unknown)
+	require.NoError(t, WriteProof(server, Proof(key, nonce), key))
+	require.Eventually(t, func() bool { return r.Waiting("office") == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	// The other links get a new challenge each, so an answer can't be replayed
+	local, remote = net.Pipe()
+	go r.Handle(remote)
+	client := streams.NewBufferedInputConnection(local)
+	require.NoError(t, WriteHello(client, RoleClient, "office"))
+	other, unknown, err := ReadChallenge(client.Reader)
+	require.NoError(t, err)
+	require.False(t, unknown)
+	require.NotEqual(t, nonce, other)
+	require.NoError(t, WriteProof(client, Proof(key, nonce), ""))
+	require.Error(t, ReadReply(client.Reader))
+	require.Equal(t, 1, r.Waiting("office"))
+}
+
+func Test_RelaySessionRetention(t *testing.T) {
+	retention := SessionRetention
+	defer func() {
+		SessionRetention = retention
+	}()
+	r := &Relay{}
+
+	server := openLink(t, r, RoleServer, "office", "s3cret")
+	require.Eventually(t, func() bool { return r.Waiting("office") == 1 }, 5*time.Second, 10*time.Millisecond)
+	streams.TryClose(server)
+	require.Eventually(t, func() bool { return r.Waiting("office") == 0 }, 5*time.Second, 10*time.Millisecond)
+
+	// The session is remembered, so another server can't take it over while the server reconnects
+	intruder := openLink(t, r, RoleServer, "office", "guess")
+	require.Error(t, ReadReply(intruder.Reader))
+	server = openLink(t, r, RoleServer, "office", "s3cret")
+	require.Eventually(t, func() bool { return r.Waiting("office") == 1 }, 5*time.Second, 10*time.Millisecond)
+	streams.TryClose(server)
+	require.Eventually(t, func() bool { return r.Waiting("office") == 0 }, 5*time.Second, 10*time.Millisecond)
+
+	// Once forgotten, the session may be registered with another secret
+	SessionRetention = 0
+	openLink(t, r, RoleServer, "office", "other")
+	require.Eventually(t, func() bool { return r.Waiting("office") == 1 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func Test_RelayAddress(t *testing.T) {
+	a, err := ParseAddress(addr.MustParseAddress("relay+wss://relay.example.org/relay?session=office&secret=s3cret&mux-version=2"))
+	require.NoError(t, err)
+	require.Equal(t, "wss://relay.example.org/relay?mux-version=2", a.Transport.String())
+	require.Equal(t, "office", a.Session)
+	require.Equal(t, "s3cret", a.Secret)
+	require.Equal(t, "relay.example.org", a.ServerName)
+	require.NotContains(t, Redact(addr.MustParseAddress("relay+tcp://relay.example.org:9000?session=office&secret=s3cret")), "s3cret")
+
+	_, err = ParseAddress(addr.MustParseAddress("relay+tcp://relay.example.org:9000"))
+	require.Error(t, err)
+	_, err = ParseAddress(addr.MustParseAddress("tcp://relay.example.org:9000?session=office"))
+	require.Error(t, err)
+}
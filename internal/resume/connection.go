@@ -0,0 +1,727 @@
+package resume
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/bokysan/socketace/v2/internal/util/buffers"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxReplay is the maximum number of bytes kept in the replay buffer. Writes block when the peer did not
+	// acknowledge this many bytes.
+	DefaultMaxReplay = 4 * 1024 * 1024
+	// KeepAliveInterval defines how often pings are sent over an otherwise idle physical connection
+	KeepAliveInterval = 10 * time.Second
+	// KeepAliveTimeout defines after how much time without any frames the physical connection is considered dead
+	KeepAliveTimeout = 30 * time.Second
+)
+
+const (
+	frameData  byte = 0x01
+	frameAck   byte = 0x02
+	framePing  byte = 0x03
+	frameClose byte = 0x04
+	// The frames below are only sent while the Connection runs over multiple paths, which means the peer
+	// supports them
+	frameProbe    byte = 0x05
+	frameProbeAck byte = 0x06
+	frameFin      byte = 0x07
+)
+
+const (
+	maxFramePayload = buffers.BufferSize
+	ackThreshold    = 64 * 1024
+)
+
+// ErrDetached is reported to the detach listener when the physical connection went silent
+var ErrDetached = errors.New("Physical connection timed out")
+
+// Connection is a resumable connection. It frames the data written into it with sequence numbers and keeps the
+// data in the (bounded) replay buffer until the peer acknowledges it. When the physical connection breaks, the
+// Connection is "detached": reads and writes block until a new physical connection is attached (see
+// Connection.Attach) and the unacknowledged data is replayed on the new link.
+//
+// The Connection may run over multiple physical connections (paths) at once, see Connection.Join. Each data frame
+// is sent over the idle path with the lowest round-trip time (penalized by the measured loss) and the frames are put
+// back in order by the receiver. When a path is lost, the unacknowledged data is sent again over the remaining ones.
+//
+// As all the logical (smux) streams are multiplexed over the Connection, their data is sequenced and replayed as well.
+type Connection struct {
+	id        string
+	secret    string // proves the ownership of the session when resuming it, see Registry.Create
+	maxReplay int
+	onDetach  func(c *Connection, err error)
+	onClose   func(c *Connection)
+
+	mutex      sync.Mutex
+	cond       *sync.Cond
+	writeMutex sync.Mutex // serializes the calls to Write
+
+	paths         []*path
+	localAddr     net.Addr
+	remoteAddr    net.Addr
+	duplicateLoss float64
+
+	sent     uint64 // number of bytes written by the application
+	flushed  uint64 // number of bytes handed over to the paths
+	acked    uint64 // number of bytes acknowledged by the peer
+	replay   []byte // bytes [acked, sent)
+	received uint64 // number of bytes received from the peer
+	ackSent  uint64 // last acknowledged value sent to the peer
+	readBuf  bytes.Buffer
+
+	pending      map[uint64][]byte // frames received ahead of the missing data, by sequence
+	pendingBytes int
+	fin          uint64 // number of bytes the peer sent in total, valid if finishing is set
+	finishing    bool
+
+	closed bool
+	err    error
+}
+
+// NewConnection will create a new, detached connection. The onDetach callback (if provided) is called each time
+// the last physical connection is lost, while the Connection is not closed.
+func NewConnection(id string, onDetach func(c *Connection, err error)) *Connection {
+	return newConnection(id, onDetach, nil)
+}
+
+// newConnection will create a new, detached connection. The onClose callback (if provided) is called once, when
+// the Connection is closed by either side.
+func newConnection(id string, onDetach func(c *Connection, err error), onClose func(c *Connection)) *Connection {
+	c := &Connection{
+		id:        id,
+		maxReplay: DefaultMaxReplay,
+		onDetach:  onDetach,
+		onClose:   onClose,
+		pending:   make(map[uint64][]byte),
+	}
+	c.cond = sync.NewCond(&c.mutex)
+	go c.keepAlive()
+	return c
+}
+
+func (c *Connection) String() string {
+	return fmt.Sprintf("session[%v]", c.id)
+}
+
+// ID returns the session ID
+func (c *Connection) ID() string {
+	return c.id
+}
+
+// Secret returns the secret of the session, as returned by the server when the session was created
+func (c *Connection) Secret() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.secret
+}
+
+// SetSecret sets the secret the client presents when resuming the session
+func (c *Connection) SetSecret(secret string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.secret = secret
+}
+
+// Received returns the number of bytes received from the peer. The peer will replay everything after this point
+// when the connection is resumed.
+func (c *Connection) Received() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.received
+}
+
+// Attached returns true if the Connection currently runs over at least one physical connection
+func (c *Connection) Attached() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.paths) > 0
+}
+
+// Detach will drop all the physical connections, e.g. when the session stopped responding. The Connection stays
+// open and may be attached to a new physical connection.
+func (c *Connection) Detach(err error) {
+	c.mutex.Lock()
+	if len(c.paths) == 0 {
+		c.mutex.Unlock()
+		return
+	}
+	for _, p := range c.paths {
+		p.gone = true
+		p.close()
+	}
+	c.paths = nil
+	closed := c.closed
+	c.cond.Broadcast()
+	c.mutex.Unlock()
+
+	if !closed {
+		c.detached(err)
+	}
+}
+
+// Attach will (re)attach the Connection to the new physical link. Any previous physical connections will be
+// closed. Data not received by the peer (as reported by peerReceived) will be sent again.
+func (c *Connection) Attach(conn net.Conn, peerReceived uint64) error {
+	return c.attach(conn, peerReceived, false)
+}
+
+// Join will add the physical link to the ones the Connection already runs over. If the Connection is detached,
+// Join is the same as Attach.
+func (c *Connection) Join(conn net.Conn, peerReceived uint64) error {
+	return c.attach(conn, peerReceived, true)
+}
+
+func (c *Connection) attach(conn net.Conn, peerReceived uint64, join bool) error {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return errors.Errorf("Session %v already closed", c.id)
+	}
+	if peerReceived < c.acked {
+		// The peer has acknowledged more data since reporting its position over the new connection. This happens
+		// when a live connection is replaced, so the acknowledged position is the correct one.
+		peerReceived = c.acked
+	}
+	if peerReceived > c.sent {
+		c.mutex.Unlock()
+		return errors.Errorf("Session %v out of sync: peer received %v, acknowledged %v, sent %v",
+			c.id, peerReceived, c.acked, c.sent)
+	}
+
+	if !join || len(c.paths) == 0 {
+		for _, p := range c.paths {
+			p.gone = true
+			p.close()
+		}
+		c.paths = nil
+		c.flushed = peerReceived
+		c.ackSent = c.received
+		c.localAddr = conn.LocalAddr()
+		c.remoteAddr = conn.RemoteAddr()
+	}
+
+	c.replay = c.replay[peerReceived-c.acked:]
+	c.acked = peerReceived
+	p := newPath(conn)
+	c.paths = append(c.paths, p)
+	paths := len(c.paths)
+	pending := len(c.replay)
+	c.cond.Broadcast()
+	c.mutex.Unlock()
+
+	if paths > 1 {
+		log.Debugf("[Session] %v joined by %v, running over %v paths", c, conn.RemoteAddr(), paths)
+	} else {
+		log.Debugf("[Session] %v attached to %v, replaying %v bytes", c, conn.RemoteAddr(), pending)
+	}
+
+	go c.readLoop(p)
+	go c.writeLoop(p)
+
+	return nil
+}
+
+// detach will drop the path if it's still in use
+func (c *Connection) detach(p *path, err error) {
+	c.mutex.Lock()
+	if p.gone {
+		c.mutex.Unlock()
+		return
+	}
+	p.gone = true
+	p.close()
+	for i, x := range c.paths {
+		if x == p {
+			c.paths = append(c.paths[:i], c.paths[i+1:]...)
+			break
+		}
+	}
+	remaining := len(c.paths)
+	if remaining > 0 {
+		// Frames sent over the lost path might never arrive, send everything unacknowledged again
+		c.flushed = c.acked
+		c.localAddr = c.paths[0].conn.LocalAddr()
+		c.remoteAddr = c.paths[0].conn.RemoteAddr()
+	}
+	closed := c.closed
+	c.cond.Broadcast()
+	c.mutex.Unlock()
+
+	if closed {
+		return
+	}
+	if remaining > 0 {
+		log.WithError(err).Infof("[Session] %v lost path to %v, %v remaining: %v", c, p.conn.RemoteAddr(), remaining, err)
+		return
+	}
+	c.detached(err)
+}
+
+// detached is called when the last physical connection has been lost
+func (c *Connection) detached(err error) {
+	log.WithError(err).Infof("[Session] %v detached: %v", c, err)
+	if c.onDetach != nil {
+		c.onDetach(c, err)
+	}
+}
+
+// unflushed returns true if there is data not yet handed over to any of the paths. Expects the mutex to be held.
+func (c *Connection) unflushed() bool {
+	if c.flushed < c.acked {
+		// Acknowledged by the peer over the previous physical connection
+		c.flushed = c.acked
+	}
+	return c.flushed < c.sent
+}
+
+// writing returns true if any of the paths is writing a data frame. Expects the mutex to be held.
+func (c *Connection) writing() bool {
+	for _, p := range c.paths {
+		if p.busy {
+			return true
+		}
+	}
+	return false
+}
+
+// writeLoop will send the data from the replay buffer which was not yet sent, whenever the path is the best idle
+// one. Writes to the physical connection are done here and not in Write, as some physical connections (e.g. pipes)
+// block until the peer reads the data. Write returning only after the peer got the data would allow the peer to
+// respond before the writer is ready to receive the response.
+func (c *Connection) writeLoop(p *path) {
+	for {
+		c.mutex.Lock()
+		for !p.gone && !(c.unflushed() && c.best(true, nil) == p) {
+			c.cond.Wait()
+		}
+		if p.gone {
+			c.mutex.Unlock()
+			return
+		}
+		seq := c.flushed
+		n := c.sent - seq
+		if n > maxFramePayload {
+			n = maxFramePayload
+		}
+		start := seq - c.acked
+		frame := dataFrame(seq, c.replay[start:start+n])
+		c.flushed = seq + n
+		p.busy = true
+		dup := c.duplicate(p)
+		c.mutex.Unlock()
+
+		// Data is in the replay buffer and will be sent again if the frame does not make it
+		err := p.write(frame)
+		var dupErr error
+		if err == nil && dup != nil {
+			dupErr = dup.write(frame)
+		}
+
+		c.mutex.Lock()
+		p.busy = false
+		c.cond.Broadcast()
+		c.mutex.Unlock()
+
+		if dupErr != nil {
+			c.detach(dup, dupErr)
+		}
+		if err != nil {
+			c.detach(p, err)
+			return
+		}
+	}
+}
+
+func (c *Connection) readLoop(p *path) {
+	reader := bufio.NewReaderSize(p.conn, maxFramePayload+16)
+	header := make([]byte, 12)
+	for {
+		frameType, err := reader.ReadByte()
+		if err != nil {
+			c.detach(p, err)
+			return
+		}
+
+		switch frameType {
+		case frameData:
+			if _, err := io.ReadFull(reader, header); err != nil {
+				c.detach(p, err)
+				return
+			}
+			seq := binary.BigEndian.Uint64(header[0:8])
+			length := binary.BigEndian.Uint32(header[8:12])
+			if length > maxFramePayload {
+				c.detach(p, errors.Errorf("Frame too large: %v", length))
+				return
+			}
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(reader, payload); err != nil {
+				c.detach(p, err)
+				return
+			}
+			if err := c.receiveData(p, seq, payload); err != nil {
+				c.detach(p, err)
+				return
+			}
+		case frameAck, frameProbe, frameProbeAck, frameFin:
+			if _, err := io.ReadFull(reader, header[0:8]); err != nil {
+				c.detach(p, err)
+				return
+			}
+			value := binary.BigEndian.Uint64(header[0:8])
+			switch frameType {
+			case frameAck:
+				c.receiveAck(p, value)
+			case frameProbe:
+				c.touch(p)
+				// Don't block the reader while other frames are being written
+				go func() {
+					if err := p.write(seqFrame(frameProbeAck, value)); err != nil {
+						c.detach(p, err)
+					}
+				}()
+			case frameProbeAck:
+				c.probeAnswered(p, value)
+			case frameFin:
+				c.receiveFin(p, value)
+			}
+		case framePing:
+			c.touch(p)
+		case frameClose:
+			log.Debugf("[Session] %v closed by peer", c)
+			c.shutdown(io.EOF)
+			return
+		default:
+			c.detach(p, errors.Errorf("Unknown frame type: %v", frameType))
+			return
+		}
+	}
+}
+
+func (c *Connection) touch(p *path) {
+	c.mutex.Lock()
+	if !p.gone {
+		p.lastSeen = time.Now()
+	}
+	c.mutex.Unlock()
+}
+
+func (c *Connection) receiveData(p *path, seq uint64, payload []byte) error {
+	c.mutex.Lock()
+	if p.gone {
+		c.mutex.Unlock()
+		return nil
+	}
+	p.lastSeen = time.Now()
+
+	end := seq + uint64(len(payload))
+	if seq > c.received {
+		// Arrived ahead of the data sent over the other paths
+		if existing, ok := c.pending[seq]; !ok || len(existing) < len(payload) {
+			if c.pendingBytes+len(payload)-len(existing) > c.maxReplay {
+				c.mutex.Unlock()
+				return errors.Errorf("Too much data received out of order: expected sequence %v, got %v", c.received, seq)
+			}
+			c.pending[seq] = payload
+			c.pendingBytes += len(payload) - len(existing)
+		}
+	} else if end > c.received {
+		c.deliver(seq, payload)
+		c.deliverPending()
+	}
+
+	var ack uint64
+	if c.received-c.ackSent >= ackThreshold {
+		ack = c.received
+		c.ackSent = ack
+	}
+	finished := c.finishing && c.received >= c.fin
+	target := c.best(false, nil)
+	c.mutex.Unlock()
+
+	if finished {
+		log.Debugf("[Session] %v closed by peer", c)
+		c.shutdown(io.EOF)
+		return nil
+	}
+	if ack > 0 && target != nil {
+		// Don't block the reader while other frames are being written
+		go func() {
+			if err := target.write(seqFrame(frameAck, ack)); err != nil {
+				c.detach(target, err)
+			}
+		}()
+	}
+	return nil
+}
+
+// deliver will make the part of the payload not yet received available to the reader. Expects the mutex to be held.
+func (c *Connection) deliver(seq uint64, payload []byte) {
+	c.readBuf.Write(payload[c.received-seq:])
+	c.received = seq + uint64(len(payload))
+	c.cond.Broadcast()
+}
+
+// deliverPending will deliver the frames received out of order, which are not ahead anymore. Expects the mutex to
+// be held.
+func (c *Connection) deliverPending() {
+	for progress := true; progress && len(c.pending) > 0; {
+		progress = false
+		for seq, payload := range c.pending {
+			if seq > c.received {
+				continue
+			}
+			delete(c.pending, seq)
+			c.pendingBytes -= len(payload)
+			if seq+uint64(len(payload)) > c.received {
+				c.deliver(seq, payload)
+				progress = true
+			}
+		}
+	}
+}
+
+func (c *Connection) receiveAck(p *path, ack uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if p.gone {
+		return
+	}
+	p.lastSeen = time.Now()
+	if ack > c.acked && ack <= c.sent {
+		c.replay = c.replay[ack-c.acked:]
+		c.acked = ack
+		c.cond.Broadcast()
+	}
+}
+
+// receiveFin is called when the peer closed the session after sending the given number of bytes. The frames sent
+// over the other paths might still be on their way, so the session is closed once they arrive.
+func (c *Connection) receiveFin(p *path, total uint64) {
+	c.mutex.Lock()
+	if p.gone {
+		c.mutex.Unlock()
+		return
+	}
+	c.fin = total
+	c.finishing = true
+	finished := c.received >= total
+	c.mutex.Unlock()
+
+	if finished {
+		log.Debugf("[Session] %v closed by peer", c)
+		c.shutdown(io.EOF)
+	}
+}
+
+type keepAliveFrame struct {
+	path  *path
+	frame []byte
+}
+
+// keepAlive will ping (or, while running over multiple paths, probe) the peer and drop the paths where the peer
+// stopped responding
+func (c *Connection) keepAlive() {
+	ticker := time.NewTicker(ProbeInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.mutex.Lock()
+		if c.closed {
+			c.mutex.Unlock()
+			return
+		}
+		now := time.Now()
+		multipath := len(c.paths) > 1
+		dead := make([]*path, 0)
+		frames := make([]*keepAliveFrame, 0, len(c.paths)+1)
+		for _, p := range c.paths {
+			silent := now.Sub(p.lastSeen)
+			if silent > KeepAliveTimeout || (multipath && silent > PathTimeout) {
+				dead = append(dead, p)
+				continue
+			}
+			if multipath && now.Sub(p.lastProbe) >= ProbeInterval {
+				if p.probe != 0 {
+					p.probed(0, true)
+					c.cond.Broadcast()
+				}
+				p.probe = uint64(now.UnixNano())
+				p.lastProbe = now
+				frames = append(frames, &keepAliveFrame{path: p, frame: seqFrame(frameProbe, p.probe)})
+			} else if now.Sub(p.lastPing) >= KeepAliveInterval {
+				p.lastPing = now
+				frames = append(frames, &keepAliveFrame{path: p, frame: []byte{framePing}})
+			}
+		}
+		if c.received != c.ackSent {
+			if p := c.best(false, nil); p != nil {
+				c.ackSent = c.received
+				frames = append(frames, &keepAliveFrame{path: p, frame: seqFrame(frameAck, c.received)})
+			}
+		}
+		c.mutex.Unlock()
+
+		for _, p := range dead {
+			c.detach(p, ErrDetached)
+		}
+		for _, f := range frames {
+			if err := f.path.write(f.frame); err != nil {
+				c.detach(f.path, err)
+			}
+		}
+	}
+}
+
+func dataFrame(seq uint64, data []byte) []byte {
+	frame := make([]byte, 13+len(data))
+	frame[0] = frameData
+	binary.BigEndian.PutUint64(frame[1:9], seq)
+	binary.BigEndian.PutUint32(frame[9:13], uint32(len(data)))
+	copy(frame[13:], data)
+	return frame
+}
+
+// Read will read the data received from the peer. It blocks while the Connection is detached.
+func (c *Connection) Read(p []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for c.readBuf.Len() == 0 && !c.closed {
+		c.cond.Wait()
+	}
+	if c.readBuf.Len() == 0 {
+		return 0, c.err
+	}
+	return c.readBuf.Read(p)
+}
+
+// Write will send the data to the peer. Data is stored in the replay buffer until acknowledged and sent in the
+// background. If the replay buffer is full, Write blocks.
+func (c *Connection) Write(p []byte) (written int, err error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	for len(p) > 0 {
+		c.mutex.Lock()
+		for !c.closed && len(c.replay) >= c.maxReplay {
+			c.cond.Wait()
+		}
+		if c.closed {
+			c.mutex.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		n := len(p)
+		if free := c.maxReplay - len(c.replay); n > free {
+			n = free
+		}
+		c.replay = append(c.replay, p[:n]...)
+		c.sent += uint64(n)
+		c.cond.Broadcast()
+		c.mutex.Unlock()
+
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+// shutdown marks the connection closed and closes the physical links
+func (c *Connection) shutdown(err error) {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return
+	}
+	if err == nil {
+		err = io.EOF
+	}
+	c.closed = true
+	c.err = err
+	paths := c.paths
+	for _, p := range paths {
+		p.gone = true
+	}
+	c.paths = nil
+	c.cond.Broadcast()
+	c.mutex.Unlock()
+
+	for _, p := range paths {
+		p.close()
+	}
+	if c.onClose != nil {
+		c.onClose(c)
+	}
+}
+
+// Close will send the pending data, notify the peer that the session is finished and close the physical connections
+func (c *Connection) Close() error {
+	c.mutex.Lock()
+	for !c.closed && len(c.paths) > 0 && (c.unflushed() || c.writing()) {
+		c.cond.Wait()
+	}
+	paths := make([]*path, len(c.paths))
+	copy(paths, c.paths)
+	sent := c.sent
+	closed := c.closed
+	c.mutex.Unlock()
+	if closed {
+		return nil
+	}
+
+	// With a single path the close frame follows the data. Otherwise, the data sent over the other paths might
+	// arrive after it, so the peer is told how much data to wait for.
+	frame := []byte{frameClose}
+	if len(paths) > 1 {
+		frame = seqFrame(frameFin, sent)
+	}
+	for _, p := range paths {
+		if err := p.write(frame); err != nil {
+			log.WithError(err).Debugf("[Session] Could not notify peer about closing %v: %v", c, err)
+		}
+	}
+	c.shutdown(io.EOF)
+	return nil
+}
+
+// Closed returns true if the session has been closed
+func (c *Connection) Closed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closed
+}
+
+func (c *Connection) LocalAddr() net.Addr {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.localAddr
+}
+
+func (c *Connection) RemoteAddr() net.Addr {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.remoteAddr
+}
+
+// SetDeadline is not supported, as the deadlines would interfere with resumption
+func (c *Connection) SetDeadline(t time.Time) error {
+	return nil
+}
+
+// SetReadDeadline is not supported, as the deadlines would interfere with resumption
+func (c *Connection) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline is not supported, as the deadlines would interfere with resumption
+func (c *Connection) SetWriteDeadline(t time.Time) error {
+	return nil
+}
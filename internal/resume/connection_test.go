@@ -0,0 +1,227 @@
+package resume
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func attach(t *testing.T, a, b *Connection) (net.Conn, net.Conn) {
+	p1, p2 := net.Pipe()
+	aReceived, bReceived := a.Received(), b.Received()
+	require.NoError(t, a.Attach(p1, bReceived))
+	require.NoError(t, b.Attach(p2, aReceived))
+	return p1, p2
+}
+
+func waitDetached(t *testing.T, c ...*Connection) {
+	require.Eventually(t, func() bool {
+		for _, x := range c {
+			if x.Attached() {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func Test_ConnectionResume(t *testing.T) {
+	a := NewConnection("test", nil)
+	b := NewConnection("test", nil)
+	defer a.Close()
+	defer b.Close()
+
+	p1, _ := attach(t, a, b)
+
+	_, err := a.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(b, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+
+	// Break the link and write while detached
+	require.NoError(t, p1.Close())
+	waitDetached(t, a, b)
+
+	_, err = a.Write([]byte("world"))
+	require.NoError(t, err)
+
+	attach(t, a, b)
+
+	_, err = io.ReadFull(b, buf)
+	require.NoError(t, err)
+	require.Equal(t, "world", string(buf))
+	require.Equal(t, uint64(10), b.Received())
+}
+
+func Test_ConnectionResumeLargeTransfer(t *testing.T) {
+	a := NewConnection("test", nil)
+	b := NewConnection("test", nil)
+	defer a.Close()
+	defer b.Close()
+
+	data := make([]byte, 1024*1024)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	p1, _ := attach(t, a, b)
+
+	go func() {
+		_, err := a.Write(data)
+		require.NoError(t, err)
+	}()
+
+	received := make([]byte, len(data))
+	_, err = io.ReadFull(b, received[:len(data)/3])
+	require.NoError(t, err)
+
+	require.NoError(t, p1.Close())
+	waitDetached(t, a, b)
+	attach(t, a, b)
+
+	_, err = io.ReadFull(b, received[len(data)/3:])
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data, received), "Data corrupted during resume")
+}
+
+func Test_ConnectionClose(t *testing.T) {
+	a := NewConnection("test", nil)
+	b := NewConnection("test", nil)
+
+	attach(t, a, b)
+
+	require.NoError(t, a.Close())
+	_, err := b.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err)
+	require.True(t, b.Closed())
+
+	_, err = a.Write([]byte("closed"))
+	require.Error(t, err)
+}
+
+func Test_ConnectionOutOfSync(t *testing.T) {
+	a := NewConnection("test", nil)
+	defer a.Close()
+
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+	require.Error(t, a.Attach(p1, 100))
+}
+
+func Test_ConnectionReplace(t *testing.T) {
+	a := NewConnection("test", nil)
+	b := NewConnection("test", nil)
+	defer a.Close()
+	defer b.Close()
+
+	data := make([]byte, 1024*1024)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	attach(t, a, b)
+
+	go func() {
+		_, err := a.Write(data)
+		require.NoError(t, err)
+	}()
+
+	received := make([]byte, len(data))
+	_, err = io.ReadFull(b, received[:len(data)/3])
+	require.NoError(t, err)
+
+	// Replace the physical connection while it's still alive
+	attach(t, a, b)
+
+	_, err = io.ReadFull(b, received[len(data)/3:])
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data, received), "Data corrupted while replacing the connection")
+}
+
+func Test_ConnectionDetach(t *testing.T) {
+	detached := make(chan error, 1)
+	a := NewConnection("test", func(c *Connection, err error) {
+		detached <- err
+	})
+	b := NewConnection("test", nil)
+	defer a.Close()
+	defer b.Close()
+
+	attach(t, a, b)
+	a.Detach(ErrDetached)
+
+	require.Equal(t, ErrDetached, <-detached)
+	require.False(t, a.Attached())
+	require.False(t, a.Closed())
+}
+
+func join(t *testing.T, a, b *Connection) (net.Conn, net.Conn) {
+	p1, p2 := net.Pipe()
+	aReceived, bReceived := a.Received(), b.Received()
+	require.NoError(t, a.Join(p1, bReceived))
+	require.NoError(t, b.Join(p2, aReceived))
+	return p1, p2
+}
+
+func Test_ConnectionMultipath(t *testing.T) {
+	a := NewConnection("test", nil)
+	b := NewConnection("test", nil)
+	defer a.Close()
+	defer b.Close()
+
+	data := make([]byte, 1024*1024)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	attach(t, a, b)
+	p1, _ := join(t, a, b)
+	join(t, a, b)
+	require.Len(t, a.Paths(), 3)
+
+	go func() {
+		_, err := a.Write(data)
+		require.NoError(t, err)
+	}()
+
+	received := make([]byte, len(data))
+	_, err = io.ReadFull(b, received[:len(data)/3])
+	require.NoError(t, err)
+
+	// Losing one of the paths must not lose any data
+	require.NoError(t, p1.Close())
+	require.Eventually(t, func() bool {
+		return len(a.Paths()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	require.True(t, a.Attached())
+
+	_, err = io.ReadFull(b, received[len(data)/3:])
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data, received), "Data corrupted while losing a path")
+}
+
+func Test_ConnectionMultipathClose(t *testing.T) {
+	a := NewConnection("test", nil)
+	b := NewConnection("test", nil)
+
+	attach(t, a, b)
+	join(t, a, b)
+	a.SetDuplicateLoss(0.1)
+
+	data := make([]byte, 256*1024)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	_, err = a.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, a.Close())
+
+	received, err := ioutil.ReadAll(b)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data, received), "Data lost while closing")
+	require.True(t, b.Closed())
+}
@@ -0,0 +1,178 @@
+package resume
+
+import (
+	"encoding/binary"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"net"
+	"sync"
+	"time"
+)
+
+// ProbeInterval defines how often the round-trip time of each path is measured, while the Connection runs over
+// multiple paths
+var ProbeInterval = time.Second
+
+// PathTimeout defines after how much time without any frames a path is considered dead, while the Connection runs
+// over multiple paths. A single path is only dropped after KeepAliveTimeout.
+var PathTimeout = 5 * time.Second
+
+const (
+	// lossPenalty defines how much the probe loss increases the cost of the path
+	lossPenalty = 4
+	// rttWeight and lossWeight are the weights of the new sample in the smoothed round-trip time and loss
+	rttWeight  = 0.125
+	lossWeight = 0.2
+)
+
+// PathInfo describes one of the physical connections the Connection runs over
+type PathInfo struct {
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+	RTT        time.Duration // RTT is the smoothed round-trip time, zero until measured
+	Loss       float64       // Loss is the smoothed ratio of unanswered probes
+}
+
+// path is one of the physical connections the Connection runs over. Apart from the conn, the mutex and the once,
+// the fields are guarded by the Connection mutex.
+type path struct {
+	conn  net.Conn
+	mutex sync.Mutex // serializes the frames written to the physical connection
+	once  sync.Once  // closes the physical connection
+
+	gone      bool // the path has been dropped
+	busy      bool // a data frame is being written
+	lastSeen  time.Time
+	lastPing  time.Time
+	lastProbe time.Time
+	probe     uint64 // nonce of the unanswered probe, zero if none
+	rtt       time.Duration
+	loss      float64
+}
+
+func newPath(conn net.Conn) *path {
+	now := time.Now()
+	return &path{
+		conn:     conn,
+		lastSeen: now,
+		lastPing: now,
+	}
+}
+
+func (p *path) write(frame []byte) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	_, err := p.conn.Write(frame)
+	return err
+}
+
+// close closes the physical connection. It's safe to call it from the concurrent goroutines.
+func (p *path) close() {
+	p.once.Do(func() {
+		streams.TryClose(p.conn)
+	})
+}
+
+// cost estimates how long it takes for a frame to get to the peer over the path
+func (p *path) cost() time.Duration {
+	return time.Duration(float64(p.rtt) * (1 + lossPenalty*p.loss))
+}
+
+// probed records the answer to a probe, or the lack of it
+func (p *path) probed(rtt time.Duration, lost bool) {
+	if lost {
+		p.loss += lossWeight * (1 - p.loss)
+		return
+	}
+	p.loss -= lossWeight * p.loss
+	if p.rtt == 0 {
+		p.rtt = rtt
+	} else {
+		p.rtt += time.Duration(rttWeight * float64(rtt-p.rtt))
+	}
+}
+
+func (p *path) info() PathInfo {
+	return PathInfo{
+		LocalAddr:  p.conn.LocalAddr(),
+		RemoteAddr: p.conn.RemoteAddr(),
+		RTT:        p.rtt,
+		Loss:       p.loss,
+	}
+}
+
+// Paths returns the physical connections the Connection currently runs over
+func (c *Connection) Paths() []PathInfo {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	res := make([]PathInfo, 0, len(c.paths))
+	for _, p := range c.paths {
+		res = append(res, p.info())
+	}
+	return res
+}
+
+// HasPath returns true if the Connection currently runs over the physical connection
+func (c *Connection) HasPath(conn net.Conn) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, p := range c.paths {
+		if p.conn == conn {
+			return true
+		}
+	}
+	return false
+}
+
+// SetDuplicateLoss defines the probe loss ratio at which the data frames sent over a path are sent over the next
+// best path as well. Zero disables the duplication.
+func (c *Connection) SetDuplicateLoss(ratio float64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.duplicateLoss = ratio
+}
+
+// best returns the path with the lowest cost. If idle is set, the paths busy writing are skipped. Expects the mutex
+// to be held.
+func (c *Connection) best(idle bool, except *path) *path {
+	var res *path
+	for _, p := range c.paths {
+		if p == except || (idle && p.busy) {
+			continue
+		}
+		if res == nil || p.cost() < res.cost() {
+			res = p
+		}
+	}
+	return res
+}
+
+// duplicate returns the path to send a copy of the data frames sent over p to, if p is too lossy. Expects the mutex
+// to be held.
+func (c *Connection) duplicate(p *path) *path {
+	if c.duplicateLoss <= 0 || p.loss < c.duplicateLoss {
+		return nil
+	}
+	return c.best(false, p)
+}
+
+// probeAnswered is called when the peer echoed the probe sent over the path
+func (c *Connection) probeAnswered(p *path, nonce uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if p.gone {
+		return
+	}
+	p.lastSeen = time.Now()
+	if nonce != 0 && nonce == p.probe {
+		p.probe = 0
+		p.probed(time.Since(p.lastProbe), false)
+		c.cond.Broadcast()
+	}
+}
+
+func seqFrame(frameType byte, seq uint64) []byte {
+	frame := make([]byte, 9)
+	frame[0] = frameType
+	binary.BigEndian.PutUint64(frame[1:], seq)
+	return frame
+}
@@ -0,0 +1,64 @@
+package resume
+
+import (
+	"github.com/stretchr/testify/require"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_PathScheduling(t *testing.T) {
+	c := &Connection{duplicateLoss: 0.5}
+	c.cond = sync.NewCond(&c.mutex)
+
+	fast, slow := newPath(nil), newPath(nil)
+	fast.probed(10*time.Millisecond, false)
+	slow.probed(30*time.Millisecond, false)
+	c.paths = []*path{slow, fast}
+
+	require.Equal(t, fast, c.best(true, nil))
+	require.Equal(t, slow, c.best(false, fast))
+
+	// Busy paths are skipped, so the frames spill over to the slower path
+	fast.busy = true
+	require.Equal(t, slow, c.best(true, nil))
+	require.Equal(t, fast, c.best(false, nil))
+	fast.busy = false
+
+	// Lost probes make the path more expensive than a slower, reliable one
+	for i := 0; i < 10; i++ {
+		fast.probed(0, true)
+	}
+	require.Equal(t, slow, c.best(true, nil))
+	require.Nil(t, c.duplicate(slow))
+	require.Equal(t, slow, c.duplicate(fast))
+
+	// Answered probes bring it back
+	for i := 0; i < 20; i++ {
+		fast.probed(10*time.Millisecond, false)
+	}
+	require.Equal(t, fast, c.best(true, nil))
+	require.Nil(t, c.duplicate(fast))
+}
+
+func Test_PathProbe(t *testing.T) {
+	a := NewConnection("test", nil)
+	b := NewConnection("test", nil)
+	defer a.Close()
+	defer b.Close()
+
+	p1, p2 := net.Pipe()
+	require.NoError(t, a.Attach(p1, 0))
+	require.NoError(t, b.Attach(p2, 0))
+	join(t, a, b)
+
+	require.Eventually(t, func() bool {
+		for _, p := range a.Paths() {
+			if p.RTT == 0 {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+}
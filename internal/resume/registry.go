@@ -0,0 +1,145 @@
+package resume
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// DefaultGracePeriod is the time the server keeps a detached session alive, waiting for the client to come back
+const DefaultGracePeriod = time.Minute
+
+var (
+	// ErrUnknownSession is returned when the session does not exist (anymore)
+	ErrUnknownSession = errors.New("Unknown session")
+	// ErrSessionOwner is returned when a client tries to resume somebody else's session
+	ErrSessionOwner = errors.New("Session belongs to a different client")
+)
+
+type entry struct {
+	connection *Connection
+	owner      string
+	secret     string
+	timer      *time.Timer
+}
+
+// Registry keeps track of server-side sessions. When a session's physical connection breaks, the session is kept
+// alive for the duration of the grace period. If the client does not resume it in time, the session is closed.
+type Registry struct {
+	GracePeriod time.Duration
+
+	mutex    sync.Mutex
+	sessions map[string]*entry
+}
+
+func NewRegistry(gracePeriod time.Duration) *Registry {
+	return &Registry{
+		GracePeriod: gracePeriod,
+		sessions:    make(map[string]*entry),
+	}
+}
+
+// NewId generates a new random session ID
+func NewId() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(errors.Wrapf(err, "Could not generate session ID"))
+	}
+	return hex.EncodeToString(id)
+}
+
+// Create registers a new session for the given owner. The returned secret must be presented to resume the session.
+func (r *Registry) Create(owner string) (*Connection, string) {
+	e := &entry{
+		owner:  owner,
+		secret: NewId(),
+	}
+	e.connection = newConnection(NewId(), r.detached, r.closed)
+
+	r.mutex.Lock()
+	r.sessions[e.connection.ID()] = e
+	r.mutex.Unlock()
+
+	log.Debugf("[Session] Created %v for %v", e.connection, owner)
+	return e.connection, e.secret
+}
+
+// Resume finds the session with the given ID. The session must belong to the same owner, who must know the secret
+// returned when the session was created.
+func (r *Registry) Resume(id, owner, secret string) (*Connection, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	e, ok := r.sessions[id]
+	if !ok || e.connection.Closed() {
+		return nil, ErrUnknownSession
+	}
+	if e.owner != owner || subtle.ConstantTimeCompare([]byte(e.secret), []byte(secret)) != 1 {
+		return nil, ErrSessionOwner
+	}
+	if e.timer != nil {
+		e.timer.Stop()
+		e.timer = nil
+	}
+	return e.connection, nil
+}
+
+// Len returns the number of sessions currently tracked
+func (r *Registry) Len() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.sessions)
+}
+
+// closed will forget the session, together with the data kept for replaying
+func (r *Registry) closed(c *Connection) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	e, ok := r.sessions[c.ID()]
+	if !ok || e.connection != c {
+		return
+	}
+	if e.timer != nil {
+		e.timer.Stop()
+	}
+	delete(r.sessions, c.ID())
+}
+
+// detached will start the grace period timer for the session
+func (r *Registry) detached(c *Connection, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	e, ok := r.sessions[c.ID()]
+	if !ok {
+		return
+	}
+
+	if r.GracePeriod <= 0 {
+		delete(r.sessions, c.ID())
+		go c.shutdown(err)
+		return
+	}
+
+	if e.timer != nil {
+		e.timer.Stop()
+	}
+	log.Debugf("[Session] Waiting %v for the client to resume %v", r.GracePeriod, c)
+	e.timer = time.AfterFunc(r.GracePeriod, func() {
+		r.mutex.Lock()
+		if current, ok := r.sessions[c.ID()]; !ok || current != e || c.Attached() {
+			r.mutex.Unlock()
+			return
+		}
+		delete(r.sessions, c.ID())
+		r.mutex.Unlock()
+
+		log.Infof("[Session] %v not resumed within %v, closing", c, r.GracePeriod)
+		c.shutdown(errors.Wrapf(err, "Session not resumed within %v", r.GracePeriod))
+	})
+}
@@ -0,0 +1,73 @@
+package resume
+
+import (
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_RegistryResume(t *testing.T) {
+	r := NewRegistry(time.Minute)
+
+	c, secret := r.Create("alice")
+	require.Len(t, c.ID(), 32)
+	require.Len(t, secret, 32)
+	require.Equal(t, 1, r.Len())
+
+	p1, p2 := net.Pipe()
+	require.NoError(t, c.Attach(p1, 0))
+	require.NoError(t, p2.Close())
+	waitDetached(t, c)
+
+	_, err := r.Resume(c.ID(), "bob", secret)
+	require.Equal(t, ErrSessionOwner, err)
+
+	// The ID alone is not enough
+	_, err = r.Resume(c.ID(), "alice", "")
+	require.Equal(t, ErrSessionOwner, err)
+	_, err = r.Resume(c.ID(), "alice", c.ID())
+	require.Equal(t, ErrSessionOwner, err)
+
+	_, err = r.Resume("unknown", "alice", secret)
+	require.Equal(t, ErrUnknownSession, err)
+
+	resumed, err := r.Resume(c.ID(), "alice", secret)
+	require.NoError(t, err)
+	require.Equal(t, c, resumed)
+	require.False(t, c.Closed())
+
+	require.NoError(t, c.Close())
+	require.Equal(t, 0, r.Len())
+}
+
+func Test_RegistryGracePeriod(t *testing.T) {
+	r := NewRegistry(100 * time.Millisecond)
+
+	c, secret := r.Create("alice")
+	p1, p2 := net.Pipe()
+	require.NoError(t, c.Attach(p1, 0))
+	require.NoError(t, p2.Close())
+
+	require.Eventually(t, c.Closed, 5*time.Second, 10*time.Millisecond)
+
+	_, err := r.Resume(c.ID(), "alice", secret)
+	require.Equal(t, ErrUnknownSession, err)
+}
+
+func Test_RegistryClosedByPeer(t *testing.T) {
+	r := NewRegistry(time.Minute)
+
+	c, _ := r.Create("alice")
+	peer := NewConnection(c.ID(), nil)
+	p1, p2 := net.Pipe()
+	require.NoError(t, c.Attach(p1, 0))
+	require.NoError(t, peer.Attach(p2, 0))
+	require.Equal(t, 1, r.Len())
+
+	require.NoError(t, peer.Close())
+	require.Eventually(t, func() bool {
+		return r.Len() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.True(t, c.Closed())
+}
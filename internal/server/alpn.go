@@ -0,0 +1,124 @@
+package server
+
+import (
+	"crypto/tls"
+	"github.com/bokysan/socketace/v2/internal/socketace"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// TlsHandshakeTimeout is the maximum time to complete the TLS handshake of an accepted connection
+var TlsHandshakeTimeout = 10 * time.Second
+
+// withAlpn returns a copy of the TLS configuration advertising SocketAce (first) and the other protocols with ALPN
+func withAlpn(config *tls.Config, protocols ...string) *tls.Config {
+	config = config.Clone()
+	config.NextProtos = append([]string{socketace.AlpnProtocol}, protocols...)
+	return config
+}
+
+// handshake completes the TLS handshake of the accepted connection and returns the negotiated protocol
+func handshake(conn *tls.Conn) (string, error) {
+	if err := conn.SetDeadline(time.Now().Add(TlsHandshakeTimeout)); err != nil {
+		return "", errors.WithStack(err)
+	}
+	if err := conn.Handshake(); err != nil {
+		return "", errors.WithStack(err)
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return conn.ConnectionState().NegotiatedProtocol, nil
+}
+
+// alpnListener completes the TLS handshakes of the accepted connections. The connections which negotiated SocketAce
+// with ALPN are passed to the SocketAce handler, the others are returned by Accept, so that a single TLS listener can
+// serve both SocketAce and HTTP.
+type alpnListener struct {
+	net.Listener
+	config    *tls.Config
+	socketace func(conn net.Conn)
+
+	accepted  chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+func newAlpnListener(ln net.Listener, config *tls.Config, socketace func(conn net.Conn)) *alpnListener {
+	l := &alpnListener{
+		Listener:  ln,
+		config:    config,
+		socketace: socketace,
+		accepted:  make(chan net.Conn),
+		closed:    make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *alpnListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			_ = l.close(err)
+			return
+		}
+		go l.handshake(tls.Server(conn, l.config))
+	}
+}
+
+func (l *alpnListener) handshake(conn *tls.Conn) {
+	protocol, err := handshake(conn)
+	if err != nil {
+		log.WithError(err).Debugf("[Server] TLS handshake with %v failed: %v", conn.RemoteAddr(), err)
+		streams.TryClose(conn)
+		return
+	}
+	if protocol == socketace.AlpnProtocol {
+		log.Debugf("[Server] %v negotiated %v", conn.RemoteAddr(), protocol)
+		l.socketace(conn)
+		return
+	}
+	select {
+	case l.accepted <- conn:
+	case <-l.closed:
+		streams.TryClose(conn)
+	}
+}
+
+// Accept returns the next connection which did not negotiate SocketAce
+func (l *alpnListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accepted:
+		return conn, nil
+	case <-l.closed:
+		if l.err != nil {
+			return nil, l.err
+		}
+		return nil, io.EOF
+	}
+}
+
+func (l *alpnListener) Close() error {
+	return l.close(nil)
+}
+
+// close stops the listener; Accept returns the cause, if any
+func (l *alpnListener) close(cause error) error {
+	var err error
+	l.closeOnce.Do(func() {
+		l.err = cause
+		close(l.closed)
+		err = l.Listener.Close()
+	})
+	return err
+}
@@ -3,74 +3,90 @@ package server
 import (
 	"encoding/json"
 	"fmt"
-	"github.com/armon/go-socks5"
+	"github.com/bokysan/socketace/v2/internal/shaping"
+	"github.com/bokysan/socketace/v2/internal/socketace"
 	"github.com/bokysan/socketace/v2/internal/streams"
 	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/bokysan/socketace/v2/internal/util/auth"
 	"github.com/davecgh/go-spew/spew"
 	"github.com/hashicorp/go-multierror"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
-	"io"
 	"net"
 	"regexp"
+	"strings"
+	"sync"
 )
 
 type Channel interface {
 	fmt.Stringer
 	Name() string
-	OpenConnection() (net.Conn, error)
+	// OpenConnection will connect to the channel. The metadata describes the original client connection, if the
+	// client sent it.
+	OpenConnection(metadata *socketace.StreamMetadata) (net.Conn, error)
+	// Allowed returns true if the client with the given identity may use this channel
+	Allowed(identity *auth.Identity) bool
+	// TrustsMetadata returns true if the stream metadata sent by the client with the given identity may be used
+	TrustsMetadata(identity *auth.Identity) bool
+	// Shaper returns the rate limits and the priority of the streams of this channel
+	Shaper() *shaping.Shaper
+}
+
+// TargetChannel is a channel the client selects along with a target, e.g. `/name/example.org:22`
+type TargetChannel interface {
+	Channel
+	// Permits returns true if the client may use the target
+	Permits(target string) bool
+}
+
+// channelTarget returns the target from the selected protocol, if the protocol is a selection of the channel
+func channelTarget(channel Channel, protocol string) (string, bool) {
+	prefix := "/" + channel.Name() + "/"
+	if !strings.HasPrefix(protocol, prefix) || len(protocol) == len(prefix) {
+		return "", false
+	}
+	return protocol[len(prefix):], true
 }
 
 type AbstractChannel struct {
 	addr.ProtoName `yaml:",inline"`
 	Address        addr.ProtoAddress `json:"address"`
+	Allow          auth.Rules        `json:"allow"`
+	TrustMetadata  auth.Rules        `json:"trustMetadata"`
+	shaping.Policy `yaml:",inline"`
+
+	shaper     *shaping.Shaper
+	shaperOnce sync.Once
 }
 
 func (u *AbstractChannel) Name() string {
 	return u.ProtoName.Name
 }
 
-type SocksChannel struct {
-	AbstractChannel
+// Allowed checks the identity against the list of access rules. If no rules are defined, everybody is allowed.
+func (u *AbstractChannel) Allowed(identity *auth.Identity) bool {
+	return u.Allow.Allows(identity)
 }
 
-func (u *SocksChannel) String() string {
-	return fmt.Sprintf("%v:%v", u.Name(), "socks")
+// TrustsMetadata checks the identity against the list of metadata rules. Unlike Allowed, nobody is trusted if no
+// rules are defined.
+func (u *AbstractChannel) TrustsMetadata(identity *auth.Identity) bool {
+	return len(u.TrustMetadata) > 0 && u.TrustMetadata.Allows(identity)
 }
 
-func (u *SocksChannel) OpenConnection() (net.Conn, error) {
-	conf := &socks5.Config{}
-	server, err := socks5.New(conf)
-	if err != nil {
-		return nil, errors.Wrapf(err, "Could not configure a socks proxy!")
-	}
-
-	p1Reader, p1Writer := io.Pipe()
-	p2Reader, p2Writer := io.Pipe()
-	p1 := streams.NewReadWriteCloser(p1Reader, p2Writer)
-	p2 := streams.NewReadWriteCloser(p2Reader, p1Writer)
-
-	var clientPipe streams.Connection
-	var serverPipe streams.Connection
-
-	clientPipe = streams.NewSimulatedConnection(p1, streams.Localhost, streams.Localhost)
-	serverPipe = streams.NewSimulatedConnection(p2, streams.Localhost, streams.Localhost)
-
-	clientPipe = streams.NewNamedConnection(clientPipe, u.String())
-
-	go func() {
-		defer streams.TryClose(serverPipe)
-		if err := server.ServeConn(serverPipe); err != nil {
-			log.WithError(err).Errorf("Error processing SOCKS connection: %v", err)
-		}
-	}()
-
-	return clientPipe, nil
+// Shaper returns the limits of the channel, shared by all its streams
+func (u *AbstractChannel) Shaper() *shaping.Shaper {
+	u.shaperOnce.Do(func() {
+		u.shaper = shaping.NewShaper(u.Policy)
+	})
+	return u.shaper
 }
 
 // Channel is a configuration of one of the server that are going to be multiplexed in the connection
 type NetworkChannel struct {
 	AbstractChannel
+	// ProxyProtocol is the version of the PROXY protocol header sent to the upstream server before any data
+	ProxyProtocol ProxyProtocol `json:"proxyProtocol"`
 }
 
 func (u *NetworkChannel) String() string {
@@ -78,27 +94,34 @@ func (u *NetworkChannel) String() string {
 }
 
 // OpenConnection will open a connection the the upstream server
-func (u *NetworkChannel) OpenConnection() (net.Conn, error) {
+func (u *NetworkChannel) OpenConnection(metadata *socketace.StreamMetadata) (net.Conn, error) {
 	scheme := u.Address.Scheme
 	switch scheme {
 	case "udp", "udp4", "udp6", "unixgram":
-		return nil, errors.Errorf("Packet connections (%v) are not yet supported", scheme)
+		return nil, errors.Errorf("Packet connections (%v) need a datagram channel", scheme)
 	}
 
 	conn, err := net.Dial(u.Address.Scheme, u.Address.Host)
 	if err != nil {
 		err = errors.Wrapf(err, "Remote connection failed to %v", u.Address)
 		log.WithError(err).Errorf("Could not connect to %v: %+v", u.Address, err)
+		return nil, err
 	}
 	conn = streams.NewNamedConnection(conn, u.String())
 
+	if err := u.ProxyProtocol.WriteHeader(conn, metadata); err != nil {
+		streams.TryClose(conn)
+		return nil, err
+	}
+
 	log.Tracef("[Channel] Connected to %v", conn)
 	return conn, err
 }
 
 // ------ // ------ // ------ // ------ // ------ // ------ // ------ //
 
-var ChannelRegex = regexp.MustCompile("^(/[a-z0-9_^/]*)->((tcp|udp|unix|unixgram|unixpacket):(.*))$")
+// ChannelRegex matches the channel flag, e.g. `ssh->tcp:127.0.0.1:22` or `dns->udp://127.0.0.1:53`
+var ChannelRegex = regexp.MustCompile("^/?([a-z0-9_^/-]+)->((tcp|udp|unix|unixgram|unixpacket):(.*))$")
 
 type Channels []Channel
 
@@ -134,6 +157,17 @@ func (chl *Channels) Filter(names []string) (Channels, error) {
 	return upstreams, errs
 }
 
+// Allowed will return the list of channels the client with the given identity may use
+func (chl *Channels) Allowed(identity *auth.Identity) Channels {
+	res := make(Channels, 0)
+	for _, ch := range *chl {
+		if ch.Allowed(identity) {
+			res = append(res, ch)
+		}
+	}
+	return res
+}
+
 // Find finds an endpoint by name (case sensitive). If the
 // endpoint does not exist, it returns an error
 func (chl *Channels) Find(name string) (Channel, error) {
@@ -154,20 +188,24 @@ func (chl *Channels) UnmarshalFlag(endpoint string) error {
 		return errors.Errorf("Channel '%s' does not match %s!", endpoint, ChannelRegex.String())
 	}
 
-	parts := ChannelRegex.FindAllStringSubmatch(endpoint, -1)[0]
+	parts := ChannelRegex.FindStringSubmatch(endpoint)
 
-	address, err := addr.ParseAddress(parts[1])
+	// Both `tcp:127.0.0.1:22` and `tcp://127.0.0.1:22` are accepted
+	address, err := addr.ParseAddress(parts[3] + "://" + strings.TrimPrefix(parts[4], "//"))
 	if err != nil {
 		return err
 	}
 
-	e := &NetworkChannel{
-		AbstractChannel: AbstractChannel{
-			ProtoName: addr.ProtoName{
-				Name: parts[0],
-			},
-			Address: *address,
-		},
+	name := addr.ProtoName{
+		Name: parts[1],
+	}
+
+	var e Channel
+	switch parts[3] {
+	case "udp", "unixgram":
+		e = &DatagramChannel{AbstractChannel: AbstractChannel{ProtoName: name, Address: *address}}
+	default:
+		e = &NetworkChannel{AbstractChannel: AbstractChannel{ProtoName: name, Address: *address}}
 	}
 
 	*chl = append(*chl, e)
@@ -237,6 +275,16 @@ func unmarshalChannel(s interface{}) (Channel, error) {
 		channel = &SocksChannel{}
 	case "tcp", "unix", "unixpacket":
 		channel = &NetworkChannel{}
+	case "udp", "udp4", "udp6", "unixgram":
+		channel = &DatagramChannel{}
+	case "dynamic":
+		channel = &DynamicChannel{}
+	case "reverse":
+		channel = &ReverseChannel{}
+	case "hub":
+		channel = &HubChannel{}
+	case "vpn":
+		channel = &VpnChannel{}
 	default:
 		return nil, errors.Errorf("Unknown channel type: %s", address.Scheme)
 	}
@@ -1,23 +1,29 @@
 package server
 
 import (
+	"github.com/bokysan/socketace/v2/internal/resume"
+	"github.com/bokysan/socketace/v2/internal/shaping"
 	"github.com/bokysan/socketace/v2/internal/socketace"
 	"github.com/bokysan/socketace/v2/internal/streams"
-	"github.com/bokysan/socketace/v2/internal/util/buffers"
+	"github.com/bokysan/socketace/v2/internal/util/auth"
 	"github.com/bokysan/socketace/v2/internal/util/cert"
 	"github.com/multiformats/go-multistream"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/xtaci/smux"
 	"io"
+	"math"
 	"net"
 	"os"
 	"strings"
 )
 
-func AcceptConnection(conn net.Conn, manager cert.TlsConfig, secure bool, channels Channels) error {
+// Sessions keeps the resumable sessions of all the servers, so that the client may resume the session over any of them
+var Sessions = resume.NewRegistry(resume.DefaultGracePeriod)
+
+func AcceptConnection(conn net.Conn, manager cert.TlsConfig, secure bool, authenticator auth.Authenticator, mux *socketace.MuxConfig, channels Channels) error {
 	log.Tracef("Establishing SocketAce connection...")
-	server, err := socketace.NewServerConnection(conn, manager, secure)
+	server, err := socketace.NewServerConnection(conn, manager, secure, authenticator, mux)
 	if err != nil {
 		if !strings.Contains(err.Error(), "use of closed network connection") {
 			log.WithError(err).Errorf("Could not negotiate connection: %v", err)
@@ -28,10 +34,33 @@ func AcceptConnection(conn net.Conn, manager cert.TlsConfig, secure bool, channe
 		return err
 	}
 
+	var connection net.Conn = server
+	keepAlive := true
+	if server.HasCapability(socketace.CapabilityResume) {
+		session, resumed, err := acceptSession(server)
+		if err != nil {
+			log.WithError(err).Errorf("Could not negotiate session: %v", err)
+			streams.TryClose(server)
+			return err
+		} else if resumed {
+			// The existing connection handler will continue serving the session
+			return nil
+		}
+		connection = session
+		// Liveness is checked by the session itself, so that smux does not kill the detached session
+		keepAlive = false
+	}
+
 	connectionHandler := &ConnectionHandler{
-		channels: channels,
+		channels:  channels,
+		identity:  server.Identity(),
+		keepAlive: keepAlive,
+		mux:       server.Mux(),
+		scheduler: shaping.NewScheduler(),
+		metadata:  server.HasCapability(socketace.CapabilityMetadata),
+		peer:      socketace.NewStreamMetadata(server),
 	}
-	if err := connectionHandler.HandleConnection(server); err != nil {
+	if err := connectionHandler.HandleConnection(connection); err != nil {
 		log.WithError(err).Errorf("Could not handle connection: %v", err)
 		if conn != nil {
 			streams.TryClose(conn)
@@ -42,16 +71,71 @@ func AcceptConnection(conn net.Conn, manager cert.TlsConfig, secure bool, channe
 	return nil
 }
 
+// acceptSession will either create a new resumable session or attach the connection to an existing one. It returns
+// true if an existing session was resumed (or joined by an additional path).
+func acceptSession(server *socketace.ServerConnection) (*resume.Connection, bool, error) {
+	owner := server.Identity().String()
+	var session *resume.Connection
+	var peerReceived uint64
+
+	conn, negotiated, err := socketace.AcceptSession(server, func(requested *socketace.Session) (*socketace.Session, error) {
+		if requested.Join && !server.HasCapability(socketace.CapabilityMultipath) {
+			return nil, errors.Errorf("Multipath not negotiated, can't join session %v", requested.Id)
+		}
+		if requested.Id != "" {
+			if s, err := Sessions.Resume(requested.Id, owner, requested.Secret); err == nil {
+				session = s
+				peerReceived = requested.Received
+				return &socketace.Session{Id: s.ID(), Received: s.Received(), Resumed: true, Join: requested.Join}, nil
+			} else if err != resume.ErrUnknownSession || requested.Join {
+				return nil, err
+			}
+			log.Infof("[Server] Session %v expired, starting a new one", requested.Id)
+		}
+		var secret string
+		session, secret = Sessions.Create(owner)
+		return &socketace.Session{Id: session.ID(), Secret: secret}, nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	if negotiated.Join {
+		err = session.Join(conn, peerReceived)
+	} else {
+		err = session.Attach(conn, peerReceived)
+	}
+	if err != nil {
+		streams.TryClose(conn)
+		return nil, false, errors.Wrapf(err, "Could not attach to session %v", session.ID())
+	}
+	if negotiated.Join {
+		log.Infof("[Server] Session %v joined by %v", session.ID(), conn.RemoteAddr())
+	} else if negotiated.Resumed {
+		log.Infof("[Server] Session %v resumed", session.ID())
+	}
+	return session, negotiated.Resumed, nil
+}
+
 // ConnectionHandler will overlay a logical connection multiplexer over a pyhisical line
 type ConnectionHandler struct {
-	session  *smux.Session
-	channels Channels
+	session   *smux.Session
+	channels  Channels
+	identity  *auth.Identity
+	keepAlive bool
+	mux       *socketace.MuxConfig
+	scheduler *shaping.Scheduler
+	metadata  bool                      // the client sends the stream metadata after selecting the channel
+	peer      *socketace.StreamMetadata // peer describes the physical connection of the client
 }
 
 // Create a logical mutex session of a pyhisical link
 func (ch *ConnectionHandler) HandleConnection(conn net.Conn) (err error) {
-	config := smux.DefaultConfig()
-	config.MaxFrameSize = buffers.BufferSize - 128
+	config := ch.mux.Smux()
+	if !ch.keepAlive {
+		// Never time out, the resumable session takes care of the physical connection
+		config.KeepAliveTimeout = math.MaxInt64
+	}
 	ch.session, err = smux.Server(conn, config)
 
 	if err != nil {
@@ -61,6 +145,14 @@ func (ch *ConnectionHandler) HandleConnection(conn net.Conn) (err error) {
 		return errors.WithStack(err)
 	}
 
+	if log.IsLevelEnabled(log.DebugLevel) {
+		names := make([]string, 0)
+		for _, u := range ch.channels.Allowed(ch.identity) {
+			names = append(names, u.Name())
+		}
+		log.Debugf("[Server] Client %v may access channels: %v", ch.identity, names)
+	}
+
 	go ch.acceptStream()
 
 	return
@@ -83,34 +175,98 @@ func (ch *ConnectionHandler) acceptStream() {
 		stream = streams.NewNamedConnection(stream, stream.RemoteAddr().String())
 		log.Debugf("[Server] New logical connection accepted: %v", stream)
 
-		if err = ch.multiplexToUpstream(stream); err != nil {
-			log.WithError(err).Errorf("Error selecting multichannel stream: %v", err)
-			streams.TryClose(stream)
-		}
+		// Serve the streams concurrently, a long-lived stream must not block the others (e.g. health probes)
+		go func(stream net.Conn) {
+			if err := ch.multiplexToUpstream(stream); err != nil {
+				log.WithError(err).Errorf("Error selecting multichannel stream: %v", err)
+				streams.TryClose(stream)
+			}
+		}(stream)
 	}
 }
 
 func (ch *ConnectionHandler) muxHandler(protocol string, downstreamConnection io.ReadWriteCloser) error {
-	for _, channel := range ch.channels {
-		if protocol == "/"+channel.Name() {
-			log.Debugf("[Upstream] Opening connection to upstream: %v", channel.String())
-			upstreamConnection, err := channel.OpenConnection()
-			if err != nil {
+	for _, channel := range ch.channels.Allowed(ch.identity) {
+		_, isTarget := channel.(TargetChannel)
+		var target string
+		if isTarget {
+			var ok bool
+			if target, ok = channelTarget(channel, protocol); !ok {
+				continue
+			}
+		} else if protocol != "/"+channel.Name() {
+			continue
+		}
+
+		var metadata *socketace.StreamMetadata
+		if ch.metadata {
+			var err error
+			if metadata, err = socketace.ReadStreamMetadata(downstreamConnection); err != nil {
 				return err
 			}
-			return streams.PipeData(downstreamConnection, upstreamConnection)
+			log.Debugf("[Upstream] Stream opened for %v", metadata.Source)
+		}
+		if !channel.TrustsMetadata(ch.identity) {
+			// The client could claim to be anybody, so pass on the address it connected from
+			metadata = ch.peer
 		}
+		if reverse, ok := channel.(*ReverseChannel); ok {
+			return ch.serveReverse(reverse, target, downstreamConnection)
+		} else if hub, ok := channel.(*HubChannel); ok {
+			return ch.relayHub(hub, target, downstreamConnection)
+		} else if v, ok := channel.(*VpnChannel); ok {
+			return ch.serveVpn(v, downstreamConnection)
+		}
+
+		log.Debugf("[Upstream] Opening connection to upstream: %v", channel.String())
+		var upstreamConnection net.Conn
+		var err error
+		if dynamic, ok := channel.(*DynamicChannel); ok {
+			upstreamConnection, err = dynamic.OpenTarget(target, metadata)
+		} else {
+			upstreamConnection, err = channel.OpenConnection(metadata)
+		}
+		if err != nil {
+			return err
+		}
+		return streams.PipeData(channel.Shaper().Server(downstreamConnection, ch.scheduler), upstreamConnection)
 	}
 	return errors.Errorf("Uknown protocol %s", protocol)
 }
 
+// healthHandler will echo back everything the client sends, so the client can measure the round-trip time
+func (ch *ConnectionHandler) healthHandler(protocol string, conn io.ReadWriteCloser) error {
+	_, err := io.Copy(conn, conn)
+	return errors.WithStack(err)
+}
+
 // Create a multistream to let the client choose an appropriate solution
 func (ch *ConnectionHandler) multiplexToUpstream(multiplexChannel net.Conn) error {
 	mux := multistream.NewMultistreamMuxer()
 	log.Tracef("[Server] Connection muxer created for %v", multiplexChannel)
 	for _, u := range ch.channels {
+		if hub, ok := u.(*HubChannel); ok && hub.MayPublish(ch.identity) {
+			prefix := socketace.PublishProtocol + "/" + hub.Name() + "/"
+			mux.AddHandlerWithFunc(prefix, func(protocol string) bool {
+				return strings.HasPrefix(protocol, prefix) && len(protocol) > len(prefix)
+			}, ch.publishHandler(hub))
+		}
+		if !u.Allowed(ch.identity) {
+			log.Tracef("[Server] Channel %v not allowed for %v", u.Name(), ch.identity)
+			continue
+		}
+		if tc, ok := u.(TargetChannel); ok {
+			// The client names the target in the protocol, e.g. `/name/example.org:22`. The targets which are not
+			// permitted are refused, so the client sees the channel as not supported.
+			mux.AddHandlerWithFunc("/"+u.Name(), func(protocol string) bool {
+				target, ok := channelTarget(tc, protocol)
+				return ok && tc.Permits(target)
+			}, ch.muxHandler)
+			continue
+		}
 		mux.AddHandler("/"+u.Name(), ch.muxHandler)
 	}
+	mux.AddHandler(socketace.HealthProtocol, ch.healthHandler)
 
 	defer func() {
 		if err := streams.LogClose(multiplexChannel); err != nil {
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"github.com/bokysan/socketace/v2/internal/shaping"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/bokysan/socketace/v2/internal/util/auth"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startEcho starts a TCP service which sends back everything it receives and returns its address
+func startEcho(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		streams.TryClose(l)
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer streams.TryClose(conn)
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// openStream will select the protocol on a new stream of an anonymous client and return the client side of the stream
+func openStream(t *testing.T, channels Channels, protocol string) net.Conn {
+	ch := &ConnectionHandler{
+		channels:  channels,
+		identity:  &auth.Identity{},
+		scheduler: shaping.NewScheduler(),
+	}
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		streams.TryClose(client)
+	})
+	go func() {
+		if err := ch.muxHandler(protocol, server); err != nil {
+			streams.TryClose(server)
+		}
+	}()
+	return client
+}
+
+func Test_ChannelRateLimit(t *testing.T) {
+	channel := &NetworkChannel{
+		AbstractChannel: AbstractChannel{
+			ProtoName: addr.ProtoName{Name: "echo"},
+			Address:   addr.MustParseAddress("tcp://" + startEcho(t)),
+			Policy: shaping.Policy{
+				DownloadLimit: 64 * 1024,
+				Priority:      shaping.Bulk,
+			},
+		},
+	}
+	conn := openStream(t, Channels{channel}, "/echo")
+
+	// 64kB pass in the initial burst, the other 64kB take a second
+	data := make([]byte, 128*1024)
+	start := time.Now()
+	go func() {
+		_, _ = conn.Write(data)
+	}()
+	_, err := io.ReadFull(conn, make([]byte, len(data)))
+	require.NoError(t, err)
+
+	elapsed := time.Since(start)
+	require.Greater(t, int64(elapsed), int64(800*time.Millisecond))
+	require.Less(t, int64(elapsed), int64(3*time.Second))
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"fmt"
+	"github.com/bokysan/socketace/v2/internal/socketace"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/bokysan/socketace/v2/internal/util/duration"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"time"
+)
+
+// DatagramChannel forwards the datagrams to a UDP or unixgram service, e.g. `udp://10.0.0.53:53`. Each stream is a
+// separate flow with its own socket on the server, so the replies find their way back to the client which sent the
+// request, like a NAT would do. The datagrams are framed on the stream with streams.WriteDatagram. The flow is closed
+// after IdleTimeout without any datagrams.
+type DatagramChannel struct {
+	AbstractChannel
+	IdleTimeout duration.Duration `json:"idleTimeout"`
+}
+
+func (u *DatagramChannel) String() string {
+	return fmt.Sprintf("%v->%v", u.Name(), u.Address.String())
+}
+
+// OpenConnection will open a new flow to the service
+func (u *DatagramChannel) OpenConnection(metadata *socketace.StreamMetadata) (net.Conn, error) {
+	conn, err := u.dial()
+	if err != nil {
+		err = errors.Wrapf(err, "Remote connection failed to %v", u.Address)
+		log.WithError(err).Errorf("Could not connect to %v: %+v", u.Address, err)
+		return nil, err
+	}
+
+	timeout := time.Duration(u.IdleTimeout)
+	if timeout == 0 {
+		timeout = streams.DefaultIdleTimeout
+	}
+	log.Tracef("[Channel] Datagram flow %v -> %v", conn.LocalAddr(), u.Address.String())
+	return streams.NewNamedConnection(streams.NewDatagramConnection(conn, timeout), u.String()), nil
+}
+
+func (u *DatagramChannel) dial() (net.Conn, error) {
+	if !streams.IsDatagramNetwork(u.Address.Scheme) {
+		return nil, errors.Errorf("Can't handle format: %s", u.Address.Scheme)
+	}
+	address := u.Address.Host
+	if u.Address.Scheme == "unixgram" && address == "" {
+		address = u.Address.Path
+	}
+	return streams.DialDatagram(u.Address.Scheme, address)
+}
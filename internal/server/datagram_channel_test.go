@@ -0,0 +1,157 @@
+package server
+
+import (
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// datagramEcho echoes the datagrams back to the sender
+func datagramEcho(conn net.PacketConn) {
+	buf := make([]byte, streams.MaxDatagramSize)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		_, _ = conn.WriteTo(buf[:n], from)
+	}
+}
+
+func Test_DatagramChannel(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go datagramEcho(echo)
+
+	chl := &Channels{}
+	require.NoError(t, chl.UnmarshalJSON([]byte(`[{
+		"name": "dns",
+		"address": "udp://`+echo.LocalAddr().String()+`",
+		"idleTimeout": "200ms"
+	}]`)))
+	c, ok := (*chl)[0].(*DatagramChannel)
+	require.True(t, ok)
+
+	// Each flow gets its own socket, so the replies don't get mixed up
+	first, err := c.OpenConnection(nil)
+	require.NoError(t, err)
+	defer first.Close()
+	second, err := c.OpenConnection(nil)
+	require.NoError(t, err)
+	defer second.Close()
+
+	require.NoError(t, streams.WriteDatagram(first, []byte("first")))
+	require.NoError(t, streams.WriteDatagram(second, []byte("second")))
+
+	p := make([]byte, 16)
+	n, err := streams.ReadDatagram(second, p)
+	require.NoError(t, err)
+	require.Equal(t, "second", string(p[:n]))
+	n, err = streams.ReadDatagram(first, p)
+	require.NoError(t, err)
+	require.Equal(t, "first", string(p[:n]))
+
+	// The flow is closed when idle
+	_, err = first.Read(p)
+	require.Equal(t, io.EOF, err)
+}
+
+func Test_DatagramChannelStream(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go datagramEcho(echo)
+
+	channel := &DatagramChannel{
+		AbstractChannel: AbstractChannel{
+			ProtoName: addr.ProtoName{Name: "dns"},
+			Address:   addr.MustParseAddress("udp://" + echo.LocalAddr().String()),
+		},
+	}
+
+	// The stream carries the framed datagrams, also the empty ones
+	conn := openStream(t, Channels{channel}, "/dns")
+	buf := make([]byte, 1024)
+	for _, datagram := range []string{"first", "", "third"} {
+		require.NoError(t, streams.WriteDatagram(conn, []byte(datagram)))
+		n, err := streams.ReadDatagram(conn, buf)
+		require.NoError(t, err)
+		require.Equal(t, datagram, string(buf[:n]))
+	}
+}
+
+func Test_DatagramChannelUnixgram(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socketace")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "echo.sock")
+	echo, err := net.ListenPacket("unixgram", path)
+	require.NoError(t, err)
+	defer echo.Close()
+	go datagramEcho(echo)
+
+	c := &DatagramChannel{}
+	c.Address.Scheme = "unixgram"
+	c.Address.Path = path
+
+	conn, err := c.OpenConnection(nil)
+	require.NoError(t, err)
+	require.NoError(t, streams.WriteDatagram(conn, []byte("hello")))
+	p := make([]byte, 16)
+	n, err := streams.ReadDatagram(conn, p)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(p[:n]))
+
+	// The local socket is removed with the flow
+	local := conn.LocalAddr().String()
+	require.NoError(t, conn.Close())
+	_, err = os.Stat(local)
+	require.True(t, os.IsNotExist(err))
+}
+
+func Test_DatagramChannelConfig(t *testing.T) {
+	chl := &Channels{}
+	require.NoError(t, chl.UnmarshalJSON([]byte(`[{"name":"syslog","address":"unixgram:///dev/log"}]`)))
+	_, ok := (*chl)[0].(*DatagramChannel)
+	require.True(t, ok)
+	require.Error(t, chl.UnmarshalJSON([]byte(`[{"name":"dns","address":"udp://127.0.0.1:53","idleTimeout":"soon"}]`)))
+}
+
+func Test_DatagramChannelFlag(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go datagramEcho(echo)
+
+	chl := &Channels{}
+	require.NoError(t, chl.UnmarshalFlag("dns->udp:"+echo.LocalAddr().String()))
+	require.NoError(t, chl.UnmarshalFlag("/ssh->tcp://127.0.0.1:22"))
+	require.Error(t, chl.UnmarshalFlag("->tcp:127.0.0.1:22"))
+	require.Error(t, chl.UnmarshalFlag("ssh->http:127.0.0.1:80"))
+	require.Len(t, *chl, 2)
+
+	c, ok := (*chl)[0].(*DatagramChannel)
+	require.True(t, ok)
+	require.Equal(t, "dns", c.Name())
+	network, ok := (*chl)[1].(*NetworkChannel)
+	require.True(t, ok)
+	require.Equal(t, "ssh", network.Name())
+	require.Equal(t, "127.0.0.1:22", network.Address.Host)
+
+	conn, err := c.OpenConnection(nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, streams.WriteDatagram(conn, []byte("query")))
+	p := make([]byte, 16)
+	n, err := streams.ReadDatagram(conn, p)
+	require.NoError(t, err)
+	require.Equal(t, "query", string(p[:n]))
+}
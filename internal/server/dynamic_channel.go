@@ -0,0 +1,232 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bokysan/socketace/v2/internal/socketace"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DynamicResolveTimeout is the maximum time to resolve the host name of a dynamic channel target
+var DynamicResolveTimeout = 5 * time.Second
+
+// Network is a CIDR network, e.g. `10.0.0.0/8`. A single IP is a network of its own.
+type Network struct {
+	*net.IPNet
+}
+
+func (n *Network) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.WithStack(err)
+	}
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return errors.Errorf("Invalid network: %v", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		n.IPNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		return nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid network: %v", s)
+	}
+	n.IPNet = network
+	return nil
+}
+
+// PortRange is a single port (e.g. `22`) or a range of ports (e.g. `8000-8100`)
+type PortRange struct {
+	From int
+	To   int
+}
+
+func (pr *PortRange) UnmarshalJSON(b []byte) error {
+	var val interface{}
+	if err := json.Unmarshal(b, &val); err != nil {
+		return errors.WithStack(err)
+	}
+	s := strings.TrimSpace(fmt.Sprint(val))
+	from, to := s, s
+	if i := strings.Index(s, "-"); i > 0 {
+		from, to = s[:i], s[i+1:]
+	}
+	var err error
+	if pr.From, err = strconv.Atoi(strings.TrimSpace(from)); err != nil {
+		return errors.Errorf("Invalid port range: %v", s)
+	}
+	if pr.To, err = strconv.Atoi(strings.TrimSpace(to)); err != nil {
+		return errors.Errorf("Invalid port range: %v", s)
+	}
+	if pr.From < 1 || pr.To > 65535 || pr.From > pr.To {
+		return errors.Errorf("Invalid port range: %v", s)
+	}
+	return nil
+}
+
+func (pr PortRange) contains(port int) bool {
+	return port >= pr.From && port <= pr.To
+}
+
+// Destinations are the allowlists of the targets. Without any Networks, the host must match any of the Hosts
+// patterns. If Networks are defined, the host must resolve to an IP within any of them -- the hosts matching the
+// Hosts patterns as well -- and only the addresses within the Networks are dialed. The port must be within any of
+// the Ports ranges (any port, if no ranges are defined).
+type Destinations struct {
+	Networks []Network   `json:"networks"`
+	Hosts    []string    `json:"hosts"`
+	Ports    []PortRange `json:"ports"`
+}
+
+// DynamicChannel lets the client choose the target (`host:port`) when selecting the channel, e.g. `/internal/db:5432`
+// for the channel `internal`. Only the Destinations may be reached.
+type DynamicChannel struct {
+	AbstractChannel
+	Destinations
+	ProxyProtocol ProxyProtocol `json:"proxyProtocol"`
+}
+
+func (u *DynamicChannel) String() string {
+	return fmt.Sprintf("%v->%v", u.Name(), "dynamic")
+}
+
+// Permits returns true if the name and the port of the target are allowed. The addresses the name resolves to are
+// checked when the connection is opened.
+func (u *DynamicChannel) Permits(target string) bool {
+	_, _, err := u.check(target)
+	if err != nil {
+		log.WithError(err).Debugf("[Channel] Target %v of %v not permitted: %v", target, u.Name(), err)
+	}
+	return err == nil
+}
+
+// check will check the name and the port of the target against the allowlists and split it into the host and the port
+func (d *Destinations) check(target string) (string, string, error) {
+	host, p, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "Invalid target: %v", target)
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil || port < 1 || port > 65535 {
+		return "", "", errors.Errorf("Invalid port: %v", target)
+	}
+	if !d.permitsPort(port) {
+		return "", "", errors.Errorf("Port %v is not allowed", port)
+	}
+
+	if d.permitsHost(host) {
+		return host, p, nil
+	}
+	if len(d.Networks) == 0 {
+		return "", "", errors.Errorf("Host %v is not allowed", host)
+	}
+	if ip := net.ParseIP(host); ip != nil && !d.permitsIP(ip) {
+		return "", "", errors.Errorf("Host %v is not within the allowed networks", host)
+	}
+	return host, p, nil
+}
+
+// resolve will check the target against the allowlists and return the addresses which may be dialed. The name is
+// resolved only once, so that it can't resolve to a different address between the check and the connection.
+func (d *Destinations) resolve(target string, resolver *net.Resolver) ([]string, error) {
+	host, p, err := d.check(target)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DynamicResolveTimeout)
+	defer cancel()
+	ips, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not resolve %v", host)
+	}
+	addresses := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		if len(d.Networks) == 0 || d.permitsIP(ip.IP) {
+			addresses = append(addresses, net.JoinHostPort(ip.IP.String(), p))
+		}
+	}
+	if len(addresses) == 0 {
+		return nil, errors.Errorf("Host %v is not within the allowed networks", host)
+	}
+	return addresses, nil
+}
+
+func (d *Destinations) permitsPort(port int) bool {
+	if len(d.Ports) == 0 {
+		return true
+	}
+	for _, pr := range d.Ports {
+		if pr.contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Destinations) permitsHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range d.Hosts {
+		if ok, err := path.Match(strings.ToLower(pattern), host); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Destinations) permitsIP(ip net.IP) bool {
+	for _, n := range d.Networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// OpenConnection fails, as the dynamic channel needs a target
+func (u *DynamicChannel) OpenConnection(metadata *socketace.StreamMetadata) (net.Conn, error) {
+	return nil, errors.Errorf("Channel %v needs a target, e.g. /%v/example.org:22", u.Name(), u.Name())
+}
+
+// OpenTarget will check the target against the allowlists and open a connection to one of the addresses which have
+// been checked
+func (u *DynamicChannel) OpenTarget(target string, metadata *socketace.StreamMetadata) (net.Conn, error) {
+	addresses, err := u.resolve(target, net.DefaultResolver)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Target %v not allowed by %v", target, u.Name())
+	}
+
+	var conn net.Conn
+	for _, a := range addresses {
+		if conn, err = net.Dial("tcp", a); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		err = errors.Wrapf(err, "Remote connection failed to %v", target)
+		log.WithError(err).Errorf("Could not connect to %v: %+v", target, err)
+		return nil, err
+	}
+	conn = streams.NewNamedConnection(conn, u.Name()+"->"+target)
+
+	if err := u.ProxyProtocol.WriteHeader(conn, metadata); err != nil {
+		streams.TryClose(conn)
+		return nil, err
+	}
+
+	log.Tracef("[Channel] Connected to %v", conn)
+	return conn, nil
+}
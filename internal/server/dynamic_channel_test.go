@@ -0,0 +1,118 @@
+package server
+
+import (
+	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test_DynamicChannelAllowlist(t *testing.T) {
+	chl := &Channels{}
+	require.NoError(t, chl.UnmarshalJSON([]byte(`[{
+		"name": "internal",
+		"address": "dynamic://",
+		"networks": ["10.0.0.0/8", "127.0.0.1"],
+		"hosts": ["*.example.org"],
+		"ports": [22, "8000-8100"]
+	}]`)))
+	require.Len(t, *chl, 1)
+	c, ok := (*chl)[0].(*DynamicChannel)
+	require.True(t, ok)
+
+	target, ok := channelTarget(c, "/internal/db.example.org:22")
+	require.True(t, ok)
+	require.Equal(t, "db.example.org:22", target)
+	_, ok = channelTarget(c, "/internal")
+	require.False(t, ok)
+	_, ok = channelTarget(c, "/other/db.example.org:22")
+	require.False(t, ok)
+
+	require.True(t, c.Permits("db.example.org:22"))
+	require.True(t, c.Permits("DB.Example.Org:8050"))
+	require.True(t, c.Permits("10.1.2.3:22"))
+	require.True(t, c.Permits("127.0.0.1:8100"))
+	require.False(t, c.Permits("127.0.0.2:22"))
+	require.False(t, c.Permits("db.example.org:25"))
+	// Other names are checked against the networks once they are resolved
+	require.True(t, c.Permits("example.org:22"))
+	require.False(t, c.Permits("10.1.2.3"))
+
+	_, err := c.OpenConnection(nil)
+	require.Error(t, err)
+}
+
+func Test_DynamicChannelInvalid(t *testing.T) {
+	chl := &Channels{}
+	require.Error(t, chl.UnmarshalJSON([]byte(`[{"name":"a","address":"dynamic://","networks":["10.0.0.0/33"]}]`)))
+	require.Error(t, chl.UnmarshalJSON([]byte(`[{"name":"a","address":"dynamic://","ports":["100-10"]}]`)))
+	require.Error(t, chl.UnmarshalJSON([]byte(`[{"name":"a","address":"dynamic://","ports":[70000]}]`)))
+}
+
+func Test_DynamicChannelResolve(t *testing.T) {
+	chl := &Channels{}
+	require.NoError(t, chl.UnmarshalJSON([]byte(`[{
+		"name": "internal",
+		"address": "dynamic://",
+		"networks": ["127.0.0.0/8"],
+		"hosts": ["localhost"]
+	}]`)))
+	c := (*chl)[0].(*DynamicChannel)
+
+	// Names are checked without resolving them, the addresses are checked when opening the connection
+	require.True(t, c.Permits("localhost:22"))
+	require.True(t, c.Permits("db.example.org:22"))
+	require.False(t, c.Permits("10.1.2.3:22"))
+
+	addresses, err := c.resolve("localhost:22", net.DefaultResolver)
+	require.NoError(t, err)
+	require.Equal(t, []string{"127.0.0.1:22"}, addresses)
+	addresses, err = c.resolve("127.0.0.2:22", net.DefaultResolver)
+	require.NoError(t, err)
+	require.Equal(t, []string{"127.0.0.2:22"}, addresses)
+
+	// Matching host names must still resolve within the networks
+	c.Networks = []Network{{IPNet: &net.IPNet{IP: net.IPv4(10, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)}}}
+	_, err = c.resolve("localhost:22", net.DefaultResolver)
+	require.Error(t, err)
+	_, err = c.OpenTarget("localhost:22", nil)
+	require.Error(t, err)
+}
+
+func Test_DynamicChannelOpen(t *testing.T) {
+	echo := startEcho(t)
+	_, port, err := net.SplitHostPort(echo)
+	require.NoError(t, err)
+	allowed, err := strconv.Atoi(port)
+	require.NoError(t, err)
+
+	channel := &DynamicChannel{
+		AbstractChannel: AbstractChannel{
+			ProtoName: addr.ProtoName{Name: "internal"},
+			Address:   addr.MustParseAddress("dynamic://"),
+		},
+		Destinations: Destinations{
+			Networks: []Network{{IPNet: &net.IPNet{IP: net.IPv4(127, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)}}},
+			Ports:    []PortRange{{From: allowed, To: allowed}},
+		},
+	}
+
+	// The target is chosen by the client
+	conn := openStream(t, Channels{channel}, "/internal/"+echo)
+	_, err = conn.Write([]byte("HELLO"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "HELLO", string(buf))
+
+	// The target not on the allowlist is refused
+	conn = openStream(t, Channels{channel}, "/internal/127.0.0.1:"+strconv.Itoa(allowed+1))
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = conn.Read(buf)
+	require.Error(t, err)
+	require.NotContains(t, err.Error(), "timeout")
+}
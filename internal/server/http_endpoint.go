@@ -2,10 +2,22 @@ package server
 
 import "fmt"
 
+// The modes of the HTTP endpoints
+const (
+	// ModeWebsocket endpoints only accept websockets
+	ModeWebsocket = "websocket"
+	// ModePolling endpoints only accept the polling transport (POST uploads and long-polling GET downloads)
+	ModePolling = "polling"
+	// ModeAny endpoints accept both, so the clients may fall back to polling when the websockets are blocked
+	ModeAny = "any"
+)
+
 type HttpEndpoint struct {
 	Channels          []string `json:"channels"`
 	Endpoint          string   `json:"endpoint"`
 	EnableCompression bool     `json:"enableCompression"`
+	// Mode is the transport accepted by the endpoint, ModeWebsocket if not set
+	Mode string `json:"mode"`
 }
 
 func (wsm *HttpEndpoint) String() string {
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"github.com/pkg/errors"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+// HttpFallback is the response to all the requests which are not tunneled: the requests of the unknown paths, the
+// plain requests of the endpoints and the failed websocket upgrades. The server looks like an ordinary website,
+// serving the static files of the Directory, passing the requests to the Proxy website or returning the canned
+// response (the Status, the Headers and the Body).
+type HttpFallback struct {
+	Directory string            `json:"directory"`
+	Proxy     string            `json:"proxy"`
+	Status    int               `json:"status"`
+	Headers   map[string]string `json:"headers"`
+	Body      string            `json:"body"`
+}
+
+// Handler returns the handler of the fallback requests
+func (f *HttpFallback) Handler() (http.Handler, error) {
+	if f.Directory != "" && f.Proxy != "" {
+		return nil, errors.Errorf("Fallback can either serve a directory or a proxy, not both")
+	}
+	if f.Directory != "" {
+		return http.FileServer(http.Dir(f.Directory)), nil
+	}
+	if f.Proxy != "" {
+		target, err := url.Parse(f.Proxy)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid fallback proxy: %v", f.Proxy)
+		}
+		if target.Scheme != "http" && target.Scheme != "https" || target.Host == "" {
+			return nil, errors.Errorf("Invalid fallback proxy: %v, expected http(s)://host[:port]", f.Proxy)
+		}
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		director := proxy.Director
+		proxy.Director = func(r *http.Request) {
+			director(r)
+			// The website expects its own name
+			r.Host = target.Host
+		}
+		return proxy, nil
+	}
+	return http.HandlerFunc(f.canned), nil
+}
+
+// canned writes the canned response
+func (f *HttpFallback) canned(w http.ResponseWriter, r *http.Request) {
+	for k, v := range f.Headers {
+		w.Header().Set(k, v)
+	}
+	if w.Header().Get("Content-Type") == "" && f.Body != "" {
+		w.Header().Set("Content-Type", http.DetectContentType([]byte(f.Body)))
+	}
+	status := f.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write([]byte(f.Body))
+	}
+}
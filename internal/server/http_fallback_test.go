@@ -0,0 +1,128 @@
+package server
+
+import (
+	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_HttpFallbackCanned(t *testing.T) {
+	handler, err := (&HttpFallback{
+		Status:  http.StatusForbidden,
+		Headers: map[string]string{"Server": "nginx"},
+		Body:    "<html><body>Forbidden</body></html>",
+	}).Handler()
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/anything", nil))
+	require.Equal(t, http.StatusForbidden, w.Code)
+	require.Equal(t, "nginx", w.Header().Get("Server"))
+	require.Contains(t, w.Header().Get("Content-Type"), "text/html")
+	require.Equal(t, "<html><body>Forbidden</body></html>", w.Body.String())
+}
+
+func Test_HttpFallbackDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fallback")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("Welcome"), 0644))
+
+	handler, err := (&HttpFallback{Directory: dir}).Handler()
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "Welcome", w.Body.String())
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/missing", nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func Test_HttpFallbackProxy(t *testing.T) {
+	website := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Host + r.URL.Path))
+	}))
+	defer website.Close()
+
+	handler, err := (&HttpFallback{Proxy: website.URL}).Handler()
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.org/page", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, website.Listener.Addr().String()+"/page", w.Body.String())
+
+	_, err = (&HttpFallback{Proxy: "ftp://example.org"}).Handler()
+	require.Error(t, err)
+	_, err = (&HttpFallback{Proxy: website.URL, Directory: "."}).Handler()
+	require.Error(t, err)
+}
+
+func Test_HttpServerFallback(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	ws := &HttpServer{
+		Address: addr.MustParseAddress("http://" + address),
+		Endpoints: WebsocketEndpointList{
+			HttpEndpoint{
+				Endpoint: "/ws/all",
+			},
+		},
+		Fallback: &HttpFallback{
+			Headers: map[string]string{"Server": "nginx"},
+			Body:    "<html><body>It works!</body></html>",
+		},
+	}
+	require.NoError(t, ws.Startup(Channels{}))
+	defer func() {
+		require.NoError(t, ws.Shutdown())
+	}()
+
+	// The tunnel still works
+	conn, res, err := websocket.DefaultDialer.Dial("ws://"+address+"/ws/all", nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+	require.NoError(t, conn.Close())
+
+	// Unknown paths, plain requests to the endpoint and failed upgrades all get the same response
+	base := "http://" + address
+	requests := make([]*http.Request, 0)
+	for _, target := range []string{"/", "/unknown/", "/ws/all"} {
+		req, err := http.NewRequest("GET", base+target, nil)
+		require.NoError(t, err)
+		requests = append(requests, req)
+	}
+	req, err := http.NewRequest("POST", base+"/ws/all", nil)
+	require.NoError(t, err)
+	requests = append(requests, req)
+	req, err = http.NewRequest("GET", base+"/ws/all", nil)
+	require.NoError(t, err)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	requests = append(requests, req)
+
+	for _, req := range requests {
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		require.Equal(t, http.StatusOK, res.StatusCode, "%v %v", req.Method, req.URL)
+		require.Equal(t, "nginx", res.Header.Get("Server"))
+		require.Empty(t, res.Header.Get("Sec-Websocket-Version"))
+		require.Equal(t, "<html><body>It works!</body></html>", string(body))
+	}
+}
@@ -4,8 +4,11 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"github.com/bokysan/socketace/v2/internal/socketace"
 	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/bokysan/socketace/v2/internal/streams/polling"
 	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/bokysan/socketace/v2/internal/util/auth"
 	"github.com/bokysan/socketace/v2/internal/util/cert"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
@@ -15,16 +18,28 @@ import (
 	log "github.com/sirupsen/logrus"
 	"net"
 	"net/http"
+	"sync"
 	"time"
 )
 
 type HttpServer struct {
 	cert.ServerConfig
+	Authentication auth.ServerConfig   `json:"authentication"`
+	Mux            socketace.MuxConfig `json:"mux"`
 
 	Address   addr.ProtoAddress     `json:"address"`
 	Endpoints WebsocketEndpointList `json:"endpoints"`
+	// AlpnChannels are the channels of the clients which negotiated SocketAce with ALPN. The channels of all the
+	// endpoints, if not set.
+	AlpnChannels []string `json:"alpnChannels"`
+	// Fallback answers the requests which are not tunneled. Unknown paths get a 404 and failed upgrades an error,
+	// if not set.
+	Fallback *HttpFallback `json:"fallback"`
 
 	secure        bool
+	fallback      http.Handler
+	mutex         sync.Mutex
+	pollers       []*polling.Server
 	server        *http.Server
 	couldNotStart chan struct{}
 }
@@ -46,25 +61,84 @@ func (ws *HttpServer) EndpointHandler(ep *HttpEndpoint, upstreams Channels) (htt
 		EnableCompression: ep.EnableCompression,
 	} // use default options
 
+	fallback := ws.fallback
+	if fallback != nil {
+		// The failed upgrades look like the rest of the website
+		upgrader.Error = func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+			fallback.ServeHTTP(w, r)
+		}
+	}
+
+	mode := ep.Mode
+	var poller *polling.Server
+	switch mode {
+	case "", ModeWebsocket:
+	case ModePolling, ModeAny:
+		poller = polling.NewServer(func(conn net.Conn) {
+			conn = streams.NewNamedConnection(conn, "polling")
+			if err := AcceptConnection(conn, &ws.ServerConfig, ws.secure, &ws.Authentication, &ws.Mux, upstreams); err != nil {
+				log.WithError(err).Errorf("Error accepting connection: %v", err)
+			}
+		})
+		poller.NotFound = fallback
+		ws.mutex.Lock()
+		ws.pollers = append(ws.pollers, poller)
+		ws.mutex.Unlock()
+	default:
+		return nil, errors.Errorf("Unknown mode of endpoint %v: %v", ep.Endpoint, ep.Mode)
+	}
+
 	return func(w http.ResponseWriter, r *http.Request) {
+		if poller != nil && polling.IsPollingRequest(r) {
+			poller.ServeHTTP(w, r)
+			return
+		}
+		if mode == ModePolling || fallback != nil && !websocket.IsWebSocketUpgrade(r) {
+			if fallback != nil {
+				fallback.ServeHTTP(w, r)
+			} else {
+				http.NotFound(w, r)
+			}
+			return
+		}
 		log.Debugf("New client request...")
 
+		// The upgrader responds to the failed upgrades
 		c, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			log.WithError(err).Errorf("Socket upgrade failed: %+v", err)
-			http.Error(w, err.Error(), 500)
 			return
 		}
 		var conn streams.Connection
 		conn = streams.NewWebsocketTunnelConnection(c)
 		conn = streams.NewNamedConnection(conn, "websocket")
 
-		if err = AcceptConnection(conn, &ws.ServerConfig, ws.secure, upstreams); err != nil {
+		if err = AcceptConnection(conn, &ws.ServerConfig, ws.secure, &ws.Authentication, &ws.Mux, upstreams); err != nil {
 			log.WithError(err).Errorf("Error accepting connection: %v", err)
 		}
 	}, nil
 }
 
+// alpnChannels returns the channels of the clients which negotiated SocketAce with ALPN
+func (ws *HttpServer) alpnChannels(channels Channels) (Channels, error) {
+	names := ws.AlpnChannels
+	if len(names) == 0 {
+		seen := make(map[string]bool)
+		for _, endpoint := range ws.Endpoints {
+			if len(endpoint.Channels) == 0 {
+				return channels, nil
+			}
+			for _, name := range endpoint.Channels {
+				if !seen[name] {
+					seen[name] = true
+					names = append(names, name)
+				}
+			}
+		}
+	}
+	return channels.Filter(names)
+}
+
 //noinspection GoUnusedParameter
 func (ws *HttpServer) Startup(channels Channels) error {
 	var errs error
@@ -79,11 +153,24 @@ func (ws *HttpServer) Startup(channels Channels) error {
 		middleware.RequestID, // Set Request Id on all requests
 		middleware.RealIP,    // Extract actual IP if running behind reverse proxy
 		GetRequestLogger(address),
-		middleware.RedirectSlashes, // Redirect slashes to no slash URLs
-		middleware.Recoverer,       // Recover from panics without crashing the server
+	)
+	if ws.Fallback == nil {
+		// The fallback website decides about the slashes itself
+		router.Use(middleware.RedirectSlashes) // Redirect slashes to no slash URLs
+	}
+	router.Use(
+		middleware.Recoverer, // Recover from panics without crashing the server
 		// middleware.Timeout(60*time.Second),
 	)
 
+	if ws.Fallback != nil {
+		if ws.fallback, err = ws.Fallback.Handler(); err != nil {
+			return errors.WithStack(err)
+		}
+		router.NotFound(ws.fallback.ServeHTTP)
+		router.MethodNotAllowed(ws.fallback.ServeHTTP)
+	}
+
 	debugData := make([]string, 0)
 
 	for _, endpoint := range ws.Endpoints {
@@ -133,13 +220,24 @@ func (ws *HttpServer) Startup(channels Channels) error {
 		if tlsConfig, err = ws.ServerConfig.GetTlsConfig(); err != nil {
 			return errors.Wrapf(err, "Could not configure TLS")
 		}
+		alpnChannels, err := ws.alpnChannels(channels)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		// The clients negotiating SocketAce with ALPN skip HTTP, the others are served HTTP/2 or HTTP/1.1
+		tlsConfig = withAlpn(tlsConfig, "h2", "http/1.1")
 		ws.server.TLSConfig = tlsConfig
+		ln = newAlpnListener(ln, tlsConfig, func(conn net.Conn) {
+			if err := AcceptConnection(conn, &ws.ServerConfig, true, &ws.Authentication, &ws.Mux, alpnChannels); err != nil {
+				log.WithError(err).Errorf("Error accepting connection: %v", err)
+			}
+		})
 	}
 
 	go func() {
 		if ws.secure {
 			log.Infof("Starting HTTPS server at %v", ws)
-			if err := ws.server.ServeTLS(ln, "", ""); err != http.ErrServerClosed {
+			if err := ws.server.Serve(ln); err != http.ErrServerClosed {
 				err = errors.WithStack(err)
 				log.WithError(err).Errorf("Could not start the server %v", err)
 			}
@@ -161,6 +259,11 @@ func (ws *HttpServer) Shutdown() error {
 	defer func() {
 		cancel()
 	}()
+	ws.mutex.Lock()
+	for _, poller := range ws.pollers {
+		_ = poller.Close()
+	}
+	ws.mutex.Unlock()
 	return ws.server.Shutdown(ctx)
 
 }
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"fmt"
+	"github.com/bokysan/socketace/v2/internal/socketace"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/bokysan/socketace/v2/internal/util/auth"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// HubChannel relays the streams between the clients. The clients matching the Publish rules publish their services
+// under a name, e.g. `laptop-ssh`, and the clients allowed to use the channel open them as `/hub/laptop-ssh`. The
+// server keeps the registry of the published names; a name is removed when its client disconnects.
+type HubChannel struct {
+	AbstractChannel
+	Publish auth.Rules `json:"publish"`
+
+	mutex     sync.Mutex
+	published map[string]*publication
+}
+
+// publication is a name published by a connected client
+type publication struct {
+	handler  *ConnectionHandler
+	identity string
+}
+
+func (u *HubChannel) String() string {
+	return fmt.Sprintf("%v<->%v", u.Name(), "hub")
+}
+
+// OpenConnection fails, as the hub channel needs the name of a published service
+func (u *HubChannel) OpenConnection(metadata *socketace.StreamMetadata) (net.Conn, error) {
+	return nil, errors.Errorf("Channel %v needs a published name, e.g. /%v/laptop-ssh", u.Name(), u.Name())
+}
+
+// MayPublish returns true if the client with the given identity may publish its services. Unlike Allowed, nobody
+// may publish if no rules are defined.
+func (u *HubChannel) MayPublish(identity *auth.Identity) bool {
+	return len(u.Publish) > 0 && u.Publish.Allows(identity)
+}
+
+// Permits returns true if the name has been published
+func (u *HubChannel) Permits(name string) bool {
+	return u.lookup(name) != nil
+}
+
+// Published returns the published names along with the identities of the clients which published them
+func (u *HubChannel) Published() map[string]string {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	res := make(map[string]string, len(u.published))
+	for name, p := range u.published {
+		res[name] = p.identity
+	}
+	return res
+}
+
+func (u *HubChannel) lookup(name string) *publication {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.published[name]
+}
+
+func (u *HubChannel) publish(name string, handler *ConnectionHandler) error {
+	if name == "" || strings.ContainsAny(name, "~\r\n") {
+		return errors.Errorf("Invalid name: %q", name)
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if p, ok := u.published[name]; ok {
+		return errors.Errorf("Name %v already published by %v", name, p.identity)
+	}
+	if u.published == nil {
+		u.published = make(map[string]*publication)
+	}
+	u.published[name] = &publication{handler: handler, identity: handler.identity.String()}
+	return nil
+}
+
+func (u *HubChannel) unpublish(name string, handler *ConnectionHandler) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if p, ok := u.published[name]; ok && p.handler == handler {
+		delete(u.published, name)
+	}
+}
+
+// publishHandler returns the handler of the control streams of the names published by the client
+func (ch *ConnectionHandler) publishHandler(hub *HubChannel) func(protocol string, control io.ReadWriteCloser) error {
+	prefix := socketace.PublishProtocol + "/" + hub.Name() + "/"
+	return func(protocol string, control io.ReadWriteCloser) error {
+		defer streams.TryClose(control)
+		if ch.metadata {
+			if _, err := socketace.ReadStreamMetadata(control); err != nil {
+				return err
+			}
+		}
+
+		name := strings.TrimPrefix(protocol, prefix)
+		if err := hub.publish(name, ch); err != nil {
+			log.WithError(err).Warnf("[Server] Client %v could not publish %v: %v", ch.identity, name, err)
+			return socketace.WriteBindReply(control, err)
+		}
+		defer hub.unpublish(name, ch)
+
+		if err := socketace.WriteBindReply(control, nil); err != nil {
+			return err
+		}
+		log.Infof("[Server] Client %v published %v in %v", ch.identity, name, hub.Name())
+		if log.IsLevelEnabled(log.DebugLevel) {
+			names := make([]string, 0)
+			for n := range hub.Published() {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			log.Debugf("[Server] Published in %v: %v", hub.Name(), names)
+		}
+
+		// The client closes the control stream (or the session dies) when the name is not published anymore
+		_, _ = io.Copy(ioutil.Discard, control)
+		log.Infof("[Server] Client %v withdrew %v from %v", ch.identity, name, hub.Name())
+		return nil
+	}
+}
+
+// relayHub will connect the stream to the client which published the name
+func (ch *ConnectionHandler) relayHub(hub *HubChannel, name string, downstream io.ReadWriteCloser) error {
+	p := hub.lookup(name)
+	if p == nil {
+		return errors.Errorf("Name %v is not published in %v", name, hub.Name())
+	}
+	upstream, err := p.handler.openStream("/" + hub.Name() + "/" + name)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("[Server] Relaying %v from %v to %v", name, ch.identity, p.identity)
+	return streams.PipeData(hub.Shaper().Server(downstream, ch.scheduler), upstream)
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"github.com/bokysan/socketace/v2/internal/util/auth"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func Test_HubRegistry(t *testing.T) {
+	chl := &Channels{}
+	require.NoError(t, chl.UnmarshalJSON([]byte(`[{"name":"hub","address":"hub://","publish":[{"user":"device-*"}]}]`)))
+	hub, ok := (*chl)[0].(*HubChannel)
+	require.True(t, ok)
+
+	require.True(t, hub.MayPublish(&auth.Identity{User: "device-1"}))
+	require.False(t, hub.MayPublish(&auth.Identity{User: "alice"}))
+	require.False(t, (&HubChannel{}).MayPublish(&auth.Identity{User: "device-1"}), "Nobody may publish without rules")
+
+	first := &ConnectionHandler{identity: &auth.Identity{User: "device-1"}}
+	second := &ConnectionHandler{identity: &auth.Identity{User: "device-2"}}
+	require.NoError(t, hub.publish("ssh", first))
+	require.Error(t, hub.publish("ssh", second), "The name is taken")
+	require.Error(t, hub.publish("", second))
+	require.True(t, hub.Permits("ssh"))
+	require.False(t, hub.Permits("web"))
+	require.Equal(t, map[string]string{"ssh": "user=device-1"}, hub.Published())
+
+	hub.unpublish("ssh", second)
+	require.True(t, hub.Permits("ssh"), "Only the publisher may withdraw the name")
+	hub.unpublish("ssh", first)
+	require.False(t, hub.Permits("ssh"))
+}
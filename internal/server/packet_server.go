@@ -3,8 +3,10 @@ package server
 import (
 	"crypto/sha256"
 	"fmt"
+	"github.com/bokysan/socketace/v2/internal/socketace"
 	"github.com/bokysan/socketace/v2/internal/streams"
 	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/bokysan/socketace/v2/internal/util/auth"
 	"github.com/bokysan/socketace/v2/internal/util/cert"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
@@ -18,6 +20,8 @@ type ListenerFromPacketConn func(block kcp.BlockCrypt, conn net.PacketConn) (net
 
 type PacketServer struct {
 	cert.ServerConfig
+	Authentication auth.ServerConfig   `json:"authentication"`
+	Mux            socketace.MuxConfig `json:"mux"`
 
 	Address  addr.ProtoAddress `json:"address"`
 	Channels []string          `json:"channels"`
@@ -136,7 +140,7 @@ func (st *PacketServer) acceptConnection() {
 		// Even though the connection might be secured by an AES-encrypted symmetric ciper, we
 		// state here "secure=false" to enable the client to provide StartTLS and do a potential
 		// host check and/or identify itself with a client certificate
-		if err = AcceptConnection(conn, &st.ServerConfig, false, st.upstreams); err != nil {
+		if err = AcceptConnection(conn, &st.ServerConfig, false, &st.Authentication, &st.Mux, st.upstreams); err != nil {
 			log.WithError(err).Errorf("Error accepting connection: %v", err)
 		}
 	}
@@ -0,0 +1,333 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"github.com/bokysan/socketace/v2/internal/socketace"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/bokysan/socketace/v2/internal/util/duration"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"path"
+	"strings"
+	"time"
+)
+
+// DefaultSharingTimeout is how long the server waits for the first bytes of a shared connection
+const DefaultSharingTimeout = 2 * time.Second
+
+// The protocols detected on the shared ports
+const (
+	ProtocolSocketAce = "socketace"
+	ProtocolTls       = "tls"
+	ProtocolSsh       = "ssh"
+	ProtocolHttp      = "http"
+	// ProtocolTimeout is "detected" when the client sends nothing within the timeout, e.g. a protocol where the
+	// server speaks first
+	ProtocolTimeout = "timeout"
+	// ProtocolUnknown is any other protocol
+	ProtocolUnknown = "unknown"
+)
+
+// maxTlsRecord is the size of the largest TLS record, with its header
+const maxTlsRecord = 5 + 16384
+
+// signatures are the first bytes sent by the clients of the protocols
+var signatures = []struct {
+	protocol string
+	prefix   string
+}{
+	{ProtocolSocketAce, socketace.RequestMethod + " "},
+	{ProtocolSsh, "SSH-"},
+	{ProtocolHttp, "GET "},
+	{ProtocolHttp, "HEAD "},
+	{ProtocolHttp, "POST "},
+	{ProtocolHttp, "PUT "},
+	{ProtocolHttp, "DELETE "},
+	{ProtocolHttp, "OPTIONS "},
+	{ProtocolHttp, "CONNECT "},
+	{ProtocolHttp, "PATCH "},
+	{ProtocolHttp, "TRACE "},
+	{ProtocolHttp, "PRI * HTTP/2.0"},
+}
+
+// PortSharing lets the server share its port with other services, like sslh. The server detects the protocol of each
+// connection from its first bytes: the SocketAce connections are accepted, and the other connections are passed to
+// the first Fallback backend with a matching rule. The connections matching no rule are closed.
+type PortSharing struct {
+	Timeout  duration.Duration `json:"timeout"`
+	Fallback []FallbackRule    `json:"fallback"`
+}
+
+// FallbackRule is the backend of the connections of the Protocol (any protocol, if empty). The TLS connections may be
+// matched by the server name (SNI) and the offered application protocols (ALPN) as well; these are glob patterns,
+// e.g. `*.example.org` or `h2`.
+type FallbackRule struct {
+	Protocol      string            `json:"protocol"`
+	ServerName    string            `json:"sni"`
+	Alpn          string            `json:"alpn"`
+	Address       addr.ProtoAddress `json:"address"`
+	ProxyProtocol ProxyProtocol     `json:"proxyProtocol"`
+}
+
+func (r *FallbackRule) String() string {
+	protocol := r.Protocol
+	if protocol == "" {
+		protocol = "any"
+	}
+	return protocol + "->" + r.Address.String()
+}
+
+// matches returns true if the rule applies to the detected connection
+func (r *FallbackRule) matches(d *detected) bool {
+	if r.Protocol != "" && r.Protocol != "any" && !strings.EqualFold(r.Protocol, d.protocol) {
+		return false
+	}
+	if r.ServerName != "" {
+		if ok, err := path.Match(strings.ToLower(r.ServerName), strings.ToLower(d.serverName)); err != nil || !ok {
+			return false
+		}
+	}
+	if r.Alpn != "" {
+		found := false
+		for _, p := range d.alpn {
+			if ok, err := path.Match(r.Alpn, p); err == nil && ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// connect will connect the client to the backend of the rule
+func (r *FallbackRule) connect(conn net.Conn) error {
+	address := r.Address.Host
+	if address == "" {
+		address = r.Address.Path
+	}
+	backend, err := net.Dial(r.Address.Scheme, address)
+	if err != nil {
+		return errors.Wrapf(err, "Could not connect to %v", r.Address.String())
+	}
+	if err := r.ProxyProtocol.WriteHeader(backend, socketace.NewStreamMetadata(conn)); err != nil {
+		streams.TryClose(backend)
+		return err
+	}
+	return streams.PipeData(conn, streams.NewNamedConnection(backend, r.Address.String()))
+}
+
+// detected is the protocol of the connection
+type detected struct {
+	protocol string
+	// serverName is the SNI of the TLS connections
+	serverName string
+	// alpn are the application protocols offered by the TLS clients
+	alpn []string
+}
+
+func (d *detected) String() string {
+	if d.protocol != ProtocolTls {
+		return d.protocol
+	}
+	return "tls (sni=" + d.serverName + ", alpn=" + strings.Join(d.alpn, ",") + ")"
+}
+
+// sharedConnection replays the bytes read while detecting the protocol
+type sharedConnection struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func newSharedConnection(conn net.Conn) *sharedConnection {
+	return &sharedConnection{
+		Conn:   conn,
+		reader: bufio.NewReaderSize(conn, maxTlsRecord),
+	}
+}
+
+func (sc *sharedConnection) Read(p []byte) (int, error) {
+	return sc.reader.Read(p)
+}
+
+// Unwrap returns the embedded net.Conn
+func (sc *sharedConnection) Unwrap() net.Conn {
+	return sc.Conn
+}
+
+// detect waits (up to the timeout) for enough bytes to tell the protocol of the connection
+func (sc *sharedConnection) detect(timeout time.Duration) (*detected, error) {
+	if err := sc.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer func() {
+		_ = sc.SetReadDeadline(time.Time{})
+	}()
+
+	for {
+		// Wait for more bytes, then look at all the bytes received so far
+		_, err := sc.reader.Peek(sc.reader.Buffered() + 1)
+		data, _ := sc.reader.Peek(sc.reader.Buffered())
+		if protocol, decided := matchSignature(data); decided {
+			if protocol == ProtocolTls {
+				return sc.detectTls(), nil
+			}
+			return &detected{protocol: protocol}, nil
+		}
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				if len(data) == 0 {
+					return &detected{protocol: ProtocolTimeout}, nil
+				}
+				return &detected{protocol: ProtocolUnknown}, nil
+			}
+			return nil, errors.WithStack(err)
+		}
+	}
+}
+
+// detectTls reads the server name and the application protocols from the TLS ClientHello
+func (sc *sharedConnection) detectTls() *detected {
+	d := &detected{protocol: ProtocolTls}
+	header, err := sc.reader.Peek(5)
+	if err != nil {
+		return d
+	}
+	record, err := sc.reader.Peek(5 + (int(header[3])<<8 | int(header[4])))
+	if err != nil {
+		return d
+	}
+
+	// Let the TLS library parse the hello and abort the handshake
+	_ = tls.Server(&helloConnection{Reader: bytes.NewReader(record)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			d.serverName = hello.ServerName
+			d.alpn = hello.SupportedProtos
+			return nil, errors.New("Hello read")
+		},
+	}).Handshake()
+	return d
+}
+
+// matchSignature returns the protocol of the data. It's not decided while the data might still match more than one
+// protocol.
+func matchSignature(data []byte) (string, bool) {
+	if len(data) == 0 {
+		return "", false
+	}
+	if data[0] == 0x16 {
+		// TLS handshake record
+		return ProtocolTls, true
+	}
+	candidate := false
+	for _, s := range signatures {
+		if bytes.HasPrefix(data, []byte(s.prefix)) {
+			return s.protocol, true
+		}
+		if bytes.HasPrefix([]byte(s.prefix), data) {
+			candidate = true
+		}
+	}
+	if candidate {
+		return "", false
+	}
+	return ProtocolUnknown, true
+}
+
+// helloConnection feeds the recorded ClientHello to the TLS library. Anything written is discarded.
+type helloConnection struct {
+	io.Reader
+}
+
+func (hc *helloConnection) Write(p []byte) (int, error)      { return len(p), nil }
+func (hc *helloConnection) Close() error                     { return nil }
+func (hc *helloConnection) LocalAddr() net.Addr              { return streams.Localhost }
+func (hc *helloConnection) RemoteAddr() net.Addr             { return streams.Localhost }
+func (hc *helloConnection) SetDeadline(time.Time) error      { return nil }
+func (hc *helloConnection) SetReadDeadline(time.Time) error  { return nil }
+func (hc *helloConnection) SetWriteDeadline(time.Time) error { return nil }
+
+// share detects the protocol of the connection accepted by the server and passes it to SocketAce or to the fallback
+// backend. On secure servers, the TLS connections not passed through are decrypted and detected again.
+func (st *SocketServer) share(conn net.Conn) {
+	timeout := time.Duration(st.Sharing.Timeout)
+	if timeout <= 0 {
+		timeout = DefaultSharingTimeout
+	}
+
+	shared := newSharedConnection(conn)
+	d, err := shared.detect(timeout)
+	if err != nil {
+		log.WithError(err).Debugf("[Server] Could not detect the protocol of %v: %v", conn.RemoteAddr(), err)
+		streams.TryClose(conn)
+		return
+	}
+	log.Debugf("[Server] Detected %v from %v", d, conn.RemoteAddr())
+
+	secure := false
+	var accepted net.Conn = shared
+	if d.protocol == ProtocolTls && st.tlsConfig != nil && !st.passThrough(d) {
+		tlsConn := tls.Server(shared, st.tlsConfig)
+		protocol, err := handshake(tlsConn)
+		if err != nil {
+			log.WithError(err).Debugf("[Server] TLS handshake with %v failed: %v", conn.RemoteAddr(), err)
+			streams.TryClose(conn)
+			return
+		}
+		decrypted := newSharedConnection(tlsConn)
+		if protocol == socketace.AlpnProtocol {
+			// No need to look at the data, the client negotiated SocketAce
+			d = &detected{protocol: ProtocolSocketAce}
+		} else if d, err = decrypted.detect(timeout); err != nil {
+			log.WithError(err).Debugf("[Server] TLS connection from %v failed: %v", conn.RemoteAddr(), err)
+			streams.TryClose(conn)
+			return
+		}
+		log.Debugf("[Server] Detected %v over TLS from %v", d, conn.RemoteAddr())
+		secure, accepted = true, decrypted
+	}
+
+	// SocketAce is only accepted over TLS on the secure servers
+	if d.protocol == ProtocolSocketAce && secure == (st.tlsConfig != nil) {
+		if err := AcceptConnection(accepted, &st.ServerConfig, secure, &st.Authentication, &st.Mux, st.upstreams); err != nil {
+			log.WithError(err).Errorf("Error accepting connection: %v", err)
+		}
+		return
+	}
+
+	rule := st.fallback(d)
+	if rule == nil {
+		log.Infof("[Server] No fallback for %v from %v, closing the connection", d, conn.RemoteAddr())
+		streams.TryClose(conn)
+		return
+	}
+	log.Debugf("[Server] Passing %v from %v to %v", d, conn.RemoteAddr(), rule.Address.String())
+	if err := rule.connect(accepted); err != nil {
+		log.WithError(err).Warnf("[Server] Fallback %v failed: %v", rule, err)
+	}
+	streams.TryClose(accepted)
+}
+
+// passThrough returns true if the TLS connection is passed to a backend as it is. On secure servers, only the rules
+// explicitly naming the TLS protocol apply; the other TLS connections are decrypted.
+func (st *SocketServer) passThrough(d *detected) bool {
+	rule := st.fallback(d)
+	return rule != nil && strings.EqualFold(rule.Protocol, ProtocolTls)
+}
+
+// fallback returns the first rule matching the connection
+func (st *SocketServer) fallback(d *detected) *FallbackRule {
+	for i := range st.Sharing.Fallback {
+		if st.Sharing.Fallback[i].matches(d) {
+			return &st.Sharing.Fallback[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/bokysan/socketace/v2/internal/socketace"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/bokysan/socketace/v2/internal/util/cert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_MatchSignature(t *testing.T) {
+	for data, expected := range map[string]string{
+		"X-SOCKETACE / SOCKETACE/1.0\r\n": ProtocolSocketAce,
+		"SSH-2.0-OpenSSH_8.4\r\n":         ProtocolSsh,
+		"GET / HTTP/1.1\r\n":              ProtocolHttp,
+		"PRI * HTTP/2.0\r\n":              ProtocolHttp,
+		"\x16\x03\x01":                    ProtocolTls,
+		"EHLO example.org\r\n":            ProtocolUnknown,
+	} {
+		protocol, decided := matchSignature([]byte(data))
+		require.True(t, decided, data)
+		require.Equal(t, expected, protocol, data)
+	}
+
+	for _, data := range []string{"", "X-SOCKET", "SS", "P"} {
+		_, decided := matchSignature([]byte(data))
+		require.False(t, decided, data)
+	}
+}
+
+func Test_Detect(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		_ = tls.Client(client, &tls.Config{ServerName: "web.example.org", NextProtos: []string{"h2", "http/1.1"}}).Handshake()
+	}()
+	d, err := newSharedConnection(server).detect(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, ProtocolTls, d.protocol)
+	require.Equal(t, "web.example.org", d.serverName)
+	require.Equal(t, []string{"h2", "http/1.1"}, d.alpn)
+
+	require.True(t, (&FallbackRule{Protocol: "tls", ServerName: "*.EXAMPLE.org"}).matches(d))
+	require.True(t, (&FallbackRule{Alpn: "h2"}).matches(d))
+	require.False(t, (&FallbackRule{Protocol: "tls", Alpn: "socketace*"}).matches(d))
+	require.False(t, (&FallbackRule{Protocol: "ssh"}).matches(d))
+
+	// Nothing is sent
+	client, server = net.Pipe()
+	defer client.Close()
+	d, err = newSharedConnection(server).detect(100 * time.Millisecond)
+	require.NoError(t, err)
+	require.Equal(t, ProtocolTimeout, d.protocol)
+
+	// A partial signature
+	client, server = net.Pipe()
+	defer client.Close()
+	go func() {
+		_, _ = client.Write([]byte("SS"))
+	}()
+	shared := newSharedConnection(server)
+	d, err = shared.detect(100 * time.Millisecond)
+	require.NoError(t, err)
+	require.Equal(t, ProtocolUnknown, d.protocol)
+
+	// The bytes are replayed
+	buf := make([]byte, 2)
+	n, err := shared.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "SS", string(buf[:n]))
+}
+
+// testServerConfig returns the configuration with a self-signed certificate for localhost
+func testServerConfig(t *testing.T) cert.ServerConfig {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	privateKey, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	return cert.ServerConfig{
+		Config: cert.Config{
+			Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate})),
+			PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateKey})),
+		},
+	}
+}
+
+func Test_PortSharing(t *testing.T) {
+	echo := addr.MustParseAddress("tcp://" + startEcho(t))
+
+	// An HTTPS site passed through as it is, and an HTTP site behind the decrypted connections
+	passedThrough := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("passed through"))
+	}))
+	defer passedThrough.Close()
+	decrypted := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("decrypted"))
+	}))
+	defer decrypted.Close()
+
+	st := &SocketServer{
+		ServerConfig: testServerConfig(t),
+		Address:      addr.MustParseAddress("tcp+tls://127.0.0.1:0"),
+		Sharing: &PortSharing{
+			Fallback: []FallbackRule{
+				{Protocol: "tls", ServerName: "web.example.org", Address: addr.MustParseAddress("tcp://" + passedThrough.Listener.Addr().String())},
+				{Protocol: "ssh", Address: echo},
+				{Protocol: "http", Address: addr.MustParseAddress("tcp://" + decrypted.Listener.Addr().String())},
+			},
+		},
+	}
+	require.NoError(t, st.Startup(Channels{}))
+	defer func() {
+		require.NoError(t, st.Shutdown())
+	}()
+	address := st.listener.Addr().String()
+
+	// SocketAce
+	conn, err := tls.Dial("tcp", address, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{socketace.AlpnProtocol}})
+	require.NoError(t, err)
+	_, err = socketace.NewClientConnection(conn, &cert.ClientConfig{InsecureSkipVerify: true}, true, address, nil, &socketace.MuxConfig{})
+	require.NoError(t, err)
+	streams.TryClose(conn)
+
+	// SSH
+	plain, err := net.Dial("tcp", address)
+	require.NoError(t, err)
+	_, err = plain.Write([]byte("SSH-2.0-Test\r\n"))
+	require.NoError(t, err)
+	line, err := bufio.NewReader(plain).ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "SSH-2.0-Test\r\n", line)
+	streams.TryClose(plain)
+
+	// HTTPS
+	get := func(serverName string) string {
+		client := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{ServerName: serverName, InsecureSkipVerify: true},
+			},
+		}
+		res, err := client.Get("https://" + address + "/")
+		require.NoError(t, err)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+	require.Equal(t, "passed through", get("web.example.org"))
+	require.Equal(t, "decrypted", get("localhost"))
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/bokysan/socketace/v2/internal/socketace"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"strings"
+)
+
+// ProxyProtocol is the version of the PROXY protocol header sent to the channel backend, so that it can see the
+// address of the original client. See https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+type ProxyProtocol string
+
+const (
+	ProxyProtocolNone ProxyProtocol = ""
+	ProxyProtocolV1   ProxyProtocol = "v1"
+	ProxyProtocolV2   ProxyProtocol = "v2"
+)
+
+var proxyV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// UnmarshalJSON accepts `v1`, `v2` (or just `1` and `2`) and an empty value, which disables the header
+func (pp *ProxyProtocol) UnmarshalJSON(b []byte) error {
+	var val interface{}
+	if err := json.Unmarshal(b, &val); err != nil {
+		return errors.WithStack(err)
+	}
+	switch strings.ToLower(fmt.Sprint(val)) {
+	case "", "<nil>", "none", "false":
+		*pp = ProxyProtocolNone
+	case "v1", "1":
+		*pp = ProxyProtocolV1
+	case "v2", "2":
+		*pp = ProxyProtocolV2
+	default:
+		return errors.Errorf("Unsupported PROXY protocol version: %v", val)
+	}
+	return nil
+}
+
+// proxyAddresses will parse the addresses of the stream metadata. It returns nils if the original connection was not
+// a TCP connection or if the metadata is missing. If only one of the addresses is IPv4, both are sent as IPv6.
+func proxyAddresses(md *socketace.StreamMetadata) (*net.TCPAddr, *net.TCPAddr) {
+	if md == nil || !strings.HasPrefix(md.Network, "tcp") {
+		return nil, nil
+	}
+	src, err := net.ResolveTCPAddr("tcp", md.Source)
+	if err != nil || src.IP == nil {
+		return nil, nil
+	}
+	dst, err := net.ResolveTCPAddr("tcp", md.Destination)
+	if err != nil || dst.IP == nil {
+		return nil, nil
+	}
+	return src, dst
+}
+
+// WriteHeader will write the PROXY protocol header describing the original client connection
+func (pp ProxyProtocol) WriteHeader(w io.Writer, md *socketace.StreamMetadata) error {
+	var header []byte
+	switch pp {
+	case ProxyProtocolNone:
+		return nil
+	case ProxyProtocolV1:
+		header = proxyHeaderV1(proxyAddresses(md))
+	case ProxyProtocolV2:
+		header = proxyHeaderV2(proxyAddresses(md))
+	default:
+		return errors.Errorf("Unsupported PROXY protocol version: %v", string(pp))
+	}
+	_, err := w.Write(header)
+	return errors.Wrapf(err, "Could not write PROXY protocol header")
+}
+
+func proxyHeaderV1(src, dst *net.TCPAddr) []byte {
+	if src == nil || dst == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	if src.IP.To4() != nil && dst.IP.To4() != nil {
+		return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", src.IP, dst.IP, src.Port, dst.Port))
+	}
+	return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", ipv6(src.IP), ipv6(dst.IP), src.Port, dst.Port))
+}
+
+// ipv6 formats the address as IPv6, also if it's an IPv4 address
+func ipv6(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+func proxyHeaderV2(src, dst *net.TCPAddr) []byte {
+	header := bytes.NewBuffer(append([]byte{}, proxyV2Signature...))
+	if src == nil || dst == nil {
+		// LOCAL command, the backend uses the real connection endpoints
+		header.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return header.Bytes()
+	}
+
+	var family byte
+	var addresses []byte
+	if src4, dst4 := src.IP.To4(), dst.IP.To4(); src4 != nil && dst4 != nil {
+		family = 0x11 // TCP over IPv4
+		addresses = append(append(addresses, src4...), dst4...)
+	} else {
+		family = 0x21 // TCP over IPv6
+		addresses = append(append(addresses, src.IP.To16()...), dst.IP.To16()...)
+	}
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports, uint16(src.Port))
+	binary.BigEndian.PutUint16(ports[2:], uint16(dst.Port))
+	addresses = append(addresses, ports...)
+
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(addresses)))
+
+	header.Write([]byte{0x21, family}) // Version 2, PROXY command
+	header.Write(length)
+	header.Write(addresses)
+	return header.Bytes()
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/bokysan/socketace/v2/internal/shaping"
+	"github.com/bokysan/socketace/v2/internal/socketace"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/bokysan/socketace/v2/internal/util/auth"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+func proxyHeader(t *testing.T, pp ProxyProtocol, md *socketace.StreamMetadata) []byte {
+	buf := &bytes.Buffer{}
+	require.NoError(t, pp.WriteHeader(buf, md))
+	return buf.Bytes()
+}
+
+func Test_ProxyProtocolV1(t *testing.T) {
+	md := &socketace.StreamMetadata{Network: "tcp", Source: "10.1.2.3:54321", Destination: "127.0.0.1:2222"}
+	require.Equal(t, "PROXY TCP4 10.1.2.3 127.0.0.1 54321 2222\r\n", string(proxyHeader(t, ProxyProtocolV1, md)))
+
+	md = &socketace.StreamMetadata{Network: "tcp", Source: "[2001:db8::1]:54321", Destination: "127.0.0.1:2222"}
+	require.Equal(t, "PROXY TCP6 2001:db8::1 ::ffff:127.0.0.1 54321 2222\r\n", string(proxyHeader(t, ProxyProtocolV1, md)))
+
+	md = &socketace.StreamMetadata{Network: "unix", Source: "@", Destination: "/var/run/app.sock"}
+	require.Equal(t, "PROXY UNKNOWN\r\n", string(proxyHeader(t, ProxyProtocolV1, md)))
+	require.Equal(t, "PROXY UNKNOWN\r\n", string(proxyHeader(t, ProxyProtocolV1, nil)))
+
+	require.Empty(t, proxyHeader(t, ProxyProtocolNone, md))
+}
+
+func Test_ProxyProtocolV2(t *testing.T) {
+	md := &socketace.StreamMetadata{Network: "tcp", Source: "10.1.2.3:54321", Destination: "127.0.0.1:2222"}
+	expected := append([]byte{}, proxyV2Signature...)
+	expected = append(expected, 0x21, 0x11, 0x00, 12)
+	expected = append(expected, 10, 1, 2, 3, 127, 0, 0, 1, 0xD4, 0x31, 0x08, 0xAE)
+	require.Equal(t, expected, proxyHeader(t, ProxyProtocolV2, md))
+
+	// Without the addresses, the LOCAL command is sent
+	expected = append(append([]byte{}, proxyV2Signature...), 0x20, 0x00, 0x00, 0x00)
+	require.Equal(t, expected, proxyHeader(t, ProxyProtocolV2, nil))
+}
+
+func Test_ProxyProtocolUnmarshal(t *testing.T) {
+	var c NetworkChannel
+	require.NoError(t, json.Unmarshal([]byte(`{"name":"smtp","address":"tcp://127.0.0.1:25","proxyProtocol":"v2"}`), &c))
+	require.Equal(t, ProxyProtocolV2, c.ProxyProtocol)
+	require.NoError(t, json.Unmarshal([]byte(`{"proxyProtocol":1}`), &c))
+	require.Equal(t, ProxyProtocolV1, c.ProxyProtocol)
+	require.Error(t, json.Unmarshal([]byte(`{"proxyProtocol":"v3"}`), &c))
+}
+
+// proxyHeaderFor will open a stream to a PROXY protocol channel as the given user and return the header the upstream
+// received
+func proxyHeaderFor(t *testing.T, channel *NetworkChannel, user string) string {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer streams.TryClose(backend)
+	headers := make(chan string, 1)
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer streams.TryClose(conn)
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		headers <- line
+	}()
+	channel.Address = addr.MustParseAddress("tcp://" + backend.Addr().String())
+
+	ch := &ConnectionHandler{
+		channels:  Channels{channel},
+		identity:  &auth.Identity{User: user},
+		scheduler: shaping.NewScheduler(),
+		metadata:  true,
+		peer:      &socketace.StreamMetadata{Network: "tcp", Source: "192.0.2.1:40000", Destination: "127.0.0.1:9999"},
+	}
+	client, server := net.Pipe()
+	defer streams.TryClose(client)
+	go func() {
+		_ = ch.muxHandler("/smtp", server)
+	}()
+	claimed := &socketace.StreamMetadata{Network: "tcp", Source: "10.1.2.3:54321", Destination: "127.0.0.1:2222"}
+	require.NoError(t, socketace.WriteStreamMetadata(client, claimed))
+
+	select {
+	case header := <-headers:
+		return header
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "The backend did not receive the PROXY header")
+		return ""
+	}
+}
+
+func Test_ProxyProtocolTrustMetadata(t *testing.T) {
+	channel := &NetworkChannel{
+		AbstractChannel: AbstractChannel{
+			ProtoName:     addr.ProtoName{Name: "smtp"},
+			TrustMetadata: auth.Rules{{User: "gateway"}},
+		},
+		ProxyProtocol: ProxyProtocolV1,
+	}
+	require.Equal(t, "PROXY TCP4 10.1.2.3 127.0.0.1 54321 2222\r\n", proxyHeaderFor(t, channel, "gateway"))
+	require.Equal(t, "PROXY TCP4 192.0.2.1 127.0.0.1 40000 9999\r\n", proxyHeaderFor(t, channel, "mallory"))
+
+	// Without any rules, nobody is trusted
+	channel.TrustMetadata = nil
+	require.Equal(t, "PROXY TCP4 192.0.2.1 127.0.0.1 40000 9999\r\n", proxyHeaderFor(t, channel, "gateway"))
+}
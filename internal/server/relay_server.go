@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"github.com/bokysan/socketace/v2/internal/relay"
+	"github.com/bokysan/socketace/v2/internal/socketace"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/bokysan/socketace/v2/internal/util/auth"
+	"github.com/bokysan/socketace/v2/internal/util/cert"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"sync"
+	"time"
+)
+
+// RelayRetryInterval is the longest pause between the attempts to reach the relay
+var RelayRetryInterval = 30 * time.Second
+
+// RelayServer dials out to a relay instead of listening, and waits there for the clients of its session, e.g.
+// `relay+tcp://relay.example.org:9000?session=office&secret=s3cret`. It keeps Idle links open at the relay, so the
+// clients never wait for the server to dial in.
+type RelayServer struct {
+	cert.ServerConfig
+	Authentication auth.ServerConfig   `json:"authentication"`
+	Mux            socketace.MuxConfig `json:"mux"`
+
+	Address  addr.ProtoAddress `json:"address"`
+	Channels []string          `json:"channels"`
+	Idle     int               `json:"idle"`
+
+	relay     *relay.Address
+	upstreams Channels
+	mutex     sync.Mutex
+	waiting   map[io.Closer]struct{}
+	shutdown  chan struct{}
+}
+
+func NewRelayServer() *RelayServer {
+	return &RelayServer{
+		Idle: 2,
+	}
+}
+
+func (st *RelayServer) String() string {
+	return relay.Redact(st.Address)
+}
+
+func (st *RelayServer) Startup(channels Channels) error {
+	if upstreams, err := channels.Filter(st.Channels); err != nil {
+		return errors.WithStack(err)
+	} else {
+		st.upstreams = upstreams
+	}
+
+	a, err := relay.ParseAddress(st.Address)
+	if err != nil {
+		return err
+	}
+	// The relay is not trusted, the clients must be able to upgrade the link with StartTLS
+	if st.Certificate == "" && st.CertificateFile == "" {
+		return errors.Errorf("Relay server %v needs a certificate to secure the links end to end", st.String())
+	}
+	st.relay = a
+	if st.Idle < 1 {
+		st.Idle = 1
+	}
+
+	st.waiting = make(map[io.Closer]struct{})
+	st.shutdown = make(chan struct{})
+
+	log.Infof("Starting relay server at %s", st.relay.String())
+	for i := 0; i < st.Idle; i++ {
+		go st.maintain(st.shutdown)
+	}
+	return nil
+}
+
+// maintain keeps a link waiting at the relay. Once the link is paired with a client, the client is accepted and a
+// new link is opened.
+func (st *RelayServer) maintain(shutdown chan struct{}) {
+	delay := time.Second
+	for {
+		err := st.wait(shutdown)
+		select {
+		case <-shutdown:
+			return
+		default:
+		}
+		if err != nil {
+			log.WithError(err).Warnf("Relay link to %v failed: %v", st.relay, err)
+			select {
+			case <-shutdown:
+				return
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > RelayRetryInterval {
+				delay = RelayRetryInterval
+			}
+			continue
+		}
+		delay = time.Second
+	}
+}
+
+// wait opens a link to the relay and waits until it's paired with a client
+func (st *RelayServer) wait(shutdown chan struct{}) error {
+	conn, err := relay.Connect(context.Background(), st.relay, relay.RoleServer, &st.ServerConfig.Config)
+	if err != nil {
+		return err
+	}
+
+	st.mutex.Lock()
+	select {
+	case <-shutdown:
+		st.mutex.Unlock()
+		streams.TryClose(conn)
+		return nil
+	default:
+		st.waiting[conn] = struct{}{}
+	}
+	st.mutex.Unlock()
+
+	err = relay.Await(conn)
+
+	st.mutex.Lock()
+	delete(st.waiting, conn)
+	st.mutex.Unlock()
+
+	if err != nil {
+		streams.TryClose(conn)
+		return err
+	}
+
+	log.Debugf("Client paired via relay %v", st.relay)
+	go func() {
+		// The link is encrypted by the relay transport at most, not end to end: the client must use StartTLS
+		if err := AcceptConnection(streams.NewNamedConnection(conn, "relay"), &st.ServerConfig, false, &st.Authentication, &st.Mux, st.upstreams); err != nil {
+			log.WithError(err).Errorf("Error accepting connection: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (st *RelayServer) Shutdown() error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if st.shutdown != nil {
+		close(st.shutdown)
+		st.shutdown = nil
+	}
+	for conn := range st.waiting {
+		streams.TryClose(conn)
+	}
+	return nil
+}
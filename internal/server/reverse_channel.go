@@ -0,0 +1,131 @@
+package server
+
+import (
+	"fmt"
+	"github.com/bokysan/socketace/v2/internal/socketace"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/multiformats/go-multistream"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net"
+	"path"
+)
+
+// ReverseChannel lets the clients expose their services through the server, like `ssh -R`. The client selects the
+// channel with the address the server should listen on, e.g. `/expose/tcp://0.0.0.0:8080`. The server accepts the
+// connections on that address and opens a stream back to the client for each of them. The address must match any of
+// the Bind patterns; use Allow to choose the clients which may use the channel.
+type ReverseChannel struct {
+	AbstractChannel
+	Bind []string `json:"bind"`
+}
+
+func (u *ReverseChannel) String() string {
+	return fmt.Sprintf("%v<-%v", u.Name(), "reverse")
+}
+
+// OpenConnection fails, as the reverse channel is only used to listen
+func (u *ReverseChannel) OpenConnection(metadata *socketace.StreamMetadata) (net.Conn, error) {
+	return nil, errors.Errorf("Channel %v only accepts reverse tunnels", u.Name())
+}
+
+// Permits returns true if the client may listen on the address
+func (u *ReverseChannel) Permits(address string) bool {
+	a, err := addr.ParseAddress(address)
+	if err != nil {
+		return false
+	}
+	switch a.Scheme {
+	case "tcp", "tcp4", "tcp6", "unix":
+	default:
+		return false
+	}
+	for _, pattern := range u.Bind {
+		if ok, err := path.Match(pattern, address); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// listenAddress returns the network and the address to listen on
+func listenAddress(address string) (string, string, error) {
+	a, err := addr.ParseAddress(address)
+	if err != nil {
+		return "", "", err
+	}
+	if a.Host != "" {
+		return a.Scheme, a.Host, nil
+	}
+	return a.Scheme, a.Path, nil
+}
+
+// serveReverse will listen on the address for the reverse tunnel for as long as the control stream is open
+func (ch *ConnectionHandler) serveReverse(channel *ReverseChannel, address string, control io.ReadWriteCloser) error {
+	defer streams.TryClose(control)
+
+	network, host, err := listenAddress(address)
+	var listener net.Listener
+	if err == nil {
+		listener, err = net.Listen(network, host)
+	}
+	if err != nil {
+		err = errors.Wrapf(err, "Could not listen on %v", address)
+		log.WithError(err).Warnf("[Server] Reverse tunnel %v for %v refused: %v", channel.Name(), ch.identity, err)
+		return socketace.WriteBindReply(control, err)
+	}
+	defer streams.TryClose(listener)
+
+	if err := socketace.WriteBindReply(control, nil); err != nil {
+		return err
+	}
+	log.Infof("[Server] Listening on %v for %v via %v", address, ch.identity, channel.Name())
+
+	// The client closes the control stream (or the session dies) when the tunnel is not needed anymore
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, control)
+		streams.TryClose(listener)
+	}()
+
+	protocol := "/" + channel.Name() + "/" + address
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Infof("[Server] Stopped listening on %v for %v", address, ch.identity)
+			return nil
+		}
+		go ch.openReverse(channel, protocol, conn)
+	}
+}
+
+// openReverse will open a stream to the client for the connection accepted by the reverse tunnel
+func (ch *ConnectionHandler) openReverse(channel *ReverseChannel, protocol string, conn net.Conn) {
+	defer streams.TryClose(conn)
+
+	stream, err := ch.openStream(protocol)
+	if err != nil {
+		log.WithError(err).Warnf("[Server] Could not open a reverse stream for %v: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	log.Debugf("[Server] Reverse connection from %v via %v", conn.RemoteAddr(), channel.Name())
+	if err := streams.PipeData(channel.Shaper().Server(stream, ch.scheduler), conn); err != nil {
+		log.WithError(err).Debugf("[Server] Reverse connection from %v failed: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// openStream will open a stream to the client and select the protocol, which the client must have registered
+func (ch *ConnectionHandler) openStream(protocol string) (net.Conn, error) {
+	stream, err := ch.session.OpenStream()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := multistream.SelectProtoOrFail(protocol, stream); err != nil {
+		streams.TryClose(stream)
+		return nil, errors.Wrapf(err, "Client refused the stream %v", protocol)
+	}
+	return stream, nil
+}
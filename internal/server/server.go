@@ -85,6 +85,8 @@ func unmarshalServer(s interface{}) (Server, error) {
 				server = NewPacketServer()
 			case "dns", "dns+udp", "dns+tcp", "dns+tcp+tls":
 				server = NewDnsServer()
+			case "relay+tcp", "relay+tcp+tls", "relay+unix", "relay+http", "relay+https", "relay+ws", "relay+wss", "relay+udp":
+				server = NewRelayServer()
 			default:
 				return nil, errors.Errorf("Unknown network type: %s", address.Scheme)
 			}
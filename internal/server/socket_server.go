@@ -3,8 +3,10 @@ package server
 import (
 	"crypto/tls"
 	"fmt"
+	"github.com/bokysan/socketace/v2/internal/socketace"
 	"github.com/bokysan/socketace/v2/internal/streams"
 	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/bokysan/socketace/v2/internal/util/auth"
 	"github.com/bokysan/socketace/v2/internal/util/cert"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
@@ -15,12 +17,17 @@ import (
 
 type SocketServer struct {
 	cert.ServerConfig
+	Authentication auth.ServerConfig   `json:"authentication"`
+	Mux            socketace.MuxConfig `json:"mux"`
 
 	Address  addr.ProtoAddress `json:"address"`
 	Channels []string          `json:"channels"`
+	// Sharing shares the port with other services, if set
+	Sharing *PortSharing `json:"sharing"`
 
 	name      string
 	secure    bool
+	tlsConfig *tls.Config
 	upstreams Channels
 	listener  net.Listener
 	done      bool
@@ -63,11 +70,22 @@ func (st *SocketServer) Startup(channels Channels) error {
 		return errors.WithStack(err)
 	}
 
-	if st.secure {
+	if st.secure && st.Sharing != nil {
+		// The TLS connections are decrypted once the protocol is detected
+		if st.tlsConfig, err = st.ServerConfig.GetTlsConfig(); err != nil {
+			return errors.Wrapf(err, "Could not configure TLS")
+		}
+		st.tlsConfig = withAlpn(st.tlsConfig, "http/1.1")
+		log.Infof("Starting shared TLS socket server at %s", st.String())
+		if st.listener, err = net.Listen(n.Network(), n.String()); err != nil {
+			return errors.WithStack(err)
+		}
+	} else if st.secure {
 		var tlsConfig *tls.Config
 		if tlsConfig, err = st.ServerConfig.GetTlsConfig(); err != nil {
 			return errors.Wrapf(err, "Could not configure TLS")
 		}
+		tlsConfig = withAlpn(tlsConfig)
 		log.Infof("Starting TLS socket server at %s", st.String())
 		if st.listener, err = tls.Listen(n.Network(), n.String(), tlsConfig); err != nil && err != http.ErrServerClosed {
 			return errors.WithStack(err)
@@ -112,7 +130,11 @@ func (st *SocketServer) acceptConnection() {
 			}
 			continue
 		}
-		if err = AcceptConnection(conn, &st.ServerConfig, st.secure, st.upstreams); err != nil {
+		if st.Sharing != nil {
+			go st.share(conn)
+			continue
+		}
+		if err = AcceptConnection(conn, &st.ServerConfig, st.secure, &st.Authentication, &st.Mux, st.upstreams); err != nil {
 			log.WithError(err).Errorf("Error accepting connection: %v", err)
 		}
 	}
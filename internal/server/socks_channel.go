@@ -0,0 +1,317 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/armon/go-socks5"
+	"github.com/bokysan/socketace/v2/internal/socketace"
+	"github.com/bokysan/socketace/v2/internal/socks"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SocksBindTimeout is how long a BIND waits for the incoming connection
+var SocksBindTimeout = 2 * time.Minute
+
+// SocksChannel is a SOCKS5 proxy on the server, e.g. `socks://`. CONNECT opens a connection to the destination. UDP
+// ASSOCIATE does not open a UDP port on the server: after the reply, the stream itself carries the UDP requests
+// (RFC 1928, section 7), framed by streams.WriteDatagram, and the `socks` listener on the client relays them from a
+// local UDP port. BIND must be enabled; the server listens on BindAddress for a single incoming connection.
+//
+// The destinations are restricted by Destinations (any destination, if no networks and hosts are defined). The names
+// are resolved by the Resolver (a DNS server, e.g. `10.0.0.53:53`), if set. If Users are defined, the clients must
+// authenticate with one of them.
+type SocksChannel struct {
+	AbstractChannel
+	Destinations
+	Users       map[string]string `json:"users"`
+	Resolver    string            `json:"resolver"`
+	Bind        bool              `json:"bind"`
+	BindAddress string            `json:"bindAddress"`
+}
+
+func (u *SocksChannel) String() string {
+	return fmt.Sprintf("%v:%v", u.Name(), "socks")
+}
+
+func (u *SocksChannel) OpenConnection(metadata *socketace.StreamMetadata) (net.Conn, error) {
+	p1Reader, p1Writer := io.Pipe()
+	p2Reader, p2Writer := io.Pipe()
+	p1 := streams.NewReadWriteCloser(p1Reader, p2Writer)
+	p2 := streams.NewReadWriteCloser(p2Reader, p1Writer)
+
+	var clientPipe streams.Connection
+	var serverPipe streams.Connection
+
+	clientPipe = streams.NewSimulatedConnection(p1, streams.Localhost, streams.Localhost)
+	serverPipe = streams.NewSimulatedConnection(p2, streams.Localhost, streams.Localhost)
+
+	clientPipe = streams.NewNamedConnection(clientPipe, u.String())
+
+	go func() {
+		defer streams.TryClose(serverPipe)
+		if err := u.serve(serverPipe); err != nil {
+			log.WithError(err).Errorf("Error processing SOCKS connection: %v", err)
+		}
+	}()
+
+	return clientPipe, nil
+}
+
+// serve authenticates the client and handles its request
+func (u *SocksChannel) serve(conn net.Conn) error {
+	var header [2]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return errors.Wrapf(err, "Failed to read the SOCKS greeting")
+	}
+	if header[0] != socks.Version {
+		return errors.Errorf("Unsupported SOCKS version: %v", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return errors.Wrapf(err, "Failed to read the authentication methods")
+	}
+
+	var authenticator socks5.Authenticator = socks5.NoAuthAuthenticator{}
+	if len(u.Users) > 0 {
+		authenticator = socks5.UserPassAuthenticator{Credentials: socks5.StaticCredentials(u.Users)}
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == authenticator.GetCode()
+	}
+	if !offered {
+		_, _ = conn.Write([]byte{socks.Version, socks.MethodNoAcceptable})
+		return errors.Errorf("No acceptable authentication method")
+	}
+	if _, err := authenticator.Authenticate(conn, conn); err != nil {
+		return errors.Wrapf(err, "Failed to authenticate")
+	}
+
+	req, err := socks5.NewRequest(conn)
+	if err != nil {
+		_ = socks.WriteReply(conn, socks.ReplyAddressNotSupported, nil)
+		return errors.Wrapf(err, "Failed to read the request")
+	}
+
+	resolver := u.resolver()
+	switch req.Command {
+	case socks5.ConnectCommand:
+		return u.connect(conn, req.DestAddr, resolver)
+	case socks5.AssociateCommand:
+		return u.associate(conn, resolver)
+	case socks5.BindCommand:
+		if u.Bind {
+			return u.bind(conn, req.DestAddr)
+		}
+	}
+	_ = socks.WriteReply(conn, socks.ReplyCommandNotSupported, nil)
+	return errors.Errorf("Unsupported command: %v", req.Command)
+}
+
+// resolver returns the resolver of the destination names
+func (u *SocksChannel) resolver() *net.Resolver {
+	if u.Resolver == "" {
+		return net.DefaultResolver
+	}
+	server := u.Resolver
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			d := net.Dialer{}
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// destination checks the destination against the allowlists and returns the resolved addresses
+func (u *SocksChannel) destination(a *socks5.AddrSpec, resolver *net.Resolver) ([]string, uint8, error) {
+	target := a.Address()
+	addresses := []string{target}
+	if len(u.Networks) > 0 || len(u.Hosts) > 0 {
+		var err error
+		if addresses, err = u.resolve(target, resolver); err != nil {
+			return nil, socks.ReplyRuleFailure, errors.Wrapf(err, "Destination %v not allowed by %v", target, u.Name())
+		}
+	} else if !u.permitsPort(a.Port) {
+		return nil, socks.ReplyRuleFailure, errors.Errorf("Port %v is not allowed by %v", a.Port, u.Name())
+	}
+
+	// Without the allowlists, the names have not been resolved yet
+	ctx, cancel := context.WithTimeout(context.Background(), DynamicResolveTimeout)
+	defer cancel()
+	resolved := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		host, port, _ := net.SplitHostPort(address)
+		if net.ParseIP(host) != nil {
+			resolved = append(resolved, address)
+			continue
+		}
+		ips, err := resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, socks.ReplyHostUnreachable, errors.Wrapf(err, "Could not resolve %v", host)
+		}
+		for _, ip := range ips {
+			resolved = append(resolved, net.JoinHostPort(ip.IP.String(), port))
+		}
+	}
+	if len(resolved) == 0 {
+		return nil, socks.ReplyHostUnreachable, errors.Errorf("No addresses for %v", target)
+	}
+	return resolved, socks.ReplySuccess, nil
+}
+
+// replyCode returns the reply for the failed connection
+func replyCode(err error) uint8 {
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "refused"):
+		return socks.ReplyConnectionRefused
+	case strings.Contains(msg, "network is unreachable"):
+		return socks.ReplyNetworkUnreachable
+	}
+	return socks.ReplyHostUnreachable
+}
+
+// connect opens the connection to the destination
+func (u *SocksChannel) connect(conn net.Conn, dest *socks5.AddrSpec, resolver *net.Resolver) error {
+	addresses, code, err := u.destination(dest, resolver)
+	if err != nil {
+		_ = socks.WriteReply(conn, code, nil)
+		return err
+	}
+
+	var target net.Conn
+	for _, a := range addresses {
+		if target, err = net.Dial("tcp", a); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		_ = socks.WriteReply(conn, replyCode(err), nil)
+		return errors.Wrapf(err, "Remote connection failed to %v", dest.Address())
+	}
+	target = streams.NewNamedConnection(target, u.Name()+"->"+dest.Address())
+
+	if err := socks.WriteReply(conn, socks.ReplySuccess, socks.AddrSpec(target.LocalAddr())); err != nil {
+		streams.TryClose(target)
+		return errors.WithStack(err)
+	}
+	log.Tracef("[Channel] SOCKS connected to %v", target)
+	return streams.PipeData(conn, target)
+}
+
+// bind waits for a single connection from the destination, e.g. for active FTP
+func (u *SocksChannel) bind(conn net.Conn, dest *socks5.AddrSpec) error {
+	listener, err := net.Listen("tcp", net.JoinHostPort(u.BindAddress, "0"))
+	if err != nil {
+		_ = socks.WriteReply(conn, socks.ReplyServerFailure, nil)
+		return errors.Wrapf(err, "Could not listen on %v", u.BindAddress)
+	}
+	defer streams.TryClose(listener)
+
+	if err := socks.WriteReply(conn, socks.ReplySuccess, socks.AddrSpec(listener.Addr())); err != nil {
+		return errors.WithStack(err)
+	}
+	_ = listener.(*net.TCPListener).SetDeadline(time.Now().Add(SocksBindTimeout))
+	peer, err := listener.Accept()
+	if err != nil {
+		_ = socks.WriteReply(conn, socks.ReplyTTLExpired, nil)
+		return errors.Wrapf(err, "No connection to %v", listener.Addr())
+	}
+
+	// Only the destination of the request may connect
+	remote := peer.RemoteAddr().(*net.TCPAddr)
+	if dest.IP != nil && !dest.IP.IsUnspecified() && !dest.IP.Equal(remote.IP) {
+		streams.TryClose(peer)
+		_ = socks.WriteReply(conn, socks.ReplyRuleFailure, nil)
+		return errors.Errorf("Unexpected connection from %v, expected %v", remote, dest.IP)
+	}
+
+	if err := socks.WriteReply(conn, socks.ReplySuccess, socks.AddrSpec(remote)); err != nil {
+		streams.TryClose(peer)
+		return errors.WithStack(err)
+	}
+	log.Tracef("[Channel] SOCKS accepted %v", remote)
+	return streams.PipeData(conn, streams.NewNamedConnection(peer, u.Name()+"<-"+remote.String()))
+}
+
+// associate relays the datagrams carried over the stream. Only the replies from the destinations are passed back.
+func (u *SocksChannel) associate(conn net.Conn, resolver *net.Resolver) error {
+	relay, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		_ = socks.WriteReply(conn, socks.ReplyServerFailure, nil)
+		return errors.Wrapf(err, "Could not open a UDP socket")
+	}
+	defer streams.TryClose(relay)
+
+	// The datagrams are sent over this stream, there's no address to send them to
+	if err := socks.WriteReply(conn, socks.ReplySuccess, nil); err != nil {
+		return errors.WithStack(err)
+	}
+
+	// The stream is only closed by the caller: once the association ends, the relay is closed and this stops too
+	var mutex sync.Mutex
+	contacted := make(map[string]bool)
+	go func() {
+		buf := make([]byte, streams.MaxDatagramSize)
+		for {
+			n, from, err := relay.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			mutex.Lock()
+			known := contacted[from.String()]
+			mutex.Unlock()
+			if !known {
+				continue
+			}
+			p, err := socks.Datagram(socks.AddrSpec(from), buf[:n])
+			if err == nil {
+				err = streams.WriteDatagram(conn, p)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	destinations := make(map[string]*net.UDPAddr)
+	buf := make([]byte, streams.MaxDatagramSize)
+	for {
+		n, err := streams.ReadDatagram(conn, buf)
+		if err != nil {
+			// The association ends with the stream
+			return nil
+		}
+		dest, data, err := socks.ParseDatagram(buf[:n])
+		if err != nil {
+			log.WithError(err).Debugf("[Channel] Dropping SOCKS datagram: %v", err)
+			continue
+		}
+
+		target, ok := destinations[dest.Address()]
+		if !ok {
+			if addresses, _, err := u.destination(dest, resolver); err != nil {
+				log.WithError(err).Debugf("[Channel] Dropping SOCKS datagram: %v", err)
+			} else if target, err = net.ResolveUDPAddr("udp", addresses[0]); err == nil {
+				mutex.Lock()
+				contacted[target.String()] = true
+				mutex.Unlock()
+			}
+			destinations[dest.Address()] = target
+		}
+		if target != nil {
+			_, _ = relay.WriteTo(data, target)
+		}
+	}
+}
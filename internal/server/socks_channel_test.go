@@ -0,0 +1,149 @@
+package server
+
+import (
+	"github.com/armon/go-socks5"
+	"github.com/bokysan/socketace/v2/internal/socks"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"testing"
+)
+
+// socksRequest authenticates and sends the request to the channel, returning the reply
+func socksRequest(t *testing.T, c *SocksChannel, user, password string, command uint8, dest *socks5.AddrSpec) (net.Conn, uint8, *socks5.AddrSpec) {
+	conn, err := c.OpenConnection(nil)
+	require.NoError(t, err)
+
+	choice := make([]byte, 2)
+	if user == "" {
+		_, err = conn.Write([]byte{socks.Version, 1, socks.MethodNoAuth})
+		require.NoError(t, err)
+		_, err = io.ReadFull(conn, choice)
+		require.NoError(t, err)
+		require.Equal(t, socks.MethodNoAuth, choice[1])
+	} else {
+		_, err = conn.Write([]byte{socks.Version, 1, socks.MethodUserPass})
+		require.NoError(t, err)
+		_, err = io.ReadFull(conn, choice)
+		require.NoError(t, err)
+		require.Equal(t, socks.MethodUserPass, choice[1])
+		msg := append([]byte{1, byte(len(user))}, user...)
+		msg = append(append(msg, byte(len(password))), password...)
+		_, err = conn.Write(msg)
+		require.NoError(t, err)
+		_, err = io.ReadFull(conn, choice)
+		require.NoError(t, err)
+		require.Equal(t, uint8(0), choice[1])
+	}
+
+	require.NoError(t, socks.WriteRequest(conn, command, dest))
+	code, bound, err := socks.ReadReply(conn)
+	require.NoError(t, err)
+	return conn, code, bound
+}
+
+func Test_SocksChannelConnect(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	port := echo.Addr().(*net.TCPAddr).Port
+
+	chl := &Channels{}
+	require.NoError(t, chl.UnmarshalJSON([]byte(`[{
+		"name": "proxy",
+		"address": "socks://",
+		"users": {"john": "s3cret"},
+		"networks": ["127.0.0.0/8"]
+	}]`)))
+	c, ok := (*chl)[0].(*SocksChannel)
+	require.True(t, ok)
+
+	conn, code, _ := socksRequest(t, c, "john", "s3cret", socks5.ConnectCommand, &socks5.AddrSpec{FQDN: "localhost", Port: port})
+	defer conn.Close()
+	require.Equal(t, socks.ReplySuccess, code)
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+
+	// The destination is not allowed
+	_, code, _ = socksRequest(t, c, "john", "s3cret", socks5.ConnectCommand, &socks5.AddrSpec{IP: net.ParseIP("10.1.2.3"), Port: 22})
+	require.Equal(t, socks.ReplyRuleFailure, code)
+
+	// BIND is not enabled
+	_, code, _ = socksRequest(t, c, "john", "s3cret", socks5.BindCommand, &socks5.AddrSpec{IP: net.IPv4zero})
+	require.Equal(t, socks.ReplyCommandNotSupported, code)
+
+	// Authentication is required
+	conn, err = c.OpenConnection(nil)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte{socks.Version, 1, socks.MethodNoAuth})
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, buf[:2])
+	require.NoError(t, err)
+	require.Equal(t, socks.MethodNoAcceptable, buf[1])
+}
+
+func Test_SocksChannelAssociate(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go datagramEcho(echo)
+	dest := socks.AddrSpec(echo.LocalAddr())
+
+	c := &SocksChannel{}
+	conn, code, bound := socksRequest(t, c, "", "", socks5.AssociateCommand, &socks5.AddrSpec{IP: net.IPv4zero})
+	defer conn.Close()
+	require.Equal(t, socks.ReplySuccess, code)
+	require.Equal(t, 0, bound.Port)
+
+	p, err := socks.Datagram(dest, []byte("query"))
+	require.NoError(t, err)
+	require.NoError(t, streams.WriteDatagram(conn, p))
+
+	buf := make([]byte, 1024)
+	n, err := streams.ReadDatagram(conn, buf)
+	require.NoError(t, err)
+	from, data, err := socks.ParseDatagram(buf[:n])
+	require.NoError(t, err)
+	require.Equal(t, "query", string(data))
+	require.Equal(t, dest.Port, from.Port)
+	require.True(t, dest.IP.Equal(from.IP))
+}
+
+func Test_SocksChannelBind(t *testing.T) {
+	c := &SocksChannel{Bind: true, BindAddress: "127.0.0.1"}
+	conn, code, bound := socksRequest(t, c, "", "", socks5.BindCommand, &socks5.AddrSpec{IP: net.ParseIP("127.0.0.1")})
+	defer conn.Close()
+	require.Equal(t, socks.ReplySuccess, code)
+
+	peer, err := net.Dial("tcp", bound.Address())
+	require.NoError(t, err)
+	defer peer.Close()
+	code, remote, err := socks.ReadReply(conn)
+	require.NoError(t, err)
+	require.Equal(t, socks.ReplySuccess, code)
+	require.Equal(t, peer.LocalAddr().(*net.TCPAddr).Port, remote.Port)
+
+	_, err = peer.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+}
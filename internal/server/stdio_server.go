@@ -3,8 +3,10 @@ package server
 import (
 	"crypto/tls"
 	"fmt"
+	"github.com/bokysan/socketace/v2/internal/socketace"
 	"github.com/bokysan/socketace/v2/internal/streams"
 	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/bokysan/socketace/v2/internal/util/auth"
 	"github.com/bokysan/socketace/v2/internal/util/cert"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
@@ -14,6 +16,8 @@ import (
 
 type IoServer struct {
 	cert.ServerConfig
+	Authentication auth.ServerConfig   `json:"authentication"`
+	Mux            socketace.MuxConfig `json:"mux"`
 
 	Address  addr.ProtoAddress `json:"address"`
 	Channels []string          `json:"channels"`
@@ -85,7 +89,7 @@ func (st *IoServer) Startup(channels Channels) error {
 		}
 		stream = streams.NewNamedConnection(stream, "stdin")
 
-		if err := AcceptConnection(stream, &st.ServerConfig, secure, st.upstreams); err != nil {
+		if err := AcceptConnection(stream, &st.ServerConfig, secure, &st.Authentication, &st.Mux, st.upstreams); err != nil {
 			log.WithError(err).Errorf("Error accepting connection: %v", err)
 		}
 	}()
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"fmt"
+	"github.com/bokysan/socketace/v2/internal/socketace"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/bokysan/socketace/v2/internal/util/auth"
+	"github.com/bokysan/socketace/v2/internal/vpn"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"sync"
+)
+
+// VpnChannel routes the IP packets of the clients, e.g. `vpn://`. The server attaches to the Device (a TUN interface,
+// e.g. `tun://socketace0`, or a userspace network stack, `userspace://`) with the first address of the Network, and
+// the clients get the other addresses. The Routes (the networks reachable through the server) are pushed to the
+// clients. The Clients matching the rules get a fixed Address and their Routes (the networks behind them) are routed
+// to them; the first matching entry is used.
+type VpnChannel struct {
+	AbstractChannel
+	Network Network           `json:"network"`
+	Device  addr.ProtoAddress `json:"device"`
+	MTU     int               `json:"mtu"`
+	Routes  []Network         `json:"routes"`
+	Clients []VpnClient       `json:"clients"`
+
+	switchOnce sync.Once
+	sw         *vpn.Switch
+	err        error
+}
+
+// VpnClient is the configuration of the VPN clients matching the rule
+type VpnClient struct {
+	auth.Rule
+	Address string    `json:"address"`
+	Routes  []Network `json:"routes"`
+}
+
+func (u *VpnChannel) String() string {
+	return fmt.Sprintf("%v<->%v", u.Name(), "vpn")
+}
+
+// OpenConnection fails, as the VPN channel only carries the packets of the clients
+func (u *VpnChannel) OpenConnection(metadata *socketace.StreamMetadata) (net.Conn, error) {
+	return nil, errors.Errorf("Channel %v only carries VPN packets", u.Name())
+}
+
+// Switch opens the device and returns the switch of the channel. The device is opened when the first client
+// attaches.
+func (u *VpnChannel) Switch() (*vpn.Switch, error) {
+	u.switchOnce.Do(func() {
+		if u.Network.IPNet == nil {
+			u.err = errors.Errorf("No network defined for %v", u.Name())
+			return
+		}
+		var device vpn.Device
+		if device, u.err = vpn.Open(&u.Device); u.err != nil {
+			return
+		}
+		routes := make([]*net.IPNet, 0)
+		for _, c := range u.Clients {
+			routes = append(routes, networks(c.Routes)...)
+		}
+		if u.sw, u.err = vpn.NewSwitch(device, u.Network.IPNet, u.MTU, routes); u.err != nil {
+			streams.TryClose(device)
+		}
+	})
+	return u.sw, u.err
+}
+
+// attachment returns the configuration of the client with the given identity
+func (u *VpnChannel) attachment(identity *auth.Identity) (vpn.Attachment, error) {
+	a := vpn.Attachment{
+		Name: identity.String(),
+		Push: networks(u.Routes),
+	}
+	var found *VpnClient
+	for i := range u.Clients {
+		if found == nil && u.Clients[i].Matches(identity) {
+			found = &u.Clients[i]
+		} else {
+			a.Push = append(a.Push, networks(u.Clients[i].Routes)...)
+		}
+	}
+	if found == nil {
+		return a, nil
+	}
+
+	if found.Address != "" {
+		if a.Address = net.ParseIP(found.Address); a.Address == nil {
+			return a, errors.Errorf("Invalid address of %v: %v", found.String(), found.Address)
+		}
+		if ip4 := a.Address.To4(); ip4 != nil {
+			a.Address = ip4
+		}
+	}
+	a.Routes = networks(found.Routes)
+	return a, nil
+}
+
+// networks returns the IP networks of the configured networks
+func networks(list []Network) []*net.IPNet {
+	res := make([]*net.IPNet, 0, len(list))
+	for _, n := range list {
+		res = append(res, n.IPNet)
+	}
+	return res
+}
+
+// serveVpn will attach the client to the switch of the channel for as long as the stream is open
+func (ch *ConnectionHandler) serveVpn(channel *VpnChannel, stream io.ReadWriteCloser) error {
+	defer streams.TryClose(stream)
+
+	sw, err := channel.Switch()
+	var a vpn.Attachment
+	if err == nil {
+		a, err = channel.attachment(ch.identity)
+	}
+	if err != nil {
+		log.WithError(err).Warnf("[Server] VPN %v for %v refused: %v", channel.Name(), ch.identity, err)
+		return vpn.WriteConfig(stream, nil, err)
+	}
+	return sw.Attach(channel.Shaper().Server(stream, ch.scheduler), a)
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"fmt"
+	"github.com/bokysan/socketace/v2/internal/util/auth"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func Test_VpnChannel(t *testing.T) {
+	chl := &Channels{}
+	require.NoError(t, chl.UnmarshalJSON([]byte(`[{"name":"vpn","address":"vpn://","network":"10.8.0.0/24",
+		"routes":["192.168.1.0/24"],"clients":[{"user":"office","address":"10.8.0.10","routes":["192.168.5.0/24"]}]}]`)))
+	channel, ok := (*chl)[0].(*VpnChannel)
+	require.True(t, ok)
+
+	a, err := channel.attachment(&auth.Identity{User: "office"})
+	require.NoError(t, err)
+	require.Equal(t, "10.8.0.10", a.Address.String())
+	require.Equal(t, "[192.168.5.0/24]", fmt.Sprint(a.Routes))
+	require.Equal(t, "[192.168.1.0/24]", fmt.Sprint(a.Push))
+
+	a, err = channel.attachment(&auth.Identity{User: "laptop"})
+	require.NoError(t, err)
+	require.Nil(t, a.Address)
+	require.Empty(t, a.Routes)
+	require.Equal(t, "[192.168.1.0/24 192.168.5.0/24]", fmt.Sprint(a.Push))
+
+	sw, err := channel.Switch()
+	require.NoError(t, err)
+	defer sw.Close()
+	require.Equal(t, "10.8.0.1", sw.Address().String())
+	require.Equal(t, "userspace", sw.Device().Name())
+
+	_, err = (&VpnChannel{}).Switch()
+	require.Error(t, err, "No network")
+}
@@ -0,0 +1,64 @@
+package shaping
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket which limits the number of bytes per second. The bucket holds at most one second worth
+// of tokens, so an idle stream can burst for up to a second.
+type Limiter struct {
+	mutex  sync.Mutex
+	rate   float64 // tokens added per second
+	burst  float64 // maximum number of tokens in the bucket
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter will create a new token bucket. It returns nil, which is a valid unlimited Limiter, if the bandwidth
+// is not limited.
+func NewLimiter(bandwidth Bandwidth) *Limiter {
+	if bandwidth <= 0 {
+		return nil
+	}
+	burst := float64(bandwidth)
+	if burst < ChunkSize {
+		burst = ChunkSize
+	}
+	return &Limiter{
+		rate:   float64(bandwidth),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// reserve takes n tokens from the bucket and returns how long to wait until they are available. The bucket may
+// go into debt, so that the concurrent callers are served in order.
+func (l *Limiter) reserve(n int) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// Wait blocks until n bytes may be sent
+func (l *Limiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	if d := l.reserve(n); d > 0 {
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,34 @@
+package shaping
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func Test_LimiterUnlimited(t *testing.T) {
+	var l *Limiter
+	require.Nil(t, NewLimiter(0))
+
+	start := time.Now()
+	l.Wait(1 << 30)
+	require.Less(t, int64(time.Since(start)), int64(10*time.Millisecond))
+}
+
+func Test_Limiter(t *testing.T) {
+	l := NewLimiter(100 * 1024)
+
+	// The first second is the burst
+	start := time.Now()
+	l.Wait(100 * 1024)
+	require.Less(t, int64(time.Since(start)), int64(50*time.Millisecond))
+
+	// After that, 20kB take 200ms
+	start = time.Now()
+	for i := 0; i < 5; i++ {
+		l.Wait(4 * 1024)
+	}
+	elapsed := time.Since(start)
+	require.Greater(t, int64(elapsed), int64(150*time.Millisecond))
+	require.Less(t, int64(elapsed), int64(400*time.Millisecond))
+}
@@ -0,0 +1,93 @@
+package shaping
+
+import (
+	"sync"
+	"time"
+)
+
+// MaxDelay is the longest a write waits for the writes of the higher priority classes. It makes sure the streams of
+// the lower classes are never starved completely.
+var MaxDelay = 100 * time.Millisecond
+
+// Scheduler orders the writes of the streams sharing a physical link. A write waits while there are writes of a
+// higher priority class in progress. When the link is idle, writes complete immediately and nobody waits; when it's
+// congested, the writes of the higher classes take longer and the lower classes yield to them.
+type Scheduler struct {
+	mutex   sync.Mutex
+	active  [classes]int
+	changed chan struct{} // closed whenever a write completes
+}
+
+// NewScheduler creates a scheduler for one physical link
+func NewScheduler() *Scheduler {
+	return &Scheduler{
+		changed: make(chan struct{}),
+	}
+}
+
+func index(p Priority) int {
+	i := int(p - Bulk)
+	if i < 0 {
+		return 0
+	} else if i >= classes {
+		return classes - 1
+	}
+	return i
+}
+
+// blocked returns true if there are writes of a higher class in progress. Expects the mutex to be held.
+func (s *Scheduler) blocked(i int) bool {
+	for j := i + 1; j < classes; j++ {
+		if s.active[j] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Acquire blocks until the stream of the given class may write. Each Acquire must be followed by a Release.
+func (s *Scheduler) Acquire(p Priority) {
+	if s == nil {
+		return
+	}
+	i := index(p)
+
+	var timeout <-chan time.Time
+	for {
+		s.mutex.Lock()
+		if !s.blocked(i) {
+			s.active[i]++
+			s.mutex.Unlock()
+			return
+		}
+		changed := s.changed
+		s.mutex.Unlock()
+
+		if timeout == nil {
+			timer := time.NewTimer(MaxDelay)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case <-changed:
+		case <-timeout:
+			s.mutex.Lock()
+			s.active[i]++
+			s.mutex.Unlock()
+			return
+		}
+	}
+}
+
+// Release marks the write of the stream of the given class as completed
+func (s *Scheduler) Release(p Priority) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.active[index(p)]--
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
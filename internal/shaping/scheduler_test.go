@@ -0,0 +1,63 @@
+package shaping
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func Test_SchedulerIdle(t *testing.T) {
+	s := NewScheduler()
+
+	// Nobody waits when there are no writes of a higher class
+	start := time.Now()
+	s.Acquire(Bulk)
+	s.Acquire(Normal)
+	s.Acquire(Interactive)
+	s.Release(Interactive)
+	s.Release(Normal)
+	s.Release(Bulk)
+	require.Less(t, int64(time.Since(start)), int64(10*time.Millisecond))
+}
+
+func Test_SchedulerPriority(t *testing.T) {
+	s := NewScheduler()
+	s.Acquire(Interactive)
+
+	acquired := make(chan Priority, 2)
+	go func() {
+		s.Acquire(Bulk)
+		acquired <- Bulk
+	}()
+	go func() {
+		s.Acquire(Interactive)
+		acquired <- Interactive
+	}()
+
+	// The interactive write does not wait for the other interactive write, the bulk one does
+	require.Equal(t, Interactive, <-acquired)
+	select {
+	case <-acquired:
+		require.Fail(t, "Bulk write should wait for the interactive ones")
+	case <-time.After(MaxDelay / 4):
+	}
+
+	s.Release(Interactive)
+	s.Release(Interactive)
+	require.Equal(t, Bulk, <-acquired)
+	s.Release(Bulk)
+}
+
+func Test_SchedulerStarvation(t *testing.T) {
+	s := NewScheduler()
+	s.Acquire(Interactive)
+	defer s.Release(Interactive)
+
+	// A write of a lower class waits for at most MaxDelay
+	start := time.Now()
+	s.Acquire(Bulk)
+	s.Release(Bulk)
+	elapsed := time.Since(start)
+	require.GreaterOrEqual(t, int64(elapsed), int64(MaxDelay))
+	require.Less(t, int64(elapsed), int64(MaxDelay*3))
+}
@@ -0,0 +1,163 @@
+package shaping
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+)
+
+// Priority is the class of the stream. When the physical link is congested, the streams of a higher class are
+// scheduled ahead of the streams of a lower class.
+type Priority int
+
+const (
+	// Bulk streams (e.g. backups) yield to all the others
+	Bulk Priority = iota - 1
+	// Normal is the class of the streams with no priority configured
+	Normal
+	// Interactive streams (e.g. ssh) are scheduled first and their writes are never split
+	Interactive
+
+	classes = 3
+)
+
+var priorityNames = map[Priority]string{
+	Interactive: "interactive",
+	Normal:      "normal",
+	Bulk:        "bulk",
+}
+
+func (p Priority) String() string {
+	if name, ok := priorityNames[p]; ok {
+		return name
+	}
+	return strconv.Itoa(int(p))
+}
+
+// ParsePriority will parse the name of the priority class. An empty name is the Normal class.
+func ParsePriority(name string) (Priority, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return Normal, nil
+	}
+	for p, n := range priorityNames {
+		if n == name {
+			return p, nil
+		}
+	}
+	return Normal, errors.Errorf("Unknown priority: %v. Expected one of: interactive, normal, bulk", name)
+}
+
+func (p Priority) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
+}
+
+func (p *Priority) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err != nil {
+		return errors.WithStack(err)
+	}
+	var err error
+	*p, err = ParsePriority(name)
+	return err
+}
+
+// Bandwidth is the rate limit in bytes per second. Zero means unlimited.
+type Bandwidth int64
+
+var bandwidthUnits = []struct {
+	suffix     string
+	multiplier float64
+}{
+	{"g", 1 << 30},
+	{"m", 1 << 20},
+	{"k", 1 << 10},
+	{"", 1},
+}
+
+// ParseBandwidth will parse the bandwidth in bytes per second, with an optional binary unit, e.g. `512k`, `1.5M`
+// or `10MB`
+func ParseBandwidth(value string) (Bandwidth, error) {
+	s := strings.ToLower(strings.TrimSpace(value))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "/s"), "b")
+	if s == "" {
+		return 0, nil
+	}
+	for _, u := range bandwidthUnits {
+		if !strings.HasSuffix(s, u.suffix) {
+			continue
+		}
+		f, err := strconv.ParseFloat(strings.TrimSuffix(s, u.suffix), 64)
+		if err != nil || f < 0 {
+			return 0, errors.Errorf("Invalid bandwidth: %v", value)
+		}
+		return Bandwidth(f * u.multiplier), nil
+	}
+	return 0, errors.Errorf("Invalid bandwidth: %v", value)
+}
+
+func (b Bandwidth) String() string {
+	for _, u := range bandwidthUnits {
+		if u.multiplier > 1 && int64(b)%int64(u.multiplier) == 0 && b != 0 {
+			return fmt.Sprintf("%d%s", int64(b)/int64(u.multiplier), strings.ToUpper(u.suffix))
+		}
+	}
+	return strconv.FormatInt(int64(b), 10)
+}
+
+// UnmarshalJSON accepts the bandwidth as a number of bytes per second or as a string with units, e.g. `512k`
+func (b *Bandwidth) UnmarshalJSON(data []byte) error {
+	var val interface{}
+	if err := json.Unmarshal(data, &val); err != nil {
+		return errors.WithStack(err)
+	}
+	switch v := val.(type) {
+	case nil:
+		*b = 0
+	case float64:
+		*b = Bandwidth(v)
+	case string:
+		res, err := ParseBandwidth(v)
+		if err != nil {
+			return err
+		}
+		*b = res
+	default:
+		return errors.Errorf("Expected a bandwidth, got: %v", val)
+	}
+	return nil
+}
+
+// Policy defines the rate limits and the priority of the streams of a channel. The directions are always seen
+// from the client: upload is the data sent by the client, download the data sent by the server.
+type Policy struct {
+	UploadLimit   Bandwidth `json:"uploadLimit"`
+	DownloadLimit Bandwidth `json:"downloadLimit"`
+	Priority      Priority  `json:"priority"`
+}
+
+// Set will set the parameter by its name, as used in the query parameters, e.g. `upload-limit=1M`
+func (c *Policy) Set(name, value string) (err error) {
+	switch strings.ToLower(name) {
+	case "upload-limit":
+		c.UploadLimit, err = ParseBandwidth(value)
+	case "download-limit":
+		c.DownloadLimit, err = ParseBandwidth(value)
+	case "priority":
+		c.Priority, err = ParsePriority(value)
+	default:
+		return errors.Errorf("Unknown shaping parameter: %v", name)
+	}
+	return err
+}
+
+// IsParameter returns true if the query parameter configures the shaping
+func IsParameter(name string) bool {
+	switch strings.ToLower(name) {
+	case "upload-limit", "download-limit", "priority":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package shaping
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func Test_ParseBandwidth(t *testing.T) {
+	for value, expected := range map[string]Bandwidth{
+		"":       0,
+		"1000":   1000,
+		"512k":   512 * 1024,
+		"1.5M":   1536 * 1024,
+		"10MB":   10 * 1024 * 1024,
+		"1gb/s":  1024 * 1024 * 1024,
+		" 64kB ": 64 * 1024,
+	} {
+		b, err := ParseBandwidth(value)
+		require.NoError(t, err, value)
+		require.Equal(t, expected, b, value)
+	}
+
+	for _, value := range []string{"fast", "-1k", "1x"} {
+		_, err := ParseBandwidth(value)
+		require.Error(t, err, value)
+	}
+
+	require.Equal(t, "512K", Bandwidth(512*1024).String())
+	require.Equal(t, "1000", Bandwidth(1000).String())
+}
+
+func Test_PolicyUnmarshal(t *testing.T) {
+	p := Policy{}
+	require.NoError(t, json.Unmarshal([]byte(`{"uploadLimit":"1M","downloadLimit":2048,"priority":"bulk"}`), &p))
+	require.Equal(t, Policy{UploadLimit: 1024 * 1024, DownloadLimit: 2048, Priority: Bulk}, p)
+
+	p = Policy{}
+	require.NoError(t, json.Unmarshal([]byte(`{}`), &p))
+	require.Equal(t, Normal, p.Priority)
+
+	require.Error(t, json.Unmarshal([]byte(`{"priority":"urgent"}`), &p))
+}
+
+func Test_PolicySet(t *testing.T) {
+	p := Policy{}
+	require.NoError(t, p.Set("priority", "interactive"))
+	require.NoError(t, p.Set("Upload-Limit", "128k"))
+	require.Error(t, p.Set("download-limit", "lots"))
+	require.Error(t, p.Set("burst", "1"))
+	require.Equal(t, Policy{UploadLimit: 128 * 1024, Priority: Interactive}, p)
+}
@@ -0,0 +1,113 @@
+package shaping
+
+import (
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"io"
+)
+
+// ChunkSize is the largest write of a non-interactive stream passed to the multiplexer at once. Smaller chunks let
+// the interactive streams overtake the bulk transfers sooner, which matters on the slow transports (DNS, stdio).
+const ChunkSize = 4096
+
+// Shaper applies the limits of one channel to its streams. The limits are shared by all the streams of the channel.
+// A nil Shaper does not limit the streams.
+type Shaper struct {
+	upload   *Limiter
+	download *Limiter
+	priority Priority
+}
+
+// NewShaper will create the limiters of the policy
+func NewShaper(policy Policy) *Shaper {
+	return &Shaper{
+		upload:   NewLimiter(policy.UploadLimit),
+		download: NewLimiter(policy.DownloadLimit),
+		priority: policy.Priority,
+	}
+}
+
+// Priority returns the priority class of the streams
+func (s *Shaper) Priority() Priority {
+	if s == nil {
+		return Normal
+	}
+	return s.priority
+}
+
+// Client will shape the stream on the client side, where the writes are uploads
+func (s *Shaper) Client(rw io.ReadWriteCloser, scheduler *Scheduler) *Stream {
+	if s == nil {
+		return NewStream(rw, scheduler, Normal, nil, nil)
+	}
+	return NewStream(rw, scheduler, s.priority, s.download, s.upload)
+}
+
+// Server will shape the stream on the server side, where the writes are downloads
+func (s *Shaper) Server(rw io.ReadWriteCloser, scheduler *Scheduler) *Stream {
+	if s == nil {
+		return NewStream(rw, scheduler, Normal, nil, nil)
+	}
+	return NewStream(rw, scheduler, s.priority, s.upload, s.download)
+}
+
+// Stream is a logical stream with rate limits and a priority class
+type Stream struct {
+	io.ReadWriteCloser
+	scheduler *Scheduler
+	priority  Priority
+	read      *Limiter
+	write     *Limiter
+}
+
+// NewStream will wrap the stream. Any of the scheduler and the limiters may be nil.
+func NewStream(rw io.ReadWriteCloser, scheduler *Scheduler, priority Priority, read, write *Limiter) *Stream {
+	return &Stream{
+		ReadWriteCloser: rw,
+		scheduler:       scheduler,
+		priority:        priority,
+		read:            read,
+		write:           write,
+	}
+}
+
+func (s *Stream) Read(p []byte) (int, error) {
+	if s.read != nil && len(p) > ChunkSize {
+		p = p[:ChunkSize]
+	}
+	n, err := s.ReadWriteCloser.Read(p)
+	s.read.Wait(n)
+	return n, err
+}
+
+func (s *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if s.priority != Interactive && len(chunk) > ChunkSize {
+			chunk = chunk[:ChunkSize]
+		}
+		s.write.Wait(len(chunk))
+
+		s.scheduler.Acquire(s.priority)
+		n, err := s.ReadWriteCloser.Write(chunk)
+		s.scheduler.Release(s.priority)
+
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (s *Stream) Closed() bool {
+	if c, ok := s.ReadWriteCloser.(streams.Closed); ok {
+		return c.Closed()
+	}
+	return false
+}
+
+func (s *Stream) Unwrap() io.ReadWriteCloser {
+	return s.ReadWriteCloser
+}
@@ -0,0 +1,45 @@
+package shaping
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"testing"
+)
+
+type recorder struct {
+	bytes.Buffer
+	writes []int
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	r.writes = append(r.writes, len(p))
+	return r.Buffer.Write(p)
+}
+
+func (r *recorder) Close() error {
+	return nil
+}
+
+func Test_StreamChunks(t *testing.T) {
+	data := make([]byte, 3*ChunkSize+10)
+
+	// Bulk writes are split...
+	r := &recorder{}
+	s := NewShaper(Policy{Priority: Bulk}).Client(r, NewScheduler())
+	n, err := s.Write(data)
+	require.NoError(t, err)
+	require.Equal(t, len(data), n)
+	require.Equal(t, []int{ChunkSize, ChunkSize, ChunkSize, 10}, r.writes)
+
+	// ...interactive are not
+	r = &recorder{}
+	s = NewShaper(Policy{Priority: Interactive}).Server(r, NewScheduler())
+	_, err = s.Write(data)
+	require.NoError(t, err)
+	require.Equal(t, []int{len(data)}, r.writes)
+
+	read, err := ioutil.ReadAll(s)
+	require.NoError(t, err)
+	require.Equal(t, data, read)
+}
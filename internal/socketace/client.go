@@ -4,6 +4,7 @@ import (
 	"crypto/tls"
 	"fmt"
 	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/bokysan/socketace/v2/internal/util/auth"
 	"github.com/bokysan/socketace/v2/internal/util/cert"
 	"github.com/bokysan/socketace/v2/internal/util/mime"
 	"github.com/bokysan/socketace/v2/internal/version"
@@ -23,18 +24,24 @@ type ClientConnection struct {
 	negotiatedVersion string
 	capabilities      []string
 	manager           cert.TlsConfig
+	credentials       auth.Credentials
 	host              string
 	secure            bool
 	securityTech      string
+	mux               *MuxConfig
 }
 
-// NewClientConnection will create a connection and negotiate the protocol and TLS security
-func NewClientConnection(c net.Conn, manager cert.TlsConfig, secure bool, host string) (*ClientConnection, error) {
+// NewClientConnection will create a connection and negotiate the protocol and TLS security. If the server
+// requires authorization, the provided credentials will be sent to the server. The multiplexer parameters (nil for
+// the defaults) are offered to the server, see ClientConnection.Mux for the agreed ones.
+func NewClientConnection(c net.Conn, manager cert.TlsConfig, secure bool, host string, credentials auth.Credentials, mux *MuxConfig) (*ClientConnection, error) {
 	conn := streams.NewBufferedInputConnection(c)
 	connection := &ClientConnection{
-		manager: manager,
-		host:    host,
-		secure:  secure,
+		manager:     manager,
+		credentials: credentials,
+		host:        host,
+		secure:      secure,
+		mux:         mux.withDefaults(),
 	}
 	if secure {
 		connection.securityTech = SecurityUnderlying
@@ -47,7 +54,7 @@ func NewClientConnection(c net.Conn, manager cert.TlsConfig, secure bool, host s
 		return nil, errors.Wrapf(err, "Could not negotiate protocol version: %v", err)
 	}
 
-	shouldStartTls := !secure && connection.containsCapability(connection.capabilities, CapabilityStartTls)
+	shouldStartTls := !secure && connection.HasCapability(CapabilityStartTls)
 
 	log.Debugf("[Client] SocketAce upgrade...")
 	if client, err := connection.upgrade(conn, shouldStartTls, secure); err != nil {
@@ -56,6 +63,15 @@ func NewClientConnection(c net.Conn, manager cert.TlsConfig, secure bool, host s
 		connection.Connection = client
 	}
 
+	if connection.HasCapability(CapabilityAuthorize) {
+		log.Debugf("[Client] SocketAce authorization...")
+		buffered := streams.NewBufferedInputConnection(connection.Connection)
+		if err := connection.authorize(buffered); err != nil {
+			return nil, errors.Wrapf(err, "Could not authorize: %v", err)
+		}
+		connection.Connection = streams.NewNamedConnection(buffered, "authorized")
+	}
+
 	return connection, nil
 }
 
@@ -93,6 +109,8 @@ func (cc *ClientConnection) handshake(conn *streams.BufferedInputConnection) (er
 	}
 	request.Headers.Set(AcceptsProtocolVersion, version.ProtocolVersion)
 	request.Headers.Set(UserAgent, "socketace/"+version.AppVersion())
+	request.Headers.Set(Capabilities, strings.Join(ClientCapabilities, ","))
+	cc.mux.writeHeaders(request.Headers)
 	if err := request.Write(conn); err != nil {
 		return errors.Wrapf(err, "Coud not send initial request")
 	}
@@ -110,6 +128,14 @@ func (cc *ClientConnection) handshake(conn *streams.BufferedInputConnection) (er
 	cc.negotiatedVersion = response.Headers.Get("Protocol-Version")
 	cc.capabilities = mime.SplitField(strings.ToUpper(response.Headers.Get(Capabilities)))
 
+	if !cc.HasCapability(CapabilityMux) {
+		cc.mux = cc.mux.legacy()
+	} else if cc.mux, err = readMuxHeaders(response.Headers); err != nil {
+		return errors.Wrapf(err, "Invalid multiplexer parameters")
+	} else if err = cc.mux.Validate(); err != nil {
+		return errors.Wrapf(err, "Server sent invalid multiplexer parameters")
+	}
+
 	return
 }
 
@@ -166,6 +192,53 @@ func (cc *ClientConnection) upgrade(conn *streams.BufferedInputConnection, shoul
 	return streams.NewNamedConnection(conn, "plain"), nil
 }
 
+// authorize will send the credentials to the server and check if they have been accepted
+func (cc *ClientConnection) authorize(conn *streams.BufferedInputConnection) error {
+	request := &Request{
+		Method:  RequestMethod,
+		URL:     AuthorizeUrl,
+		Headers: make(textproto.MIMEHeader),
+	}
+	request.Headers.Set(UserAgent, "socketace/"+version.AppVersion())
+
+	if cc.credentials != nil {
+		authorization, err := cc.credentials.Authorization()
+		if err != nil {
+			return errors.Wrapf(err, "Could not get credentials")
+		}
+		if authorization != "" {
+			if !cc.secure && !cc.credentials.AllowInsecure() {
+				return errors.Errorf("Refusing to send credentials over a non-encrypted connection")
+			} else if !cc.secure {
+				log.Warnf("[Client] (Insecure) Sending credentials over a non-encrypted connection!")
+			}
+			request.Headers.Set(Authorization, authorization)
+		}
+	}
+
+	if err := request.Write(conn); err != nil {
+		return errors.Wrapf(err, "Coud not send authorization request")
+	}
+
+	response := &Response{}
+	if err := response.Read(conn.Reader); err != nil {
+		return errors.Wrapf(err, "Could not get response to authorization request")
+	}
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		log.Debugf("[Client] Authorized by the server")
+		return nil
+	case http.StatusUnauthorized:
+		return errors.Errorf("Server requires authorization (%v): %v",
+			response.Headers.Get(WwwAuthenticate), response.Headers.Get("Message"))
+	case http.StatusForbidden:
+		return errors.Errorf("Server rejected our credentials: %v", response.Headers.Get("Message"))
+	default:
+		return errors.Errorf("Server refused our request with error: %v", response.StatusCode)
+	}
+}
+
 // startTls will start a TLS over the given connection
 func (cc *ClientConnection) startTls(conn streams.Connection) (streams.Connection, error) {
 	var tlsConfig *tls.Config
@@ -191,13 +264,27 @@ func (cc *ClientConnection) startTls(conn streams.Connection) (streams.Connectio
 	return streams.NewNamedConnection(tlsConn, "tls"), nil
 }
 
-// containsCapability checks if the provided slice contains the selected capability (case-insensitive)
-func (cc *ClientConnection) containsCapability(caps []string, cap string) bool {
-	cap = strings.ToUpper(cap)
-	for _, c := range caps {
-		if strings.ToUpper(c) == cap {
-			return true
+// Mux returns the multiplexer parameters agreed with the server
+func (cc *ClientConnection) Mux() *MuxConfig {
+	return cc.mux
+}
+
+// HasCapability returns true if the server advertised the given capability
+func (cc *ClientConnection) HasCapability(cap string) bool {
+	return containsCapability(cc.capabilities, cap)
+}
+
+// FindClientConnection will unwrap the connection until it finds the ClientConnection. It returns nil if the
+// connection does not wrap a ClientConnection.
+func FindClientConnection(conn net.Conn) *ClientConnection {
+	for conn != nil {
+		if cc, ok := conn.(*ClientConnection); ok {
+			return cc
+		} else if wrapper, ok := conn.(streams.UnwrappedConnection); ok {
+			conn = wrapper.Unwrap()
+		} else {
+			return nil
 		}
 	}
-	return false
+	return nil
 }
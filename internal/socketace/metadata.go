@@ -0,0 +1,95 @@
+package socketace
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"io"
+	"math"
+	"net"
+	"net/textproto"
+)
+
+const (
+	MetadataNetwork            = "Network"
+	MetadataSourceAddress      = "Source-Address"
+	MetadataDestinationAddress = "Destination-Address"
+)
+
+// StreamMetadata describes the connection a logical stream has been opened for. If CapabilityMetadata has been
+// negotiated, the client sends it on each channel stream, right after the channel has been selected.
+type StreamMetadata struct {
+	Network     string // Network of the original connection, e.g. `tcp` or `unix`
+	Source      string // Source is the address of the peer which connected to the client, e.g. `10.1.2.3:54321`
+	Destination string // Destination is the address the peer connected to
+}
+
+// NewStreamMetadata will describe the connection accepted by the client
+func NewStreamMetadata(conn net.Conn) *StreamMetadata {
+	md := &StreamMetadata{}
+	if a := conn.RemoteAddr(); a != nil {
+		md.Network = a.Network()
+		md.Source = a.String()
+	}
+	if a := conn.LocalAddr(); a != nil {
+		md.Destination = a.String()
+	}
+	return md
+}
+
+// WriteStreamMetadata will send the metadata to the server: a two-byte length followed by MIME headers. An empty
+// block is sent if the metadata is nil.
+func WriteStreamMetadata(w io.Writer, md *StreamMetadata) error {
+	headers := make(textproto.MIMEHeader)
+	if md != nil {
+		for name, value := range map[string]string{
+			MetadataNetwork:            md.Network,
+			MetadataSourceAddress:      md.Source,
+			MetadataDestinationAddress: md.Destination,
+		} {
+			if value != "" {
+				headers.Set(name, value)
+			}
+		}
+	}
+
+	block := &bytes.Buffer{}
+	for name, values := range headers {
+		for _, v := range values {
+			block.WriteString(name + ": " + v + "\r\n")
+		}
+	}
+	block.WriteString("\r\n")
+	if block.Len() > math.MaxUint16 {
+		return errors.Errorf("Stream metadata too long: %v bytes", block.Len())
+	}
+
+	frame := make([]byte, 2, 2+block.Len())
+	binary.BigEndian.PutUint16(frame, uint16(block.Len()))
+	_, err := w.Write(append(frame, block.Bytes()...))
+	return errors.Wrapf(err, "Could not send stream metadata")
+}
+
+// ReadStreamMetadata will read the metadata sent by the client. Exactly the metadata is read from the stream, so
+// it may be piped to the channel afterwards.
+func ReadStreamMetadata(r io.Reader) (*StreamMetadata, error) {
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return nil, errors.Wrapf(err, "Could not read stream metadata")
+	}
+	block := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(r, block); err != nil {
+		return nil, errors.Wrapf(err, "Could not read stream metadata")
+	}
+
+	headers, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(block))).ReadMIMEHeader()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid stream metadata")
+	}
+	return &StreamMetadata{
+		Network:     headers.Get(MetadataNetwork),
+		Source:      headers.Get(MetadataSourceAddress),
+		Destination: headers.Get(MetadataDestinationAddress),
+	}, nil
+}
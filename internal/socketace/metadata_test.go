@@ -0,0 +1,38 @@
+package socketace
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"testing"
+)
+
+func Test_StreamMetadata(t *testing.T) {
+	buf := &bytes.Buffer{}
+	md := &StreamMetadata{
+		Network:     "tcp",
+		Source:      "10.1.2.3:54321",
+		Destination: "127.0.0.1:2222",
+	}
+	require.NoError(t, WriteStreamMetadata(buf, md))
+	buf.WriteString("data")
+
+	read, err := ReadStreamMetadata(buf)
+	require.NoError(t, err)
+	require.Equal(t, md, read)
+
+	// Nothing more than the metadata is read
+	rest, err := ioutil.ReadAll(buf)
+	require.NoError(t, err)
+	require.Equal(t, "data", string(rest))
+}
+
+func Test_StreamMetadataEmpty(t *testing.T) {
+	buf := &bytes.Buffer{}
+	require.NoError(t, WriteStreamMetadata(buf, nil))
+
+	read, err := ReadStreamMetadata(buf)
+	require.NoError(t, err)
+	require.Equal(t, &StreamMetadata{}, read)
+	require.Equal(t, 0, buf.Len())
+}
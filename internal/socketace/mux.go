@@ -0,0 +1,172 @@
+package socketace
+
+import (
+	"github.com/bokysan/socketace/v2/internal/util/buffers"
+	"github.com/bokysan/socketace/v2/internal/util/duration"
+	"github.com/pkg/errors"
+	"github.com/xtaci/smux"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	MuxVersion           = "Mux-Version"
+	MuxKeepAliveInterval = "Mux-Keepalive-Interval"
+	MuxKeepAliveTimeout  = "Mux-Keepalive-Timeout"
+	MuxReceiveBuffer     = "Mux-Receive-Buffer"
+	MuxStreamBuffer      = "Mux-Stream-Buffer"
+
+	// DefaultMuxVersion is the highest smux protocol version offered by default. Version 2 adds per-stream flow
+	// control, so that one bulk stream can't starve the others.
+	DefaultMuxVersion = 2
+	maxMuxVersion     = 2
+)
+
+// MuxConfig are the parameters of the logical connection multiplexer (smux). Both sides announce their parameters
+// in the handshake and agree on the common ones: the lower of the versions, the longer of the keepalive intervals
+// and timeouts, and the smaller of the buffers. Zero values are replaced by the defaults.
+type MuxConfig struct {
+	Version           int               `json:"version"           long:"mux-version"            env:"MUX_VERSION"            description:"Highest smux protocol version to use (1 or 2). Version 2 adds per-stream flow control. Defaults to 2."`
+	KeepAliveInterval duration.Duration `json:"keepAliveInterval" long:"mux-keepalive-interval" env:"MUX_KEEPALIVE_INTERVAL" description:"How often the multiplexer pings the other side. Defaults to 10s."`
+	KeepAliveTimeout  duration.Duration `json:"keepAliveTimeout"  long:"mux-keepalive-timeout"  env:"MUX_KEEPALIVE_TIMEOUT"  description:"After how long without any data the multiplexer closes the session. Defaults to 30s."`
+	MaxReceiveBuffer  int               `json:"maxReceiveBuffer"  long:"mux-receive-buffer"     env:"MUX_RECEIVE_BUFFER"     description:"Maximum number of bytes buffered for all the streams of the session. Defaults to 4MB."`
+	MaxStreamBuffer   int               `json:"maxStreamBuffer"   long:"mux-stream-buffer"      env:"MUX_STREAM_BUFFER"      description:"Maximum number of bytes buffered for a single stream (version 2 only). Defaults to 64KB."`
+}
+
+// Set will set the parameter by its name, as used in the headers (case-insensitive, with or without the `Mux-`
+// prefix), e.g. `version` or `mux-stream-buffer`
+func (mc *MuxConfig) Set(name, value string) error {
+	name = strings.TrimPrefix(strings.ToLower(name), "mux-")
+	var err error
+	switch name {
+	case "version":
+		mc.Version, err = strconv.Atoi(value)
+	case "keepalive-interval":
+		mc.KeepAliveInterval, err = duration.Parse(value)
+	case "keepalive-timeout":
+		mc.KeepAliveTimeout, err = duration.Parse(value)
+	case "receive-buffer":
+		mc.MaxReceiveBuffer, err = strconv.Atoi(value)
+	case "stream-buffer":
+		mc.MaxStreamBuffer, err = strconv.Atoi(value)
+	default:
+		return errors.Errorf("Unknown multiplexer parameter: %v", name)
+	}
+	return errors.Wrapf(err, "Invalid multiplexer parameter %v: %v", name, value)
+}
+
+// Override returns a copy of the config with the non-zero parameters of the other config applied
+func (mc MuxConfig) Override(other *MuxConfig) MuxConfig {
+	if other == nil {
+		return mc
+	}
+	if other.Version != 0 {
+		mc.Version = other.Version
+	}
+	if other.KeepAliveInterval != 0 {
+		mc.KeepAliveInterval = other.KeepAliveInterval
+	}
+	if other.KeepAliveTimeout != 0 {
+		mc.KeepAliveTimeout = other.KeepAliveTimeout
+	}
+	if other.MaxReceiveBuffer != 0 {
+		mc.MaxReceiveBuffer = other.MaxReceiveBuffer
+	}
+	if other.MaxStreamBuffer != 0 {
+		mc.MaxStreamBuffer = other.MaxStreamBuffer
+	}
+	return mc
+}
+
+// withDefaults returns a copy of the config where the zero values are replaced by the defaults
+func (mc *MuxConfig) withDefaults() *MuxConfig {
+	defaults := smux.DefaultConfig()
+	res := MuxConfig{
+		Version:           DefaultMuxVersion,
+		KeepAliveInterval: duration.Duration(defaults.KeepAliveInterval),
+		KeepAliveTimeout:  duration.Duration(defaults.KeepAliveTimeout),
+		MaxReceiveBuffer:  defaults.MaxReceiveBuffer,
+		MaxStreamBuffer:   defaults.MaxStreamBuffer,
+	}.Override(mc)
+	return &res
+}
+
+// Validate checks if the parameters can be used by the multiplexer
+func (mc *MuxConfig) Validate() error {
+	if mc.Version < 1 || mc.Version > maxMuxVersion {
+		return errors.Errorf("Unsupported multiplexer version: %v", mc.Version)
+	}
+	return errors.WithStack(smux.VerifyConfig(mc.Smux()))
+}
+
+// legacy returns the config used with the peers which don't negotiate the multiplexer parameters
+func (mc *MuxConfig) legacy() *MuxConfig {
+	res := mc.withDefaults()
+	res.Version = 1
+	return res
+}
+
+// negotiate will agree on the parameters with the ones offered by the peer
+func (mc *MuxConfig) negotiate(offered *MuxConfig) (*MuxConfig, error) {
+	res := mc.withDefaults()
+	if offered.Version < res.Version {
+		res.Version = offered.Version
+	}
+	if offered.KeepAliveInterval > res.KeepAliveInterval {
+		res.KeepAliveInterval = offered.KeepAliveInterval
+	}
+	if offered.KeepAliveTimeout > res.KeepAliveTimeout {
+		res.KeepAliveTimeout = offered.KeepAliveTimeout
+	}
+	if offered.MaxReceiveBuffer < res.MaxReceiveBuffer {
+		res.MaxReceiveBuffer = offered.MaxReceiveBuffer
+	}
+	if offered.MaxStreamBuffer < res.MaxStreamBuffer {
+		res.MaxStreamBuffer = offered.MaxStreamBuffer
+	}
+	if res.MaxStreamBuffer > res.MaxReceiveBuffer {
+		res.MaxStreamBuffer = res.MaxReceiveBuffer
+	}
+	if err := res.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "Could not agree on the multiplexer parameters")
+	}
+	return res, nil
+}
+
+// writeHeaders will add the parameters to the handshake headers
+func (mc *MuxConfig) writeHeaders(headers textproto.MIMEHeader) {
+	headers.Set(MuxVersion, strconv.Itoa(mc.Version))
+	headers.Set(MuxKeepAliveInterval, mc.KeepAliveInterval.String())
+	headers.Set(MuxKeepAliveTimeout, mc.KeepAliveTimeout.String())
+	headers.Set(MuxReceiveBuffer, strconv.Itoa(mc.MaxReceiveBuffer))
+	headers.Set(MuxStreamBuffer, strconv.Itoa(mc.MaxStreamBuffer))
+}
+
+// readMuxHeaders will read the parameters from the handshake headers
+func readMuxHeaders(headers textproto.MIMEHeader) (*MuxConfig, error) {
+	res := &MuxConfig{}
+	for _, name := range []string{MuxVersion, MuxKeepAliveInterval, MuxKeepAliveTimeout, MuxReceiveBuffer, MuxStreamBuffer} {
+		if err := res.Set(name, headers.Get(name)); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// Smux returns the smux configuration. A nil config returns the configuration used before the parameters were
+// negotiated.
+func (mc *MuxConfig) Smux() *smux.Config {
+	if mc == nil {
+		mc = (&MuxConfig{}).legacy()
+	}
+	config := smux.DefaultConfig()
+	config.Version = mc.Version
+	config.KeepAliveInterval = time.Duration(mc.KeepAliveInterval)
+	config.KeepAliveTimeout = time.Duration(mc.KeepAliveTimeout)
+	config.MaxReceiveBuffer = mc.MaxReceiveBuffer
+	config.MaxStreamBuffer = mc.MaxStreamBuffer
+	config.MaxFrameSize = buffers.BufferSize - 128
+	return config
+}
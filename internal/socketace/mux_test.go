@@ -0,0 +1,97 @@
+package socketace
+
+import (
+	"encoding/json"
+	"github.com/bokysan/socketace/v2/internal/util/duration"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func Test_MuxNegotiation(t *testing.T) {
+	tester := newSocketaceTester()
+	tester.clientMux = &MuxConfig{
+		KeepAliveInterval: duration.Duration(20 * time.Second),
+		KeepAliveTimeout:  duration.Duration(time.Minute),
+	}
+	tester.serverMux = &MuxConfig{
+		MaxStreamBuffer: 32 * 1024,
+	}
+	go tester.testRunServer(nil, false, nil)
+	go tester.testRunClient(nil, false, "", nil)
+	tester.wg.Wait()
+
+	require.NoError(t, tester.serverErr)
+	require.NoError(t, tester.clientErr)
+	require.True(t, tester.client.HasCapability(CapabilityMux))
+
+	expected := &MuxConfig{
+		Version:           2,
+		KeepAliveInterval: duration.Duration(20 * time.Second),
+		KeepAliveTimeout:  duration.Duration(time.Minute),
+		MaxReceiveBuffer:  4 * 1024 * 1024,
+		MaxStreamBuffer:   32 * 1024,
+	}
+	require.Equal(t, expected, tester.client.Mux())
+	require.Equal(t, expected, tester.server.Mux())
+}
+
+func Test_MuxNegotiationVersion(t *testing.T) {
+	tester := newSocketaceTester()
+	tester.serverMux = &MuxConfig{
+		Version: 1,
+	}
+	go tester.testRunServer(nil, false, nil)
+	go tester.testRunClient(nil, false, "", nil)
+	tester.wg.Wait()
+
+	require.NoError(t, tester.serverErr)
+	require.NoError(t, tester.clientErr)
+	require.Equal(t, 1, tester.client.Mux().Version)
+	require.Equal(t, 1, tester.server.Mux().Version)
+}
+
+func Test_MuxLegacyClient(t *testing.T) {
+	capabilities := ClientCapabilities
+	ClientCapabilities = []string{CapabilityResume}
+	defer func() {
+		ClientCapabilities = capabilities
+	}()
+
+	tester := newSocketaceTester()
+	go tester.testRunServer(nil, false, nil)
+	go tester.testRunClient(nil, false, "", nil)
+	tester.wg.Wait()
+
+	require.NoError(t, tester.serverErr)
+	require.NoError(t, tester.clientErr)
+	require.False(t, tester.server.HasCapability(CapabilityMux))
+	require.Equal(t, 1, tester.client.Mux().Version)
+	require.Equal(t, 1, tester.server.Mux().Version)
+}
+
+func Test_MuxConfigUnmarshal(t *testing.T) {
+	mc := &MuxConfig{}
+	require.NoError(t, json.Unmarshal([]byte(`{"version": 1, "keepAliveInterval": "5s", "keepAliveTimeout": 20000000000, "maxStreamBuffer": 1024}`), mc))
+	require.Equal(t, &MuxConfig{
+		Version:           1,
+		KeepAliveInterval: duration.Duration(5 * time.Second),
+		KeepAliveTimeout:  duration.Duration(20 * time.Second),
+		MaxStreamBuffer:   1024,
+	}, mc)
+
+	require.Error(t, json.Unmarshal([]byte(`{"keepAliveInterval": "soon"}`), mc))
+}
+
+func Test_MuxConfigInvalid(t *testing.T) {
+	require.Error(t, (&MuxConfig{Version: 3}).withDefaults().Validate())
+	require.Error(t, (&MuxConfig{KeepAliveInterval: duration.Duration(time.Minute), KeepAliveTimeout: duration.Duration(time.Second)}).withDefaults().Validate())
+	require.NoError(t, (&MuxConfig{}).withDefaults().Validate())
+
+	mc := &MuxConfig{}
+	require.NoError(t, mc.Set("Mux-Stream-Buffer", "1024"))
+	require.NoError(t, mc.Set("keepalive-interval", "1s"))
+	require.Equal(t, &MuxConfig{MaxStreamBuffer: 1024, KeepAliveInterval: duration.Duration(time.Second)}, mc)
+	require.Error(t, mc.Set("mux-window", "1"))
+	require.Error(t, mc.Set("version", "two"))
+}
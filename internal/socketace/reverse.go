@@ -0,0 +1,45 @@
+package socketace
+
+import (
+	"github.com/pkg/errors"
+	"io"
+	"strings"
+)
+
+const (
+	bindOk    = "OK"
+	bindError = "ERROR "
+)
+
+// WriteBindReply tells the client whether the server listens for its reverse tunnel. The reply is sent on the
+// control stream of the tunnel, right after the channel has been selected (and the metadata has been read).
+func WriteBindReply(w io.Writer, err error) error {
+	line := bindOk
+	if err != nil {
+		line = bindError + strings.NewReplacer("\r", " ", "\n", " ").Replace(err.Error())
+	}
+	_, e := w.Write([]byte(line + "\r\n"))
+	return errors.Wrapf(e, "Could not send the bind reply")
+}
+
+// ReadBindReply reads the reply of the server and returns the error it reported, if any
+func ReadBindReply(r io.Reader) error {
+	line := make([]byte, 0, 64)
+	b := make([]byte, 1)
+	for len(line) < 4096 {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return errors.Wrapf(err, "Could not read the bind reply")
+		}
+		if b[0] == '\n' {
+			reply := strings.TrimSuffix(string(line), "\r")
+			if reply == bindOk {
+				return nil
+			} else if strings.HasPrefix(reply, bindError) {
+				return errors.Errorf("Server refused to listen: %v", strings.TrimPrefix(reply, bindError))
+			}
+			return errors.Errorf("Invalid bind reply: %q", reply)
+		}
+		line = append(line, b[0])
+	}
+	return errors.Errorf("Bind reply too long")
+}
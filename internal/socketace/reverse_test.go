@@ -0,0 +1,23 @@
+package socketace
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func Test_BindReply(t *testing.T) {
+	buf := &bytes.Buffer{}
+	require.NoError(t, WriteBindReply(buf, nil))
+	require.NoError(t, WriteBindReply(buf, errors.New("listen tcp 0.0.0.0:80:\nbind: permission denied")))
+	buf.WriteString("data")
+
+	require.NoError(t, ReadBindReply(buf))
+	err := ReadBindReply(buf)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "bind: permission denied")
+	require.Equal(t, "data", buf.String())
+
+	require.Error(t, ReadBindReply(bytes.NewBufferString("HELLO\r\n")))
+}
@@ -2,8 +2,10 @@ package socketace
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/bokysan/socketace/v2/internal/util/auth"
 	"github.com/bokysan/socketace/v2/internal/util/cert"
 	"github.com/bokysan/socketace/v2/internal/util/mime"
 	"github.com/bokysan/socketace/v2/internal/version"
@@ -23,17 +25,26 @@ type ServerConnection struct {
 	ClientVersion     string
 	negotiatedVersion string
 	manager           cert.TlsConfig
+	authenticator     auth.Authenticator
 	supportTls        bool
 	secure            bool
 	securityTech      string
+	user              string
+	certificates      []*x509.Certificate
+	verifiedChains    [][]*x509.Certificate
+	capabilities      []string
+	mux               *MuxConfig
 }
 
-// NewProxyWrapperServer will wait for client request and negotiate protocol version
-func NewServerConnection(c net.Conn, manager cert.TlsConfig, secure bool) (*ServerConnection, error) {
+// NewProxyWrapperServer will wait for client request and negotiate protocol version. If the authenticator is
+// provided (and enabled), the client will need to authorize itself before the connection is established.
+func NewServerConnection(c net.Conn, manager cert.TlsConfig, secure bool, authenticator auth.Authenticator, mux *MuxConfig) (*ServerConnection, error) {
 	conn := streams.NewBufferedInputConnection(c)
 	connection := &ServerConnection{
-		manager: manager,
-		secure:  secure,
+		manager:       manager,
+		secure:        secure,
+		authenticator: authenticator,
+		mux:           mux.withDefaults(),
 	}
 	if secure {
 		connection.securityTech = SecurityUnderlying
@@ -52,6 +63,17 @@ func NewServerConnection(c net.Conn, manager cert.TlsConfig, secure bool) (*Serv
 	} else {
 		connection.Connection = server
 	}
+	connection.certificates = cert.PeerCertificates(connection.Connection)
+	connection.verifiedChains = cert.VerifiedChains(connection.Connection)
+
+	if connection.authenticationRequired() {
+		log.Debugf("[Server] SocketAce authorization...")
+		buffered := streams.NewBufferedInputConnection(connection.Connection)
+		if err := connection.authorize(buffered); err != nil {
+			return nil, errors.Wrapf(err, "Could not authorize client: %v", err)
+		}
+		connection.Connection = streams.NewNamedConnection(buffered, "authorized")
+	}
 
 	return connection, nil
 }
@@ -66,6 +88,60 @@ func (sc *ServerConnection) SecurityTech() string {
 	return sc.securityTech
 }
 
+// User returns the name of the authorized user or an empty string if the client did not need to authorize
+func (sc *ServerConnection) User() string {
+	return sc.user
+}
+
+// negotiateMux will agree on the multiplexer parameters with the client and add them to the response. The legacy
+// parameters are used (and false returned) if the client does not support the negotiation.
+func (sc *ServerConnection) negotiateMux(clientCapabilities []string, request, response textproto.MIMEHeader) (*MuxConfig, bool) {
+	if !containsCapability(clientCapabilities, CapabilityMux) {
+		return sc.mux.legacy(), false
+	}
+	offered, err := readMuxHeaders(request)
+	var agreed *MuxConfig
+	if err == nil {
+		agreed, err = sc.mux.negotiate(offered)
+	}
+	if err != nil {
+		log.WithError(err).Warnf("Could not negotiate multiplexer parameters, using the defaults: %v", err)
+		return sc.mux.legacy(), false
+	}
+	agreed.writeHeaders(response)
+	return agreed, true
+}
+
+// Mux returns the multiplexer parameters agreed with the client
+func (sc *ServerConnection) Mux() *MuxConfig {
+	return sc.mux
+}
+
+// HasCapability returns true if the capability has been negotiated with the client
+func (sc *ServerConnection) HasCapability(cap string) bool {
+	return containsCapability(sc.capabilities, cap)
+}
+
+// PeerCertificates returns the certificate chain presented by the client or nil if the client did not present
+// a (valid) certificate
+func (sc *ServerConnection) PeerCertificates() []*x509.Certificate {
+	return sc.certificates
+}
+
+// Identity returns the identity of the client, used to decide which channels it may access
+func (sc *ServerConnection) Identity() *auth.Identity {
+	return &auth.Identity{
+		User:           sc.user,
+		Certificates:   sc.certificates,
+		VerifiedChains: sc.verifiedChains,
+	}
+}
+
+// authenticationRequired returns true if the clients need to present their credentials
+func (sc *ServerConnection) authenticationRequired() bool {
+	return sc.authenticator != nil && sc.authenticator.Enabled()
+}
+
 func (sc *ServerConnection) String() string {
 	return fmt.Sprintf("%v[%v->%v], security=%v, proto=%v",
 		sc.Connection,
@@ -162,6 +238,31 @@ func (sc *ServerConnection) handshake(conn *streams.BufferedInputConnection) err
 			"Server supports: %v, client requires: %v", SupportedProtocolVersions, acceptedProtocolVersions)
 	}
 
+	clientCapabilities := mime.SplitField(request.Headers.Get(Capabilities))
+	if containsCapability(clientCapabilities, CapabilityResume) {
+		capabilities = append(capabilities, CapabilityResume)
+		// Additional paths are joined to the resumable sessions
+		if containsCapability(clientCapabilities, CapabilityMultipath) {
+			capabilities = append(capabilities, CapabilityMultipath)
+		}
+	}
+
+	var negotiated bool
+	if sc.mux, negotiated = sc.negotiateMux(clientCapabilities, request.Headers, response.Headers); negotiated {
+		capabilities = append(capabilities, CapabilityMux)
+	}
+	if containsCapability(clientCapabilities, CapabilityMetadata) {
+		capabilities = append(capabilities, CapabilityMetadata)
+	}
+
+	if sc.authenticationRequired() {
+		capabilities = append(capabilities, CapabilityAuthorize)
+		if challenge := sc.authenticator.Challenge(); challenge != "" {
+			response.Headers.Set(WwwAuthenticate, challenge)
+		}
+	}
+
+	sc.capabilities = capabilities
 	if len(capabilities) > 0 {
 		response.Headers.Set(Capabilities, strings.Join(capabilities, ","))
 	}
@@ -283,6 +384,72 @@ func (sc *ServerConnection) upgrade(conn *streams.BufferedInputConnection) (stre
 	return streams.NewNamedConnection(conn, "plain"), nil
 }
 
+// authorize will wait for the client to send its credentials and validate them. This is done after the upgrade
+// (and after StartTLS, if requested) so that the credentials are not sent over the wire in plain text if avoidable.
+func (sc *ServerConnection) authorize(conn *streams.BufferedInputConnection) error {
+	request := &Request{}
+	if err := request.Read(conn.Reader); err != nil {
+		return errors.Wrapf(err, "Failed parsing request!")
+	}
+
+	responseHeaders := make(textproto.MIMEHeader)
+	responseHeaders.Set("Server", "socketace/"+version.AppVersion())
+
+	var response *Response
+	var err error
+
+	if request.Method != RequestMethod || request.URL != AuthorizeUrl {
+		response = &Response{
+			Status:     strconv.Itoa(http.StatusUnauthorized) + " Unauthorized",
+			StatusCode: http.StatusUnauthorized,
+		}
+		err = errors.Errorf("Expected authorization request, got: %v %v", request.Method, request.URL)
+	} else if user, e := sc.authenticator.Authenticate(request.Headers.Get(Authorization)); e == auth.ErrUnauthorized {
+		response = &Response{
+			Status:     strconv.Itoa(http.StatusUnauthorized) + " Unauthorized",
+			StatusCode: http.StatusUnauthorized,
+		}
+		err = e
+	} else if e == auth.ErrForbidden {
+		response = &Response{
+			Status:     strconv.Itoa(http.StatusForbidden) + " Forbidden",
+			StatusCode: http.StatusForbidden,
+		}
+		err = e
+	} else if e != nil {
+		response = &Response{
+			Status:     strconv.Itoa(http.StatusInternalServerError) + " Internal Server Error",
+			StatusCode: http.StatusInternalServerError,
+		}
+		log.WithError(e).Errorf("Could not validate credentials: %v", e)
+		err = errors.Errorf("Could not validate credentials")
+	} else {
+		response = &Response{
+			Status:     "200 OK",
+			StatusCode: http.StatusOK,
+		}
+		sc.user = user
+		log.Infof("[Server] Client authorized as %q", user)
+	}
+
+	if err != nil {
+		responseHeaders.Set("Message", err.Error())
+		if response.StatusCode == http.StatusUnauthorized {
+			responseHeaders.Set(WwwAuthenticate, sc.authenticator.Challenge())
+		}
+	}
+	response.Headers = responseHeaders
+
+	if e := response.Write(conn); e != nil {
+		log.WithError(e).Warnf("Could not write response: %v", e)
+		if err == nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
 // negotiateVersion will find the rpsion in the list of accepted client versions
 func (sc *ServerConnection) negotiateVersion(acceptedVersions string) string {
 	acceptedProtocolVersions := mime.SplitField(acceptedVersions)
@@ -0,0 +1,155 @@
+package socketace
+
+import (
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/bokysan/socketace/v2/internal/version"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+)
+
+// Session describes the resumable session negotiated after the handshake (and authorization)
+type Session struct {
+	Id       string // Id is the session ID, empty when requesting a new session
+	Secret   string // Secret proves the ownership of the session. The server returns it when creating the session.
+	Received uint64 // Received is the number of bytes the peer has received so far
+	Resumed  bool   // Resumed is true if the server resumed an existing session
+	Join     bool   // Join is set if the connection should be added to the existing session instead of replacing it
+}
+
+// SessionResolver will either find the requested session or create a new one
+type SessionResolver func(requested *Session) (*Session, error)
+
+// RequestSession is called by the client after the connection has been established to either create a new
+// session (if the requested session ID is empty) or to resume an existing one. The returned connection must be
+// used for further communication.
+func RequestSession(c net.Conn, requested *Session) (streams.Connection, *Session, error) {
+	conn := streams.NewBufferedInputConnection(c)
+
+	request := &Request{
+		Method:  RequestMethod,
+		URL:     SessionUrl,
+		Headers: make(textproto.MIMEHeader),
+	}
+	request.Headers.Set(UserAgent, "socketace/"+version.AppVersion())
+	if requested.Id != "" {
+		request.Headers.Set(SessionId, requested.Id)
+		request.Headers.Set(SessionSecret, requested.Secret)
+		request.Headers.Set(SessionReceived, strconv.FormatUint(requested.Received, 10))
+		if requested.Join {
+			request.Headers.Set(SessionJoin, "true")
+		}
+	}
+
+	if err := request.Write(conn); err != nil {
+		return nil, nil, errors.Wrapf(err, "Coud not send session request")
+	}
+
+	response := &Response{}
+	if err := response.Read(conn.Reader); err != nil {
+		return nil, nil, errors.Wrapf(err, "Could not get response to session request")
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, nil, errors.Errorf("Server refused our session request with error %v: %v",
+			response.StatusCode, response.Headers.Get("Message"))
+	}
+
+	received, err := strconv.ParseUint(response.Headers.Get(SessionReceived), 10, 64)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "Invalid %v: %v", SessionReceived, response.Headers.Get(SessionReceived))
+	}
+
+	session := &Session{
+		Id:       response.Headers.Get(SessionId),
+		Secret:   requested.Secret,
+		Received: received,
+		Resumed:  response.Headers.Get(SessionResumed) == "true",
+		Join:     requested.Join,
+	}
+	if session.Id == "" {
+		return nil, nil, errors.Errorf("Server did not return the session ID")
+	}
+	if !session.Resumed {
+		if session.Secret = response.Headers.Get(SessionSecret); session.Secret == "" {
+			return nil, nil, errors.Errorf("Server did not return the session secret")
+		}
+	}
+
+	return streams.NewNamedConnection(conn, "session"), session, nil
+}
+
+// AcceptSession is called by the server to read the session request from the client. The resolver will either
+// find the existing session or create a new one. The returned connection must be used for further communication.
+func AcceptSession(c net.Conn, resolver SessionResolver) (streams.Connection, *Session, error) {
+	conn := streams.NewBufferedInputConnection(c)
+
+	request := &Request{}
+	if err := request.Read(conn.Reader); err != nil {
+		return nil, nil, errors.Wrapf(err, "Failed parsing request!")
+	}
+
+	responseHeaders := make(textproto.MIMEHeader)
+	responseHeaders.Set("Server", "socketace/"+version.AppVersion())
+	response := &Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Headers:    responseHeaders,
+	}
+
+	var session *Session
+	var err error
+
+	if request.Method != RequestMethod || request.URL != SessionUrl {
+		response.Status = strconv.Itoa(http.StatusBadRequest) + " Bad Request"
+		response.StatusCode = http.StatusBadRequest
+		err = errors.Errorf("Expected session request, got: %v %v", request.Method, request.URL)
+	} else {
+		requested := &Session{
+			Id:     request.Headers.Get(SessionId),
+			Secret: request.Headers.Get(SessionSecret),
+			Join:   request.Headers.Get(SessionJoin) == "true",
+		}
+		if requested.Id != "" {
+			requested.Received, err = strconv.ParseUint(request.Headers.Get(SessionReceived), 10, 64)
+			if err != nil {
+				response.Status = strconv.Itoa(http.StatusBadRequest) + " Bad Request"
+				response.StatusCode = http.StatusBadRequest
+				err = errors.Wrapf(err, "Invalid %v: %v", SessionReceived, request.Headers.Get(SessionReceived))
+			}
+		}
+		if err == nil {
+			if session, err = resolver(requested); err != nil {
+				response.Status = strconv.Itoa(http.StatusConflict) + " Conflict"
+				response.StatusCode = http.StatusConflict
+			}
+		}
+	}
+
+	if err != nil {
+		responseHeaders.Set("Message", err.Error())
+	} else {
+		responseHeaders.Set(SessionId, session.Id)
+		responseHeaders.Set(SessionReceived, strconv.FormatUint(session.Received, 10))
+		responseHeaders.Set(SessionResumed, strconv.FormatBool(session.Resumed))
+		if !session.Resumed {
+			responseHeaders.Set(SessionSecret, session.Secret)
+		}
+	}
+
+	if e := response.Write(conn); e != nil {
+		log.WithError(e).Warnf("Could not write response: %v", e)
+		if err == nil {
+			err = e
+		}
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return streams.NewNamedConnection(conn, "session"), session, nil
+}
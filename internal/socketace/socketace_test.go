@@ -3,10 +3,13 @@ package socketace
 import (
 	"bufio"
 	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/bokysan/socketace/v2/internal/util/auth"
 	"github.com/bokysan/socketace/v2/internal/util/cert"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
 	"io"
+	"net"
 	"sync"
 	"testing"
 )
@@ -123,6 +126,9 @@ type socketaceTester struct {
 	server     *ServerConnection
 	serverErr  error
 
+	clientMux *MuxConfig
+	serverMux *MuxConfig
+
 	wg sync.WaitGroup
 }
 
@@ -147,9 +153,9 @@ func newSocketaceTester() *socketaceTester {
 	return res
 }
 
-func (st *socketaceTester) testRunServer(manager cert.TlsConfig, secure bool) {
+func (st *socketaceTester) testRunServer(manager cert.TlsConfig, secure bool, authenticator auth.Authenticator) {
 	log.Info("Creating new server connection...")
-	st.server, st.serverErr = NewServerConnection(st.serverPipe, manager, secure)
+	st.server, st.serverErr = NewServerConnection(st.serverPipe, manager, secure, authenticator, st.serverMux)
 	if st.serverErr != nil {
 		log.Infof("Server connection error: %v", st.serverErr)
 	} else {
@@ -160,9 +166,9 @@ func (st *socketaceTester) testRunServer(manager cert.TlsConfig, secure bool) {
 	return
 }
 
-func (st *socketaceTester) testRunClient(manager cert.TlsConfig, secure bool, host string) {
+func (st *socketaceTester) testRunClient(manager cert.TlsConfig, secure bool, host string, credentials auth.Credentials) {
 	log.Info("Creating new client connection...")
-	st.client, st.clientErr = NewClientConnection(st.clientPipe, manager, secure, host)
+	st.client, st.clientErr = NewClientConnection(st.clientPipe, manager, secure, host, credentials, st.clientMux)
 	if st.clientErr != nil {
 		log.Infof("Client connection error: %v", st.clientErr)
 	} else {
@@ -177,8 +183,8 @@ func Test_SimpleConnection(t *testing.T) {
 	log.SetLevel(log.TraceLevel)
 
 	tester := newSocketaceTester()
-	go tester.testRunServer(nil, false)
-	go tester.testRunClient(nil, false, "")
+	go tester.testRunServer(nil, false, nil)
+	go tester.testRunClient(nil, false, "", nil)
 
 	tester.wg.Wait()
 
@@ -195,8 +201,8 @@ func Test_SecureServer1(t *testing.T) {
 
 	tester := newSocketaceTester()
 
-	go tester.testRunServer(nil, true)
-	go tester.testRunClient(nil, true, "")
+	go tester.testRunServer(nil, true, nil)
+	go tester.testRunClient(nil, true, "", nil)
 
 	tester.wg.Wait()
 
@@ -224,8 +230,8 @@ func Test_SecureServer2(t *testing.T) {
 		PrivateKeyPasswordProgram: "",
 	}
 
-	go tester.testRunServer(serverManager, true)
-	go tester.testRunClient(nil, true, "")
+	go tester.testRunServer(serverManager, true, nil)
+	go tester.testRunClient(nil, true, "", nil)
 
 	tester.wg.Wait()
 
@@ -257,8 +263,8 @@ func Test_SecureServerTls(t *testing.T) {
 		InsecureSkipVerify: true,
 	}
 
-	go tester.testRunServer(serverManager, false)
-	go tester.testRunClient(clientManager, false, "")
+	go tester.testRunServer(serverManager, false, nil)
+	go tester.testRunClient(clientManager, false, "", nil)
 
 	tester.wg.Wait()
 
@@ -269,3 +275,176 @@ func Test_SecureServerTls(t *testing.T) {
 	require.Equal(t, SecurityTls, tester.server.SecurityTech())
 	require.Equal(t, SecurityTls, tester.client.SecurityTech())
 }
+
+func Test_ClientCertificateIdentity(t *testing.T) {
+	log.SetLevel(log.TraceLevel)
+
+	tester := newSocketaceTester()
+
+	serverManager := &cert.ServerConfig{
+		Config: cert.Config{
+			CaCertificate:      testCertificate,
+			Certificate:        testCertificate,
+			PrivateKey:         testPrivatekey,
+			PrivateKeyPassword: &testPassword,
+		},
+		RequireClientCert: true,
+	}
+
+	clientManager := &cert.ClientConfig{
+		Config: cert.Config{
+			Certificate:        testCertificate,
+			PrivateKey:         testPrivatekey,
+			PrivateKeyPassword: &testPassword,
+		},
+		InsecureSkipVerify: true,
+	}
+
+	go tester.testRunServer(serverManager, false, nil)
+	go tester.testRunClient(clientManager, false, "", nil)
+
+	tester.wg.Wait()
+
+	require.NoError(t, tester.serverErr, "Could not setup a server connection!")
+	require.NoError(t, tester.clientErr, "Could not setup a client connection!")
+	require.Equal(t, SecurityTls, tester.server.SecurityTech())
+
+	identity := tester.server.Identity()
+	require.NotNil(t, identity.Certificate())
+	require.Equal(t, "test.example.com", identity.Certificate().Subject.CommonName)
+	require.True(t, auth.Rules{{CommonName: "*.example.com"}}.Allows(identity))
+	require.False(t, auth.Rules{{OrganizationalUnit: "ops"}}.Allows(identity))
+
+	// The self-signed certificate is its own CA
+	require.Len(t, identity.VerifiedChains, 1)
+	require.True(t, auth.Rules{{IssuerFingerprint: auth.Fingerprint(identity.Certificate())}}.Allows(identity))
+}
+
+func Test_Authorization(t *testing.T) {
+	log.SetLevel(log.TraceLevel)
+
+	authenticator := &auth.ServerConfig{
+		Tokens: []string{"t0ken"},
+	}
+
+	tester := newSocketaceTester()
+
+	go tester.testRunServer(nil, true, authenticator)
+	go tester.testRunClient(nil, true, "", &auth.ClientCredentials{Token: "t0ken"})
+
+	tester.wg.Wait()
+
+	require.NoError(t, tester.serverErr, "Could not setup a server connection!")
+	require.NoError(t, tester.clientErr, "Could not setup a client connection!")
+	require.Equal(t, "token", tester.server.User())
+}
+
+func Test_AuthorizationInsecure(t *testing.T) {
+	log.SetLevel(log.TraceLevel)
+
+	authenticator := &auth.ServerConfig{
+		Tokens: []string{"t0ken"},
+	}
+
+	tester := newSocketaceTester()
+
+	go tester.testRunServer(nil, false, authenticator)
+	go func() {
+		tester.testRunClient(nil, false, "", &auth.ClientCredentials{Token: "t0ken"})
+		_ = tester.clientPipe.Close()
+	}()
+
+	tester.wg.Wait()
+
+	require.Error(t, tester.serverErr)
+	require.Error(t, tester.clientErr)
+	require.Contains(t, tester.clientErr.Error(), "Refusing to send credentials")
+
+	// Unless explicitly allowed
+	tester = newSocketaceTester()
+
+	go tester.testRunServer(nil, false, authenticator)
+	go tester.testRunClient(nil, false, "", &auth.ClientCredentials{Token: "t0ken", InsecureAuth: true})
+
+	tester.wg.Wait()
+
+	require.NoError(t, tester.serverErr, "Could not setup a server connection!")
+	require.NoError(t, tester.clientErr, "Could not setup a client connection!")
+	require.Equal(t, auth.TokenUser, tester.server.User())
+}
+
+func Test_AuthorizationMissing(t *testing.T) {
+	log.SetLevel(log.TraceLevel)
+
+	authenticator := &auth.ServerConfig{
+		Tokens: []string{"t0ken"},
+	}
+
+	tester := newSocketaceTester()
+
+	go tester.testRunServer(nil, true, authenticator)
+	go tester.testRunClient(nil, true, "", nil)
+
+	tester.wg.Wait()
+
+	require.Error(t, tester.serverErr)
+	require.Error(t, tester.clientErr)
+	require.Contains(t, tester.clientErr.Error(), "Server requires authorization (Bearer)")
+}
+
+func Test_AuthorizationRejected(t *testing.T) {
+	log.SetLevel(log.TraceLevel)
+
+	authenticator := &auth.ServerConfig{
+		Tokens: []string{"t0ken"},
+	}
+
+	tester := newSocketaceTester()
+
+	go tester.testRunServer(nil, true, authenticator)
+	go tester.testRunClient(nil, true, "", &auth.ClientCredentials{Token: "wrong"})
+
+	tester.wg.Wait()
+
+	require.Error(t, tester.serverErr)
+	require.Error(t, tester.clientErr)
+	require.Contains(t, tester.clientErr.Error(), "Server rejected our credentials")
+}
+
+func Test_SessionSecret(t *testing.T) {
+	log.SetLevel(log.TraceLevel)
+
+	resolver := func(requested *Session) (*Session, error) {
+		if requested.Id == "" {
+			return &Session{Id: "id", Secret: "s3cret"}, nil
+		} else if requested.Secret != "s3cret" {
+			return nil, errors.Errorf("Invalid secret")
+		}
+		return &Session{Id: requested.Id, Received: 10, Resumed: true}, nil
+	}
+	request := func(requested *Session) (*Session, error) {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+		go func() {
+			_, _, _ = AcceptSession(server, resolver)
+		}()
+		_, session, err := RequestSession(client, requested)
+		return session, err
+	}
+
+	created, err := request(&Session{})
+	require.NoError(t, err)
+	require.Equal(t, "id", created.Id)
+	require.Equal(t, "s3cret", created.Secret)
+	require.False(t, created.Resumed)
+
+	resumed, err := request(&Session{Id: created.Id, Secret: created.Secret})
+	require.NoError(t, err)
+	require.True(t, resumed.Resumed)
+	require.Equal(t, "s3cret", resumed.Secret)
+	require.Equal(t, uint64(10), resumed.Received)
+
+	_, err = request(&Session{Id: created.Id, Secret: "guessed"})
+	require.Error(t, err)
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/bokysan/socketace/v2/internal/version"
 	"github.com/pkg/errors"
 	"net/textproto"
+	"strings"
 )
 
 const (
@@ -14,11 +15,37 @@ const (
 	Status                 = "Status"
 	Capabilities           = "Capabilities"
 	CapabilityStartTls     = "StartTLS"
+	CapabilityAuthorize    = "Authorize"
+	CapabilityResume       = "Resume"
+	CapabilityMultipath    = "Multipath"
+	CapabilityMux          = "Mux"
+	CapabilityMetadata     = "Stream-Metadata"
+	Authorization          = "Authorization"
+	WwwAuthenticate        = "WWW-Authenticate"
+	AuthorizeUrl           = "/authorize"
+	SessionUrl             = "/session"
+	SessionId              = "Session-Id"
+	SessionReceived        = "Session-Received"
+	SessionResumed         = "Session-Resumed"
+	SessionJoin            = "Session-Join"
+	SessionSecret          = "Session-Secret"
+	HealthProtocol         = "/.socketace/health"  // Echo protocol, used by the clients to check the session health
+	PublishProtocol        = "/.socketace/publish" // Prefix of the control streams of the channels published to a hub
 	SecurityUnderlying     = "underlying"
 	SecurityNone           = "none"
 	SecurityTls            = "tls"
+	AlpnProtocol           = "socketace/2" // ALPN protocol ID of SocketAce over TLS
 )
 
+// ClientCapabilities are the optional features the client announces to the server. The server will advertise them
+// back if it supports them as well.
+var ClientCapabilities = []string{
+	CapabilityResume,
+	CapabilityMultipath,
+	CapabilityMux,
+	CapabilityMetadata,
+}
+
 var SupportedProtocolVersions = []string{
 	// Make sure this list is in descending order
 	version.ProtocolVersion,
@@ -39,3 +66,14 @@ func readHeader(conn *bufio.Reader) (string, textproto.MIMEHeader, error) {
 	}
 	return firstLine, header, nil
 }
+
+// containsCapability checks if the provided slice contains the selected capability (case-insensitive)
+func containsCapability(caps []string, cap string) bool {
+	cap = strings.ToUpper(cap)
+	for _, c := range caps {
+		if strings.ToUpper(c) == cap {
+			return true
+		}
+	}
+	return false
+}
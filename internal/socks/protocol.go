@@ -0,0 +1,191 @@
+// Package socks implements the parts of the SOCKS5 protocol (RFC 1928) not covered by go-socks5: the replies, the
+// addresses and the UDP request header.
+package socks
+
+import (
+	"encoding/binary"
+	"github.com/armon/go-socks5"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+)
+
+const (
+	// Version is the SOCKS protocol version
+	Version = uint8(5)
+
+	// MethodNoAuth selects no authentication
+	MethodNoAuth = uint8(0)
+	// MethodUserPass selects the username/password authentication (RFC 1929)
+	MethodUserPass = uint8(2)
+	// MethodNoAcceptable is sent when none of the methods of the client are acceptable
+	MethodNoAcceptable = uint8(0xff)
+
+	addressIPv4 = uint8(1)
+	addressFQDN = uint8(3)
+	addressIPv6 = uint8(4)
+)
+
+// The reply codes
+const (
+	ReplySuccess uint8 = iota
+	ReplyServerFailure
+	ReplyRuleFailure
+	ReplyNetworkUnreachable
+	ReplyHostUnreachable
+	ReplyConnectionRefused
+	ReplyTTLExpired
+	ReplyCommandNotSupported
+	ReplyAddressNotSupported
+)
+
+// AddrSpec returns the SOCKS address of the network address. Nil or unknown addresses are returned as `0.0.0.0:0`.
+func AddrSpec(a net.Addr) *socks5.AddrSpec {
+	switch v := a.(type) {
+	case *net.TCPAddr:
+		return &socks5.AddrSpec{IP: v.IP, Port: v.Port}
+	case *net.UDPAddr:
+		return &socks5.AddrSpec{IP: v.IP, Port: v.Port}
+	}
+	return &socks5.AddrSpec{IP: net.IPv4zero}
+}
+
+// AppendAddress appends the address type, the address and the port to the buffer
+func AppendAddress(b []byte, a *socks5.AddrSpec) ([]byte, error) {
+	switch {
+	case a == nil:
+		b = append(b, addressIPv4, 0, 0, 0, 0)
+	case a.FQDN != "":
+		if len(a.FQDN) > 255 {
+			return nil, errors.Errorf("Host name too long: %v", a.FQDN)
+		}
+		b = append(b, addressFQDN, byte(len(a.FQDN)))
+		b = append(b, a.FQDN...)
+	case a.IP.To4() != nil:
+		b = append(b, addressIPv4)
+		b = append(b, a.IP.To4()...)
+	case a.IP.To16() != nil:
+		b = append(b, addressIPv6)
+		b = append(b, a.IP.To16()...)
+	default:
+		b = append(b, addressIPv4, 0, 0, 0, 0)
+	}
+	port := 0
+	if a != nil {
+		port = a.Port
+	}
+	return append(b, byte(port>>8), byte(port)), nil
+}
+
+// ReadAddress reads the address type, the address and the port
+func ReadAddress(r io.Reader) (*socks5.AddrSpec, error) {
+	var kind [1]byte
+	if _, err := io.ReadFull(r, kind[:]); err != nil {
+		return nil, err
+	}
+	a := &socks5.AddrSpec{}
+	switch kind[0] {
+	case addressIPv4, addressIPv6:
+		size := net.IPv4len
+		if kind[0] == addressIPv6 {
+			size = net.IPv6len
+		}
+		a.IP = make(net.IP, size)
+		if _, err := io.ReadFull(r, a.IP); err != nil {
+			return nil, err
+		}
+	case addressFQDN:
+		var size [1]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return nil, err
+		}
+		fqdn := make([]byte, size[0])
+		if _, err := io.ReadFull(r, fqdn); err != nil {
+			return nil, err
+		}
+		a.FQDN = string(fqdn)
+	default:
+		return nil, errors.Errorf("Unknown address type: %v", kind[0])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return nil, err
+	}
+	a.Port = int(binary.BigEndian.Uint16(port[:]))
+	return a, nil
+}
+
+// WriteRequest sends the request with the command and the address
+func WriteRequest(w io.Writer, command uint8, a *socks5.AddrSpec) error {
+	msg, err := AppendAddress([]byte{Version, command, 0}, a)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(msg)
+	return err
+}
+
+// WriteReply sends the reply with the code and the bound address
+func WriteReply(w io.Writer, code uint8, a *socks5.AddrSpec) error {
+	msg, err := AppendAddress([]byte{Version, code, 0}, a)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(msg)
+	return err
+}
+
+// ReadReply reads the reply and returns its code and the bound address
+func ReadReply(r io.Reader) (uint8, *socks5.AddrSpec, error) {
+	var header [3]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	if header[0] != Version {
+		return 0, nil, errors.Errorf("Unsupported SOCKS version: %v", header[0])
+	}
+	a, err := ReadAddress(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	return header[1], a, nil
+}
+
+// Datagram returns the UDP request header (RFC 1928, section 7) with the address, followed by the data
+func Datagram(a *socks5.AddrSpec, data []byte) ([]byte, error) {
+	p, err := AppendAddress([]byte{0, 0, 0}, a)
+	if err != nil {
+		return nil, err
+	}
+	return append(p, data...), nil
+}
+
+// ParseDatagram returns the address and the data of the UDP request. Fragmented datagrams are not supported.
+func ParseDatagram(p []byte) (*socks5.AddrSpec, []byte, error) {
+	if len(p) < 4 {
+		return nil, nil, errors.Errorf("Datagram too short: %v bytes", len(p))
+	}
+	if p[2] != 0 {
+		return nil, nil, errors.Errorf("Fragmented datagrams are not supported")
+	}
+	r := &byteReader{data: p[3:]}
+	a, err := ReadAddress(r)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "Invalid datagram header")
+	}
+	return a, r.data, nil
+}
+
+// byteReader reads from the slice, leaving the rest in it
+type byteReader struct {
+	data []byte
+}
+
+func (r *byteReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
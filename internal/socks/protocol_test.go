@@ -0,0 +1,46 @@
+package socks
+
+import (
+	"bytes"
+	"github.com/armon/go-socks5"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+func Test_Reply(t *testing.T) {
+	for _, a := range []*socks5.AddrSpec{
+		{IP: net.ParseIP("10.1.2.3").To4(), Port: 53},
+		{IP: net.ParseIP("2001:db8::1"), Port: 443},
+		{FQDN: "example.org", Port: 8080},
+	} {
+		buf := &bytes.Buffer{}
+		require.NoError(t, WriteReply(buf, ReplyHostUnreachable, a))
+		code, b, err := ReadReply(buf)
+		require.NoError(t, err)
+		require.Equal(t, ReplyHostUnreachable, code)
+		require.Equal(t, a, b)
+		require.Equal(t, 0, buf.Len())
+	}
+
+	_, _, err := ReadReply(bytes.NewReader([]byte{4, 0, 0, 1, 0, 0, 0, 0, 0, 0}))
+	require.Error(t, err)
+}
+
+func Test_Datagram(t *testing.T) {
+	a := &socks5.AddrSpec{FQDN: "dns.example.org", Port: 53}
+	p, err := Datagram(a, []byte("query"))
+	require.NoError(t, err)
+
+	b, data, err := ParseDatagram(p)
+	require.NoError(t, err)
+	require.Equal(t, a, b)
+	require.Equal(t, "query", string(data))
+
+	// Fragments are dropped
+	p[2] = 1
+	_, _, err = ParseDatagram(p)
+	require.Error(t, err)
+	_, _, err = ParseDatagram([]byte{0, 0, 0, 1, 10})
+	require.Error(t, err)
+}
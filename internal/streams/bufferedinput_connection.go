@@ -30,3 +30,8 @@ func NewBufferedInputConnection(c net.Conn) *BufferedInputConnection {
 func (bf BufferedInputConnection) Read(p []byte) (n int, err error) {
 	return bf.Reader.Read(p)
 }
+
+// Unwrap returns the embedded net.Conn
+func (bf *BufferedInputConnection) Unwrap() net.Conn {
+	return bf.Connection
+}
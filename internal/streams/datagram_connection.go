@@ -0,0 +1,186 @@
+package streams
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// MaxDatagramSize is the size of the largest datagram which can be carried over a stream
+const MaxDatagramSize = 65535
+
+// DefaultIdleTimeout is how long a datagram flow is kept without any traffic, if not configured otherwise
+const DefaultIdleTimeout = time.Minute
+
+// localSockets counts the unixgram sockets bound by DialDatagram
+var localSockets uint64
+
+// WriteDatagram writes the datagram to the stream, prefixed by its length (two bytes, big endian)
+func WriteDatagram(w io.Writer, p []byte) error {
+	if len(p) > MaxDatagramSize {
+		return errors.Errorf("Datagram too large: %v bytes", len(p))
+	}
+	frame := make([]byte, len(p)+2)
+	binary.BigEndian.PutUint16(frame, uint16(len(p)))
+	copy(frame[2:], p)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadDatagram reads one datagram written by WriteDatagram into the buffer and returns its size
+func ReadDatagram(r io.Reader, p []byte) (int, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	size := int(binary.BigEndian.Uint16(header[:]))
+	if size > len(p) {
+		return 0, errors.Errorf("Buffer too small: datagram size is %v, but buffer size is %v", size, len(p))
+	}
+	if _, err := io.ReadFull(r, p[:size]); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return size, nil
+}
+
+// DatagramConnection carries the datagrams of a connected packet connection (e.g. UDP) over a stream: reading returns
+// the received datagrams framed as by WriteDatagram and writing sends the framed datagrams. The connection reports
+// EOF once no datagrams were sent or received for the idle timeout (if set).
+type DatagramConnection struct {
+	net.Conn
+	idleTimeout time.Duration
+	lastActive  int64
+
+	buffer  []byte
+	pending []byte
+	partial []byte
+}
+
+// NewDatagramConnection will carry the datagrams of the packet connection over a stream
+func NewDatagramConnection(conn net.Conn, idleTimeout time.Duration) *DatagramConnection {
+	dc := &DatagramConnection{
+		Conn:        conn,
+		idleTimeout: idleTimeout,
+		buffer:      make([]byte, MaxDatagramSize+2),
+	}
+	dc.touch()
+	return dc
+}
+
+func (dc *DatagramConnection) touch() {
+	atomic.StoreInt64(&dc.lastActive, time.Now().UnixNano())
+}
+
+func (dc *DatagramConnection) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&dc.lastActive)))
+}
+
+func (dc *DatagramConnection) Read(p []byte) (int, error) {
+	if len(dc.pending) == 0 {
+		if err := dc.receive(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, dc.pending)
+	dc.pending = dc.pending[n:]
+	return n, nil
+}
+
+// receive waits for the next datagram
+func (dc *DatagramConnection) receive() error {
+	for {
+		if dc.idleTimeout > 0 {
+			_ = dc.Conn.SetReadDeadline(time.Now().Add(dc.idleTimeout))
+		}
+		n, err := dc.Conn.Read(dc.buffer[2:])
+		if err == nil {
+			dc.touch()
+			binary.BigEndian.PutUint16(dc.buffer, uint16(n))
+			dc.pending = dc.buffer[:n+2]
+			return nil
+		}
+
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && dc.idleTimeout > 0 {
+			if dc.idle() < dc.idleTimeout {
+				// Datagrams were sent in the meantime
+				continue
+			}
+			return io.EOF
+		} else if strings.Contains(err.Error(), "connection refused") {
+			// Nobody listens on the other side (yet), the datagram was lost
+			continue
+		}
+		return err
+	}
+}
+
+// Write sends the whole datagrams written so far. The incomplete datagram is kept until the rest of it is written.
+func (dc *DatagramConnection) Write(p []byte) (int, error) {
+	dc.partial = append(dc.partial, p...)
+	consumed := 0
+	for len(dc.partial)-consumed >= 2 {
+		size := int(binary.BigEndian.Uint16(dc.partial[consumed:]))
+		if len(dc.partial)-consumed < size+2 {
+			break
+		}
+		if _, err := dc.Conn.Write(dc.partial[consumed+2 : consumed+2+size]); err != nil && !strings.Contains(err.Error(), "connection refused") {
+			return 0, err
+		}
+		dc.touch()
+		consumed += size + 2
+	}
+	dc.partial = append(dc.partial[:0], dc.partial[consumed:]...)
+	return len(p), nil
+}
+
+// Unwrap returns the packet connection
+func (dc *DatagramConnection) Unwrap() net.Conn {
+	return dc.Conn
+}
+
+// DialDatagram opens a connected packet socket to the address on the `udp`, `udp4`, `udp6` or `unixgram` network. The
+// unixgram socket is bound to a temporary path, so the service is able to reply. The path is removed when the
+// connection is closed.
+func DialDatagram(network, address string) (net.Conn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+		return net.Dial(network, address)
+	case "unixgram":
+		local := filepath.Join(os.TempDir(), fmt.Sprintf("socketace-%d-%d.sock", os.Getpid(), atomic.AddUint64(&localSockets, 1)))
+		conn, err := net.DialUnix("unixgram", &net.UnixAddr{Name: local, Net: "unixgram"}, &net.UnixAddr{Name: address, Net: "unixgram"})
+		if err != nil {
+			return nil, err
+		}
+		return &boundUnixConn{UnixConn: conn, path: local}, nil
+	default:
+		return nil, errors.Errorf("Not a datagram network: %s", network)
+	}
+}
+
+// IsDatagramNetwork returns true for the networks handled by DialDatagram
+func IsDatagramNetwork(network string) bool {
+	switch network {
+	case "udp", "udp4", "udp6", "unixgram":
+		return true
+	}
+	return false
+}
+
+// boundUnixConn removes the socket file when closed
+type boundUnixConn struct {
+	*net.UnixConn
+	path string
+}
+
+func (c *boundUnixConn) Close() error {
+	err := c.UnixConn.Close()
+	_ = os.Remove(c.path)
+	return err
+}
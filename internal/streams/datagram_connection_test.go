@@ -0,0 +1,72 @@
+package streams
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_Datagram_Framing(t *testing.T) {
+	buf := &bytes.Buffer{}
+	require.NoError(t, WriteDatagram(buf, []byte("hello")))
+	require.NoError(t, WriteDatagram(buf, []byte{}))
+	require.Error(t, WriteDatagram(buf, make([]byte, MaxDatagramSize+1)))
+
+	p := make([]byte, 16)
+	n, err := ReadDatagram(buf, p)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(p[:n]))
+	n, err = ReadDatagram(buf, p)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+	_, err = ReadDatagram(buf, p)
+	require.Equal(t, io.EOF, err)
+}
+
+func Test_DatagramConnection(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, MaxDatagramSize)
+		for {
+			n, from, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteTo(buf[:n], from)
+		}
+	}()
+
+	conn, err := net.Dial("udp", echo.LocalAddr().String())
+	require.NoError(t, err)
+	dc := NewDatagramConnection(conn, 200*time.Millisecond)
+	defer dc.Close()
+
+	// The datagrams may be split across the writes
+	frames := &bytes.Buffer{}
+	require.NoError(t, WriteDatagram(frames, []byte("first")))
+	require.NoError(t, WriteDatagram(frames, []byte("second")))
+	data := frames.Bytes()
+	_, err = dc.Write(data[:4])
+	require.NoError(t, err)
+	_, err = dc.Write(data[4:])
+	require.NoError(t, err)
+
+	p := make([]byte, 16)
+	n, err := ReadDatagram(dc, p)
+	require.NoError(t, err)
+	require.Equal(t, "first", string(p[:n]))
+	n, err = ReadDatagram(dc, p)
+	require.NoError(t, err)
+	require.Equal(t, "second", string(p[:n]))
+
+	// Nothing happens for the idle timeout
+	start := time.Now()
+	_, err = dc.Read(p)
+	require.Equal(t, io.EOF, err)
+	require.True(t, time.Since(start) >= 200*time.Millisecond)
+}
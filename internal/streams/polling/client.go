@@ -0,0 +1,288 @@
+package polling
+
+import (
+	"bytes"
+	"context"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ClientConnection is the client side of a polling session
+type ClientConnection struct {
+	client *http.Client
+	url    *url.URL
+	id     string
+
+	localAddress  net.Addr
+	remoteAddress net.Addr
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	uploads chan []byte
+	reader  *io.PipeReader
+	writer  *io.PipeWriter
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Dial opens a session at the address of the endpoint, e.g. `https://example.org/ws/all`
+func Dial(ctx context.Context, client *http.Client, address string) (*ClientConnection, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid address: %v", address)
+	}
+	c := &ClientConnection{
+		client:        client,
+		url:           u,
+		localAddress:  streams.Localhost,
+		remoteAddress: streams.Localhost,
+		uploads:       make(chan []byte, 16),
+		closed:        make(chan struct{}),
+	}
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			c.localAddress = info.Conn.LocalAddr()
+			c.remoteAddress = info.Conn.RemoteAddr()
+		},
+	}
+	status, data, err := c.roundTrip(httptrace.WithClientTrace(ctx, trace), http.MethodPost, url.Values{
+		ParamOperation: {OperationOpen},
+	}, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not open session at %v", address)
+	} else if status != http.StatusOK || len(data) == 0 {
+		return nil, errors.Errorf("Could not open session at %v: %v", address, http.StatusText(status))
+	}
+	c.id = string(data)
+	log.Debugf("[Polling] Opened session %v at %v", c.id, address)
+
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.reader, c.writer = io.Pipe()
+	go c.upload()
+	go c.download()
+	return c, nil
+}
+
+func (c *ClientConnection) String() string {
+	return c.url.String() + "#" + c.id
+}
+
+func (c *ClientConnection) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// Write queues the data for the upload
+func (c *ClientConnection) Write(p []byte) (int, error) {
+	for written := 0; written < len(p); {
+		n := len(p) - written
+		if n > MaxBatch {
+			n = MaxBatch
+		}
+		data := make([]byte, n)
+		copy(data, p[written:written+n])
+		select {
+		case c.uploads <- data:
+			written += n
+		case <-c.closed:
+			return written, errors.WithStack(io.ErrClosedPipe)
+		}
+	}
+	return len(p), nil
+}
+
+// Close closes the session
+func (c *ClientConnection) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.cancel()
+		_ = c.reader.Close()
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if _, _, err := c.roundTrip(ctx, http.MethodPost, url.Values{
+				ParamSession:   {c.id},
+				ParamOperation: {OperationClose},
+			}, nil); err != nil {
+				log.WithError(err).Debugf("[Polling] Could not close session %v: %v", c.id, err)
+			}
+			c.client.CloseIdleConnections()
+		}()
+	})
+	return nil
+}
+
+func (c *ClientConnection) Closed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *ClientConnection) LocalAddr() net.Addr {
+	return c.localAddress
+}
+
+func (c *ClientConnection) RemoteAddr() net.Addr {
+	return c.remoteAddress
+}
+
+// SetDeadline is not supported, as the stream is not bound to a connection
+func (c *ClientConnection) SetDeadline(t time.Time) error {
+	return nil
+}
+
+// SetReadDeadline is not supported, as the stream is not bound to a connection
+func (c *ClientConnection) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline is not supported, as the stream is not bound to a connection
+func (c *ClientConnection) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// upload sends the queued data, everything queued so far with a single request
+func (c *ClientConnection) upload() {
+	var seq uint64
+	for {
+		var batch []byte
+		select {
+		case batch = <-c.uploads:
+		case <-c.closed:
+			return
+		}
+	collect:
+		for len(batch) < MaxBatch {
+			select {
+			case data := <-c.uploads:
+				batch = append(batch, data...)
+			default:
+				break collect
+			}
+		}
+
+		for len(batch) > 0 {
+			n := len(batch)
+			if n > MaxBatch {
+				n = MaxBatch
+			}
+			status, _, err := c.retry(http.MethodPost, seq, batch[:n])
+			if err == nil && status != http.StatusOK {
+				err = errors.Errorf("Upload failed: %v", http.StatusText(status))
+			}
+			if err != nil {
+				if !c.Closed() {
+					log.WithError(err).Warnf("[Polling] Session %v lost: %v", c.id, err)
+					_ = c.writer.CloseWithError(err)
+					_ = c.Close()
+				}
+				return
+			}
+			batch = batch[n:]
+			seq++
+		}
+	}
+}
+
+// download polls the server for the data until the server closes the session
+func (c *ClientConnection) download() {
+	var seq uint64
+	for {
+		status, data, err := c.retry(http.MethodGet, seq, nil)
+		if err == nil && status == http.StatusGone {
+			log.Debugf("[Polling] Session %v closed by the server", c.id)
+			_ = c.writer.Close()
+			return
+		} else if err == nil && status != http.StatusOK {
+			err = errors.Errorf("Download failed: %v", http.StatusText(status))
+		}
+		if err != nil {
+			if !c.Closed() {
+				log.WithError(err).Warnf("[Polling] Session %v lost: %v", c.id, err)
+			}
+			_ = c.writer.CloseWithError(err)
+			return
+		}
+		if len(data) > 0 {
+			seq++
+			if _, err := c.writer.Write(data); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// retry sends the request of the session until it reaches the server
+func (c *ClientConnection) retry(method string, seq uint64, body []byte) (int, []byte, error) {
+	params := url.Values{
+		ParamSession:  {c.id},
+		ParamSequence: {strconv.FormatUint(seq, 10)},
+	}
+	for attempt := 1; ; attempt++ {
+		status, data, err := c.roundTrip(c.ctx, method, params, body)
+		if err == nil || attempt > Retries {
+			return status, data, err
+		}
+		log.WithError(err).Debugf("[Polling] Request of session %v failed, retrying: %v", c.id, err)
+		select {
+		case <-c.closed:
+			return 0, nil, errors.WithStack(io.ErrClosedPipe)
+		case <-time.After(time.Duration(attempt) * 500 * time.Millisecond):
+		}
+	}
+}
+
+// roundTrip sends the request with the parameters and reads the whole response
+func (c *ClientConnection) roundTrip(ctx context.Context, method string, params url.Values, body []byte) (int, []byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, RequestTimeout)
+	defer cancel()
+
+	u := *c.url
+	query := u.Query()
+	for k, v := range params {
+		query[k] = v
+	}
+	u.RawQuery = query.Encode()
+
+	var content io.Reader
+	if body != nil {
+		content = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u.String(), content)
+	if err != nil {
+		return 0, nil, errors.WithStack(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", ContentType)
+	}
+	noCache(req.Header)
+
+	res, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, nil, errors.WithStack(err)
+	}
+	defer streams.TryClose(res.Body)
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return 0, nil, errors.WithStack(err)
+	}
+	if !isPollingResponse(res) {
+		// E.g. an error page of a proxy
+		return 0, nil, errors.Errorf("Unexpected response: %v", res.Status)
+	}
+	return res.StatusCode, data, nil
+}
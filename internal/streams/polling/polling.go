@@ -0,0 +1,72 @@
+// Package polling tunnels a stream over plain HTTP requests, for the networks where the websockets are blocked. The
+// client uploads the data with POST requests and downloads it with long-polling GET requests. Each request carries
+// the session ID and a sequence number, so the requests may be retried, and each response is complete (with its
+// length), so the buffering proxies pass it on as soon as the server sends it.
+//
+// The requests are:
+//   - POST <endpoint>?op=open: opens the session, the response is the session ID
+//   - POST <endpoint>?s=<session>&q=<n>: uploads the n-th batch of data
+//   - GET <endpoint>?s=<session>&q=<n>: downloads the n-th batch of data, waiting for it up to PollTimeout. The
+//     response is empty if no data arrived in time and 410 Gone once the server closed the session.
+//   - POST <endpoint>?s=<session>&op=close: closes the session
+package polling
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The query parameters of the requests
+const (
+	ParamOperation = "op"
+	ParamSession   = "s"
+	ParamSequence  = "q"
+
+	OperationOpen  = "open"
+	OperationClose = "close"
+)
+
+// ContentType is the content type of the responses of the server
+const ContentType = "application/octet-stream"
+
+var (
+	// MaxBatch is the maximum size of the data sent with a single request or response
+	MaxBatch = 64 * 1024
+	// PollTimeout is how long the server holds a download request when there's no data
+	PollTimeout = 20 * time.Second
+	// SessionTimeout is how long the server keeps a session without any requests
+	SessionTimeout = time.Minute
+	// MaxSessions is the maximum number of open sessions of a server
+	MaxSessions = 1024
+	// MaxSessionsPerAddress is the maximum number of open sessions of a server from a single client IP
+	MaxSessionsPerAddress = 64
+	// RequestTimeout is the maximum duration of a request
+	RequestTimeout = PollTimeout + 30*time.Second
+	// Retries is how many times the client retries a failed request
+	Retries = 5
+)
+
+// IsPollingRequest returns true if the request belongs to the polling transport
+func IsPollingRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		return false
+	}
+	query := r.URL.Query()
+	if query.Get(ParamSession) != "" {
+		return true
+	}
+	return r.Method == http.MethodPost && query.Get(ParamOperation) == OperationOpen
+}
+
+// noCache prevents the proxies from caching the responses
+func noCache(h http.Header) {
+	h.Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	h.Set("Pragma", "no-cache")
+	h.Set("Expires", "0")
+}
+
+// isPollingResponse returns true if the response came from the polling transport and not e.g. from a proxy
+func isPollingResponse(res *http.Response) bool {
+	return strings.HasPrefix(res.Header.Get("Content-Type"), ContentType)
+}
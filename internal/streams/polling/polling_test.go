@@ -0,0 +1,181 @@
+package polling
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func echoServer() *Server {
+	return NewServer(func(conn net.Conn) {
+		_, _ = io.Copy(conn, conn)
+	})
+}
+
+// bufferingProxy passes the requests to the target, returning each response only when it's complete. Every n-th
+// response is replaced with an error after the target received the request.
+func bufferingProxy(t *testing.T, target string, n int32) *httptest.Server {
+	var count int32
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := http.NewRequest(r.Method, target+r.URL.RequestURI(), r.Body)
+		require.NoError(t, err)
+		req.Header = r.Header
+		res, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		data, err := ioutil.ReadAll(res.Body)
+		_ = res.Body.Close()
+		if err != nil || n > 0 && atomic.AddInt32(&count, 1)%n == 0 && r.URL.Query().Get(ParamSession) != "" {
+			http.Error(w, "Bad gateway", http.StatusBadGateway)
+			return
+		}
+		for k, v := range res.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(res.StatusCode)
+		_, _ = w.Write(data)
+	}))
+}
+
+func Test_PollingEcho(t *testing.T) {
+	s := echoServer()
+	defer s.Close()
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	c, err := Dial(context.Background(), http.DefaultClient, server.URL+"/ws/all")
+	require.NoError(t, err)
+	defer c.Close()
+
+	_, err = c.Write([]byte("Hello, world!"))
+	require.NoError(t, err)
+	buf := make([]byte, 13)
+	_, err = io.ReadFull(c, buf)
+	require.NoError(t, err)
+	require.Equal(t, "Hello, world!", string(buf))
+}
+
+func Test_PollingBufferingProxy(t *testing.T) {
+	s := echoServer()
+	defer s.Close()
+	server := httptest.NewServer(s)
+	defer server.Close()
+	proxy := bufferingProxy(t, server.URL, 3)
+	defer proxy.Close()
+
+	c, err := Dial(context.Background(), http.DefaultClient, proxy.URL+"/ws/all")
+	require.NoError(t, err)
+	defer c.Close()
+
+	// More than a few batches, so some of the requests are lost and retried
+	data := make([]byte, 5*MaxBatch+123)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+	go func() {
+		_, _ = c.Write(data)
+	}()
+
+	received := make([]byte, len(data))
+	_, err = io.ReadFull(c, received)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data, received))
+}
+
+func Test_PollingServerClose(t *testing.T) {
+	s := NewServer(func(conn net.Conn) {
+		_, _ = conn.Write([]byte("Bye"))
+		_ = conn.Close()
+	})
+	defer s.Close()
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	c, err := Dial(context.Background(), http.DefaultClient, server.URL)
+	require.NoError(t, err)
+	defer c.Close()
+
+	data, err := ioutil.ReadAll(c)
+	require.NoError(t, err)
+	require.Equal(t, "Bye", string(data))
+}
+
+func Test_PollingUnknownSession(t *testing.T) {
+	s := echoServer()
+	defer s.Close()
+	s.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("<html></html>"))
+	})
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/?s=unknown&q=0")
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.False(t, isPollingResponse(res))
+
+	// The client refuses to open a session with a server which does not speak polling
+	website := httptest.NewServer(s.NotFound)
+	defer website.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = Dial(ctx, http.DefaultClient, website.URL)
+	require.Error(t, err)
+}
+
+// openSession sends the request to open a session from the address and returns the status of the response
+func openSession(s *Server, remoteAddr string) int {
+	req := httptest.NewRequest("POST", "/ws?op=open", nil)
+	req.RemoteAddr = remoteAddr
+	res := httptest.NewRecorder()
+	s.ServeHTTP(res, req)
+	return res.Code
+}
+
+func Test_PollingSessionLimits(t *testing.T) {
+	maxSessions, maxPerAddress := MaxSessions, MaxSessionsPerAddress
+	defer func() {
+		MaxSessions, MaxSessionsPerAddress = maxSessions, maxPerAddress
+	}()
+	MaxSessions, MaxSessionsPerAddress = 3, 2
+
+	s := echoServer()
+	defer s.Close()
+
+	require.Equal(t, http.StatusOK, openSession(s, "192.0.2.1:1000"))
+	require.Equal(t, http.StatusOK, openSession(s, "192.0.2.1:1001"))
+	require.Equal(t, http.StatusServiceUnavailable, openSession(s, "192.0.2.1:1002"))
+	require.Equal(t, http.StatusOK, openSession(s, "192.0.2.2:1000"))
+	require.Equal(t, http.StatusServiceUnavailable, openSession(s, "192.0.2.3:1000"))
+
+	// Closing a session makes room for another one
+	s.mutex.Lock()
+	var id string
+	for k, sess := range s.sessions {
+		if sess.host == "192.0.2.1" {
+			id = k
+		}
+	}
+	s.mutex.Unlock()
+	req := httptest.NewRequest("POST", "/ws?op=close&s="+id, nil)
+	s.ServeHTTP(httptest.NewRecorder(), req)
+	require.Equal(t, http.StatusOK, openSession(s, "192.0.2.1:1003"))
+}
+
+func Test_IsPollingRequest(t *testing.T) {
+	require.True(t, IsPollingRequest(httptest.NewRequest("POST", "/ws?op=open", nil)))
+	require.True(t, IsPollingRequest(httptest.NewRequest("GET", "/ws?s=abc&q=1", nil)))
+	require.False(t, IsPollingRequest(httptest.NewRequest("GET", "/ws?op=open", nil)))
+	require.False(t, IsPollingRequest(httptest.NewRequest("GET", "/ws", nil)))
+	require.False(t, IsPollingRequest(httptest.NewRequest("PUT", "/ws?s=abc", nil)))
+}
@@ -0,0 +1,401 @@
+package polling
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Server keeps the sessions of the polling clients. The stream of each new session is passed to the accept function,
+// which takes over the stream; the session ends when the stream is closed.
+type Server struct {
+	// NotFound answers the requests of the unknown sessions. http.NotFound, if not set.
+	NotFound http.Handler
+
+	accept    func(conn net.Conn)
+	mutex     sync.Mutex
+	sessions  map[string]*session
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewServer(accept func(conn net.Conn)) *Server {
+	s := &Server{
+		accept:   accept,
+		sessions: make(map[string]*session),
+		closed:   make(chan struct{}),
+	}
+	go s.expire()
+	return s
+}
+
+// Close closes all the sessions
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.mutex.Lock()
+		for id, sess := range s.sessions {
+			delete(s.sessions, id)
+			sess.close()
+		}
+		s.mutex.Unlock()
+	})
+	return nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	id := query.Get(ParamSession)
+	operation := query.Get(ParamOperation)
+	if id == "" {
+		if r.Method == http.MethodPost && operation == OperationOpen {
+			s.open(w, r)
+		} else {
+			s.notFound(w, r)
+		}
+		return
+	}
+
+	sess := s.session(id)
+	if sess == nil {
+		s.notFound(w, r)
+		return
+	}
+	if r.Method == http.MethodPost && operation == OperationClose {
+		s.remove(id)
+		sess.close()
+		respond(w, nil)
+		return
+	}
+
+	seq, err := strconv.ParseUint(query.Get(ParamSequence), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid sequence", http.StatusBadRequest)
+		return
+	}
+	if r.Method == http.MethodPost {
+		sess.upload(w, r, seq)
+	} else {
+		sess.download(w, r, seq)
+	}
+}
+
+func (s *Server) notFound(w http.ResponseWriter, r *http.Request) {
+	if s.NotFound != nil {
+		s.NotFound.ServeHTTP(w, r)
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+// open creates a new session and passes its stream to the accept function
+func (s *Server) open(w http.ResponseWriter, r *http.Request) {
+	id, err := newId()
+	if err != nil {
+		log.WithError(err).Errorf("[Polling] Could not open session: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	host := r.RemoteAddr
+	if h, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		host = h
+	}
+
+	s.mutex.Lock()
+	if err := s.limit(host); err != nil {
+		s.mutex.Unlock()
+		log.Warnf("[Polling] Refusing session for %v: %v", r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	local, remote := net.Pipe()
+	sess := newSession(id, host, local)
+	s.sessions[id] = sess
+	s.mutex.Unlock()
+
+	conn := &sessionConnection{
+		Conn:          remote,
+		localAddress:  streams.Localhost,
+		remoteAddress: tcpAddr(r.RemoteAddr),
+	}
+	if a, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		conn.localAddress = a
+	}
+	log.Debugf("[Polling] Opened session %v for %v", id, conn.remoteAddress)
+
+	go s.accept(conn)
+	respond(w, []byte(id))
+}
+
+// limit checks if another session may be opened for the client. Expects the mutex to be held.
+func (s *Server) limit(host string) error {
+	if len(s.sessions) >= MaxSessions {
+		return errors.Errorf("Too many sessions")
+	}
+	count := 0
+	for _, sess := range s.sessions {
+		if sess.host == host {
+			count++
+		}
+	}
+	if count >= MaxSessionsPerAddress {
+		return errors.Errorf("Too many sessions from %v", host)
+	}
+	return nil
+}
+
+// session returns the session with the ID and marks it as active
+func (s *Server) session(id string) *session {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok {
+		return nil
+	}
+	sess.seen = time.Now()
+	return sess
+}
+
+func (s *Server) remove(id string) {
+	s.mutex.Lock()
+	delete(s.sessions, id)
+	s.mutex.Unlock()
+}
+
+// expire closes the sessions without requests for longer than SessionTimeout
+func (s *Server) expire() {
+	ticker := time.NewTicker(SessionTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+		}
+		s.mutex.Lock()
+		for id, sess := range s.sessions {
+			if time.Since(sess.seen) > SessionTimeout {
+				log.Debugf("[Polling] Session %v expired", id)
+				delete(s.sessions, id)
+				sess.close()
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// session is the server side of a polling client's stream
+type session struct {
+	id string
+	// host is the IP of the client which opened the session
+	host string
+	conn net.Conn
+	// seen is the time of the last request, guarded by the server's mutex
+	seen time.Time
+
+	uploadMutex sync.Mutex
+	// uploaded is the sequence of the next upload
+	uploaded uint64
+
+	downloadMutex sync.Mutex
+	// downloaded is the sequence of the next download
+	downloaded uint64
+	// last is the previous download, kept until the client asks for the next one
+	last []byte
+	// pending is the data read, but not yet downloaded
+	pending []byte
+	chunks  chan []byte
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newSession(id, host string, conn net.Conn) *session {
+	sess := &session{
+		id:     id,
+		host:   host,
+		conn:   conn,
+		seen:   time.Now(),
+		chunks: make(chan []byte, 16),
+		closed: make(chan struct{}),
+	}
+	go sess.read()
+	return sess
+}
+
+func (sess *session) close() {
+	sess.closeOnce.Do(func() {
+		close(sess.closed)
+		streams.TryClose(sess.conn)
+	})
+}
+
+// read queues the data of the stream for the downloads
+func (sess *session) read() {
+	defer close(sess.chunks)
+	buf := make([]byte, 16*1024)
+	for {
+		n, err := sess.conn.Read(buf)
+		if n > 0 {
+			chunk := make([]byte, n)
+			copy(chunk, buf[:n])
+			select {
+			case sess.chunks <- chunk:
+			case <-sess.closed:
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// upload writes the uploaded data to the stream. The uploads already written are acknowledged again.
+func (sess *session) upload(w http.ResponseWriter, r *http.Request, seq uint64) {
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(MaxBatch)+1))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if len(data) > MaxBatch {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	sess.uploadMutex.Lock()
+	defer sess.uploadMutex.Unlock()
+	if seq < sess.uploaded {
+		respond(w, nil)
+		return
+	} else if seq > sess.uploaded {
+		http.Error(w, "Unexpected sequence", http.StatusConflict)
+		return
+	}
+	if _, err := sess.conn.Write(data); err != nil {
+		gone(w)
+		return
+	}
+	sess.uploaded++
+	respond(w, nil)
+}
+
+// download sends the data of the stream, waiting for it up to PollTimeout. The previous download is sent again if
+// the client asks for it.
+func (sess *session) download(w http.ResponseWriter, r *http.Request, seq uint64) {
+	sess.downloadMutex.Lock()
+	defer sess.downloadMutex.Unlock()
+	if seq+1 == sess.downloaded && sess.last != nil {
+		respond(w, sess.last)
+		return
+	} else if seq != sess.downloaded {
+		http.Error(w, "Unexpected sequence", http.StatusConflict)
+		return
+	}
+	sess.last = nil
+
+	batch := sess.pending
+	sess.pending = nil
+	if len(batch) == 0 {
+		timer := time.NewTimer(PollTimeout)
+		defer timer.Stop()
+		select {
+		case chunk, ok := <-sess.chunks:
+			if !ok {
+				gone(w)
+				return
+			}
+			batch = chunk
+		case <-sess.closed:
+			gone(w)
+			return
+		case <-timer.C:
+			respond(w, nil)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	// Send everything which is already there
+collect:
+	for len(batch) < MaxBatch {
+		select {
+		case chunk, ok := <-sess.chunks:
+			if !ok {
+				break collect
+			}
+			batch = append(batch, chunk...)
+		default:
+			break collect
+		}
+	}
+	if len(batch) > MaxBatch {
+		sess.pending = batch[MaxBatch:]
+		batch = batch[:MaxBatch:MaxBatch]
+	}
+
+	sess.last = batch
+	sess.downloaded++
+	respond(w, batch)
+}
+
+// sessionConnection is the stream of the session, with the addresses of the client's request
+type sessionConnection struct {
+	net.Conn
+	localAddress  net.Addr
+	remoteAddress net.Addr
+}
+
+func (sc *sessionConnection) LocalAddr() net.Addr {
+	return sc.localAddress
+}
+
+func (sc *sessionConnection) RemoteAddr() net.Addr {
+	return sc.remoteAddress
+}
+
+// respond sends the data as a complete response
+func respond(w http.ResponseWriter, data []byte) {
+	noCache(w.Header())
+	w.Header().Set("Content-Type", ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+}
+
+// gone tells the client that the server closed the session
+func gone(w http.ResponseWriter) {
+	noCache(w.Header())
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(http.StatusGone)
+}
+
+func newId() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", errors.Wrapf(err, "Could not generate session ID")
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// tcpAddr returns the address of the request's client
+func tcpAddr(address string) net.Addr {
+	if a, err := net.ResolveTCPAddr("tcp", address); err == nil {
+		return a
+	}
+	if ip := net.ParseIP(address); ip != nil {
+		return &net.TCPAddr{IP: ip}
+	}
+	return streams.Localhost
+}
@@ -0,0 +1,180 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Identity describes who is on the other side of the connection: the user authorized via the `Authorization`
+// header (if any) and the certificate chain the peer presented during the TLS handshake (if any), together with the
+// chains it was verified with.
+type Identity struct {
+	User           string
+	Certificates   []*x509.Certificate
+	VerifiedChains [][]*x509.Certificate
+}
+
+// Certificate returns the peer (leaf) certificate or nil if the peer did not present one
+func (id *Identity) Certificate() *x509.Certificate {
+	if id == nil || len(id.Certificates) == 0 {
+		return nil
+	}
+	return id.Certificates[0]
+}
+
+func (id *Identity) String() string {
+	c := id.Certificate()
+	if c == nil && id.User == "" {
+		return "anonymous"
+	} else if c == nil {
+		return fmt.Sprintf("user=%v", id.User)
+	} else if id.User == "" {
+		return fmt.Sprintf("cn=%v, issuer=%v", c.Subject.CommonName, c.Issuer.CommonName)
+	}
+	return fmt.Sprintf("user=%v, cn=%v, issuer=%v", id.User, c.Subject.CommonName, c.Issuer.CommonName)
+}
+
+// ------ // ------ // ------ // ------ // ------ // ------ // ------ //
+
+// Rule is a single access rule. All the values, except the fingerprint, are shell-style glob patterns (e.g.
+// `*.example.org`). For a rule to match, all of the defined properties must match. Undefined (empty) properties are
+// ignored.
+type Rule struct {
+	CommonName         string `json:"cn"`
+	SubjectAltName     string `json:"san"`
+	OrganizationalUnit string `json:"ou"`
+	Issuer             string `json:"issuer"`
+	// IssuerFingerprint is the SHA-256 fingerprint of a CA certificate the client certificate was verified with
+	IssuerFingerprint string `json:"issuerFingerprint"`
+	User              string `json:"user"`
+}
+
+func (r *Rule) String() string {
+	parts := make([]string, 0)
+	for _, p := range [][2]string{
+		{"cn", r.CommonName},
+		{"san", r.SubjectAltName},
+		{"ou", r.OrganizationalUnit},
+		{"issuer", r.Issuer},
+		{"issuerFingerprint", r.IssuerFingerprint},
+		{"user", r.User},
+	} {
+		if p[1] != "" {
+			parts = append(parts, p[0]+"="+p[1])
+		}
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+// Matches returns true if the given identity satisfies the rule
+func (r *Rule) Matches(id *Identity) bool {
+	// Anonymous clients never match a user, not even `*`
+	if r.User != "" && (id == nil || id.User == "" || !globMatch(r.User, id.User)) {
+		return false
+	}
+
+	if r.CommonName == "" && r.SubjectAltName == "" && r.OrganizationalUnit == "" && r.Issuer == "" &&
+		r.IssuerFingerprint == "" {
+		return true
+	}
+
+	c := id.Certificate()
+	if c == nil {
+		return false
+	}
+
+	if r.CommonName != "" && !globMatch(r.CommonName, c.Subject.CommonName) {
+		return false
+	}
+	if r.OrganizationalUnit != "" && !globMatchAny(r.OrganizationalUnit, c.Subject.OrganizationalUnit) {
+		return false
+	}
+	if r.Issuer != "" && !globMatch(r.Issuer, c.Issuer.CommonName) && !globMatch(r.Issuer, c.Issuer.String()) {
+		return false
+	}
+	if r.IssuerFingerprint != "" && !id.verifiedBy(r.IssuerFingerprint) {
+		return false
+	}
+	if r.SubjectAltName != "" {
+		names := make([]string, 0)
+		names = append(names, c.DNSNames...)
+		names = append(names, c.EmailAddresses...)
+		for _, ip := range c.IPAddresses {
+			names = append(names, ip.String())
+		}
+		for _, u := range c.URIs {
+			names = append(names, u.String())
+		}
+		if !globMatchAny(r.SubjectAltName, names) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// verifiedBy returns true if any of the CA certificates of the verified chains has the given fingerprint
+func (id *Identity) verifiedBy(fingerprint string) bool {
+	fingerprint = normalizeFingerprint(fingerprint)
+	for _, chain := range id.VerifiedChains {
+		// The first certificate of the chain is the client's own, unless it's trusted directly
+		cas := chain
+		if len(chain) > 1 {
+			cas = chain[1:]
+		}
+		for _, ca := range cas {
+			if Fingerprint(ca) == fingerprint {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the certificate, as lowercase hex without separators
+func Fingerprint(c *x509.Certificate) string {
+	sum := sha256.Sum256(c.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeFingerprint allows the fingerprints in the `AB:CD:...` format, as printed by `openssl x509 -fingerprint`
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.NewReplacer(":", "", " ", "").Replace(fingerprint))
+}
+
+// Rules is a list of access rules. An identity is allowed if it matches any of the rules. An empty list allows
+// everybody.
+type Rules []Rule
+
+// Allows returns true if the identity matches any of the rules or if the list of rules is empty
+func (rl Rules) Allows(id *Identity) bool {
+	if len(rl) == 0 {
+		return true
+	}
+	for _, r := range rl {
+		if r.Matches(id) {
+			return true
+		}
+	}
+	return false
+}
+
+func globMatch(pattern, value string) bool {
+	if ok, err := path.Match(pattern, value); err == nil && ok {
+		return true
+	}
+	return strings.EqualFold(pattern, value)
+}
+
+func globMatchAny(pattern string, values []string) bool {
+	for _, v := range values {
+		if globMatch(pattern, v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/stretchr/testify/require"
+	"net"
+	"strings"
+	"testing"
+)
+
+func Test_Rules(t *testing.T) {
+	ops := &Identity{
+		Certificates: []*x509.Certificate{
+			{
+				Subject: pkix.Name{
+					CommonName:         "alice.admin.example.org",
+					OrganizationalUnit: []string{"ops"},
+				},
+				Issuer: pkix.Name{
+					CommonName: "Example Admin CA",
+				},
+				DNSNames:    []string{"alice.example.org"},
+				IPAddresses: []net.IP{net.ParseIP("10.0.0.1")},
+			},
+		},
+	}
+	dev := &Identity{
+		Certificates: []*x509.Certificate{
+			{
+				Subject: pkix.Name{
+					CommonName:         "bob",
+					OrganizationalUnit: []string{"developers"},
+				},
+				Issuer: pkix.Name{
+					CommonName: "Example Dev CA",
+				},
+			},
+		},
+	}
+	jenkins := &Identity{User: "jenkins"}
+	anonymous := &Identity{}
+
+	ssh := Rules{
+		{OrganizationalUnit: "ops"},
+		{CommonName: "*.admin.example.org", Issuer: "Example Admin CA"},
+	}
+	require.True(t, ssh.Allows(ops))
+	require.False(t, ssh.Allows(dev))
+	require.False(t, ssh.Allows(jenkins))
+	require.False(t, ssh.Allows(anonymous))
+	require.False(t, ssh.Allows(nil))
+
+	web := Rules{
+		{OrganizationalUnit: "developers"},
+		{User: "jenkins"},
+	}
+	require.False(t, web.Allows(ops))
+	require.True(t, web.Allows(dev))
+	require.True(t, web.Allows(jenkins))
+	require.False(t, web.Allows(anonymous))
+
+	san := Rules{{SubjectAltName: "10.0.0.*"}}
+	require.True(t, san.Allows(ops))
+	require.False(t, san.Allows(dev))
+
+	combined := Rules{{User: "jenkins", OrganizationalUnit: "ops"}}
+	require.False(t, combined.Allows(ops))
+	require.False(t, combined.Allows(jenkins))
+	require.True(t, combined.Allows(&Identity{User: "jenkins", Certificates: ops.Certificates}))
+
+	var all Rules
+	require.True(t, all.Allows(anonymous))
+	require.True(t, all.Allows(nil))
+
+	authenticated := Rules{{User: "*"}}
+	require.True(t, authenticated.Allows(jenkins))
+	require.False(t, authenticated.Allows(anonymous))
+	require.False(t, authenticated.Allows(ops))
+	require.False(t, authenticated.Allows(nil))
+}
+
+func Test_RulesIssuerFingerprint(t *testing.T) {
+	adminCa := &x509.Certificate{Raw: []byte("admin ca"), Subject: pkix.Name{CommonName: "Example CA"}}
+	otherCa := &x509.Certificate{Raw: []byte("other ca"), Subject: pkix.Name{CommonName: "Example CA"}}
+	leaf := &x509.Certificate{
+		Raw:     []byte("alice"),
+		Subject: pkix.Name{CommonName: "alice"},
+		Issuer:  pkix.Name{CommonName: "Example CA"},
+	}
+	admin := &Identity{
+		Certificates:   []*x509.Certificate{leaf},
+		VerifiedChains: [][]*x509.Certificate{{leaf, adminCa}},
+	}
+	other := &Identity{
+		Certificates:   []*x509.Certificate{leaf},
+		VerifiedChains: [][]*x509.Certificate{{leaf, otherCa}},
+	}
+	unverified := &Identity{
+		Certificates: []*x509.Certificate{leaf, adminCa},
+	}
+
+	// Both CAs have the same name, only the fingerprint tells them apart
+	byName := Rules{{Issuer: "Example CA"}}
+	require.True(t, byName.Allows(admin))
+	require.True(t, byName.Allows(other))
+
+	fingerprint := Fingerprint(adminCa)
+	colons := strings.ToUpper(fingerprint[:2] + ":" + fingerprint[2:4] + ":" + fingerprint[4:])
+	for _, f := range []string{fingerprint, colons} {
+		byFingerprint := Rules{{IssuerFingerprint: f}}
+		require.True(t, byFingerprint.Allows(admin))
+		require.False(t, byFingerprint.Allows(other))
+		require.False(t, byFingerprint.Allows(unverified))
+		require.False(t, byFingerprint.Allows(&Identity{}))
+	}
+}
@@ -0,0 +1,218 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"github.com/bokysan/socketace/v2/internal/util"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	SchemeBearer = "Bearer"
+	SchemeBasic  = "Basic"
+
+	// TokenUser is the name of the user authenticated with a token which has no name
+	TokenUser = "token"
+)
+
+var (
+	// ErrUnauthorized is returned when the client did not provide any (usable) credentials
+	ErrUnauthorized = errors.New("Authorization required")
+	// ErrForbidden is returned when the client provided the credentials but they were not accepted
+	ErrForbidden = errors.New("Invalid credentials")
+)
+
+// Authenticator checks the value of the `Authorization` header sent by the client
+type Authenticator interface {
+	// Enabled will return true if the clients must authenticate
+	Enabled() bool
+	// Authenticate will validate the `Authorization` header and return the name of the authenticated user
+	Authenticate(authorization string) (string, error)
+	// Challenge returns the list of supported authentication schemes, as sent in the `WWW-Authenticate` header
+	Challenge() string
+}
+
+// Credentials provide the value of the `Authorization` header sent to the server
+type Credentials interface {
+	// Authorization returns the value of the header or an empty string if no credentials are configured
+	Authorization() (string, error)
+	// AllowInsecure returns true if the credentials may be sent over a connection which is not encrypted
+	AllowInsecure() bool
+}
+
+// ------ // ------ // ------ // ------ // ------ // ------ // ------ //
+
+// ClientCredentials are the credentials the client will use to authenticate against the server
+type ClientCredentials struct {
+	Token     string `json:"token" long:"token" env:"AUTH_TOKEN" description:"Bearer token used to authenticate with the server"`
+	TokenFile string `json:"tokenFile" long:"token-file" env:"AUTH_TOKEN_FILE" description:"File with the bearer token used to authenticate with the server"`
+	Username  string `json:"username" long:"username" env:"AUTH_USERNAME" description:"Username used to authenticate with the server"`
+	Password  string `json:"password" long:"password" env:"AUTH_PASSWORD" description:"Password used to authenticate with the server"`
+
+	InsecureAuth bool `json:"insecureAuth" long:"insecure-auth" env:"AUTH_INSECURE" description:"Send the credentials even if the connection to the server is not encrypted"`
+}
+
+func (c *ClientCredentials) GetToken() (string, error) {
+	if c.TokenFile != "" {
+		data, err := ioutil.ReadFile(util.FindFile(c.TokenFile))
+		if err != nil {
+			return "", errors.Wrapf(err, "Could not read token file: %s", c.TokenFile)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return strings.TrimSpace(c.Token), nil
+}
+
+func (c *ClientCredentials) AllowInsecure() bool {
+	return c.InsecureAuth
+}
+
+func (c *ClientCredentials) Authorization() (string, error) {
+	token, err := c.GetToken()
+	if err != nil {
+		return "", err
+	}
+
+	if token != "" {
+		return SchemeBearer + " " + token, nil
+	} else if c.Username != "" {
+		return SchemeBasic + " " + base64.StdEncoding.EncodeToString([]byte(c.Username+":"+c.Password)), nil
+	}
+	return "", nil
+}
+
+// ------ // ------ // ------ // ------ // ------ // ------ // ------ //
+
+// Token is a bearer token accepted by the server and the name of the user it authenticates
+type Token struct {
+	Name  string
+	Value string
+}
+
+// ParseToken parses the token in the `name:token` format. Tokens without a name authenticate as TokenUser.
+func ParseToken(s string) Token {
+	if i := strings.IndexByte(s, ':'); i > 0 {
+		return Token{Name: strings.TrimSpace(s[:i]), Value: strings.TrimSpace(s[i+1:])}
+	}
+	return Token{Name: TokenUser, Value: s}
+}
+
+// ServerConfig defines which credentials will be accepted by the server
+type ServerConfig struct {
+	Tokens       []string `json:"tokens"`
+	TokensFile   string   `json:"tokensFile"`
+	Htpasswd     string   `json:"htpasswd"`
+	HtpasswdFile string   `json:"htpasswdFile"`
+}
+
+func (s *ServerConfig) Enabled() bool {
+	return len(s.Tokens) > 0 || s.TokensFile != "" || s.Htpasswd != "" || s.HtpasswdFile != ""
+}
+
+// GetTokens will return the list of all configured tokens, read from configuration and from the tokens file.
+func (s *ServerConfig) GetTokens() ([]Token, error) {
+	tokens := make([]Token, 0, len(s.Tokens))
+	for _, t := range s.Tokens {
+		if t = strings.TrimSpace(t); t != "" {
+			tokens = append(tokens, ParseToken(t))
+		}
+	}
+
+	if s.TokensFile != "" {
+		data, err := ioutil.ReadFile(util.FindFile(s.TokensFile))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not read tokens file: %s", s.TokensFile)
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			tokens = append(tokens, ParseToken(line))
+		}
+	}
+
+	return tokens, nil
+}
+
+// GetHtpasswd will parse and return the list of users from the htpasswd configuration
+func (s *ServerConfig) GetHtpasswd() (Htpasswd, error) {
+	if s.HtpasswdFile != "" {
+		data, err := ioutil.ReadFile(util.FindFile(s.HtpasswdFile))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not read htpasswd file: %s", s.HtpasswdFile)
+		}
+		return ParseHtpasswd(data)
+	} else if s.Htpasswd != "" {
+		return ParseHtpasswd([]byte(s.Htpasswd))
+	}
+	return Htpasswd{}, nil
+}
+
+// Authenticate will check the value of the `Authorization` header against the configured tokens and users.
+// Files are re-read on every call so credentials may be changed without restarting the server.
+func (s *ServerConfig) Authenticate(authorization string) (string, error) {
+	authorization = strings.TrimSpace(authorization)
+	if authorization == "" {
+		return "", ErrUnauthorized
+	}
+
+	scheme := authorization
+	value := ""
+	if i := strings.IndexByte(authorization, ' '); i > 0 {
+		scheme = authorization[:i]
+		value = strings.TrimSpace(authorization[i+1:])
+	}
+
+	switch {
+	case strings.EqualFold(scheme, SchemeBearer):
+		tokens, err := s.GetTokens()
+		if err != nil {
+			return "", err
+		}
+		for _, t := range tokens {
+			if t.Value != "" && subtle.ConstantTimeCompare([]byte(t.Value), []byte(value)) == 1 {
+				return t.Name, nil
+			}
+		}
+		return "", ErrForbidden
+
+	case strings.EqualFold(scheme, SchemeBasic):
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return "", ErrForbidden
+		}
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) != 2 {
+			return "", ErrForbidden
+		}
+		users, err := s.GetHtpasswd()
+		if err != nil {
+			return "", err
+		}
+		if users.Verify(parts[0], parts[1]) {
+			return parts[0], nil
+		}
+		return "", ErrForbidden
+
+	default:
+		return "", ErrUnauthorized
+	}
+}
+
+// Challenge returns the value of the `WWW-Authenticate` header which lists the accepted authentication schemes
+func (s *ServerConfig) Challenge() string {
+	schemes := make([]string, 0)
+	if len(s.Tokens) > 0 || s.TokensFile != "" {
+		schemes = append(schemes, SchemeBearer)
+	}
+	if s.Htpasswd != "" || s.HtpasswdFile != "" {
+		schemes = append(schemes, SchemeBasic)
+	}
+	return strings.Join(schemes, ", ")
+}
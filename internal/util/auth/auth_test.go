@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"encoding/base64"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"testing"
+)
+
+func basic(user, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
+
+func Test_Htpasswd(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	users, err := ParseHtpasswd([]byte(`
+# Comment
+apr:$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0
+sha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=
+bcrypt:` + string(bcryptHash) + `
+`))
+	require.NoError(t, err)
+	require.Len(t, users, 3)
+
+	for _, u := range []string{"apr", "sha", "bcrypt"} {
+		require.True(t, users.Verify(u, "secret"), "Password for %v not verified", u)
+		require.False(t, users.Verify(u, "wrong"), "Wrong password for %v verified", u)
+	}
+	require.False(t, users.Verify("nobody", "secret"))
+}
+
+func Test_Authenticate(t *testing.T) {
+	config := &ServerConfig{
+		Tokens:   []string{"t0ken"},
+		Htpasswd: "apr:$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0",
+	}
+	require.True(t, config.Enabled())
+	require.Equal(t, "Bearer, Basic", config.Challenge())
+
+	user, err := config.Authenticate("Bearer t0ken")
+	require.NoError(t, err)
+	require.Equal(t, TokenUser, user)
+
+	user, err = config.Authenticate(basic("apr", "secret"))
+	require.NoError(t, err)
+	require.Equal(t, "apr", user)
+
+	_, err = config.Authenticate("")
+	require.Equal(t, ErrUnauthorized, err)
+	_, err = config.Authenticate("Digest abc")
+	require.Equal(t, ErrUnauthorized, err)
+	_, err = config.Authenticate("Bearer wrong")
+	require.Equal(t, ErrForbidden, err)
+	_, err = config.Authenticate(basic("apr", "wrong"))
+	require.Equal(t, ErrForbidden, err)
+}
+
+func Test_AuthenticateNamedTokens(t *testing.T) {
+	config := &ServerConfig{
+		Tokens: []string{"alice:t0ken-a", "bob: t0ken-b", "t0ken-c"},
+	}
+
+	for token, name := range map[string]string{"t0ken-a": "alice", "t0ken-b": "bob", "t0ken-c": TokenUser} {
+		user, err := config.Authenticate("Bearer " + token)
+		require.NoError(t, err)
+		require.Equal(t, name, user)
+	}
+
+	// The name is not a part of the token
+	_, err := config.Authenticate("Bearer alice:t0ken-a")
+	require.Equal(t, ErrForbidden, err)
+}
+
+func Test_ClientCredentials(t *testing.T) {
+	a, err := (&ClientCredentials{}).Authorization()
+	require.NoError(t, err)
+	require.Equal(t, "", a)
+
+	a, err = (&ClientCredentials{Token: "t0ken", Username: "ignored"}).Authorization()
+	require.NoError(t, err)
+	require.Equal(t, "Bearer t0ken", a)
+
+	a, err = (&ClientCredentials{Username: "apr", Password: "secret"}).Authorization()
+	require.NoError(t, err)
+	require.Equal(t, basic("apr", "secret"), a)
+}
@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+// Htpasswd is a map of users and their (hashed) passwords, as read from an Apache htpasswd file. The following
+// hash formats are supported:
+// - bcrypt (`$2y$`, `$2a$`, `$2b$`), e.g. `htpasswd -B`
+// - Apache MD5 (`$apr1$`), the default format of `htpasswd`
+// - SHA1 (`{SHA}`), e.g. `htpasswd -s`
+type Htpasswd map[string]string
+
+// ParseHtpasswd will parse the htpasswd file contents. Empty lines and comments are ignored.
+func ParseHtpasswd(data []byte) (Htpasswd, error) {
+	res := make(Htpasswd)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.Errorf("Invalid htpasswd entry at line %v", lineNo)
+		}
+		res[parts[0]] = parts[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return res, nil
+}
+
+// Verify checks if the user exists and the password matches
+func (h Htpasswd) Verify(user, password string) bool {
+	hash, ok := h[user]
+	if !ok {
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(hash, "$2y$") || strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expected := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 1
+	case strings.HasPrefix(hash, "$apr1$"):
+		parts := strings.Split(hash, "$")
+		if len(parts) != 4 {
+			return false
+		}
+		expected := apr1(password, parts[2])
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 1
+	default:
+		return false
+	}
+}
+
+const apr1Alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1 implements the Apache variant of the MD5-based crypt algorithm
+func apr1(password, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	magic := "$apr1$"
+	pw := []byte(password)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	ctx := md5.New()
+	ctx.Write(pw)
+	ctx.Write([]byte(magic))
+	ctx.Write([]byte(salt))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			ctx.Write(altSum)
+		} else {
+			ctx.Write(altSum[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	sum := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 == 1 {
+			round.Write(pw)
+		} else {
+			round.Write(sum)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 == 1 {
+			round.Write(sum)
+		} else {
+			round.Write(pw)
+		}
+		sum = round.Sum(nil)
+	}
+
+	out := make([]byte, 0, 22)
+	encode := func(a, b, c byte, n int) {
+		v := uint(a)<<16 | uint(b)<<8 | uint(c)
+		for ; n > 0; n-- {
+			out = append(out, apr1Alphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	encode(sum[0], sum[6], sum[12], 4)
+	encode(sum[1], sum[7], sum[13], 4)
+	encode(sum[2], sum[8], sum[14], 4)
+	encode(sum[3], sum[9], sum[15], 4)
+	encode(sum[4], sum[10], sum[5], 4)
+	encode(0, 0, sum[11], 2)
+
+	return magic + salt + "$" + string(out)
+}
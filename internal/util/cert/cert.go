@@ -5,15 +5,13 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
-	"github.com/bokysan/socketace/v2/internal/args"
+	"github.com/bokysan/socketace/v2/internal/util"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/youmark/pkcs8"
 	_ "github.com/youmark/pkcs8"
 	"io/ioutil"
-	"os"
 	"os/exec"
-	"path/filepath"
 	"strings"
 )
 
@@ -51,7 +49,7 @@ type ConfigGetter interface {
 
 func (m *Config) GetCertificate() ([]byte, error) {
 	if m.CertificateFile != "" {
-		certPemBlock, err := ioutil.ReadFile(findFile(m.CertificateFile))
+		certPemBlock, err := ioutil.ReadFile(util.FindFile(m.CertificateFile))
 		if err != nil {
 			return nil, errors.Wrapf(err, "Could not read certificate file: %s", m.CertificateFile)
 		}
@@ -64,7 +62,7 @@ func (m *Config) GetCertificate() ([]byte, error) {
 
 func (m *Config) GetPrivateKey() (privateKeyPemBlock []byte, err error) {
 	if m.PrivateKeyFile != "" {
-		privateKeyPemBlock, err = ioutil.ReadFile(findFile(m.PrivateKeyFile))
+		privateKeyPemBlock, err = ioutil.ReadFile(util.FindFile(m.PrivateKeyFile))
 		if err != nil {
 			err = errors.Wrapf(err, "Could not read private key file: %s", m.PrivateKeyFile)
 		}
@@ -162,7 +160,7 @@ func (m *Config) GetX509KeyPair() (*tls.Certificate, error) {
 
 func (m *Config) GetCaCertificates() ([]byte, error) {
 	if m.CaCertificateFile != "" {
-		certPemBlock, err := ioutil.ReadFile(findFile(m.CaCertificateFile))
+		certPemBlock, err := ioutil.ReadFile(util.FindFile(m.CaCertificateFile))
 		if err != nil {
 			return nil, errors.Wrapf(err, "Could not read ca certificate file: %s", m.CaCertificateFile)
 		}
@@ -233,27 +231,14 @@ func (m *ServerConfig) GetTlsConfig() (conf *tls.Config, err error) {
 	log.Debug("ServerConfig.GetTlsConfig()")
 	conf, err = m.Config.GetTlsConfig()
 
-	if err != nil {
+	if err == nil {
 		if m.RequireClientCert {
 			conf.ClientAuth = tls.RequireAndVerifyClientCert
+		} else if conf.ClientCAs != nil {
+			// Ask for the certificate so it can be used to select the channels, but don't require it
+			conf.ClientAuth = tls.VerifyClientCertIfGiven
 		}
 	}
 
 	return
 }
-
-// findFile will try to locale the file based on relaltive path of the configuration location and,
-// failing that, return the provided location as ist
-func findFile(name string) string {
-	if args.General.ConfigurationFilePath != "" {
-		path := filepath.Dir(args.General.ConfigurationFilePath)
-		file := filepath.Join(path, name)
-
-		_, err := os.Stat(file)
-		if !os.IsNotExist(err) {
-			return file
-		}
-	}
-
-	return name
-}
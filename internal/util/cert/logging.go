@@ -2,30 +2,63 @@ package cert
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"github.com/bokysan/socketace/v2/internal/streams"
 	log "github.com/sirupsen/logrus"
 	"net"
 )
 
-func PrintPeerCertificates(conn net.Conn) {
-	for {
+// FindTlsConnection will unwrap the connection until it finds the underlying TLS connection. It returns nil
+// if the connection is not encrypted with TLS.
+func FindTlsConnection(conn net.Conn) *tls.Conn {
+	for conn != nil {
 		if tlsConn, ok := conn.(*tls.Conn); ok {
-			state := tlsConn.ConnectionState()
-			certChain := state.PeerCertificates
-			cert := certChain[len(certChain)-1]
-
-			log.Infof(
-				"Peer certificate: ver=%v, serial=%v, subject=%v",
-				cert.Version,
-				cert.SerialNumber,
-				cert.Subject,
-			)
-			return
+			return tlsConn
 		} else if wrapper, ok := conn.(streams.UnwrappedConnection); ok {
 			conn = wrapper.Unwrap()
 		} else {
-			log.Tracef("%v not a valid TLS connection.", conn)
-			return
+			return nil
 		}
 	}
+	return nil
+}
+
+// PeerCertificates returns the certificate chain presented by the other side of the connection or nil if the
+// connection is not encrypted with TLS or the peer did not present a certificate.
+func PeerCertificates(conn net.Conn) []*x509.Certificate {
+	if tlsConn := FindTlsConnection(conn); tlsConn != nil {
+		return tlsConn.ConnectionState().PeerCertificates
+	}
+	return nil
+}
+
+// VerifiedChains returns the chains the peer's certificate was verified with, each ending with a trusted CA
+// certificate, or nil if the connection is not encrypted with TLS or the peer's certificate was not verified.
+func VerifiedChains(conn net.Conn) [][]*x509.Certificate {
+	if tlsConn := FindTlsConnection(conn); tlsConn != nil {
+		return tlsConn.ConnectionState().VerifiedChains
+	}
+	return nil
+}
+
+func PrintPeerCertificates(conn net.Conn) {
+	tlsConn := FindTlsConnection(conn)
+	if tlsConn == nil {
+		log.Tracef("%v not a valid TLS connection.", conn)
+		return
+	}
+
+	certChain := tlsConn.ConnectionState().PeerCertificates
+	if len(certChain) == 0 {
+		log.Tracef("%v: peer did not present any certificates.", conn)
+		return
+	}
+	cert := certChain[len(certChain)-1]
+
+	log.Infof(
+		"Peer certificate: ver=%v, serial=%v, subject=%v",
+		cert.Version,
+		cert.SerialNumber,
+		cert.Subject,
+	)
 }
@@ -0,0 +1,81 @@
+package duration
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// Duration is a duration in the configuration, e.g. a timeout. It accepts a string (e.g. `30s`) as well as a number
+// of nanoseconds.
+type Duration time.Duration
+
+// Parse will parse the duration from a string, e.g. `30s` or `1m30s`
+func Parse(s string) (Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return Duration(d), nil
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// UnmarshalFlag parses the duration given on the command line or in the environment, e.g. `30s`
+func (d *Duration) UnmarshalFlag(value string) error {
+	parsed, err := Parse(value)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+// MarshalFlag returns the duration as shown in the help, e.g. `30s`
+func (d Duration) MarshalFlag() (string, error) {
+	return d.String(), nil
+}
+
+// UnmarshalJSON accepts the duration as a string (e.g. `30s`) as well as nanoseconds
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var val interface{}
+	if err := json.Unmarshal(b, &val); err != nil {
+		return errors.WithStack(err)
+	}
+	return d.set(val)
+}
+
+// UnmarshalYAML accepts the duration as a string (e.g. `30s`) as well as nanoseconds
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var val interface{}
+	if err := unmarshal(&val); err != nil {
+		return errors.WithStack(err)
+	}
+	return d.set(val)
+}
+
+func (d *Duration) set(val interface{}) error {
+	switch v := val.(type) {
+	case nil:
+		*d = 0
+	case float64:
+		*d = Duration(v)
+	case int:
+		*d = Duration(v)
+	case int64:
+		*d = Duration(v)
+	case uint64:
+		*d = Duration(v)
+	case string:
+		parsed, err := Parse(v)
+		if err != nil {
+			return err
+		}
+		*d = parsed
+	default:
+		return errors.Errorf("Expected a duration, got: %v", val)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package duration
+
+import (
+	"encoding/json"
+	"github.com/jessevdk/go-flags"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func Test_DurationUnmarshalJSON(t *testing.T) {
+	var d Duration
+	require.NoError(t, json.Unmarshal([]byte(`"1m30s"`), &d))
+	require.Equal(t, Duration(90*time.Second), d)
+	require.NoError(t, json.Unmarshal([]byte(`200000000`), &d))
+	require.Equal(t, Duration(200*time.Millisecond), d)
+	require.NoError(t, json.Unmarshal([]byte(`null`), &d))
+	require.Equal(t, Duration(0), d)
+	require.Error(t, json.Unmarshal([]byte(`"soon"`), &d))
+	require.Error(t, json.Unmarshal([]byte(`true`), &d))
+}
+
+func Test_DurationUnmarshalYAML(t *testing.T) {
+	var d Duration
+	require.NoError(t, d.UnmarshalYAML(func(v interface{}) error {
+		*(v.(*interface{})) = "10s"
+		return nil
+	}))
+	require.Equal(t, Duration(10*time.Second), d)
+	require.NoError(t, d.UnmarshalYAML(func(v interface{}) error {
+		*(v.(*interface{})) = uint64(5)
+		return nil
+	}))
+	require.Equal(t, Duration(5), d)
+}
+
+func Test_DurationParse(t *testing.T) {
+	d, err := Parse("30s")
+	require.NoError(t, err)
+	require.Equal(t, "30s", d.String())
+	_, err = Parse("30")
+	require.Error(t, err)
+}
+
+func Test_DurationFlag(t *testing.T) {
+	var opts struct {
+		Timeout Duration `long:"timeout" default:"250ms"`
+	}
+	_, err := flags.ParseArgs(&opts, []string{})
+	require.NoError(t, err)
+	require.Equal(t, Duration(250*time.Millisecond), opts.Timeout)
+	_, err = flags.ParseArgs(&opts, []string{"--timeout", "1m"})
+	require.NoError(t, err)
+	require.Equal(t, Duration(time.Minute), opts.Timeout)
+	_, err = flags.ParseArgs(&opts, []string{"--timeout", "soon"})
+	require.Error(t, err)
+}
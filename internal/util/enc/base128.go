@@ -104,7 +104,10 @@ func (b *Base128Encoder) Encode(src []byte) []byte {
 		whichByte++
 	}
 
-	dst = append(dst, bufByte)
+	if whichByte > 1 {
+		// Only add the remaining bits if there are any, otherwise the length is not valid base128
+		dst = append(dst, bufByte)
+	}
 	dst = escape128(dst)
 	return dst
 }
@@ -28,3 +28,16 @@ func Test_Base128Encoder(t *testing.T) {
 		require.Equal(t, encoderTest, decoded)
 	}
 }
+
+func Test_Base128EncoderLengths(t *testing.T) {
+	encoder := Base128Encoder{}
+	for l := 0; l < 30; l++ {
+		data := make([]byte, l)
+		for k := range data {
+			data[k] = byte(255 - k)
+		}
+		decoded, err := encoder.Decode(encoder.Encode(data))
+		require.NoError(t, err, "Could not decode %v bytes", l)
+		require.Equal(t, data, decoded)
+	}
+}
@@ -0,0 +1,23 @@
+package util
+
+import (
+	"github.com/bokysan/socketace/v2/internal/args"
+	"os"
+	"path/filepath"
+)
+
+// FindFile will try to locale the file based on relaltive path of the configuration location and,
+// failing that, return the provided location as ist
+func FindFile(name string) string {
+	if args.General.ConfigurationFilePath != "" {
+		path := filepath.Dir(args.General.ConfigurationFilePath)
+		file := filepath.Join(path, name)
+
+		_, err := os.Stat(file)
+		if !os.IsNotExist(err) {
+			return file
+		}
+	}
+
+	return name
+}
@@ -0,0 +1,68 @@
+// Package vpn carries IP packets between the TUN interfaces (or the userspace network stacks) of the clients and the
+// server. The packets are sent over a dedicated stream of the session, framed by streams.WriteDatagram.
+package vpn
+
+import (
+	"github.com/bokysan/socketace/v2/internal/util/addr"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+)
+
+// DefaultMTU is the MTU of the interfaces, if not configured otherwise
+const DefaultMTU = 1400
+
+// Config is the configuration of the interface
+type Config struct {
+	// Address is the address of the interface, with the mask of the network, e.g. `10.8.0.2/24`
+	Address *net.IPNet
+	// Routes are the networks reachable through the interface, beside the network of the address
+	Routes []*net.IPNet
+	// MTU is the largest packet sent through the interface
+	MTU int
+}
+
+// Device is a network interface exchanging whole IP packets: each Read returns a single packet and each Write sends
+// a single packet.
+type Device interface {
+	io.ReadWriteCloser
+	// Name returns the name of the interface
+	Name() string
+	// Configure sets the address and the routes of the interface
+	Configure(config Config) error
+}
+
+// Open opens the device of the address: `tun://<name>` for a TUN interface (the kernel chooses the name, if empty)
+// or `userspace://` for a userspace network stack.
+func Open(address *addr.ProtoAddress) (Device, error) {
+	switch address.Scheme {
+	case "tun":
+		return OpenTun(address.Host)
+	case "userspace", "":
+		return NewStack(), nil
+	default:
+		return nil, errors.Errorf("Unknown device: %v", address.String())
+	}
+}
+
+// source returns the source address of the IPv4 or IPv6 packet
+func source(p []byte) net.IP {
+	switch {
+	case len(p) >= 20 && p[0]>>4 == 4:
+		return net.IP(p[12:16])
+	case len(p) >= 40 && p[0]>>4 == 6:
+		return net.IP(p[8:24])
+	}
+	return nil
+}
+
+// destination returns the destination address of the IPv4 or IPv6 packet
+func destination(p []byte) net.IP {
+	switch {
+	case len(p) >= 20 && p[0]>>4 == 4:
+		return net.IP(p[16:20])
+	case len(p) >= 40 && p[0]>>4 == 6:
+		return net.IP(p[24:40])
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package vpn
+
+import (
+	"github.com/pkg/errors"
+	"net"
+	"sync"
+)
+
+// Pool assigns the addresses of the network to the clients. The network address and the IPv4 broadcast address are
+// never assigned.
+type Pool struct {
+	network *net.IPNet
+	mutex   sync.Mutex
+	used    map[string]bool
+}
+
+// NewPool creates the pool of the addresses of the network
+func NewPool(network *net.IPNet) *Pool {
+	ip := network.IP.Mask(network.Mask)
+	if ip4 := ip.To4(); ip4 != nil && len(network.Mask) == net.IPv4len {
+		ip = ip4
+	}
+	return &Pool{
+		network: &net.IPNet{IP: ip, Mask: network.Mask},
+		used:    make(map[string]bool),
+	}
+}
+
+// Network returns the network of the pool
+func (p *Pool) Network() *net.IPNet {
+	return p.network
+}
+
+// Allocate returns the first free address
+func (p *Pool) Allocate() (net.IP, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for ip := next(p.network.IP); p.network.Contains(ip); ip = next(ip) {
+		if p.assignable(ip) && !p.used[ip.String()] {
+			p.used[ip.String()] = true
+			return ip, nil
+		}
+	}
+	return nil, errors.Errorf("No free addresses in %v", p.network)
+}
+
+// Reserve marks the address as used
+func (p *Pool) Reserve(ip net.IP) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.network.Contains(ip) || !p.assignable(ip) {
+		return errors.Errorf("Address %v can't be assigned from %v", ip, p.network)
+	}
+	if p.used[ip.String()] {
+		return errors.Errorf("Address %v is already in use", ip)
+	}
+	p.used[ip.String()] = true
+	return nil
+}
+
+// Release returns the address to the pool
+func (p *Pool) Release(ip net.IP) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.used, ip.String())
+}
+
+// assignable returns false for the network and the broadcast address
+func (p *Pool) assignable(ip net.IP) bool {
+	if ip.Equal(p.network.IP) {
+		return false
+	}
+	if ip4 := ip.To4(); ip4 != nil && len(p.network.Mask) == net.IPv4len {
+		for i := range ip4 {
+			if ip4[i]|p.network.Mask[i] != 0xff {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// next returns the following address
+func next(ip net.IP) net.IP {
+	n := append(net.IP(nil), ip...)
+	for i := len(n) - 1; i >= 0; i-- {
+		n[i]++
+		if n[i] != 0 {
+			break
+		}
+	}
+	return n
+}
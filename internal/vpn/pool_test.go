@@ -0,0 +1,31 @@
+package vpn
+
+import (
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+func Test_Pool(t *testing.T) {
+	_, network, err := net.ParseCIDR("10.8.0.0/30")
+	require.NoError(t, err)
+	p := NewPool(network)
+
+	first, err := p.Allocate()
+	require.NoError(t, err)
+	require.Equal(t, "10.8.0.1", first.String())
+	second, err := p.Allocate()
+	require.NoError(t, err)
+	require.Equal(t, "10.8.0.2", second.String())
+
+	// Neither the network nor the broadcast address are assigned
+	_, err = p.Allocate()
+	require.Error(t, err)
+	require.Error(t, p.Reserve(net.ParseIP("10.8.0.3")))
+	require.Error(t, p.Reserve(net.ParseIP("10.8.0.0")))
+	require.Error(t, p.Reserve(net.ParseIP("10.9.0.1")))
+
+	require.Error(t, p.Reserve(first))
+	p.Release(first)
+	require.NoError(t, p.Reserve(first))
+}
@@ -0,0 +1,95 @@
+package vpn
+
+import (
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	configOk    = "OK"
+	configError = "ERROR "
+)
+
+// WriteConfig sends the configuration of the client's interface (or the reason the client was refused) on the VPN
+// stream, e.g. `OK address=10.8.0.2/24 mtu=1400 routes=10.0.0.0/8,192.168.5.0/24`. The packets follow.
+func WriteConfig(w io.Writer, config *Config, err error) error {
+	line := configError
+	if err != nil {
+		line += strings.NewReplacer("\r", " ", "\n", " ").Replace(err.Error())
+	} else {
+		line = configOk + " address=" + config.Address.String() + " mtu=" + strconv.Itoa(config.MTU)
+		if len(config.Routes) > 0 {
+			routes := make([]string, 0, len(config.Routes))
+			for _, r := range config.Routes {
+				routes = append(routes, r.String())
+			}
+			line += " routes=" + strings.Join(routes, ",")
+		}
+	}
+	_, e := w.Write([]byte(line + "\r\n"))
+	return errors.Wrapf(e, "Could not send the VPN configuration")
+}
+
+// ReadConfig reads the configuration sent by the server and returns the error it reported, if any
+func ReadConfig(r io.Reader) (*Config, error) {
+	line := make([]byte, 0, 128)
+	b := make([]byte, 1)
+	for b[0] != '\n' {
+		if len(line) > 4096 {
+			return nil, errors.Errorf("VPN configuration too long")
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, errors.Wrapf(err, "Could not read the VPN configuration")
+		}
+		line = append(line, b[0])
+	}
+	reply := strings.TrimRight(string(line), "\r\n")
+	if strings.HasPrefix(reply, configError) {
+		return nil, errors.Errorf("Server refused the VPN: %v", strings.TrimPrefix(reply, configError))
+	}
+	fields := strings.Fields(reply)
+	if len(fields) == 0 || fields[0] != configOk {
+		return nil, errors.Errorf("Invalid VPN configuration: %q", reply)
+	}
+
+	config := &Config{MTU: DefaultMTU}
+	for _, f := range fields[1:] {
+		i := strings.Index(f, "=")
+		if i < 0 {
+			return nil, errors.Errorf("Invalid VPN configuration: %q", reply)
+		}
+		name, value := f[:i], f[i+1:]
+		switch name {
+		case "address":
+			ip, network, err := net.ParseCIDR(value)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Invalid address: %v", value)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			config.Address = &net.IPNet{IP: ip, Mask: network.Mask}
+		case "mtu":
+			mtu, err := strconv.Atoi(value)
+			if err != nil || mtu < 68 {
+				return nil, errors.Errorf("Invalid MTU: %v", value)
+			}
+			config.MTU = mtu
+		case "routes":
+			for _, r := range strings.Split(value, ",") {
+				_, network, err := net.ParseCIDR(r)
+				if err != nil {
+					return nil, errors.Wrapf(err, "Invalid route: %v", r)
+				}
+				config.Routes = append(config.Routes, network)
+			}
+		}
+	}
+	if config.Address == nil {
+		return nil, errors.Errorf("No address in the VPN configuration: %q", reply)
+	}
+	return config, nil
+}
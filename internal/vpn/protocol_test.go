@@ -0,0 +1,35 @@
+package vpn
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+func Test_Config(t *testing.T) {
+	_, routed, err := net.ParseCIDR("192.168.5.0/24")
+	require.NoError(t, err)
+	config := &Config{
+		Address: &net.IPNet{IP: net.ParseIP("10.8.0.2").To4(), Mask: net.CIDRMask(24, 32)},
+		Routes:  []*net.IPNet{routed},
+		MTU:     1280,
+	}
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, WriteConfig(buf, config, nil))
+	buf.WriteString("packets")
+	read, err := ReadConfig(buf)
+	require.NoError(t, err)
+	require.Equal(t, config, read)
+	require.Equal(t, "packets", buf.String())
+
+	buf.Reset()
+	require.NoError(t, WriteConfig(buf, nil, errors.New("No free\r\naddresses")))
+	_, err = ReadConfig(buf)
+	require.EqualError(t, err, "Server refused the VPN: No free  addresses")
+
+	_, err = ReadConfig(bytes.NewBufferString("OK mtu=1400\r\n"))
+	require.Error(t, err)
+}
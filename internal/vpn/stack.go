@@ -0,0 +1,391 @@
+package vpn
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StackQueueSize is the number of the packets queued by the stack before they are dropped
+const StackQueueSize = 256
+
+const (
+	protocolICMP = 1
+	protocolUDP  = 17
+
+	icmpEchoReply   = 0
+	icmpEchoRequest = 8
+
+	firstEphemeralPort = 49152
+)
+
+// Stack is a minimal userspace network stack, for the setups where a TUN interface can't be created (and for the
+// tests). It only speaks IPv4: it answers the pings (ICMP echo requests) and has UDP sockets. Fragmented packets
+// are dropped.
+type Stack struct {
+	mutex   sync.Mutex
+	address net.IP
+	udp     map[uint16]*UDPConn
+	pings   map[uint32]chan struct{}
+	pingID  uint32
+
+	outgoing chan []byte
+	closed   chan struct{}
+	once     sync.Once
+}
+
+// NewStack creates the stack. It has no address until configured.
+func NewStack() *Stack {
+	return &Stack{
+		udp:      make(map[uint16]*UDPConn),
+		pings:    make(map[uint32]chan struct{}),
+		outgoing: make(chan []byte, StackQueueSize),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (s *Stack) Name() string {
+	return "userspace"
+}
+
+// Configure sets the address of the stack. The routes are ignored, as all the packets are sent to the tunnel.
+func (s *Stack) Configure(config Config) error {
+	ip := config.Address.IP.To4()
+	if ip == nil {
+		return errors.Errorf("The userspace stack only supports IPv4, not %v", config.Address)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.address = ip
+	return nil
+}
+
+// Address returns the address of the stack
+func (s *Stack) Address() net.IP {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.address
+}
+
+// Read returns the next packet sent by the stack
+func (s *Stack) Read(p []byte) (int, error) {
+	select {
+	case packet := <-s.outgoing:
+		return copy(p, packet), nil
+	case <-s.closed:
+		return 0, io.EOF
+	}
+}
+
+// Write passes the packet to the stack
+func (s *Stack) Write(p []byte) (int, error) {
+	select {
+	case <-s.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	if len(p) < 20 || p[0]>>4 != 4 {
+		return len(p), nil
+	}
+	size := int(p[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(p[2:4]))
+	if size < 20 || total < size || total > len(p) || binary.BigEndian.Uint16(p[6:8])&0x3fff != 0 {
+		// Invalid or fragmented
+		return len(p), nil
+	}
+	src, dst := net.IP(p[12:16]), net.IP(p[16:20])
+	if address := s.Address(); address == nil || !dst.Equal(address) {
+		return len(p), nil
+	}
+
+	payload := p[size:total]
+	switch p[9] {
+	case protocolICMP:
+		s.receiveICMP(src, payload)
+	case protocolUDP:
+		s.receiveUDP(src, payload)
+	}
+	return len(p), nil
+}
+
+// Close stops the stack and closes its sockets
+func (s *Stack) Close() error {
+	s.once.Do(func() {
+		close(s.closed)
+	})
+	return nil
+}
+
+// send queues the IPv4 packet for the tunnel. The packet is dropped if the queue is full.
+func (s *Stack) send(dst net.IP, protocol byte, payload []byte) error {
+	src := s.Address()
+	if src == nil {
+		return errors.Errorf("The stack has no address")
+	}
+	dst = dst.To4()
+	if dst == nil {
+		return errors.Errorf("The userspace stack only supports IPv4")
+	}
+
+	packet := make([]byte, 20+len(payload))
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	packet[8] = 64
+	packet[9] = protocol
+	copy(packet[12:16], src)
+	copy(packet[16:20], dst)
+	binary.BigEndian.PutUint16(packet[10:12], checksum(packet[:20], 0))
+	copy(packet[20:], payload)
+
+	select {
+	case s.outgoing <- packet:
+	case <-s.closed:
+		return io.ErrClosedPipe
+	default:
+	}
+	return nil
+}
+
+func (s *Stack) receiveICMP(src net.IP, payload []byte) {
+	if len(payload) < 8 || checksum(payload, 0) != 0 {
+		return
+	}
+	switch payload[0] {
+	case icmpEchoRequest:
+		reply := append([]byte(nil), payload...)
+		reply[0] = icmpEchoReply
+		reply[2], reply[3] = 0, 0
+		binary.BigEndian.PutUint16(reply[2:4], checksum(reply, 0))
+		_ = s.send(src, protocolICMP, reply)
+	case icmpEchoReply:
+		s.mutex.Lock()
+		done := s.pings[binary.BigEndian.Uint32(payload[4:8])]
+		s.mutex.Unlock()
+		if done != nil {
+			select {
+			case done <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// Ping sends an ICMP echo request to the address and returns the round-trip time of the reply
+func (s *Stack) Ping(dst net.IP, timeout time.Duration) (time.Duration, error) {
+	id := atomic.AddUint32(&s.pingID, 1)
+	key := id<<16 | 1
+	done := make(chan struct{}, 1)
+	s.mutex.Lock()
+	s.pings[key] = done
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.pings, key)
+		s.mutex.Unlock()
+	}()
+
+	request := make([]byte, 8+32)
+	request[0] = icmpEchoRequest
+	binary.BigEndian.PutUint32(request[4:8], key)
+	copy(request[8:], "socketace")
+	binary.BigEndian.PutUint16(request[2:4], checksum(request, 0))
+
+	start := time.Now()
+	if err := s.send(dst, protocolICMP, request); err != nil {
+		return 0, err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return time.Since(start), nil
+	case <-timer.C:
+		return 0, errors.Errorf("No reply from %v", dst)
+	case <-s.closed:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+func (s *Stack) receiveUDP(src net.IP, payload []byte) {
+	if len(payload) < 8 {
+		return
+	}
+	size := int(binary.BigEndian.Uint16(payload[4:6]))
+	if size < 8 || size > len(payload) {
+		return
+	}
+	s.mutex.Lock()
+	conn := s.udp[binary.BigEndian.Uint16(payload[2:4])]
+	s.mutex.Unlock()
+	if conn == nil {
+		return
+	}
+	d := udpDatagram{
+		data: append([]byte(nil), payload[8:size]...),
+		from: &net.UDPAddr{IP: append(net.IP(nil), src...), Port: int(binary.BigEndian.Uint16(payload[0:2]))},
+	}
+	select {
+	case conn.incoming <- d:
+	default:
+	}
+}
+
+// ListenUDP opens the UDP socket on the port of the stack. A free port is chosen if the port is 0.
+func (s *Stack) ListenUDP(port int) (*UDPConn, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if port == 0 {
+		for p := firstEphemeralPort; p <= 65535; p++ {
+			if _, ok := s.udp[uint16(p)]; !ok {
+				port = p
+				break
+			}
+		}
+	}
+	if port <= 0 || port > 65535 {
+		return nil, errors.Errorf("Invalid port: %v", port)
+	}
+	if _, ok := s.udp[uint16(port)]; ok {
+		return nil, errors.Errorf("Port %v is already in use", port)
+	}
+	conn := &UDPConn{
+		stack:    s,
+		port:     uint16(port),
+		incoming: make(chan udpDatagram, StackQueueSize),
+		closed:   make(chan struct{}),
+	}
+	s.udp[conn.port] = conn
+	return conn, nil
+}
+
+// checksum returns the internet checksum (RFC 1071) of the data, added to the initial sum
+func checksum(data []byte, initial uint32) uint16 {
+	sum := initial
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// ------ // ------ // ------ // ------ // ------ // ------ // ------ //
+
+type udpDatagram struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+// timeoutError is returned when the read deadline is reached
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// UDPConn is a UDP socket of the userspace stack
+type UDPConn struct {
+	stack    *Stack
+	port     uint16
+	incoming chan udpDatagram
+	closed   chan struct{}
+	once     sync.Once
+
+	mutex    sync.Mutex
+	deadline time.Time
+}
+
+func (c *UDPConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.mutex.Lock()
+	deadline := c.deadline
+	c.mutex.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case d := <-c.incoming:
+		return copy(p, d.data), d.from, nil
+	case <-c.closed:
+		return 0, nil, io.EOF
+	case <-c.stack.closed:
+		return 0, nil, io.EOF
+	case <-timeout:
+		return 0, nil, timeoutError{}
+	}
+}
+
+func (c *UDPConn) WriteTo(p []byte, a net.Addr) (int, error) {
+	to, ok := a.(*net.UDPAddr)
+	if !ok {
+		return 0, errors.Errorf("Not a UDP address: %v", a)
+	}
+	src := c.stack.Address()
+	if src == nil || to.IP.To4() == nil {
+		return 0, errors.Errorf("Can't send from %v to %v", src, to)
+	}
+
+	segment := make([]byte, 8+len(p))
+	binary.BigEndian.PutUint16(segment[0:2], c.port)
+	binary.BigEndian.PutUint16(segment[2:4], uint16(to.Port))
+	binary.BigEndian.PutUint16(segment[4:6], uint16(len(segment)))
+	copy(segment[8:], p)
+
+	// The pseudo header: the addresses, the protocol and the length
+	var sum uint32
+	for _, ip := range []net.IP{src, to.IP.To4()} {
+		sum += uint32(binary.BigEndian.Uint16(ip[0:2])) + uint32(binary.BigEndian.Uint16(ip[2:4]))
+	}
+	sum += protocolUDP + uint32(len(segment))
+	crc := checksum(segment, sum)
+	if crc == 0 {
+		crc = 0xffff
+	}
+	binary.BigEndian.PutUint16(segment[6:8], crc)
+
+	if err := c.stack.send(to.IP, protocolUDP, segment); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *UDPConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.stack.mutex.Lock()
+		delete(c.stack.udp, c.port)
+		c.stack.mutex.Unlock()
+	})
+	return nil
+}
+
+func (c *UDPConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: c.stack.Address(), Port: int(c.port)}
+}
+
+func (c *UDPConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *UDPConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *UDPConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
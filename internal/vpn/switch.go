@@ -0,0 +1,213 @@
+package vpn
+
+import (
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"sync"
+)
+
+// Attachment describes the client attached to the switch
+type Attachment struct {
+	// Name of the client, for the logs
+	Name string
+	// Address is the fixed address of the client. It's assigned from the pool if nil.
+	Address net.IP
+	// Routes are the networks behind the client
+	Routes []*net.IPNet
+	// Push are the routes sent to the client
+	Push []*net.IPNet
+}
+
+// client is the attached client
+type client struct {
+	Attachment
+	mutex  sync.Mutex
+	stream io.Writer
+}
+
+// owns returns true if the client may send packets from the address
+func (c *client) owns(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	if ip.Equal(c.Address) {
+		return true
+	}
+	for _, r := range c.Routes {
+		if r.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *client) send(packet []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := streams.WriteDatagram(c.stream, packet); err != nil {
+		log.WithError(err).Tracef("[VPN] Could not send the packet to %v: %v", c.Name, err)
+	}
+}
+
+// Switch forwards the packets between the device of the server and the clients. The packets are sent to the client
+// with the destination address or with the route containing it, and all the other packets sent by the clients go to
+// the device. The packets from the addresses the clients don't own are dropped.
+type Switch struct {
+	device Device
+	pool   *Pool
+	config Config
+
+	mutex   sync.RWMutex
+	clients []*client
+}
+
+// NewSwitch configures the device with the first address of the network and starts forwarding its packets. The
+// routes (the networks behind the clients) are routed to the device as well.
+func NewSwitch(device Device, network *net.IPNet, mtu int, routes []*net.IPNet) (*Switch, error) {
+	if mtu == 0 {
+		mtu = DefaultMTU
+	}
+	pool := NewPool(network)
+	address, err := pool.Allocate()
+	if err != nil {
+		return nil, err
+	}
+	s := &Switch{
+		device: device,
+		pool:   pool,
+		config: Config{
+			Address: &net.IPNet{IP: address, Mask: pool.Network().Mask},
+			Routes:  routes,
+			MTU:     mtu,
+		},
+	}
+	if err := device.Configure(s.config); err != nil {
+		return nil, errors.Wrapf(err, "Could not configure %v", device.Name())
+	}
+	log.Infof("[VPN] %v is %v", device.Name(), s.config.Address)
+	go s.readDevice()
+	return s, nil
+}
+
+// Address returns the address of the server
+func (s *Switch) Address() net.IP {
+	return s.config.Address.IP
+}
+
+// Device returns the device of the server
+func (s *Switch) Device() Device {
+	return s.device
+}
+
+// Close stops the switch and closes the device
+func (s *Switch) Close() error {
+	return s.device.Close()
+}
+
+// Attach sends the configuration to the client and forwards its packets until the stream is closed
+func (s *Switch) Attach(stream io.ReadWriter, a Attachment) error {
+	var err error
+	if a.Address != nil {
+		err = s.pool.Reserve(a.Address)
+	} else {
+		a.Address, err = s.pool.Allocate()
+	}
+	if err != nil {
+		err = errors.Wrapf(err, "No address for %v", a.Name)
+		_ = WriteConfig(stream, nil, err)
+		return err
+	}
+	defer s.pool.Release(a.Address)
+
+	c := &client{Attachment: a, stream: stream}
+	config := &Config{
+		Address: &net.IPNet{IP: a.Address, Mask: s.pool.Network().Mask},
+		Routes:  a.Push,
+		MTU:     s.config.MTU,
+	}
+	if err := WriteConfig(stream, config, nil); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	s.clients = append(s.clients, c)
+	s.mutex.Unlock()
+	log.Infof("[VPN] %v attached as %v", a.Name, a.Address)
+	defer func() {
+		s.mutex.Lock()
+		for i, other := range s.clients {
+			if other == c {
+				s.clients = append(s.clients[:i], s.clients[i+1:]...)
+				break
+			}
+		}
+		s.mutex.Unlock()
+		log.Infof("[VPN] %v detached", a.Name)
+	}()
+
+	buf := make([]byte, streams.MaxDatagramSize)
+	for {
+		n, err := streams.ReadDatagram(stream, buf)
+		if err != nil {
+			return nil
+		}
+		s.forward(buf[:n], c)
+	}
+}
+
+// readDevice forwards the packets of the device to the clients
+func (s *Switch) readDevice() {
+	buf := make([]byte, streams.MaxDatagramSize)
+	for {
+		n, err := s.device.Read(buf)
+		if err != nil {
+			log.Debugf("[VPN] Stopped reading %v: %v", s.device.Name(), err)
+			return
+		}
+		s.forward(buf[:n], nil)
+	}
+}
+
+// forward sends the packet from the client (or from the device, if nil) to its destination
+func (s *Switch) forward(packet []byte, from *client) {
+	if from != nil && !from.owns(source(packet)) {
+		log.Tracef("[VPN] Dropping packet from %v: source %v not owned by %v", from.Name, source(packet), from.Address)
+		return
+	}
+	dst := destination(packet)
+	if dst == nil {
+		return
+	}
+
+	to := s.lookup(dst)
+	switch {
+	case to != nil && to != from:
+		to.send(packet)
+	case to == nil && from != nil:
+		if _, err := s.device.Write(packet); err != nil {
+			log.WithError(err).Tracef("[VPN] Could not write the packet to %v: %v", s.device.Name(), err)
+		}
+	}
+}
+
+// lookup returns the client with the address or, failing that, the client with the most specific route to it
+func (s *Switch) lookup(ip net.IP) *client {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var found *client
+	longest := -1
+	for _, c := range s.clients {
+		if ip.Equal(c.Address) {
+			return c
+		}
+		for _, r := range c.Routes {
+			if size, _ := r.Mask.Size(); r.Contains(ip) && size > longest {
+				found, longest = c, size
+			}
+		}
+	}
+	return found
+}
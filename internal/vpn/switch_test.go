@@ -0,0 +1,130 @@
+package vpn
+
+import (
+	"github.com/bokysan/socketace/v2/internal/streams"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+// attach attaches a userspace stack to the switch and returns it once configured
+func attach(t *testing.T, s *Switch, a Attachment) (*Stack, *Config) {
+	local, remote := net.Pipe()
+	go func() {
+		_ = s.Attach(remote, a)
+		_ = remote.Close()
+	}()
+
+	config, err := ReadConfig(local)
+	require.NoError(t, err)
+	stack := NewStack()
+	require.NoError(t, stack.Configure(*config))
+
+	go func() {
+		buf := make([]byte, streams.MaxDatagramSize)
+		for {
+			n, err := stack.Read(buf)
+			if err != nil || streams.WriteDatagram(local, buf[:n]) != nil {
+				_ = local.Close()
+				return
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, streams.MaxDatagramSize)
+		for {
+			n, err := streams.ReadDatagram(local, buf)
+			if err != nil {
+				_ = stack.Close()
+				return
+			}
+			_, _ = stack.Write(buf[:n])
+		}
+	}()
+	return stack, config
+}
+
+func Test_Switch(t *testing.T) {
+	_, network, err := net.ParseCIDR("10.8.0.0/24")
+	require.NoError(t, err)
+	_, behind, err := net.ParseCIDR("192.168.5.0/24")
+	require.NoError(t, err)
+
+	server := NewStack()
+	s, err := NewSwitch(server, network, 0, nil)
+	require.NoError(t, err)
+	defer s.Close()
+	require.Equal(t, "10.8.0.1", s.Address().String())
+
+	first, config := attach(t, s, Attachment{Name: "first", Push: []*net.IPNet{behind}})
+	require.Equal(t, "10.8.0.2/24", config.Address.String())
+	require.Equal(t, []*net.IPNet{behind}, config.Routes)
+	require.Equal(t, DefaultMTU, config.MTU)
+
+	second, config := attach(t, s, Attachment{Name: "second", Address: net.ParseIP("10.8.0.100").To4()})
+	require.Equal(t, "10.8.0.100/24", config.Address.String())
+
+	// The server and the other client are reachable
+	_, err = first.Ping(s.Address(), 5*time.Second)
+	require.NoError(t, err)
+	_, err = first.Ping(second.Address(), 5*time.Second)
+	require.NoError(t, err)
+	_, err = server.Ping(second.Address(), 5*time.Second)
+	require.NoError(t, err)
+	_, err = first.Ping(net.ParseIP("10.8.0.50"), 100*time.Millisecond)
+	require.Error(t, err)
+
+	// UDP between the clients
+	listener, err := second.ListenUDP(53)
+	require.NoError(t, err)
+	defer listener.Close()
+	conn, err := first.ListenUDP(0)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.WriteTo([]byte("query"), listener.LocalAddr())
+	require.NoError(t, err)
+
+	buf := make([]byte, 1024)
+	require.NoError(t, listener.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, from, err := listener.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, "query", string(buf[:n]))
+	require.Equal(t, conn.LocalAddr().String(), from.String())
+
+	_, err = listener.WriteTo([]byte("answer"), from)
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, _, err = conn.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, "answer", string(buf[:n]))
+
+	// The packets from the addresses the client doesn't own are dropped
+	local, remote := net.Pipe()
+	go func() {
+		_ = s.Attach(remote, Attachment{Name: "spoofer"})
+	}()
+	_, err = ReadConfig(local)
+	require.NoError(t, err)
+	spoofed := NewStack()
+	require.NoError(t, spoofed.Configure(Config{Address: &net.IPNet{IP: net.ParseIP("10.8.0.77").To4(), Mask: network.Mask}}))
+	spoofedConn, err := spoofed.ListenUDP(0)
+	require.NoError(t, err)
+	_, err = spoofedConn.WriteTo([]byte("spoofed"), listener.LocalAddr())
+	require.NoError(t, err)
+	n, err = spoofed.Read(buf)
+	require.NoError(t, err)
+	require.NoError(t, streams.WriteDatagram(local, buf[:n]))
+	require.NoError(t, listener.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+	_, _, err = listener.ReadFrom(buf)
+	require.Error(t, err)
+	_ = local.Close()
+
+	// The address is taken
+	local, remote = net.Pipe()
+	go func() {
+		_ = s.Attach(remote, Attachment{Name: "third", Address: net.ParseIP("10.8.0.100").To4()})
+	}()
+	_, err = ReadConfig(local)
+	require.Error(t, err)
+}
@@ -0,0 +1,75 @@
+//go:build linux
+// +build linux
+
+package vpn
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// tunDevice is a TUN interface of the kernel
+type tunDevice struct {
+	*os.File
+	name string
+}
+
+// OpenTun creates the TUN interface. The kernel chooses the name, if empty. Creating the interface needs the
+// CAP_NET_ADMIN capability.
+func OpenTun(name string) (Device, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not open /dev/net/tun")
+	}
+
+	// struct ifreq: the name, followed by the flags
+	var ifr [unix.IFNAMSIZ + 64]byte
+	copy(ifr[:unix.IFNAMSIZ-1], name)
+	*(*uint16)(unsafe.Pointer(&ifr[unix.IFNAMSIZ])) = unix.IFF_TUN | unix.IFF_NO_PI
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), uintptr(unix.TUNSETIFF), uintptr(unsafe.Pointer(&ifr[0]))); errno != 0 {
+		_ = unix.Close(fd)
+		return nil, errors.Wrapf(errno, "Could not create TUN interface %q", name)
+	}
+	name = string(ifr[:bytes.IndexByte(ifr[:unix.IFNAMSIZ], 0)])
+
+	// Let the runtime poller wait for the packets, so that Close interrupts Read
+	if err := unix.SetNonblock(fd, true); err != nil {
+		_ = unix.Close(fd)
+		return nil, errors.WithStack(err)
+	}
+	log.Infof("Created TUN interface %v", name)
+	return &tunDevice{File: os.NewFile(uintptr(fd), "/dev/net/tun"), name: name}, nil
+}
+
+func (t *tunDevice) Name() string {
+	return t.name
+}
+
+// Configure sets the address, the MTU and the routes of the interface with the `ip` command
+func (t *tunDevice) Configure(config Config) error {
+	mtu := config.MTU
+	if mtu == 0 {
+		mtu = DefaultMTU
+	}
+	commands := [][]string{
+		{"link", "set", "dev", t.name, "mtu", strconv.Itoa(mtu), "up"},
+		{"addr", "flush", "dev", t.name},
+		{"addr", "add", config.Address.String(), "dev", t.name},
+	}
+	for _, r := range config.Routes {
+		commands = append(commands, []string{"route", "replace", r.String(), "dev", t.name})
+	}
+	for _, args := range commands {
+		if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			return errors.Wrapf(err, "Failed: ip %v: %v", strings.Join(args, " "), strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
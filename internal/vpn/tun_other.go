@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package vpn
+
+import (
+	"github.com/pkg/errors"
+)
+
+// OpenTun fails, as the TUN interfaces are only supported on Linux
+func OpenTun(name string) (Device, error) {
+	return nil, errors.Errorf("TUN interfaces are only supported on Linux, use userspace:// instead")
+}